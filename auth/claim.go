@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"pebble-dev/rebble-auth/common"
+	"pebble-dev/rebble-auth/db"
+	"strings"
+)
+
+// ClaimConfig configures how users prove they are the Pebble developer they claim to be
+type ClaimConfig struct {
+	// MetadataURL returns the apps of a developer, in the format of the Pebble appstore API. `{developer_id}` is
+	// replaced with the ID of the developer. If empty, claims can only be approved by an administrator.
+	MetadataURL string `json:"metadata_url"`
+}
+
+// developerApps is the list of apps returned by ClaimConfig.MetadataURL
+type developerApps struct {
+	Apps []map[string]interface{} `json:"data"`
+}
+
+// ClaimDeveloper asks for the mirror account of a Pebble developer to be merged into the user's account, once the
+// claim is either verified or approved by an administrator
+// Returns success, errorMessage, claim, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func ClaimDeveloper(ctx context.Context, database db.Store, accessToken string, developerId string, remoteIp string) (bool, string, db.DeveloperClaim, error) {
+	loggedIn, errorMessage, err := database.SessionInformation(ctx, accessToken)
+	if err != nil {
+		return false, "Internal server error: Could not query session information", db.DeveloperClaim{}, err
+	}
+
+	if !loggedIn {
+		return false, "Not logged in", db.DeveloperClaim{}, nil
+	}
+
+	claim, errorMessage, err := database.ClaimDeveloper(ctx, accessToken, developerId, remoteIp)
+	if err != nil {
+		return false, "Internal server error: Could not claim developer", db.DeveloperClaim{}, err
+	}
+
+	if errorMessage != "" {
+		return false, errorMessage, db.DeveloperClaim{}, nil
+	}
+
+	return true, "", claim, nil
+}
+
+// DeveloperClaims returns the claims made by the user
+// Returns success, errorMessage, claims, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func DeveloperClaims(ctx context.Context, database db.Store, accessToken string) (bool, string, []db.DeveloperClaim, error) {
+	loggedIn, errorMessage, err := database.SessionInformation(ctx, accessToken)
+	if err != nil {
+		return false, "Internal server error: Could not query session information", nil, err
+	}
+
+	if !loggedIn {
+		return false, "Not logged in", nil, nil
+	}
+
+	claims, errorMessage, err := database.AccountDeveloperClaims(ctx, accessToken)
+	if err != nil {
+		return false, "Internal server error: Could not list claims", nil, err
+	}
+
+	if errorMessage != "" {
+		return false, errorMessage, nil, nil
+	}
+
+	return true, "", claims, nil
+}
+
+// tokenPublished checks whether the claim token was put in the metadata (description, website, ...) of one of the
+// developer's apps
+func tokenPublished(config ClaimConfig, claim db.DeveloperClaim) (bool, error) {
+	uri := strings.Replace(config.MetadataURL, "{developer_id}", url.PathEscape(claim.DeveloperId), -1)
+
+	var apps developerApps
+	err := common.Get(uri, &url.Values{}, "", &apps)
+	if err != nil {
+		return false, err
+	}
+
+	for _, app := range apps.Apps {
+		if app["developer_id"] != claim.DeveloperId {
+			continue
+		}
+
+		for _, value := range app {
+			if s, ok := value.(string); ok && strings.Contains(s, claim.Token) {
+				return true, nil
+			}
+		}
+	}
+
+	return false, nil
+}
+
+// VerifyDeveloperClaim approves one of the user's claims if its token can be found in the metadata of one of the
+// developer's apps, merging the developer's mirror account into the user's
+// Returns success, errorMessage, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func VerifyDeveloperClaim(ctx context.Context, database db.Store, config ClaimConfig, accessToken string, claimId int64, remoteIp string) (bool, string, error) {
+	success, errorMessage, claims, err := DeveloperClaims(ctx, database, accessToken)
+	if !success {
+		return false, errorMessage, err
+	}
+
+	var claim *db.DeveloperClaim
+	for i := range claims {
+		if claims[i].Id == claimId {
+			claim = &claims[i]
+		}
+	}
+	if claim == nil {
+		return false, "No such claim", nil
+	}
+	if claim.Status != db.ClaimPending {
+		return false, "This claim was already " + claim.Status, nil
+	}
+
+	if config.MetadataURL == "" {
+		return false, "Claims can't be verified automatically, please wait for an administrator to review yours", nil
+	}
+
+	published, err := tokenPublished(config, *claim)
+	if err != nil {
+		return false, "Could not fetch the developer's apps, please try again later", fmt.Errorf("Could not fetch the apps of developer %v: %v", claim.DeveloperId, err)
+	}
+	if !published {
+		return false, "The claim token wasn't found in the description of any of the developer's apps", nil
+	}
+
+	// Claims verified by their token are approved by the claimant themselves
+	errorMessage, err = database.ApproveDeveloperClaim(ctx, claim.Id, db.ClaimByToken, claim.UserId, remoteIp)
+	if err != nil {
+		return false, "Internal server error: Could not approve claim", err
+	}
+
+	if errorMessage != "" {
+		return false, errorMessage, nil
+	}
+
+	return true, "", nil
+}
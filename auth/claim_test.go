@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"pebble-dev/rebble-auth/db"
+)
+
+// newTestAppstore returns the configuration of a fake appstore, whose only app is by dev1 and has the given
+// description
+func newTestAppstore(t *testing.T, description string) ClaimConfig {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/developers/dev1" {
+			w.Write([]byte(`{"data": []}`))
+			return
+		}
+
+		json.NewEncoder(w).Encode(developerApps{Apps: []map[string]interface{}{{
+			"developer_id": "dev1",
+			"author":       "Developer",
+			"description":  description,
+		}}})
+	}))
+	t.Cleanup(server.Close)
+
+	return ClaimConfig{MetadataURL: server.URL + "/developers/{developer_id}"}
+}
+
+// claimDev1 imports the mirror of dev1, logs alice in and makes her claim it
+// Returns alice's access token and her claim
+func claimDev1(t *testing.T, store db.Store) (string, db.DeveloperClaim) {
+	t.Helper()
+
+	_, err := store.ImportPebbleDevelopers(context.Background(), []db.PebbleDeveloper{{Id: "dev1", Name: "Developer"}}, db.AuditActorAdmin)
+	if err != nil {
+		t.Fatalf("Could not import developer: %v", err)
+	}
+
+	accessToken, _, _, err := store.AccountLoginOrRegister(context.Background(), "test", "alice", "Alice", "alice@example.com", false, "{}", "", "", 0, db.SessionMetadata{})
+	if err != nil {
+		t.Fatalf("Could not log in: %v", err)
+	}
+
+	success, errorMessage, claim, err := ClaimDeveloper(context.Background(), store, accessToken, "dev1", "")
+	if !success || err != nil {
+		t.Fatalf("Could not claim developer: %v (%v)", errorMessage, err)
+	}
+
+	return accessToken, claim
+}
+
+func TestVerifyDeveloperClaim(t *testing.T) {
+	store := db.NewMemoryStore()
+	accessToken, claim := claimDev1(t, store)
+	config := newTestAppstore(t, "My watchface. "+claim.Token)
+
+	success, errorMessage, err := VerifyDeveloperClaim(context.Background(), store, config, accessToken, claim.Id, "")
+	if !success || err != nil {
+		t.Fatalf("Could not verify claim: %v (%v)", errorMessage, err)
+	}
+
+	success, _, claims, _ := DeveloperClaims(context.Background(), store, accessToken)
+	if !success || len(claims) != 1 || claims[0].Status != db.ClaimApproved || claims[0].ResolvedBy != db.ClaimByToken {
+		t.Errorf("Got claims %+v, expected the claim to be approved by its token", claims)
+	}
+
+	userId, _, _ := store.AccountId(context.Background(), accessToken)
+	developerId, _, _ := store.ResolveAlias(context.Background(), "dev1")
+	if developerId != userId {
+		t.Errorf("dev1 resolves to %q, expected alice's account", developerId)
+	}
+
+	success, errorMessage, _ = VerifyDeveloperClaim(context.Background(), store, config, accessToken, claim.Id, "")
+	if success || errorMessage != "This claim was already approved" {
+		t.Errorf("VerifyDeveloperClaim() = %v, %q for an approved claim", success, errorMessage)
+	}
+}
+
+func TestVerifyUnpublishedClaim(t *testing.T) {
+	store := db.NewMemoryStore()
+	accessToken, claim := claimDev1(t, store)
+
+	for _, config := range []ClaimConfig{newTestAppstore(t, "My watchface"), {}} {
+		success, errorMessage, err := VerifyDeveloperClaim(context.Background(), store, config, accessToken, claim.Id, "")
+		if success || errorMessage == "" || err != nil {
+			t.Errorf("VerifyDeveloperClaim() = %v, %q, %v, expected the claim not to be verified", success, errorMessage, err)
+		}
+	}
+
+	success, errorMessage, err := VerifyDeveloperClaim(context.Background(), store, newTestAppstore(t, claim.Token), accessToken, claim.Id+1, "")
+	if success || errorMessage != "No such claim" || err != nil {
+		t.Errorf("VerifyDeveloperClaim() = %v, %q, %v for an unknown claim", success, errorMessage, err)
+	}
+
+	claims, _, _ := store.AccountDeveloperClaims(context.Background(), accessToken)
+	if len(claims) != 1 || claims[0].Status != db.ClaimPending {
+		t.Errorf("Got claims %+v, expected the claim to still be pending", claims)
+	}
+}
+
+func TestVerifyClaimOfUnreachableAppstore(t *testing.T) {
+	store := db.NewMemoryStore()
+	accessToken, claim := claimDev1(t, store)
+	config := ClaimConfig{MetadataURL: "http://127.0.0.1:1/{developer_id}"}
+
+	success, errorMessage, err := VerifyDeveloperClaim(context.Background(), store, config, accessToken, claim.Id, "")
+	if success || errorMessage == "" || err == nil {
+		t.Errorf("VerifyDeveloperClaim() = %v, %q, %v, expected the appstore to be unreachable", success, errorMessage, err)
+	}
+}
+
+func TestClaimWithoutSession(t *testing.T) {
+	success, errorMessage, _, err := ClaimDeveloper(context.Background(), db.NewMemoryStore(), "invalid", "dev1", "")
+	if success || errorMessage != "Not logged in" || err != nil {
+		t.Errorf("ClaimDeveloper() = %v, %q, %v, expected the user not to be logged in", success, errorMessage, err)
+	}
+}
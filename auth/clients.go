@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"context"
+	"net/url"
+
+	"pebble-dev/rebble-auth/db"
+)
+
+// ClientId returns the ID of the client a redirect URI belongs to: its origin, or an empty string if it doesn't have
+// one
+func ClientId(redirectURI string) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return ""
+	}
+
+	return u.Scheme + "://" + u.Host
+}
+
+// SaveClient registers a client, or updates it. The ID of the client may be any URL of the client, whose origin is
+// kept.
+// Returns success, errorMessage, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func SaveClient(ctx context.Context, database db.Store, client db.Client, actorId string, remoteIp string) (bool, string, error) {
+	client.Id = ClientId(client.Id)
+	if client.Id == "" {
+		return false, "The client ID must be the origin of the client, such as https://example.com", nil
+	}
+
+	if client.Name == "" {
+		return false, "Name can't be empty", nil
+	}
+
+	errorMessage, err := database.SaveClient(ctx, client, actorId, remoteIp)
+	if err != nil {
+		return false, "Internal server error: Could not save client", err
+	}
+
+	if errorMessage != "" {
+		return false, errorMessage, nil
+	}
+
+	return true, "", nil
+}
+
+// DeleteClient unregisters a client
+// Returns success, errorMessage, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func DeleteClient(ctx context.Context, database db.Store, id string, actorId string, remoteIp string) (bool, string, error) {
+	errorMessage, err := database.DeleteClient(ctx, id, actorId, remoteIp)
+	if err != nil {
+		return false, "Internal server error: Could not delete client", err
+	}
+
+	if errorMessage != "" {
+		return false, errorMessage, nil
+	}
+
+	return true, "", nil
+}
@@ -0,0 +1,262 @@
+package auth
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"pebble-dev/rebble-auth/common"
+	"pebble-dev/rebble-auth/db"
+	"pebble-dev/rebble-auth/sso"
+)
+
+// recentAuthentication is how recently a user must have logged in to be allowed to delete their account
+const recentAuthentication = 10 * time.Minute
+
+// notificationBatch is how many deletion notifications are sent at a time
+const notificationBatch = 100
+
+// Services which can't be notified of a deletion are tried again after notificationRetry, then twice as long after
+// each failure, up to maxNotificationRetry
+const (
+	notificationRetry    = 5 * time.Minute
+	maxNotificationRetry = 24 * time.Hour
+)
+
+// DeletionConfig configures how accounts are deleted
+type DeletionConfig struct {
+	GracePeriodDays int            `json:"grace_period_days"` // How long the user has to change their mind
+	Hooks           []DeletionHook `json:"hooks"`             // Rebble services to notify when an account is deleted
+}
+
+// DeletionHook is a Rebble service which has to purge its own data when an account is deleted. The hook is POSTed
+// `{"userId": "<id>"}`, with an `Authorization: Bearer <secret>` header if a secret is set.
+type DeletionHook struct {
+	URL    string `json:"url"`
+	Secret string `json:"secret"`
+}
+
+type deletionNotification struct {
+	UserId string `json:"userId"`
+}
+
+// GracePeriod returns how long after asking for it an account is deleted
+func (config DeletionConfig) GracePeriod() time.Duration {
+	return time.Duration(config.GracePeriodDays) * 24 * time.Hour
+}
+
+// hookURLs returns the URLs of the hooks to notify of deletions
+func (config DeletionConfig) hookURLs() []string {
+	urls := []string{}
+	for _, hook := range config.Hooks {
+		urls = append(urls, hook.URL)
+	}
+
+	return urls
+}
+
+// hook returns the hook with the given URL, if there is one
+func (config DeletionConfig) hook(url string) (DeletionHook, bool) {
+	for _, hook := range config.Hooks {
+		if hook.URL == url {
+			return hook, true
+		}
+	}
+
+	return DeletionHook{}, false
+}
+
+// ScheduleDeletion schedules the deletion of the user's account after the grace period, and logs them out everywhere
+// The user has to have logged in recently, and logging in again before the deletion date cancels the deletion.
+// Returns success, errorMessage, deletionDate, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func ScheduleDeletion(ctx context.Context, database db.Store, config DeletionConfig, accessToken string, remoteIp string) (bool, string, time.Time, error) {
+	loggedIn, errorMessage, err := database.SessionInformation(ctx, accessToken)
+	if err != nil {
+		return false, "Internal server error: Could not query session information", time.Time{}, err
+	}
+
+	if !loggedIn {
+		return false, "Not logged in", time.Time{}, nil
+	}
+
+	now := time.Now()
+	deletion := now.Add(config.GracePeriod())
+	errorMessage, err = database.AccountScheduleDeletion(ctx, accessToken, now.Add(-recentAuthentication), deletion, remoteIp)
+	if err != nil {
+		return false, "Internal server error: Could not schedule account deletion", time.Time{}, err
+	}
+
+	if errorMessage != "" {
+		return false, errorMessage, time.Time{}, nil
+	}
+
+	return true, "", deletion, nil
+}
+
+// revokeTokens revokes the tokens we hold for an identity at its provider, if the provider allows it
+func revokeTokens(sso sso.Sso, session db.ProviderSession) error {
+	endpoint := sso.Discovery.RevocationEndpoint
+	if endpoint == "" {
+		return nil
+	}
+
+	switch sso.Type {
+	case "oidc":
+		// https://tools.ietf.org/html/rfc7009; revoking the refresh token revokes the whole grant
+		token := session.RefreshToken
+		if token == "" {
+			token = session.AccessToken
+		}
+
+		v := url.Values{}
+		v.Add("token", token)
+		v.Add("client_id", sso.ClientID)
+		v.Add("client_secret", sso.ClientSecret)
+		return common.Send("POST", endpoint, &v, "")
+	case "facebook":
+		// https://developers.facebook.com/docs/facebook-login/permissions/requesting-and-revoking
+		v := url.Values{}
+		v.Add("access_token", session.AccessToken)
+		return common.Send("DELETE", endpoint, &v, "")
+	case "fitbit":
+		bearer := "Basic " + base64.URLEncoding.EncodeToString([]byte(sso.ClientID+":"+sso.ClientSecret))
+
+		v := url.Values{}
+		v.Add("token", session.AccessToken)
+		return common.Send("POST", endpoint, &v, bearer)
+	}
+
+	return fmt.Errorf("Invalid SSO provider type %v", sso.Type)
+}
+
+// deleteAccount deletes an account if it is still due for deletion, queuing the notifications of the Rebble services
+// along with it, then revokes its identities at their providers. Nothing is sent before the deletion is confirmed, as
+// the user might have logged in (and cancelled it) in the meantime. The notifications are sent by notifyDeletions.
+// Returns whether the account was deleted, err
+func deleteAccount(ctx context.Context, ssos []sso.Sso, database db.Store, config DeletionConfig, userId string, now time.Time) (bool, error) {
+	// The identities are deleted along with the account, so their tokens have to be read first
+	sessions, err := database.AccountProviderSessions(ctx, userId)
+	if err != nil {
+		return false, err
+	}
+
+	deleted, err := database.AccountDelete(ctx, userId, now, config.hookURLs())
+	if err != nil || !deleted {
+		return false, err
+	}
+
+	for _, session := range sessions {
+		for _, s := range ssos {
+			if s.Name == session.Provider {
+				err = revokeTokens(s, session)
+				if err != nil {
+					log.Printf("Could not revoke %v tokens of user %v: %v", session.Provider, userId, err)
+				}
+			}
+		}
+	}
+
+	return true, nil
+}
+
+// retryDelay returns how long to wait before notifying a service again, after it already failed the given number of
+// times
+func retryDelay(attempts int) time.Duration {
+	delay := notificationRetry
+	for i := 0; i < attempts && delay < maxNotificationRetry; i++ {
+		delay *= 2
+	}
+	if delay > maxNotificationRetry {
+		delay = maxNotificationRetry
+	}
+
+	return delay
+}
+
+// NotifyDeletions notifies the Rebble services of the deletions they weren't told about yet. A service which can't be
+// reached is tried again later, backing off up to once a day, until it is.
+// Returns the number of notifications sent
+func NotifyDeletions(ctx context.Context, database db.Store, config DeletionConfig) (int, error) {
+	return notifyDeletions(ctx, database, config, time.Now())
+}
+
+func notifyDeletions(ctx context.Context, database db.Store, config DeletionConfig, now time.Time) (int, error) {
+	notifications, err := database.DueDeletionNotifications(ctx, now, notificationBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	var hookErr error
+	for _, notification := range notifications {
+		hook, ok := config.hook(notification.URL)
+		if !ok {
+			// The service isn't one to notify anymore
+			log.Printf("Not notifying %v of the deletion of user %v, as it isn't a deletion hook anymore", notification.URL, notification.UserId)
+			err = database.DeletionNotificationDone(ctx, notification.Id)
+			if err != nil {
+				return sent, err
+			}
+			continue
+		}
+
+		authorization := ""
+		if hook.Secret != "" {
+			authorization = "Bearer " + hook.Secret
+		}
+
+		postErr := common.PostJSON(hook.URL, deletionNotification{notification.UserId}, authorization)
+		if postErr != nil {
+			hookErr = fmt.Errorf("Could not notify %v: %v", hook.URL, postErr)
+			log.Printf("Could not notify %v of the deletion of user %v (attempt %v): %v", hook.URL, notification.UserId, notification.Attempts+1, postErr)
+
+			err = database.DeletionNotificationFailed(ctx, notification.Id, postErr.Error(), now.Add(retryDelay(notification.Attempts)))
+			if err != nil {
+				return sent, err
+			}
+			continue
+		}
+
+		err = database.DeletionNotificationDone(ctx, notification.Id)
+		if err != nil {
+			return sent, err
+		}
+		sent++
+	}
+
+	return sent, hookErr
+}
+
+// PurgeDeletedAccounts deletes the accounts whose grace period is over, and notifies the Rebble services right away
+// Returns the number of accounts deleted
+func PurgeDeletedAccounts(ctx context.Context, ssos []sso.Sso, database db.Store, config DeletionConfig) (int, error) {
+	now := time.Now()
+	ids, err := database.AccountsDueForDeletion(ctx, now)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, id := range ids {
+		deleted, err := deleteAccount(ctx, ssos, database, config, id, now)
+		if deleted {
+			count++
+		}
+		if err != nil {
+			log.Printf("Could not delete account %v: %v", id, err)
+		}
+	}
+
+	if count > 0 {
+		_, err = notifyDeletions(ctx, database, config, now)
+		if err != nil {
+			log.Printf("Could not notify every service of the deletions: %v", err)
+		}
+	}
+
+	return count, nil
+}
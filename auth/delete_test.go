@@ -0,0 +1,205 @@
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"pebble-dev/rebble-auth/db"
+	"pebble-dev/rebble-auth/sso"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// testHook is a Rebble service to notify of deletions, which records the notifications it gets
+type testHook struct {
+	*httptest.Server
+
+	lock          sync.Mutex
+	status        int
+	notifications []string // "<authorization header> <user ID>"
+}
+
+func newTestHook(t *testing.T, status int) *testHook {
+	hook := &testHook{status: status}
+	hook.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hook.lock.Lock()
+		defer hook.lock.Unlock()
+
+		var notification deletionNotification
+		json.NewDecoder(r.Body).Decode(&notification)
+		hook.notifications = append(hook.notifications, r.Header.Get("Authorization")+" "+notification.UserId)
+		w.WriteHeader(hook.status)
+	}))
+	t.Cleanup(hook.Close)
+
+	return hook
+}
+
+func (hook *testHook) received() []string {
+	hook.lock.Lock()
+	defer hook.lock.Unlock()
+
+	return append([]string{}, hook.notifications...)
+}
+
+// scheduleDeletion logs alice in, and schedules the deletion of her account
+// Returns the ID of the account
+func scheduleDeletion(t *testing.T, ssos []sso.Sso, store db.Store, config DeletionConfig) string {
+	t.Helper()
+
+	accessToken, _ := login(t, ssos, store, "test", "alice")
+	userId, _, _ := store.AccountId(context.Background(), accessToken)
+
+	success, errorMessage, deletion, err := ScheduleDeletion(context.Background(), store, config, accessToken, "")
+	if !success || err != nil {
+		t.Fatalf("Could not schedule deletion: %v (%v)", errorMessage, err)
+	}
+	if deletion.After(time.Now()) != (config.GracePeriodDays > 0) {
+		t.Errorf("Got deletion date %v, expected it to be after the grace period", deletion)
+	}
+
+	// The user is logged out everywhere
+	loggedIn, _, _ := store.SessionInformation(context.Background(), accessToken)
+	if loggedIn {
+		t.Errorf("The user is still logged in after asking for their account to be deleted")
+	}
+
+	return userId
+}
+
+func TestPurgeDeletedAccounts(t *testing.T) {
+	p := newTestProvider(t)
+	ssos := []sso.Sso{p.sso("test", false)}
+	store := db.NewMemoryStore()
+	hook := newTestHook(t, http.StatusOK)
+	config := DeletionConfig{Hooks: []DeletionHook{{URL: hook.URL, Secret: "secret"}}}
+
+	p.setUser("alice", jwt.MapClaims{"name": "Alice", "email": "alice@example.com"}, nil)
+	userId := scheduleDeletion(t, ssos, store, config)
+
+	count, err := PurgeDeletedAccounts(context.Background(), ssos, store, config)
+	if count != 1 || err != nil {
+		t.Fatalf("PurgeDeletedAccounts() = %v, %v, expected 1 account to be deleted", count, err)
+	}
+
+	exists, _ := store.AccountExists(context.Background(), "test", "alice")
+	if exists {
+		t.Errorf("The account still exists")
+	}
+
+	if notifications := hook.received(); len(notifications) != 1 || notifications[0] != "Bearer secret "+userId {
+		t.Errorf("The hook received %v, expected the ID of the deleted user", notifications)
+	}
+
+	if len(p.revoked) != 1 || p.revoked[0] != "refresh-alice" {
+		t.Errorf("Revoked %v, expected the refresh token of the identity", p.revoked)
+	}
+}
+
+func TestPurgeWithUnreachableHook(t *testing.T) {
+	p := newTestProvider(t)
+	ssos := []sso.Sso{p.sso("test", false)}
+	store := db.NewMemoryStore()
+	hook := newTestHook(t, http.StatusInternalServerError)
+	config := DeletionConfig{Hooks: []DeletionHook{{URL: hook.URL}}}
+
+	p.setUser("alice", jwt.MapClaims{"name": "Alice", "email": "alice@example.com"}, nil)
+	userId := scheduleDeletion(t, ssos, store, config)
+
+	// The account is deleted anyway, and the notification is kept to be sent again
+	count, _ := PurgeDeletedAccounts(context.Background(), ssos, store, config)
+	if count != 1 || len(hook.received()) != 1 || len(p.revoked) != 1 {
+		t.Errorf("Deleted %v accounts, with notifications %v and revoked tokens %v, expected the account to be deleted", count, hook.received(), p.revoked)
+	}
+
+	hook.lock.Lock()
+	hook.status = http.StatusOK
+	hook.lock.Unlock()
+
+	now := time.Now()
+	sent, err := notifyDeletions(context.Background(), store, config, now)
+	if sent != 0 || err != nil || len(hook.received()) != 1 {
+		t.Errorf("notifyDeletions() = %v, %v, expected the service to be left alone until the next attempt", sent, err)
+	}
+
+	sent, err = notifyDeletions(context.Background(), store, config, now.Add(notificationRetry))
+	if sent != 1 || err != nil || len(hook.received()) != 2 || hook.received()[1] != " "+userId {
+		t.Errorf("notifyDeletions() = %v, %v with notifications %v, expected the service to be notified again", sent, err, hook.received())
+	}
+
+	// Once sent, the notification is forgotten
+	sent, err = notifyDeletions(context.Background(), store, config, now.Add(maxNotificationRetry))
+	if sent != 0 || err != nil || len(hook.received()) != 2 {
+		t.Errorf("notifyDeletions() = %v, %v, expected nothing left to send", sent, err)
+	}
+}
+
+func TestNotifyRemovedHook(t *testing.T) {
+	p := newTestProvider(t)
+	ssos := []sso.Sso{p.sso("test", false)}
+	store := db.NewMemoryStore()
+	hook := newTestHook(t, http.StatusInternalServerError)
+	config := DeletionConfig{Hooks: []DeletionHook{{URL: hook.URL}}}
+
+	p.setUser("alice", jwt.MapClaims{"name": "Alice", "email": "alice@example.com"}, nil)
+	scheduleDeletion(t, ssos, store, config)
+	PurgeDeletedAccounts(context.Background(), ssos, store, config)
+
+	// A service which isn't a hook anymore isn't notified again
+	sent, err := notifyDeletions(context.Background(), store, DeletionConfig{}, time.Now().Add(maxNotificationRetry))
+	if sent != 0 || err != nil || len(hook.received()) != 1 {
+		t.Errorf("notifyDeletions() = %v, %v, expected the notification to be dropped", sent, err)
+	}
+
+	notifications, err := store.DueDeletionNotifications(context.Background(), time.Now().Add(maxNotificationRetry), 10)
+	if len(notifications) != 0 || err != nil {
+		t.Errorf("DueDeletionNotifications() = %+v, %v, expected none left", notifications, err)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	for attempts, expected := range map[int]time.Duration{0: notificationRetry, 1: 2 * notificationRetry, 3: 8 * notificationRetry, 100: maxNotificationRetry} {
+		if delay := retryDelay(attempts); delay != expected {
+			t.Errorf("retryDelay(%v) = %v, expected %v", attempts, delay, expected)
+		}
+	}
+}
+
+func TestDeleteCancelledAccount(t *testing.T) {
+	p := newTestProvider(t)
+	ssos := []sso.Sso{p.sso("test", false)}
+	store := db.NewMemoryStore()
+	hook := newTestHook(t, http.StatusOK)
+	config := DeletionConfig{Hooks: []DeletionHook{{URL: hook.URL}}}
+
+	p.setUser("alice", jwt.MapClaims{"name": "Alice", "email": "alice@example.com"}, nil)
+	userId := scheduleDeletion(t, ssos, store, config)
+
+	// Logging in cancels the deletion, even once the account was found to be due for deletion
+	ids, err := store.AccountsDueForDeletion(context.Background(), time.Now())
+	if err != nil || len(ids) != 1 {
+		t.Fatalf("Expected the account to be due for deletion, got %v (%v)", ids, err)
+	}
+	login(t, ssos, store, "test", "alice")
+
+	deleted, err := deleteAccount(context.Background(), ssos, store, config, userId, time.Now())
+	if deleted || err != nil {
+		t.Errorf("deleteAccount() = %v, %v, expected the account to be kept", deleted, err)
+	}
+
+	if len(hook.received()) != 0 || len(p.revoked) != 0 {
+		t.Errorf("Got notifications %v and revoked tokens %v for an account which wasn't deleted", hook.received(), p.revoked)
+	}
+}
+
+func TestScheduleDeletionWithoutSession(t *testing.T) {
+	success, errorMessage, _, err := ScheduleDeletion(context.Background(), db.NewMemoryStore(), DeletionConfig{}, "invalid", "")
+	if success || errorMessage == "" || err != nil {
+		t.Errorf("ScheduleDeletion() = %v, %q, %v, expected an error message", success, errorMessage, err)
+	}
+}
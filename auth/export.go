@@ -0,0 +1,60 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"pebble-dev/rebble-auth/common"
+	"pebble-dev/rebble-auth/db"
+)
+
+// exportInterval is how often a user may export their data
+const exportInterval = 15 * time.Minute
+
+// exportLimiter only knows about the exports made through this instance: with several instances behind a load balancer,
+// a user may export their data once per interval from each of them
+var exportLimiter = common.NewRateLimiter(exportInterval)
+
+// Export returns everything rebble-auth stores about the user
+// Returns success, errorMessage, export, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func Export(ctx context.Context, database db.Store, accessToken string) (bool, string, db.UserExport, error) {
+	loggedIn, errorMessage, err := database.SessionInformation(ctx, accessToken)
+	if err != nil {
+		return false, "Internal server error: Could not query session information", db.UserExport{}, err
+	}
+
+	if !loggedIn {
+		return false, "Not logged in", db.UserExport{}, nil
+	}
+
+	userId, errorMessage, err := database.AccountId(ctx, accessToken)
+	if err != nil {
+		return false, "Internal server error: Could not query session information", db.UserExport{}, err
+	}
+
+	if errorMessage != "" {
+		return false, errorMessage, db.UserExport{}, nil
+	}
+
+	if !exportLimiter.Allow(userId) {
+		return false, fmt.Sprintf("You can only export your data once every %v minutes", exportInterval.Minutes()), db.UserExport{}, nil
+	}
+
+	export, errorMessage, err := database.UserExport(ctx, userId)
+	if err != nil || errorMessage != "" {
+		// Only successful exports count, so that the user can try again right away if one failed
+		exportLimiter.Forget(userId)
+	}
+
+	if err != nil {
+		return false, "Internal server error: Could not export user data", db.UserExport{}, err
+	}
+
+	if errorMessage != "" {
+		return false, errorMessage, db.UserExport{}, nil
+	}
+
+	return true, "", export, nil
+}
@@ -0,0 +1,55 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"pebble-dev/rebble-auth/db"
+)
+
+// failingExportStore is a Store whose exports fail until told otherwise
+type failingExportStore struct {
+	db.Store
+	fail bool
+}
+
+func (store *failingExportStore) UserExport(ctx context.Context, userId string) (db.UserExport, string, error) {
+	if store.fail {
+		return db.UserExport{}, "Internal server error", errors.New("export failed")
+	}
+
+	return store.Store.UserExport(ctx, userId)
+}
+
+func TestExportIsRateLimited(t *testing.T) {
+	store := &failingExportStore{Store: db.NewMemoryStore(), fail: true}
+	accessToken, _, _, err := store.AccountLoginOrRegister(context.Background(), "test", "alice", "Alice", "alice@example.com", false, "{}", "", "", 0, db.SessionMetadata{})
+	if err != nil {
+		t.Fatalf("Could not log in: %v", err)
+	}
+
+	// Failed exports don't count
+	success, _, _, _ := Export(context.Background(), store, accessToken)
+	if success {
+		t.Fatalf("A failed export succeeded")
+	}
+
+	store.fail = false
+	success, errorMessage, export, err := Export(context.Background(), store, accessToken)
+	if !success || err != nil || export.Name != "Alice" {
+		t.Fatalf("Could not export data after a failed export: %v (%v)", errorMessage, err)
+	}
+
+	success, errorMessage, _, err = Export(context.Background(), store, accessToken)
+	if success || errorMessage == "" || err != nil {
+		t.Errorf("Export() = %v, %q, %v, expected to be rate limited", success, errorMessage, err)
+	}
+}
+
+func TestExportWithoutSession(t *testing.T) {
+	success, errorMessage, _, err := Export(context.Background(), db.NewMemoryStore(), "invalid")
+	if success || errorMessage == "" || err != nil {
+		t.Errorf("Export() = %v, %q, %v, expected an error message", success, errorMessage, err)
+	}
+}
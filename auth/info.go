@@ -1,12 +1,16 @@
 package auth
 
-import "pebble-dev/rebble-auth/db"
+import (
+	"context"
+
+	"pebble-dev/rebble-auth/db"
+)
 
 // Info returns information on the logged in user
 // Returns success, errorMessage, name, email, linkedProviders, err
 // err is only returned if the error was unexpected (internal server error vs bad request)
-func Info(database *db.Handler, accessToken string) (bool, string, string, string, []string, error) {
-	loggedIn, errorMessage, err := database.SessionInformation(accessToken)
+func Info(ctx context.Context, database db.Store, accessToken string) (bool, string, string, string, []string, error) {
+	loggedIn, errorMessage, err := database.SessionInformation(ctx, accessToken)
 	if err != nil {
 		return false, "Internal Server Error: Could not query session information from database", "", "", []string{}, err
 	}
@@ -15,7 +19,7 @@ func Info(database *db.Handler, accessToken string) (bool, string, string, strin
 		return false, errorMessage, "", "", []string{}, nil
 	}
 
-	loggedIn, name, email, linkedProviders, err := database.AccountInformation(accessToken)
+	loggedIn, name, email, linkedProviders, err := database.AccountInformation(ctx, accessToken)
 	if err != nil {
 		return false, "Internal Server Error: Could not query account information from database", "", "", []string{}, err
 	}
@@ -0,0 +1,26 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"pebble-dev/rebble-auth/db"
+)
+
+func TestInfo(t *testing.T) {
+	store := db.NewMemoryStore()
+	accessToken, _, _, err := store.AccountLoginOrRegister(context.Background(), "test", "alice", "Alice", "alice@example.com", false, "{}", "", "", 0, db.SessionMetadata{})
+	if err != nil {
+		t.Fatalf("Could not log in: %v", err)
+	}
+
+	success, errorMessage, name, email, providers, err := Info(context.Background(), store, accessToken)
+	if !success || err != nil || name != "Alice" || email != "alice@example.com" || len(providers) != 1 {
+		t.Errorf("Info() = %v, %q, %q, %q, %v, %v, expected Alice's account", success, errorMessage, name, email, providers, err)
+	}
+
+	success, errorMessage, _, _, _, err = Info(context.Background(), store, "invalid")
+	if success || errorMessage == "" || err != nil {
+		t.Errorf("Info() = %v, %q, %v for an invalid token, expected an error message", success, errorMessage, err)
+	}
+}
@@ -1,9 +1,12 @@
 package auth
 
 import (
+	"context"
 	"encoding/base64"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"net/url"
 	"pebble-dev/rebble-auth/common"
 	"pebble-dev/rebble-auth/db"
@@ -84,6 +87,58 @@ type fitbitError struct {
 	Message string `json:"message"`
 }
 
+// claimString returns the value of a string claim, and whether it was present (and a string)
+func claimString(claims jwt.MapClaims, name string) (string, bool) {
+	value, ok := claims[name].(string)
+	return value, ok
+}
+
+// claimBool returns the value of a boolean claim, or false if it is missing. Some providers send booleans as strings.
+func claimBool(claims jwt.MapClaims, name string) bool {
+	switch value := claims[name].(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+
+	return false
+}
+
+// claimExpiry returns the expiry date of the token (as a UNIX timestamp), or 0 if it is unknown
+func claimExpiry(claims jwt.MapClaims) int64 {
+	if exp, ok := claims["exp"].(float64); ok {
+		return int64(exp)
+	}
+
+	return 0
+}
+
+// fetchUserinfo queries the OIDC userinfo endpoint of the provider, and adds the claims it returns to the given
+// claims, without overriding claims that were already present in the ID token
+func fetchUserinfo(sso sso.Sso, accessToken string, claims jwt.MapClaims) error {
+	var userinfo map[string]interface{}
+	err := common.Get(sso.Discovery.UserinfoEndpoint, &url.Values{}, "Bearer "+accessToken, &userinfo)
+	if err != nil {
+		return err
+	}
+
+	// The userinfo answer must be about the same user as the ID token, otherwise it can't be trusted
+	// https://openid.net/specs/openid-connect-core-1_0.html#UserInfoResponse
+	sub, _ := claimString(claims, "sub")
+	if userinfoSub, ok := userinfo["sub"].(string); !ok || userinfoSub != sub {
+		return fmt.Errorf("Userinfo sub %v does not match ID token sub %v", userinfo["sub"], sub)
+	}
+
+	for key, value := range userinfo {
+		if _, ok := claims[key]; !ok {
+			claims[key] = value
+		}
+	}
+
+	return nil
+}
+
 func exchangeTokens(sso sso.Sso, code string) (bool, string, tokensStatus, jwt.MapClaims, error) {
 	switch sso.Type {
 	case "oidc":
@@ -108,6 +163,16 @@ func exchangeTokens(sso sso.Sso, code string) (bool, string, tokensStatus, jwt.M
 			return false, "Internal server error: Could not decode token information", status, nil, err
 		}
 
+		// Some providers (such as Yahoo) only include the profile information in the userinfo endpoint's answer
+		_, hasName := claimString(claims, "name")
+		_, hasEmail := claimString(claims, "email")
+		if (!hasName || !hasEmail) && sso.Discovery.UserinfoEndpoint != "" {
+			err = fetchUserinfo(sso, status.AccessToken, claims)
+			if err != nil {
+				return false, "Internal server error: Could not get user information", status, nil, err
+			}
+		}
+
 		return true, "", status, claims, nil
 	case "facebook":
 		v := url.Values{}
@@ -122,7 +187,7 @@ func exchangeTokens(sso sso.Sso, code string) (bool, string, tokensStatus, jwt.M
 			return false, fmt.Sprintf("Internal server error: Could not exchange tokens: %v", err), tokensStatus{}, nil, err
 		}
 		if status.Error.Message != "" {
-			return false, "Internal server error: Could not exchange tokens", tokensStatus{}, nil, fmt.Errorf("Could not exchange tokens: %v (%v %v)", status.Error.Message, status.Error.Type, status.Error.Code)
+			return false, "Internal server error: Could not exchange tokens", tokensStatus{Error: status.Error.Type, ErrorDescription: status.Error.Message}, nil, fmt.Errorf("Could not exchange tokens: %v (%v %v)", status.Error.Message, status.Error.Type, status.Error.Code)
 		}
 
 		// Get token information
@@ -168,7 +233,7 @@ func exchangeTokens(sso sso.Sso, code string) (bool, string, tokensStatus, jwt.M
 			return false, fmt.Sprintf("Internal server error: Could not exchange tokens: %v", err), tokensStatus{}, nil, err
 		}
 		if len(status.Errors) != 0 {
-			return false, "Internal server error: Could not exchange tokens", tokensStatus{}, nil, fmt.Errorf("Could not exchange tokens: %v", status.Errors)
+			return false, "Internal server error: Could not exchange tokens", tokensStatus{Error: status.Errors[0].Type, ErrorDescription: status.Errors[0].Message}, nil, fmt.Errorf("Could not exchange tokens: %v", status.Errors)
 		}
 
 		// Get token information
@@ -215,9 +280,12 @@ func exchangeTokens(sso sso.Sso, code string) (bool, string, tokensStatus, jwt.M
 }
 
 // Login attempts to log a user in given an auth provider and a corresponding code
-// Returns success, errorMessage, accessToken, err
+// If the identity is new but its e-mail address belongs to an existing account, a link token is returned instead of
+// an access token; the user then has to log in to the existing account to confirm the link (see ConfirmLink), or
+// decline it, in which case they are sent back to redirectURI (see DeclineLink).
+// Returns success, errorMessage, accessToken, linkToken, err
 // err is only returned if the error was unexpected (internal server error vs bad request)
-func Login(ssos []sso.Sso, database *db.Handler, authProvider string, code string, remoteAddr string) (bool, string, string, error) {
+func Login(ctx context.Context, ssos []sso.Sso, database db.Store, authProvider string, code string, session db.SessionMetadata) (bool, string, string, string, error) {
 	var sso sso.Sso
 	foundSso := false
 	for _, s := range ssos {
@@ -228,32 +296,95 @@ func Login(ssos []sso.Sso, database *db.Handler, authProvider string, code strin
 	}
 
 	if !foundSso {
-		return false, "Invalid SSO provider", "", nil
+		LogFailedLogin(ctx, database, authProvider, db.LoginInvalidProvider, session)
+		return false, "Invalid SSO provider", "", "", nil
 	}
 
 	success, errorMessage, status, claims, err := exchangeTokens(sso, code)
 
 	if !success {
-		return false, errorMessage, "", err
+		// The provider only sets an error code when it refused the code, otherwise we couldn't talk to it properly
+		reason := db.LoginProviderError
+		if status.Error != "" {
+			reason = db.LoginInvalidCode
+		}
+		LogFailedLogin(ctx, database, sso.Name, reason, session)
+		return false, errorMessage, "", "", err
 	}
 
-	var name string
-	if n, ok := claims["name"]; ok {
-		name = n.(string)
+	sub, ok := claimString(claims, "sub")
+	if !ok || sub == "" {
+		LogFailedLogin(ctx, database, sso.Name, db.LoginProviderError, session)
+		return false, "Internal server error: Identity provider did not return a user ID", "", "", errors.New("Missing sub claim")
 	}
+	// name and email are optional, not all providers give them to us
+	name, _ := claimString(claims, "name")
+	email, _ := claimString(claims, "email")
+
+	// We only link identities by e-mail address if both the provider and the address can be trusted
+	linkEmail := sso.TrustEmail && claimBool(claims, "email_verified")
 
-	accessToken, userErr, err := database.AccountLoginOrRegister(sso.Name, claims["sub"].(string), name, claims["email"].(string), status.AccessToken, status.RefreshToken, int64(claims["exp"].(float64)), remoteAddr)
+	// The original claims are kept for debugging purposes
+	profile, err := json.Marshal(claims)
 	if err != nil {
-		return false, userErr, "", err
+		return false, "Internal server error: Could not encode profile", "", "", err
 	}
 
-	return true, userErr, accessToken, nil
+	accessToken, linkToken, userErr, err := database.AccountLoginOrRegister(ctx, sso.Name, sub, name, email, linkEmail, string(profile), status.AccessToken, status.RefreshToken, claimExpiry(claims), session)
+	if err != nil {
+		return false, userErr, "", "", err
+	}
+
+	return true, userErr, accessToken, linkToken, nil
 }
 
-// AddProvider attempts to add a provider to a user's account given an auth provider and a corresponding code
+// LogFailedLogin records a login attempt which failed before the user could be identified
+// Failing to do so is logged but otherwise ignored, as it shouldn't change the outcome of the login
+func LogFailedLogin(ctx context.Context, database db.Store, provider string, reason string, session db.SessionMetadata) {
+	err := database.LogLoginAttempt(ctx, db.LoginAttempt{
+		Time:      time.Now(),
+		Reason:    reason,
+		Provider:  provider,
+		UserAgent: session.UserAgent,
+		RemoteIp:  session.RemoteIp,
+	})
+	if err != nil {
+		log.Printf("Could not log failed login attempt: %v", err)
+	}
+}
+
+// ConfirmLink links the identity waiting behind a link token to the account the user just logged in to
 // Returns success, errorMessage, err
 // err is only returned if the error was unexpected (internal server error vs bad request)
-func AddProvider(ssos []sso.Sso, database *db.Handler, authProvider string, code string, rebbleAccessToken string, remoteAddr string) (bool, string, error) {
+func ConfirmLink(ctx context.Context, database db.Store, linkToken string, accessToken string, remoteIp string) (bool, string, error) {
+	errorMessage, err := database.AccountConfirmLink(ctx, linkToken, accessToken, remoteIp)
+	if err != nil {
+		return false, errorMessage, err
+	}
+
+	return errorMessage == "", errorMessage, nil
+}
+
+// DeclineLink creates a separate account for the identity waiting behind a link token, for users who don't want it
+// linked to the existing account, and logs them in to it. The redirect URI of the client they were logging in to is
+// returned, if the link token is known.
+// Returns success, errorMessage, accessToken, redirectURI, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func DeclineLink(ctx context.Context, database db.Store, linkToken string, session db.SessionMetadata) (bool, string, string, string, error) {
+	accessToken, redirectURI, errorMessage, err := database.AccountDeclineLink(ctx, linkToken, session)
+	if err != nil {
+		return false, errorMessage, "", redirectURI, err
+	}
+
+	return errorMessage == "", errorMessage, accessToken, redirectURI, nil
+}
+
+// AddProvider attempts to add a provider to a user's account given an auth provider and a corresponding code
+// If the identity already belongs to another account, a merge token is returned, which can be used to merge that
+// account into the user's (see Merge).
+// Returns success, errorMessage, mergeToken, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func AddProvider(ctx context.Context, ssos []sso.Sso, database db.Store, authProvider string, code string, rebbleAccessToken string, remoteAddr string) (bool, string, string, error) {
 	var sso sso.Sso
 	foundSso := false
 	for _, s := range ssos {
@@ -264,25 +395,35 @@ func AddProvider(ssos []sso.Sso, database *db.Handler, authProvider string, code
 	}
 
 	if !foundSso {
-		return false, "Invalid SSO provider", nil
+		return false, "Invalid SSO provider", "", nil
 	}
 
 	// This would normally be handled by the AccountAddProvider function, but we don't want to exchange tokens if we aren't going to store them
-	loggedIn, _, _, _, err := database.AccountInformation(rebbleAccessToken)
+	loggedIn, _, _, _, err := database.AccountInformation(ctx, rebbleAccessToken)
 	if !loggedIn {
-		return false, "Invalid access token", err
+		return false, "Invalid access token", "", err
 	}
 
 	success, errorMessage, status, claims, err := exchangeTokens(sso, code)
 
 	if !success {
-		return false, errorMessage, err
+		return false, errorMessage, "", err
+	}
+
+	sub, ok := claimString(claims, "sub")
+	if !ok || sub == "" {
+		return false, "Internal server error: Identity provider did not return a user ID", "", errors.New("Missing sub claim")
 	}
 
-	userErr, err := database.AccountAddProvider(sso.Name, claims["sub"].(string), rebbleAccessToken, status.AccessToken, status.RefreshToken, int64(claims["exp"].(float64)), remoteAddr)
+	profile, err := json.Marshal(claims)
 	if err != nil {
-		return false, userErr, err
+		return false, "Internal server error: Could not encode profile", "", err
+	}
+
+	mergeToken, userErr, err := database.AccountAddProvider(ctx, sso.Name, sub, string(profile), rebbleAccessToken, status.AccessToken, status.RefreshToken, claimExpiry(claims), remoteAddr)
+	if err != nil {
+		return false, userErr, "", err
 	}
 
-	return true, userErr, nil
+	return true, userErr, mergeToken, nil
 }
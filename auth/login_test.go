@@ -0,0 +1,252 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"pebble-dev/rebble-auth/db"
+	"pebble-dev/rebble-auth/sso"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// login logs in with the code of the given user, and fails the test if it doesn't succeed
+func login(t *testing.T, ssos []sso.Sso, store db.Store, provider string, sub string) (string, string) {
+	t.Helper()
+
+	success, errorMessage, accessToken, linkToken, err := Login(context.Background(), ssos, store, provider, sub, db.SessionMetadata{RemoteIp: "192.0.2.1"})
+	if !success || err != nil {
+		t.Fatalf("Could not log in as %v: %v (%v)", sub, errorMessage, err)
+	}
+
+	return accessToken, linkToken
+}
+
+// accountInformation returns the name and e-mail address of the account an access token belongs to
+func accountInformation(t *testing.T, store db.Store, accessToken string) (string, string, []string) {
+	t.Helper()
+
+	loggedIn, name, email, providers, err := store.AccountInformation(context.Background(), accessToken)
+	if !loggedIn || err != nil {
+		t.Fatalf("Could not get account information: %v", err)
+	}
+
+	return name, email, providers
+}
+
+func TestLoginWithProfileInIdToken(t *testing.T) {
+	p := newTestProvider(t)
+	ssos := []sso.Sso{p.sso("test", false)}
+	store := db.NewMemoryStore()
+
+	p.setUser("alice", jwt.MapClaims{"name": "Alice", "email": "alice@example.com"}, nil)
+	accessToken, _ := login(t, ssos, store, "test", "alice")
+
+	name, email, _ := accountInformation(t, store, accessToken)
+	if name != "Alice" || email != "alice@example.com" {
+		t.Errorf("Got %v <%v>, expected Alice <alice@example.com>", name, email)
+	}
+	if p.calls() != 0 {
+		t.Errorf("The userinfo endpoint was called %v times, though the ID token had all the claims", p.calls())
+	}
+}
+
+func TestLoginFetchesUserinfo(t *testing.T) {
+	p := newTestProvider(t)
+	ssos := []sso.Sso{p.sso("test", false)}
+	store := db.NewMemoryStore()
+
+	// Claims of the ID token take precedence over the ones of the userinfo endpoint
+	p.setUser("bob", jwt.MapClaims{"name": "Bob"}, jwt.MapClaims{"sub": "bob", "name": "Robert", "email": "bob@example.com"})
+	accessToken, _ := login(t, ssos, store, "test", "bob")
+
+	name, email, _ := accountInformation(t, store, accessToken)
+	if name != "Bob" || email != "bob@example.com" {
+		t.Errorf("Got %v <%v>, expected Bob <bob@example.com>", name, email)
+	}
+	if p.calls() != 1 {
+		t.Errorf("The userinfo endpoint was called %v times, expected once", p.calls())
+	}
+}
+
+func TestLoginRejectsUserinfoOfAnotherUser(t *testing.T) {
+	p := newTestProvider(t)
+	ssos := []sso.Sso{p.sso("test", false)}
+	store := db.NewMemoryStore()
+
+	p.setUser("carol", jwt.MapClaims{}, jwt.MapClaims{"sub": "mallory", "email": "mallory@example.com"})
+	success, _, accessToken, _, err := Login(context.Background(), ssos, store, "test", "carol", db.SessionMetadata{})
+	if success || err == nil || accessToken != "" {
+		t.Errorf("Login succeeded with the userinfo of another user")
+	}
+
+	logins, err := store.LoginLog(context.Background(), "", "", 0, 10)
+	if err != nil || len(logins) != 1 || logins[0].Reason != db.LoginProviderError {
+		t.Errorf("Expected the login to be logged as a provider error, got %+v (%v)", logins, err)
+	}
+}
+
+func TestLoginWithoutProfileClaims(t *testing.T) {
+	p := newTestProvider(t)
+	provider := p.sso("test", false)
+	provider.Discovery.UserinfoEndpoint = ""
+	store := db.NewMemoryStore()
+
+	// Claims of the wrong type are ignored just like missing ones
+	p.setUser("dave", jwt.MapClaims{"email": 42}, nil)
+	accessToken, _ := login(t, []sso.Sso{provider}, store, "test", "dave")
+
+	// Without a name, the account is named after its ID
+	name, email, _ := accountInformation(t, store, accessToken)
+	userId, _, err := store.ResolveAlias(context.Background(), name)
+	if err != nil || name != userId || email != "" {
+		t.Errorf("Got %v <%v>, expected the user ID and no e-mail address", name, email)
+	}
+}
+
+func TestLoginWithUnknownCode(t *testing.T) {
+	p := newTestProvider(t)
+	store := db.NewMemoryStore()
+
+	success, errorMessage, _, _, _ := Login(context.Background(), []sso.Sso{p.sso("test", false)}, store, "test", "nobody", db.SessionMetadata{})
+	if success || errorMessage == "" {
+		t.Errorf("Login succeeded with an unknown code")
+	}
+}
+
+func TestClaimBool(t *testing.T) {
+	claims := jwt.MapClaims{"true": true, "false": false, "string": "true", "other": "yes", "number": 1.0}
+	for name, expected := range map[string]bool{"true": true, "false": false, "string": true, "other": false, "number": false, "missing": false} {
+		if value := claimBool(claims, name); value != expected {
+			t.Errorf("claimBool(%v) = %v, expected %v", name, value, expected)
+		}
+	}
+}
+
+func TestLoginOffersLinkForTrustedEmail(t *testing.T) {
+	p := newTestProvider(t)
+	ssos := []sso.Sso{p.sso("trusted", true), p.sso("untrusted", false)}
+
+	p.setUser("alice", jwt.MapClaims{"name": "Alice", "email": "alice@example.com", "email_verified": true}, nil)
+	p.setUser("verified", jwt.MapClaims{"name": "Alice", "email": "alice@example.com", "email_verified": true}, nil)
+	p.setUser("unverified", jwt.MapClaims{"name": "Alice", "email": "alice@example.com", "email_verified": false}, nil)
+
+	for _, test := range []struct {
+		provider string
+		sub      string
+		link     bool
+	}{
+		{"untrusted", "verified", false},
+		{"trusted", "unverified", false},
+		{"trusted", "verified", true},
+	} {
+		store := db.NewMemoryStore()
+		aliceToken, _ := login(t, ssos, store, "untrusted", "alice")
+
+		accessToken, linkToken := login(t, ssos, store, test.provider, test.sub)
+		if (linkToken != "") != test.link || (accessToken == "") != test.link {
+			t.Errorf("Logging in as %v with %v returned access token %q and link token %q, expected a link: %v", test.sub, test.provider, accessToken, linkToken, test.link)
+		}
+		if linkToken == "" {
+			continue
+		}
+
+		success, errorMessage, err := ConfirmLink(context.Background(), store, linkToken, aliceToken, "")
+		if !success || err != nil {
+			t.Errorf("Could not confirm link: %v (%v)", errorMessage, err)
+		}
+
+		_, _, providers := accountInformation(t, store, aliceToken)
+		if len(providers) != 2 {
+			t.Errorf("Expected 2 identities linked to the account, got %v", providers)
+		}
+	}
+}
+
+func TestDeclineLink(t *testing.T) {
+	p := newTestProvider(t)
+	ssos := []sso.Sso{p.sso("test", true)}
+	store := db.NewMemoryStore()
+
+	p.setUser("alice", jwt.MapClaims{"name": "Alice", "email": "alice@example.com", "email_verified": true}, nil)
+	p.setUser("alice2", jwt.MapClaims{"name": "Alice 2", "email": "alice@example.com", "email_verified": "true"}, nil)
+	login(t, ssos, store, "test", "alice")
+
+	_, linkToken := login(t, ssos, store, "test", "alice2")
+	success, errorMessage, accessToken, _, err := DeclineLink(context.Background(), store, linkToken, db.SessionMetadata{})
+	if !success || err != nil {
+		t.Fatalf("Could not decline link: %v (%v)", errorMessage, err)
+	}
+
+	name, _, _ := accountInformation(t, store, accessToken)
+	if name != "Alice 2" {
+		t.Errorf("Declining the link logged in to %v, expected a new account", name)
+	}
+
+	// Logging in again doesn't offer the link anymore
+	accessToken, linkToken = login(t, ssos, store, "test", "alice2")
+	if linkToken != "" || accessToken == "" {
+		t.Errorf("The link was offered again after it was declined")
+	}
+}
+
+func TestLoginRecordsSessionMetadata(t *testing.T) {
+	p := newTestProvider(t)
+	store := db.NewMemoryStore()
+	p.setUser("alice", jwt.MapClaims{"name": "Alice", "email": "alice@example.com"}, nil)
+
+	metadata := db.SessionMetadata{ClientId: "https://example.com", UserAgent: "Pebble app", RemoteIp: "192.0.2.1"}
+	_, _, accessToken, _, err := Login(context.Background(), []sso.Sso{p.sso("test", false)}, store, "test", "alice", metadata)
+	if err != nil {
+		t.Fatalf("Could not log in: %v", err)
+	}
+
+	success, errorMessage, sessions, currentId, err := Sessions(context.Background(), store, accessToken)
+	if !success || err != nil || len(sessions) != 1 {
+		t.Fatalf("Expected 1 session, got %+v: %v (%v)", sessions, errorMessage, err)
+	}
+	if sessions[0].Id != currentId || sessions[0].SessionMetadata != metadata || sessions[0].Provider != "test" {
+		t.Errorf("Got session %+v, expected the current session with %+v", sessions[0], metadata)
+	}
+}
+
+func TestLoginLogsFailures(t *testing.T) {
+	p := newTestProvider(t)
+	ssos := []sso.Sso{p.sso("test", false)}
+	store := db.NewMemoryStore()
+	metadata := db.SessionMetadata{UserAgent: "Pebble app", RemoteIp: "192.0.2.1"}
+
+	p.setUser("alice", jwt.MapClaims{"name": "Alice", "email": "alice@example.com"}, nil)
+	accessToken, _ := login(t, ssos, store, "test", "alice")
+	userId, _, _ := store.AccountId(context.Background(), accessToken)
+	_, err := store.SetUserDisabled(context.Background(), userId, true, db.AuditActorSystem, "")
+	if err != nil {
+		t.Fatalf("Could not disable account: %v", err)
+	}
+
+	for _, test := range []struct {
+		provider string
+		code     string
+		reason   string
+		userId   string
+	}{
+		{"unknown", "alice", db.LoginInvalidProvider, ""},
+		{"test", "nobody", db.LoginInvalidCode, ""},
+		{"test", "alice", db.LoginAccountDisabled, userId},
+	} {
+		success, _, _, _, _ := Login(context.Background(), ssos, store, test.provider, test.code, metadata)
+		if success {
+			t.Errorf("Logging in with %v and code %v succeeded", test.provider, test.code)
+			continue
+		}
+
+		logins, err := store.LoginLog(context.Background(), "", "", 0, 1)
+		if err != nil || len(logins) != 1 {
+			t.Fatalf("Could not read the login log: %v", err)
+		}
+		attempt := logins[0]
+		if attempt.Success || attempt.Reason != test.reason || attempt.Provider != test.provider || attempt.UserId != test.userId || attempt.UserAgent != "Pebble app" || attempt.RemoteIp != "192.0.2.1" {
+			t.Errorf("Logging in with %v and code %v was logged as %+v, expected reason %v", test.provider, test.code, attempt, test.reason)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"pebble-dev/rebble-auth/sso"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+// testProvider is a fake OpenID Connect identity provider. The code it is given is the sub of the user logging in,
+// whose ID token holds the claims set with setUser.
+type testProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	lock          sync.Mutex
+	claims        map[string]jwt.MapClaims // sub => ID token claims
+	userinfo      map[string]jwt.MapClaims // sub => userinfo answer
+	userinfoCalls int
+	revoked       []string // Tokens revoked through the revocation endpoint
+}
+
+func newTestProvider(t *testing.T) *testProvider {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Could not generate key: %v", err)
+	}
+
+	p := &testProvider{
+		key:      key,
+		claims:   make(map[string]jwt.MapClaims),
+		userinfo: make(map[string]jwt.MapClaims),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", p.token)
+	mux.HandleFunc("/userinfo", p.serveUserinfo)
+	mux.HandleFunc("/jwks", p.jwks)
+	mux.HandleFunc("/revoke", p.revoke)
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+// sso returns the configuration of the provider under the given name
+func (p *testProvider) sso(name string, trustEmail bool) sso.Sso {
+	return sso.Sso{
+		Name:         name,
+		ClientID:     "client",
+		ClientSecret: "secret",
+		Type:         "oidc",
+		TrustEmail:   trustEmail,
+		Discovery: sso.Discovery{
+			TokenEndpoint:      p.URL + "/token",
+			UserinfoEndpoint:   p.URL + "/userinfo",
+			JwksURI:            p.URL + "/jwks",
+			RevocationEndpoint: p.URL + "/revoke",
+		},
+	}
+}
+
+// setUser sets the claims of the ID token of a user, and the answer of the userinfo endpoint for them (nil if the
+// endpoint doesn't know about them)
+func (p *testProvider) setUser(sub string, claims jwt.MapClaims, userinfo jwt.MapClaims) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	claims["sub"] = sub
+	p.claims[sub] = claims
+	p.userinfo[sub] = userinfo
+}
+
+func (p *testProvider) token(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	sub := r.FormValue("code")
+	claims, ok := p.claims[sub]
+	if !ok {
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant", "error_description": "Unknown code"})
+		return
+	}
+
+	idClaims := jwt.MapClaims{"exp": float64(time.Now().Add(time.Hour).Unix())}
+	for key, value := range claims {
+		idClaims[key] = value
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, idClaims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token":  "access-" + sub,
+		"refresh_token": "refresh-" + sub,
+		"id_token":      idToken,
+		"expires_in":    3600,
+		"token_type":    "Bearer",
+	})
+}
+
+func (p *testProvider) serveUserinfo(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.userinfoCalls++
+	for sub, userinfo := range p.userinfo {
+		if r.Header.Get("Authorization") == "Bearer access-"+sub && userinfo != nil {
+			json.NewEncoder(w).Encode(userinfo)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(map[string]string{"error": "invalid_token"})
+}
+
+func (p *testProvider) jwks(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(sso.Certs{
+		Keys: []sso.Key{
+			{
+				Kty: "RSA",
+				Alg: "RS256",
+				Use: "sig",
+				Kid: "test",
+				N:   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+			},
+		},
+	})
+}
+
+func (p *testProvider) revoke(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.revoked = append(p.revoked, r.FormValue("token"))
+}
+
+// calls returns how many times the userinfo endpoint was called
+func (p *testProvider) calls() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	return p.userinfoCalls
+}
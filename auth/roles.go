@@ -0,0 +1,124 @@
+package auth
+
+import (
+	"context"
+
+	"pebble-dev/rebble-auth/db"
+)
+
+// Roles a user can have. The role of a user is stored as its type.
+const (
+	RoleUser      = "user"
+	RoleDeveloper = "developer" // A Pebble developer who claimed their mirror account
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+	RoleService   = "service" // Another Rebble service, looking users up on behalf of its own users
+)
+
+// Permission is something a role allows, usually using some of the admin endpoints
+type Permission string
+
+// Permissions which can be given to roles
+const (
+	PermissionViewUsers     Permission = "users.view"     // Look users up, and see their accounts
+	PermissionManageUsers   Permission = "users.manage"   // Change the accounts of other users
+	PermissionAssignRoles   Permission = "roles.assign"   // Give roles to users
+	PermissionViewLogs      Permission = "logs.view"      // Browse the login and audit logs
+	PermissionReviewClaims  Permission = "claims.review"  // Approve or reject developer claims
+	PermissionRunJobs       Permission = "jobs.run"       // Import Pebble developers, and follow and cancel admin jobs
+	PermissionBackup        Permission = "backup"         // Download backups of the database
+	PermissionViewSystem    Permission = "system.view"    // See how the background jobs and identity providers are doing
+	PermissionManageClients Permission = "clients.manage" // Register and edit the clients users log in from
+	PermissionConsole       Permission = "console"        // Log in to the admin web console
+)
+
+// rolePermissions lists the permissions of each role. Roles which aren't listed have no permissions.
+var rolePermissions = map[string][]Permission{
+	RoleModerator: {PermissionViewUsers, PermissionViewLogs, PermissionReviewClaims},
+	RoleAdmin: {
+		PermissionViewUsers, PermissionManageUsers, PermissionAssignRoles, PermissionViewLogs, PermissionReviewClaims,
+		PermissionRunJobs, PermissionBackup, PermissionViewSystem, PermissionManageClients, PermissionConsole,
+	},
+	RoleService: {PermissionViewUsers},
+}
+
+// Roles returns every role, from the least to the most privileged
+func Roles() []string {
+	return []string{RoleUser, RoleDeveloper, RoleService, RoleModerator, RoleAdmin}
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	for _, r := range Roles() {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasPermission reports whether the given role has a permission
+func HasPermission(role string, permission Permission) bool {
+	for _, p := range rolePermissions[role] {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authorize checks that the user an access token belongs to is logged in, and has a permission
+// Returns loggedIn, allowed, errorMessage, session, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func Authorize(ctx context.Context, database db.Store, accessToken string, permission Permission) (bool, bool, string, db.SessionUser, error) {
+	loggedIn, errorMessage, err := database.SessionInformation(ctx, accessToken)
+	if err != nil {
+		return false, false, "Internal server error: Could not query session information", db.SessionUser{}, err
+	}
+
+	if !loggedIn {
+		return false, false, errorMessage, db.SessionUser{}, nil
+	}
+
+	session, errorMessage, err := database.LookupSession(ctx, accessToken)
+	if err != nil {
+		return false, false, "Internal server error: Could not query session information", db.SessionUser{}, err
+	}
+
+	if errorMessage != "" {
+		return false, false, errorMessage, db.SessionUser{}, nil
+	}
+
+	if !HasPermission(session.Type, permission) {
+		return true, false, "Missing permission " + string(permission), session, nil
+	}
+
+	return true, true, "", session, nil
+}
+
+// SetRole gives a role to a user
+// Returns success, errorMessage, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func SetRole(ctx context.Context, database db.Store, userId string, role string, actorId string, remoteIp string) (bool, string, error) {
+	if !ValidRole(role) {
+		return false, "Unknown role " + role, nil
+	}
+
+	// Nobody would be left to give it back if the last admin dropped their role
+	if userId == actorId {
+		return false, "You can't change your own role", nil
+	}
+
+	errorMessage, err := database.SetUserRole(ctx, userId, role, actorId, remoteIp)
+	if err != nil {
+		return false, "Internal server error: Could not set role", err
+	}
+
+	if errorMessage != "" {
+		return false, errorMessage, nil
+	}
+
+	return true, "", nil
+}
@@ -0,0 +1,114 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"pebble-dev/rebble-auth/db"
+)
+
+func TestHasPermission(t *testing.T) {
+	for _, test := range []struct {
+		role       string
+		permission Permission
+		expected   bool
+	}{
+		{RoleAdmin, PermissionAssignRoles, true},
+		{RoleAdmin, PermissionConsole, true},
+		{RoleModerator, PermissionReviewClaims, true},
+		{RoleModerator, PermissionViewLogs, true},
+		{RoleModerator, PermissionManageUsers, false},
+		{RoleModerator, PermissionConsole, false},
+		{RoleService, PermissionViewUsers, true},
+		{RoleService, PermissionViewLogs, false},
+		{RoleDeveloper, PermissionViewUsers, false},
+		{RoleUser, PermissionViewUsers, false},
+		{"unknown", PermissionViewUsers, false},
+	} {
+		if HasPermission(test.role, test.permission) != test.expected {
+			t.Errorf("HasPermission(%v, %v) = %v, expected %v", test.role, test.permission, !test.expected, test.expected)
+		}
+	}
+
+	for _, role := range Roles() {
+		if !ValidRole(role) {
+			t.Errorf("ValidRole(%v) = false", role)
+		}
+	}
+	if ValidRole("root") {
+		t.Errorf("ValidRole(root) = true")
+	}
+}
+
+// loginWithRole logs in as a new user having the given role
+// Returns the access token and ID of the user
+func loginWithRole(t *testing.T, store db.Store, role string) (string, string) {
+	t.Helper()
+
+	accessToken, _, _, err := store.AccountLoginOrRegister(context.Background(), "test", role, role, "", false, "{}", "", "", 0, db.SessionMetadata{})
+	if err != nil {
+		t.Fatalf("Could not log in: %v", err)
+	}
+	userId, _, _ := store.AccountId(context.Background(), accessToken)
+
+	errorMessage, err := store.SetUserRole(context.Background(), userId, role, db.AuditActorSystem, "")
+	if errorMessage != "" || err != nil {
+		t.Fatalf("Could not give the %v role: %v (%v)", role, errorMessage, err)
+	}
+
+	return accessToken, userId
+}
+
+func TestAuthorize(t *testing.T) {
+	store := db.NewMemoryStore()
+	userToken, _ := loginWithRole(t, store, RoleUser)
+	adminToken, adminId := loginWithRole(t, store, RoleAdmin)
+	disabledToken, disabledId := loginWithRole(t, store, RoleModerator)
+	store.SetUserDisabled(context.Background(), disabledId, true, db.AuditActorSystem, "")
+
+	for _, test := range []struct {
+		accessToken string
+		loggedIn    bool
+		allowed     bool
+	}{
+		{"invalid", false, false},
+		{disabledToken, false, false},
+		{userToken, true, false},
+		{adminToken, true, true},
+	} {
+		loggedIn, allowed, errorMessage, session, err := Authorize(context.Background(), store, test.accessToken, PermissionViewLogs)
+		if loggedIn != test.loggedIn || allowed != test.allowed || err != nil {
+			t.Errorf("Authorize() = %v, %v, %q, %v, expected %v, %v", loggedIn, allowed, errorMessage, err, test.loggedIn, test.allowed)
+		}
+		if allowed && (session.UserId != adminId || session.Type != RoleAdmin) {
+			t.Errorf("Got session %+v, expected the admin's", session)
+		}
+	}
+}
+
+func TestSetRole(t *testing.T) {
+	store := db.NewMemoryStore()
+	_, adminId := loginWithRole(t, store, RoleAdmin)
+	_, userId := loginWithRole(t, store, RoleUser)
+
+	for _, test := range []struct {
+		userId       string
+		role         string
+		errorMessage string
+	}{
+		{userId, "root", "Unknown role root"},
+		{adminId, RoleUser, "You can't change your own role"},
+		{"unknown", RoleModerator, "No such user"},
+		{userId, RoleModerator, ""},
+	} {
+		success, errorMessage, err := SetRole(context.Background(), store, test.userId, test.role, adminId, "")
+		if success != (test.errorMessage == "") || errorMessage != test.errorMessage || err != nil {
+			t.Errorf("SetRole(%v, %v) = %v, %q, %v, expected %q", test.userId, test.role, success, errorMessage, err, test.errorMessage)
+		}
+	}
+
+	entries, _ := store.AuditLog(context.Background(), db.AuditFilter{UserId: userId, Action: db.AuditAccountRole, ActorId: adminId}, 0, 10)
+	if len(entries) != 1 || entries[0].After != `{"role":"moderator"}` {
+		t.Errorf("Got audit log %+v, expected the admin to have made the user a moderator", entries)
+	}
+}
@@ -1,14 +1,15 @@
 package auth
 
 import (
+	"context"
 	"pebble-dev/rebble-auth/db"
 )
 
 // UpdateName changes the name of a logged in user
 // Returns success, errorMessage, err
 // err is only returned if the error was unexpected (internal server error vs bad request)
-func UpdateName(database *db.Handler, accessToken string, name string) (bool, string, error) {
-	loggedIn, errorMessage, err := database.SessionInformation(accessToken)
+func UpdateName(ctx context.Context, database db.Store, accessToken string, name string, remoteIp string) (bool, string, error) {
+	loggedIn, errorMessage, err := database.SessionInformation(ctx, accessToken)
 	if err != nil {
 		return false, "Internal server error: Could not query session information", err
 	}
@@ -21,7 +22,7 @@ func UpdateName(database *db.Handler, accessToken string, name string) (bool, st
 		return false, "Name can't be empty", nil
 	}
 
-	errorMessage, err = database.UpdateName(accessToken, name)
+	errorMessage, err = database.UpdateName(ctx, accessToken, name, remoteIp)
 	if err != nil {
 		return false, "Internal server error: Could not update name", err
 	}
@@ -32,8 +33,8 @@ func UpdateName(database *db.Handler, accessToken string, name string) (bool, st
 // RemoveLinkedProvider removes a linked identity provider from a user's account
 // Returns success, errorMessage, err
 // err is only returned if the error was unexpected (internal server error vs bad request)
-func RemoveLinkedProvider(database *db.Handler, accessToken string, provider string) (bool, string, error) {
-	loggedIn, errorMessage, err := database.SessionInformation(accessToken)
+func RemoveLinkedProvider(ctx context.Context, database db.Store, accessToken string, provider string, remoteIp string) (bool, string, error) {
+	loggedIn, errorMessage, err := database.SessionInformation(ctx, accessToken)
 	if err != nil {
 		return false, "Internal server error: Could not query session information", err
 	}
@@ -42,10 +43,136 @@ func RemoveLinkedProvider(database *db.Handler, accessToken string, provider str
 		return false, "Not logged in", nil
 	}
 
-	errorMessage, err = database.AccountRemoveProvider(provider, accessToken)
+	errorMessage, err = database.AccountRemoveProvider(ctx, provider, accessToken, remoteIp)
 	if err != nil {
 		return false, "Internal server error: Could not remove provider", err
 	}
 
 	return true, errorMessage, err
 }
+
+// Merge merges the account owning an identity the user tried to link into the user's account
+// Returns success, errorMessage, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func Merge(ctx context.Context, database db.Store, accessToken string, mergeToken string, remoteIp string) (bool, string, error) {
+	loggedIn, errorMessage, err := database.SessionInformation(ctx, accessToken)
+	if err != nil {
+		return false, "Internal server error: Could not query session information", err
+	}
+
+	if !loggedIn {
+		return false, "Not logged in", nil
+	}
+
+	errorMessage, err = database.AccountMerge(ctx, mergeToken, accessToken, remoteIp)
+	if err != nil {
+		return false, "Internal server error: Could not merge accounts", err
+	}
+
+	return errorMessage == "", errorMessage, nil
+}
+
+// ProfileSettings returns which provider the user's profile is kept in sync with, and whether their name is
+// Returns success, errorMessage, profileProvider, syncName, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func ProfileSettings(ctx context.Context, database db.Store, accessToken string) (bool, string, string, bool, error) {
+	loggedIn, errorMessage, err := database.SessionInformation(ctx, accessToken)
+	if err != nil {
+		return false, "Internal server error: Could not query session information", "", false, err
+	}
+
+	if !loggedIn {
+		return false, "Not logged in", "", false, nil
+	}
+
+	profileProvider, syncName, errorMessage, err := database.ProfileSettings(ctx, accessToken)
+	if err != nil {
+		return false, "Internal server error: Could not query profile settings", "", false, err
+	}
+
+	return errorMessage == "", errorMessage, profileProvider, syncName, nil
+}
+
+// UpdateProfileSettings changes which provider the user's profile is kept in sync with, and whether their name is
+// Returns success, errorMessage, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func UpdateProfileSettings(ctx context.Context, database db.Store, accessToken string, profileProvider string, syncName bool, remoteIp string) (bool, string, error) {
+	loggedIn, errorMessage, err := database.SessionInformation(ctx, accessToken)
+	if err != nil {
+		return false, "Internal server error: Could not query session information", err
+	}
+
+	if !loggedIn {
+		return false, "Not logged in", nil
+	}
+
+	errorMessage, err = database.UpdateProfileSettings(ctx, accessToken, profileProvider, syncName, remoteIp)
+	if err != nil {
+		return false, "Internal server error: Could not update profile settings", err
+	}
+
+	return errorMessage == "", errorMessage, nil
+}
+
+// Sessions lists the user's sessions
+// Returns success, errorMessage, sessions, currentSessionId, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func Sessions(ctx context.Context, database db.Store, accessToken string) (bool, string, []db.Session, int64, error) {
+	loggedIn, errorMessage, err := database.SessionInformation(ctx, accessToken)
+	if err != nil {
+		return false, "Internal server error: Could not query session information", []db.Session{}, 0, err
+	}
+
+	if !loggedIn {
+		return false, "Not logged in", []db.Session{}, 0, nil
+	}
+
+	sessions, currentSessionId, errorMessage, err := database.AccountSessions(ctx, accessToken)
+	if err != nil {
+		return false, "Internal server error: Could not query sessions", []db.Session{}, 0, err
+	}
+
+	return errorMessage == "", errorMessage, sessions, currentSessionId, nil
+}
+
+// RevokeSession logs out one of the user's sessions
+// Returns success, errorMessage, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func RevokeSession(ctx context.Context, database db.Store, accessToken string, sessionId int64, remoteIp string) (bool, string, error) {
+	loggedIn, errorMessage, err := database.SessionInformation(ctx, accessToken)
+	if err != nil {
+		return false, "Internal server error: Could not query session information", err
+	}
+
+	if !loggedIn {
+		return false, "Not logged in", nil
+	}
+
+	errorMessage, err = database.RevokeSession(ctx, accessToken, sessionId, remoteIp)
+	if err != nil {
+		return false, "Internal server error: Could not revoke session", err
+	}
+
+	return errorMessage == "", errorMessage, nil
+}
+
+// Logins lists the user's most recent login attempts
+// Returns success, errorMessage, attempts, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func Logins(ctx context.Context, database db.Store, accessToken string, limit int) (bool, string, []db.LoginAttempt, error) {
+	loggedIn, errorMessage, err := database.SessionInformation(ctx, accessToken)
+	if err != nil {
+		return false, "Internal server error: Could not query session information", []db.LoginAttempt{}, err
+	}
+
+	if !loggedIn {
+		return false, "Not logged in", []db.LoginAttempt{}, nil
+	}
+
+	attempts, errorMessage, err := database.AccountLogins(ctx, accessToken, limit)
+	if err != nil {
+		return false, "Internal server error: Could not query login history", []db.LoginAttempt{}, err
+	}
+
+	return errorMessage == "", errorMessage, attempts, nil
+}
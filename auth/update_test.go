@@ -0,0 +1,43 @@
+package auth
+
+import (
+	"context"
+	"testing"
+
+	"pebble-dev/rebble-auth/db"
+	"pebble-dev/rebble-auth/sso"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestAddProviderAndMerge(t *testing.T) {
+	p := newTestProvider(t)
+	ssos := []sso.Sso{p.sso("test", false), p.sso("other", false)}
+	store := db.NewMemoryStore()
+
+	p.setUser("alice", jwt.MapClaims{"name": "Alice", "email": "alice@example.com"}, nil)
+	p.setUser("bob", jwt.MapClaims{"name": "Bob", "email": "bob@example.com"}, nil)
+	aliceToken, _ := login(t, ssos, store, "test", "alice")
+	bobToken, _ := login(t, ssos, store, "other", "bob")
+
+	success, errorMessage, mergeToken, err := AddProvider(context.Background(), ssos, store, "other", "bob", aliceToken, "")
+	if !success || err != nil || mergeToken == "" {
+		t.Fatalf("Expected a merge token when linking an identity of another account, got %q: %v (%v)", mergeToken, errorMessage, err)
+	}
+
+	// Only a logged in user can merge
+	success, _, _ = Merge(context.Background(), store, "invalid", mergeToken, "")
+	if success {
+		t.Errorf("Accounts were merged without being logged in")
+	}
+
+	success, errorMessage, err = Merge(context.Background(), store, aliceToken, mergeToken, "")
+	if !success || err != nil {
+		t.Fatalf("Could not merge accounts: %v (%v)", errorMessage, err)
+	}
+
+	name, _, providers := accountInformation(t, store, bobToken)
+	if name != "Alice" || len(providers) != 2 {
+		t.Errorf("Got %v with providers %v, expected Alice with both identities", name, providers)
+	}
+}
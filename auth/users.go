@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"context"
+
+	"pebble-dev/rebble-auth/db"
+)
+
+// SetDisabled disables or enables the account of another user
+// Returns success, errorMessage, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func SetDisabled(ctx context.Context, database db.Store, userId string, disabled bool, actorId string, remoteIp string) (bool, string, error) {
+	if userId == actorId {
+		return false, "You can't disable or enable your own account", nil
+	}
+
+	errorMessage, err := database.SetUserDisabled(ctx, userId, disabled, actorId, remoteIp)
+	if err != nil {
+		return false, "Internal server error: Could not update account", err
+	}
+
+	if errorMessage != "" {
+		return false, errorMessage, nil
+	}
+
+	return true, "", nil
+}
+
+// LogoutUser logs out all of the sessions of a user
+// Returns success, errorMessage, sessions, err, sessions being the number of sessions logged out
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func LogoutUser(ctx context.Context, database db.Store, userId string, actorId string, remoteIp string) (bool, string, int64, error) {
+	sessions, errorMessage, err := database.LogoutUser(ctx, userId, actorId, remoteIp)
+	if err != nil {
+		return false, "Internal server error: Could not log out sessions", 0, err
+	}
+
+	if errorMessage != "" {
+		return false, errorMessage, 0, nil
+	}
+
+	return true, "", sessions, nil
+}
+
+// SetName changes the name of another user
+// Returns success, errorMessage, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func SetName(ctx context.Context, database db.Store, userId string, name string, actorId string, remoteIp string) (bool, string, error) {
+	if name == "" {
+		return false, "Name can't be empty", nil
+	}
+
+	errorMessage, err := database.SetUserName(ctx, userId, name, actorId, remoteIp)
+	if err != nil {
+		return false, "Internal server error: Could not update name", err
+	}
+
+	if errorMessage != "" {
+		return false, errorMessage, nil
+	}
+
+	return true, "", nil
+}
+
+// RevokeUserSession logs out one of the sessions of a user
+// Returns success, errorMessage, err
+// err is only returned if the error was unexpected (internal server error vs bad request)
+func RevokeUserSession(ctx context.Context, database db.Store, userId string, sessionId int64, actorId string, remoteIp string) (bool, string, error) {
+	errorMessage, err := database.RevokeUserSession(ctx, userId, sessionId, actorId, remoteIp)
+	if err != nil {
+		return false, "Internal server error: Could not revoke session", err
+	}
+
+	if errorMessage != "" {
+		return false, errorMessage, nil
+	}
+
+	return true, "", nil
+}
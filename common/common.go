@@ -1,6 +1,7 @@
 package common
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/json"
 	"errors"
@@ -76,6 +77,67 @@ func Get(uri string, values *url.Values, authorization string, out interface{})
 	return decode(resp, err, out)
 }
 
+// checkStatus makes sure a request succeeded, for APIs which don't answer with anything we need
+func checkStatus(resp *http.Response, err error) error {
+	if err != nil {
+		return fmt.Errorf("Could not reach remote server: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Remote server answered with status %v", resp.Status)
+	}
+
+	return nil
+}
+
+// Send sends url-encoded values using the given method, and only checks that the request succeeded
+// authorization is optional, is used for APIs that use the Authorization header instead of a `clientSecret` query parameter
+func Send(method string, uri string, values *url.Values, authorization string) error {
+	client := &http.Client{}
+	var req *http.Request
+	var err error
+	if method == "GET" || method == "DELETE" {
+		req, err = http.NewRequest(method, uri+"?"+values.Encode(), nil)
+	} else {
+		req, err = http.NewRequest(method, uri, strings.NewReader(values.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := client.Do(req)
+
+	return checkStatus(resp, err)
+}
+
+// PostJSON POSTs a JSON-encoded object, and only checks that the request succeeded
+// authorization is optional
+func PostJSON(uri string, in interface{}, authorization string) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{}
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	resp, err := client.Do(req)
+
+	return checkStatus(resp, err)
+}
+
 // GetAccessToken returns the content of the `Authorization` header (stripped of the `Bearer ` part)
 func GetAccessToken(r *http.Request) (string, error) {
 	authorization := r.Header.Get("Authorization")
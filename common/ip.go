@@ -0,0 +1,21 @@
+package common
+
+import (
+	"net"
+)
+
+// AnonymizeIp truncates an IP address so that it can't be tied to a user anymore, while still telling roughly where
+// they connected from: IPv4 addresses are truncated to their /24 network, IPv6 addresses to their /48 network.
+// Anything which isn't an IP address is dropped.
+func AnonymizeIp(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(24, 32)).String()
+	}
+
+	return parsed.Mask(net.CIDRMask(48, 128)).String()
+}
@@ -0,0 +1,18 @@
+package common
+
+import "testing"
+
+func TestAnonymizeIp(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"192.0.2.123":           "192.0.2.0",
+		"2001:db8:1234:5678::1": "2001:db8:1234::",
+		"::ffff:192.0.2.123":    "192.0.2.0",
+		"192.0.2.0":             "192.0.2.0",
+		"not an ip":             "",
+		"":                      "",
+	} {
+		if anonymized := AnonymizeIp(ip); anonymized != expected {
+			t.Errorf("AnonymizeIp(%q) = %q, expected %q", ip, anonymized, expected)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter allows an action at most once per interval for each key (such as a user ID). It only keeps track of the
+// actions made by this process, so each instance of rebble-auth enforces its own limit.
+type RateLimiter struct {
+	lock     sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+}
+
+// NewRateLimiter returns a RateLimiter allowing an action once per interval
+func NewRateLimiter(interval time.Duration) *RateLimiter {
+	return &RateLimiter{
+		interval: interval,
+		last:     make(map[string]time.Time),
+	}
+}
+
+// Allow returns whether the action is allowed for the given key and, if it is, records that it happened: it won't be
+// allowed again until the interval is over. Checking and recording under the same lock means that two concurrent
+// callers can't both be allowed.
+func (limiter *RateLimiter) Allow(key string) bool {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	now := time.Now()
+	if last, ok := limiter.last[key]; ok && now.Sub(last) < limiter.interval {
+		return false
+	}
+
+	// Forget about keys which aren't limited anymore, so that the map doesn't grow forever
+	for k, last := range limiter.last {
+		if now.Sub(last) >= limiter.interval {
+			delete(limiter.last, k)
+		}
+	}
+
+	limiter.last[key] = now
+	return true
+}
+
+// Forget allows the action for the given key again right away, for instance because the one Allow let through failed
+func (limiter *RateLimiter) Forget(key string) {
+	limiter.lock.Lock()
+	defer limiter.lock.Unlock()
+
+	delete(limiter.last, key)
+}
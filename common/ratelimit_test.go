@@ -0,0 +1,60 @@
+package common
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := NewRateLimiter(50 * time.Millisecond)
+
+	if !limiter.Allow("alice") {
+		t.Fatalf("The action wasn't allowed before it ever happened")
+	}
+	if limiter.Allow("alice") {
+		t.Errorf("The action was allowed again before the interval was over")
+	}
+	if !limiter.Allow("bob") {
+		t.Errorf("The action of one key limited another one")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !limiter.Allow("alice") {
+		t.Errorf("The action wasn't allowed again after the interval")
+	}
+
+	// Keys which aren't limited anymore are forgotten
+	if _, ok := limiter.last["bob"]; ok {
+		t.Errorf("The key of an action which isn't limited anymore was kept")
+	}
+
+	limiter.Forget("alice")
+	if !limiter.Allow("alice") {
+		t.Errorf("The action wasn't allowed again once forgotten")
+	}
+}
+
+func TestRateLimiterConcurrent(t *testing.T) {
+	limiter := NewRateLimiter(time.Minute)
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if limiter.Allow("alice") {
+				lock.Lock()
+				allowed++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != 1 {
+		t.Errorf("The action was allowed %v times at once, expected once", allowed)
+	}
+}
@@ -0,0 +1,249 @@
+package db
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Actions recorded in the audit log
+const (
+	AuditAccountCreate    = "account.create"
+	AuditAccountName      = "account.name"
+	AuditAccountProfile   = "account.profile"
+	AuditAccountMerge     = "account.merge"
+	AuditAccountRole      = "account.role"
+	AuditAccountDisable   = "account.disable"
+	AuditAccountEnable    = "account.enable"
+	AuditDeletionSchedule = "account.deletion_scheduled"
+	AuditDeletionCancel   = "account.deletion_cancelled" // The user logged in during the grace period
+	AuditAccountDelete    = "account.delete"
+	AuditProviderLink     = "provider.link"
+	AuditProviderUnlink   = "provider.unlink"
+	AuditSessionRevoke    = "session.revoke"
+	AuditSessionLogout    = "session.logout" // An administrator logged out all of the sessions of a user
+	AuditClaimCreate      = "claim.create"
+	AuditClaimApprove     = "claim.approve"
+	AuditClaimReject      = "claim.reject"
+	AuditMirrorCreate     = "mirror.create"
+	AuditMirrorRename     = "mirror.rename"
+	AuditClientCreate     = "client.create"
+	AuditClientUpdate     = "client.update"
+	AuditClientDelete     = "client.delete"
+)
+
+// Actors of the changes which weren't made by a user
+const (
+	AuditActorAdmin  = "admin"  // An administrator, through the command line
+	AuditActorSystem = "system" // rebble-auth itself, such as the background jobs
+)
+
+// AuditEntry is an entry of the audit log, recording a change made to an account or to the registered clients
+type AuditEntry struct {
+	Id       int64
+	Time     time.Time
+	ActorId  string // ID of the user who made the change, or one of the AuditActor* constants
+	UserId   string // ID of the account which was changed, if any
+	Action   string
+	Before   string // JSON object of the values before the change, empty if there were none
+	After    string // JSON object of the values after the change, empty if there are none
+	RemoteIp string
+}
+
+// AuditFilter selects audit log entries. Empty fields match everything.
+type AuditFilter struct {
+	ActorId string
+	UserId  string
+	Action  string // Either an action, or a prefix such as `account.` to match a group of actions
+	Since   time.Time
+	Until   time.Time
+}
+
+// AuditSink receives the audit log entries once the changes they record are committed, for instance to ship them to
+// log storage
+type AuditSink interface {
+	WriteAudit(entry AuditEntry) error
+}
+
+// auditValues encodes the values before or after a change for the audit log
+func auditValues(values map[string]interface{}) string {
+	if values == nil {
+		return ""
+	}
+
+	// Values are only ever strings, numbers, booleans, dates and lists of them, which can always be encoded
+	data, _ := json.Marshal(values)
+	return string(data)
+}
+
+// auditHash hashes an identifier for the audit log, such as the ID of a user at their identity provider. Names, e-mail
+// addresses and identifiers are never audited as-is, since the audit log is kept after the accounts it is about are
+// deleted; the hash can still be matched against an identifier which is already known.
+func auditHash(value string) string {
+	hash := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(hash[:])
+}
+
+// audit adds an entry to the audit log, or hands it to the event writer once the transaction is committed. Either way,
+// it is sent to the audit sink once it is committed.
+func audit(tx *Tx, entry AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	if tx.events != nil {
+		tx.audits = append(tx.audits, entry)
+		return nil
+	}
+
+	_, err := tx.Exec("INSERT INTO auditLog(time, actorId, userId, action, oldValue, newValue, remoteIp) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		entry.Time.UnixNano(), entry.ActorId, entry.UserId, entry.Action, entry.Before, entry.After, entry.RemoteIp)
+	if err != nil {
+		return err
+	}
+
+	tx.audits = append(tx.audits, entry)
+	return nil
+}
+
+// writeAudits sends audit log entries to a sink. Failures are logged, as the changes are already committed.
+func writeAudits(sink AuditSink, entries []AuditEntry) {
+	if sink == nil {
+		return
+	}
+
+	for _, entry := range entries {
+		err := sink.WriteAudit(entry)
+		if err != nil {
+			log.Printf("Could not write %v audit log entry to sink: %v", entry.Action, err)
+		}
+	}
+}
+
+// AuditLog returns a page of the audit log, latest first
+func (handler Handler) AuditLog(ctx context.Context, filter AuditFilter, offset int, limit int) ([]AuditEntry, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.ActorId != "" {
+		conditions = append(conditions, "actorId=?")
+		args = append(args, filter.ActorId)
+	}
+	if filter.UserId != "" {
+		conditions = append(conditions, "userId=?")
+		args = append(args, filter.UserId)
+	}
+	if strings.HasSuffix(filter.Action, ".") {
+		conditions = append(conditions, "substr(action, 1, ?)=?")
+		args = append(args, len(filter.Action), filter.Action)
+	} else if filter.Action != "" {
+		conditions = append(conditions, "action=?")
+		args = append(args, filter.Action)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "time>=?")
+		args = append(args, filter.Since.UnixNano())
+	}
+	if !filter.Until.IsZero() {
+		conditions = append(conditions, "time<?")
+		args = append(args, filter.Until.UnixNano())
+	}
+
+	query := ""
+	if len(conditions) > 0 {
+		query = "WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY time DESC, id DESC LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	return handler.queryAuditLog(ctx, query, args...)
+}
+
+// queryAuditLog runs a query selecting audit log entries, and returns them
+func (handler Handler) queryAuditLog(ctx context.Context, query string, args ...interface{}) ([]AuditEntry, error) {
+	rows, err := handler.Query(ctx, "SELECT id, time, actorId, userId, action, oldValue, newValue, remoteIp FROM auditLog "+query, args...)
+	if err != nil {
+		return []AuditEntry{}, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var entry AuditEntry
+		var t int64
+		err = rows.Scan(&entry.Id, &t, &entry.ActorId, &entry.UserId, &entry.Action, &entry.Before, &entry.After, &entry.RemoteIp)
+		if err != nil {
+			return []AuditEntry{}, err
+		}
+		entry.Time = unixNanoTime(t)
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// auditLine is the format of the entries written by AuditFile
+type auditLine struct {
+	Time     time.Time       `json:"time"`
+	ActorId  string          `json:"actorId"`
+	UserId   string          `json:"userId"`
+	Action   string          `json:"action"`
+	Before   json.RawMessage `json:"before"`
+	After    json.RawMessage `json:"after"`
+	RemoteIp string          `json:"remoteIp"`
+}
+
+// AuditFile is an AuditSink appending the audit log entries to a file, one JSON object per line
+type AuditFile struct {
+	lock sync.Mutex
+	f    *os.File
+}
+
+// OpenAuditFile opens (or creates) a JSON lines file to append the audit log to
+func OpenAuditFile(path string) (*AuditFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuditFile{f: f}, nil
+}
+
+// WriteAudit appends an entry to the file
+func (file *AuditFile) WriteAudit(entry AuditEntry) error {
+	line := auditLine{
+		Time:     entry.Time,
+		ActorId:  entry.ActorId,
+		UserId:   entry.UserId,
+		Action:   entry.Action,
+		RemoteIp: entry.RemoteIp,
+	}
+	if entry.Before != "" {
+		line.Before = json.RawMessage(entry.Before)
+	}
+	if entry.After != "" {
+		line.After = json.RawMessage(entry.After)
+	}
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	file.lock.Lock()
+	defer file.lock.Unlock()
+
+	_, err = file.f.Write(append(data, '\n'))
+	return err
+}
+
+// Close closes the file
+func (file *AuditFile) Close() error {
+	return file.f.Close()
+}
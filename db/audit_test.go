@@ -0,0 +1,162 @@
+package db
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		aliceId := testUserId(t, store, aliceToken)
+		bobToken := testLogin(t, store, "bob", "Bob", "bob@example.com")
+		bobId := testUserId(t, store, bobToken)
+
+		errorMessage, err := store.UpdateName(ctx, aliceToken, "Alice Liddell", "192.0.2.1")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not update name: %v (%v)", errorMessage, err)
+		}
+		errorMessage, err = store.SetUserRole(ctx, bobId, "admin", AuditActorSystem, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not set role: %v (%v)", errorMessage, err)
+		}
+
+		entries, err := store.AuditLog(ctx, AuditFilter{UserId: aliceId}, 0, 10)
+		if err != nil || len(entries) != 2 || entries[0].Action != AuditAccountName || entries[1].Action != AuditAccountCreate {
+			t.Fatalf("AuditLog() = %+v, %v, expected alice's changes, latest first", entries, err)
+		}
+		rename := entries[0]
+		if rename.ActorId != aliceId || rename.RemoteIp != "192.0.2.1" || rename.Before != "" || rename.After != "" {
+			t.Errorf("Got entry %+v, expected alice to have renamed herself, without her names", rename)
+		}
+
+		// Personal details don't outlive the account in the audit log
+		created := entries[1]
+		if created.After != `{"provider":"test","subHash":"`+auditHash("alice")+`"}` {
+			t.Errorf("Got entry %+v, expected only the provider and the hash of alice's identifier", created)
+		}
+
+		for _, test := range []struct {
+			filter   AuditFilter
+			expected int
+		}{
+			{AuditFilter{}, 4},
+			{AuditFilter{Action: "account."}, 4},
+			{AuditFilter{Action: "account"}, 0},
+			{AuditFilter{Action: AuditAccountRole}, 1},
+			{AuditFilter{ActorId: AuditActorSystem}, 1},
+			{AuditFilter{UserId: bobId, Action: AuditAccountCreate}, 1},
+			{AuditFilter{Since: rename.Time}, 2},
+			{AuditFilter{Until: rename.Time}, 2},
+			{AuditFilter{Since: time.Now().Add(time.Hour)}, 0},
+		} {
+			entries, err = store.AuditLog(ctx, test.filter, 0, 10)
+			if err != nil || len(entries) != test.expected {
+				t.Errorf("AuditLog(%+v) = %v entries, %v, expected %v", test.filter, len(entries), err, test.expected)
+			}
+		}
+
+		entries, _ = store.AuditLog(ctx, AuditFilter{}, 3, 10)
+		if len(entries) != 1 || entries[0].UserId != aliceId || entries[0].Action != AuditAccountCreate {
+			t.Errorf("Got %+v, expected the last page to hold the creation of alice's account", entries)
+		}
+	})
+}
+
+// recordingSink is an AuditSink keeping the entries it receives
+type recordingSink struct {
+	lock    sync.Mutex
+	entries []AuditEntry
+}
+
+func (sink *recordingSink) WriteAudit(entry AuditEntry) error {
+	sink.lock.Lock()
+	defer sink.lock.Unlock()
+
+	sink.entries = append(sink.entries, entry)
+	return nil
+}
+
+func TestAuditSink(t *testing.T) {
+	sqlite := openTestHandler(t)
+	sqliteSink := &recordingSink{}
+	sqlite.AuditSink = sqliteSink
+
+	memory := NewMemoryStore()
+	memorySink := &recordingSink{}
+	memory.AuditSink = memorySink
+
+	for name, test := range map[string]struct {
+		store Store
+		sink  *recordingSink
+	}{"SQLite": {sqlite, sqliteSink}, "Memory": {memory, memorySink}} {
+		t.Run(name, func(t *testing.T) {
+			accessToken := testLogin(t, test.store, "alice", "Alice", "alice@example.com")
+			test.store.UpdateName(context.Background(), accessToken, "Alice Liddell", "")
+
+			if len(test.sink.entries) != 2 || test.sink.entries[0].Action != AuditAccountCreate || test.sink.entries[1].Action != AuditAccountName {
+				t.Errorf("The sink received %+v, expected the creation and renaming of alice's account", test.sink.entries)
+			}
+
+			// Failed changes aren't sent
+			test.store.UpdateName(context.Background(), "invalid", "Mallory", "")
+			if len(test.sink.entries) != 2 {
+				t.Errorf("The sink received %v entries, expected only the committed changes", len(test.sink.entries))
+			}
+		})
+	}
+}
+
+func TestAuditFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	file, err := OpenAuditFile(path)
+	if err != nil {
+		t.Fatalf("Could not open audit file: %v", err)
+	}
+
+	entries := []AuditEntry{
+		{Time: time.Now(), ActorId: AuditActorAdmin, UserId: "alice", Action: AuditAccountRole, Before: `{"role":"user"}`, After: `{"role":"admin"}`},
+		{Time: time.Now(), ActorId: AuditActorSystem, UserId: "bob", Action: AuditAccountDelete},
+	}
+	for _, entry := range entries {
+		err = file.WriteAudit(entry)
+		if err != nil {
+			t.Fatalf("Could not write entry: %v", err)
+		}
+	}
+	file.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Could not open audit file: %v", err)
+	}
+	defer f.Close()
+
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		err = json.Unmarshal(scanner.Bytes(), &line)
+		if err != nil {
+			t.Fatalf("Could not decode %q: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+
+	if len(lines) != 2 {
+		t.Fatalf("Got %v lines, expected 2", len(lines))
+	}
+	if before, _ := lines[0]["before"].(map[string]interface{}); before["role"] != "user" || lines[0]["action"] != AuditAccountRole {
+		t.Errorf("Got %v, expected the role given to alice", lines[0])
+	}
+	if lines[1]["before"] != nil || lines[1]["after"] != nil || lines[1]["actorId"] != AuditActorSystem {
+		t.Errorf("Got %v, expected the deletion of bob's account without values", lines[1])
+	}
+}
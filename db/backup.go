@@ -0,0 +1,237 @@
+package db
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// ErrBackupUnsupported is returned when backing up or restoring a database that isn't an SQLite database. PostgreSQL
+// databases should be backed up with pg_dump instead.
+var ErrBackupUnsupported = errors.New("Only SQLite databases can be backed up and restored by rebble-auth, use pg_dump for PostgreSQL")
+
+// Backuper is implemented by stores which can write a snapshot of their data
+type Backuper interface {
+	// WriteBackup writes a consistent snapshot of the database to w, compressed with gzip if asked to
+	WriteBackup(w io.Writer, compress bool) error
+}
+
+// backupStepPages is how many pages are copied at once during a backup. Between steps, the database is unlocked so
+// that the server can keep writing to it.
+const backupStepPages = 256
+
+// sqliteConn returns the driver connection underlying a database/sql connection
+func sqliteConn(conn *sql.Conn) (*sqlite3.SQLiteConn, error) {
+	var sqliteConn *sqlite3.SQLiteConn
+	err := conn.Raw(func(driverConn interface{}) error {
+		c, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("Unexpected SQLite driver connection type %T", driverConn)
+		}
+		sqliteConn = c
+		return nil
+	})
+
+	return sqliteConn, err
+}
+
+// backupTo copies the database to a new SQLite database at the given path, using the SQLite online backup API
+func (handler Handler) backupTo(path string) error {
+	ctx := context.Background()
+
+	dest, err := sql.Open(SQLite, path)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	destConn, err := dest.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	srcConn, err := handler.DB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	destSqlite, err := sqliteConn(destConn)
+	if err != nil {
+		return err
+	}
+	srcSqlite, err := sqliteConn(srcConn)
+	if err != nil {
+		return err
+	}
+
+	backup, err := destSqlite.Backup("main", srcSqlite, "main")
+	if err != nil {
+		return err
+	}
+	defer backup.Close()
+
+	for {
+		done, err := backup.Step(backupStepPages)
+		if err != nil {
+			return err
+		}
+		if done {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return backup.Finish()
+}
+
+// WriteBackup writes a consistent snapshot of the database to w, compressed with gzip if asked to
+// The snapshot is first written to a temporary file, so that nothing is written to w if it fails.
+func (handler Handler) WriteBackup(w io.Writer, compress bool) error {
+	if handler.driver != SQLite {
+		return ErrBackupUnsupported
+	}
+
+	tmp, err := ioutil.TempFile("", "rebble-auth-backup-*.db")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	err = handler.backupTo(tmp.Name())
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(tmp.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !compress {
+		_, err = io.Copy(w, f)
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	_, err = io.Copy(gz, f)
+	if err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// backupSchemaVersion returns the schema version of the SQLite database at the given path, without modifying it
+func backupSchemaVersion(path string) (int, error) {
+	database, err := sql.Open(SQLite, "file:"+path+"?mode=ro")
+	if err != nil {
+		return 0, err
+	}
+	defer database.Close()
+
+	var integrity string
+	err = database.QueryRow("PRAGMA integrity_check").Scan(&integrity)
+	if err != nil {
+		return 0, err
+	}
+	if integrity != "ok" {
+		return 0, fmt.Errorf("Integrity check failed: %v", integrity)
+	}
+
+	var version sql.NullInt64
+	err = database.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("Not a rebble-auth database: %v", err)
+	}
+
+	return int(version.Int64), nil
+}
+
+// Restore replaces the SQLite database at path with a backup (compressed with gzip or not). The backup is checked
+// before the database is replaced: it has to be a rebble-auth database whose schema isn't newer than this build. Older
+// schemas are brought up to date by the migrations the next time the database is opened.
+// rebble-auth must not be running while the database is restored.
+// Returns the schema version of the backup
+func Restore(driver string, path string, backupPath string) (int, error) {
+	if driver != SQLite {
+		return 0, ErrBackupUnsupported
+	}
+
+	backup, err := os.Open(backupPath)
+	if err != nil {
+		return 0, err
+	}
+	defer backup.Close()
+
+	// gzip streams start with 0x1f 0x8b, SQLite databases with "SQLite format 3"
+	buffered := bufio.NewReader(backup)
+	var r io.Reader = buffered
+	magic, err := buffered.Peek(2)
+	if err != nil {
+		return 0, fmt.Errorf("Could not read backup: %v", err)
+	}
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		r, err = gzip.NewReader(r)
+		if err != nil {
+			return 0, fmt.Errorf("Could not decompress backup: %v", err)
+		}
+	}
+
+	// The backup is written next to the database, so that it can then be moved in place atomically
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".restore-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("Could not read backup: %v", err)
+	}
+	err = tmp.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := backupSchemaVersion(tmp.Name())
+	if err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		return 0, errors.New("Not a rebble-auth database: no migration was ever run on it")
+	}
+	if version > LatestSchemaVersion() {
+		return 0, fmt.Errorf("Backup schema version %v is newer than the latest version known to this build (%v)", version, LatestSchemaVersion())
+	}
+
+	// Journals left over by the old database must not be applied to the new one
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		err = os.Remove(path + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+
+	err = os.Rename(tmp.Name(), path)
+	if err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeBackupFile backs a database up to a new file, and returns its path
+func writeBackupFile(t *testing.T, handler Handler, compress bool) string {
+	t.Helper()
+
+	var buffer bytes.Buffer
+	err := handler.WriteBackup(&buffer, compress)
+	if err != nil {
+		t.Fatalf("Could not back up database: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	err = os.WriteFile(path, buffer.Bytes(), 0600)
+	if err != nil {
+		t.Fatalf("Could not write backup: %v", err)
+	}
+
+	return path
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		handler := openTestHandler(t)
+		accessToken := testLogin(t, handler, "alice", "Alice", "alice@example.com")
+		backupPath := writeBackupFile(t, handler, compress)
+
+		magic, _ := os.ReadFile(backupPath)
+		if compress != (len(magic) > 2 && magic[0] == 0x1f && magic[1] == 0x8b) {
+			t.Errorf("Expected the backup to be compressed: %v", compress)
+		}
+
+		path := filepath.Join(t.TempDir(), "restored.db")
+		version, err := Restore(SQLite, path, backupPath)
+		if err != nil || version != LatestSchemaVersion() {
+			t.Fatalf("Restore() = %v, %v, expected schema version %v", version, err, LatestSchemaVersion())
+		}
+
+		restored, err := Open(SQLite, path)
+		if err != nil {
+			t.Fatalf("Could not open restored database: %v", err)
+		}
+		defer restored.Close()
+
+		loggedIn, name, _, _, err := restored.AccountInformation(context.Background(), accessToken)
+		if !loggedIn || err != nil || name != "Alice" {
+			t.Errorf("AccountInformation() = %v, %v, %v on the restored database, expected Alice", loggedIn, name, err)
+		}
+	}
+}
+
+func TestRestoreRefusesInvalidBackups(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rebble-auth.db")
+	err := os.WriteFile(path, []byte("current"), 0600)
+	if err != nil {
+		t.Fatalf("Could not write database: %v", err)
+	}
+
+	// A database from a newer build
+	newer := openTestHandler(t)
+	_, err = newer.Exec(context.Background(), "INSERT INTO schema_migrations(version, description, applied) VALUES (?, 'From the future', 0)", LatestSchemaVersion()+1)
+	if err != nil {
+		t.Fatalf("Could not insert migration: %v", err)
+	}
+
+	// A database which isn't a rebble-auth database
+	other, err := Open(SQLite, filepath.Join(t.TempDir(), "other.db"))
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer other.Close()
+	_, err = other.Exec(context.Background(), "CREATE TABLE things (id integer)")
+	if err != nil {
+		t.Fatalf("Could not create table: %v", err)
+	}
+
+	garbage := filepath.Join(t.TempDir(), "garbage.db")
+	err = os.WriteFile(garbage, []byte("This isn't a database"), 0600)
+	if err != nil {
+		t.Fatalf("Could not write file: %v", err)
+	}
+
+	for name, backupPath := range map[string]string{
+		"newer":   writeBackupFile(t, newer, true),
+		"other":   writeBackupFile(t, other, false),
+		"garbage": garbage,
+	} {
+		_, err = Restore(SQLite, path, backupPath)
+		if err == nil {
+			t.Errorf("The %v backup was restored", name)
+		}
+
+		current, _ := os.ReadFile(path)
+		if string(current) != "current" {
+			t.Errorf("The database was replaced by the %v backup", name)
+		}
+	}
+}
+
+func TestBackupUnsupported(t *testing.T) {
+	_, err := Restore(Postgres, "", "")
+	if err != ErrBackupUnsupported {
+		t.Errorf("Restore() = %v, expected %v", err, ErrBackupUnsupported)
+	}
+
+	handler, err := NewHandler(nil, Postgres)
+	if err != nil {
+		t.Fatalf("Could not create handler: %v", err)
+	}
+	err = handler.WriteBackup(&bytes.Buffer{}, false)
+	if err != ErrBackupUnsupported {
+		t.Errorf("WriteBackup() = %v, expected %v", err, ErrBackupUnsupported)
+	}
+}
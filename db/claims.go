@@ -0,0 +1,303 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"pebble-dev/rebble-auth/common"
+)
+
+// Statuses of developer claims
+const (
+	ClaimPending  = "pending"
+	ClaimApproved = "approved"
+	ClaimRejected = "rejected"
+)
+
+// How a developer claim was resolved
+const (
+	ClaimByAdmin = "admin" // An administrator reviewed the claim
+	ClaimByToken = "token" // The user put the claim token in the metadata of one of the developer's apps
+)
+
+// DeveloperClaim is a request from a user to take over the mirror account of a Pebble developer
+type DeveloperClaim struct {
+	Id          int64
+	UserId      string
+	DeveloperId string
+	Token       string // Proves the claim when found in the metadata of one of the developer's apps
+	Status      string
+	ResolvedBy  string // Empty while the claim is pending
+	Created     time.Time
+	Resolved    time.Time // Zero while the claim is pending
+}
+
+// queryDeveloperClaims runs a query selecting developer claims, and returns them
+func queryDeveloperClaims(q func(query string, args ...interface{}) (*Rows, error), query string, args ...interface{}) ([]DeveloperClaim, error) {
+	rows, err := q("SELECT id, userId, developerId, token, status, resolvedBy, created, resolved FROM developerClaims "+query, args...)
+	if err != nil {
+		return []DeveloperClaim{}, err
+	}
+	defer rows.Close()
+
+	claims := []DeveloperClaim{}
+	for rows.Next() {
+		var claim DeveloperClaim
+		var created, resolved int64
+		err = rows.Scan(&claim.Id, &claim.UserId, &claim.DeveloperId, &claim.Token, &claim.Status, &claim.ResolvedBy, &created, &resolved)
+		if err != nil {
+			return []DeveloperClaim{}, err
+		}
+		claim.Created = unixNanoTime(created)
+		claim.Resolved = unixNanoTime(resolved)
+
+		claims = append(claims, claim)
+	}
+
+	return claims, rows.Err()
+}
+
+// ClaimDeveloper asks for the mirror account of a Pebble developer to be merged into the account associated to the
+// given access token. If the user already has a pending claim for this developer, it is returned instead.
+// Returns (claim DeveloperClaim, errMessage string, err error)
+func (handler Handler) ClaimDeveloper(ctx context.Context, accessToken string, developerId string, remoteIp string) (DeveloperClaim, string, error) {
+	var claim DeveloperClaim
+	errorMessage, err := handler.transaction(ctx, func(tx *Tx) (string, error) {
+		var userId string
+		row := tx.QueryRow("SELECT userId FROM userSessions WHERE accessToken=?", hashToken(accessToken))
+		err := row.Scan(&userId)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return "Invalid access token", nil
+			}
+
+			return "Internal server error", err
+		}
+
+		pebbleMirror := false
+		row = tx.QueryRow("SELECT pebbleMirror FROM users WHERE id=?", developerId)
+		err = row.Scan(&pebbleMirror)
+		if err != nil && err != sql.ErrNoRows {
+			return "Internal server error", err
+		}
+		if err == sql.ErrNoRows || !pebbleMirror {
+			// Mirrors which were already claimed only exist as aliases
+			return "No unclaimed Pebble developer with this ID", nil
+		}
+
+		claims, err := queryDeveloperClaims(tx.Query, "WHERE userId=? AND developerId=? AND status=?", userId, developerId, ClaimPending)
+		if err != nil {
+			return "Internal server error", err
+		}
+		if len(claims) > 0 {
+			claim = claims[0]
+			return "", nil
+		}
+
+		token := "rebble-claim-" + common.GenerateString(32)
+		_, err = tx.Exec("INSERT INTO developerClaims(userId, developerId, token, status, created) VALUES (?, ?, ?, ?, ?)",
+			userId, developerId, token, ClaimPending, time.Now().UnixNano())
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		// Reading the claim back gives us its ID, whatever the database
+		claims, err = queryDeveloperClaims(tx.Query, "WHERE token=?", token)
+		if err != nil || len(claims) == 0 {
+			return "Internal server error", err
+		}
+		claim = claims[0]
+
+		err = audit(tx, AuditEntry{
+			ActorId:  userId,
+			UserId:   userId,
+			Action:   AuditClaimCreate,
+			After:    auditValues(map[string]interface{}{"claimId": claim.Id, "developerId": developerId}),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+	if errorMessage != "" || err != nil {
+		return DeveloperClaim{}, errorMessage, err
+	}
+
+	return claim, "", nil
+}
+
+// AccountDeveloperClaims returns the developer claims made by the user, latest first
+// Returns (claims []DeveloperClaim, errMessage string, err error)
+func (handler Handler) AccountDeveloperClaims(ctx context.Context, accessToken string) ([]DeveloperClaim, string, error) {
+	userId, err := handler.getAccountId(ctx, accessToken)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return []DeveloperClaim{}, "Invalid access token", nil
+		}
+
+		return []DeveloperClaim{}, "Internal server error", err
+	}
+
+	claims, err := queryDeveloperClaims(handler.queryFunc(ctx), "WHERE userId=? ORDER BY created DESC", userId)
+	if err != nil {
+		return []DeveloperClaim{}, "Internal server error", err
+	}
+
+	return claims, "", nil
+}
+
+// DeveloperClaims returns a page of the developer claims with the given status (or all of them if status is empty),
+// oldest first so that pending claims are reviewed in order
+func (handler Handler) DeveloperClaims(ctx context.Context, status string, offset int, limit int) ([]DeveloperClaim, error) {
+	if status == "" {
+		return queryDeveloperClaims(handler.queryFunc(ctx), "ORDER BY created, id LIMIT ? OFFSET ?", limit, offset)
+	}
+
+	return queryDeveloperClaims(handler.queryFunc(ctx), "WHERE status=? ORDER BY created, id LIMIT ? OFFSET ?", status, limit, offset)
+}
+
+// ApproveDeveloperClaim merges the mirror account of a claimed developer into the account of the claimant, so that
+// the developer's apps show up under their account. Other pending claims for the same developer are rejected.
+// Returns errorMessage, err
+func (handler Handler) ApproveDeveloperClaim(ctx context.Context, claimId int64, resolvedBy string, actorId string, remoteIp string) (string, error) {
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		claims, err := queryDeveloperClaims(tx.Query, "WHERE id=?", claimId)
+		if err != nil {
+			return "Internal server error", err
+		}
+		if len(claims) == 0 {
+			return "No such claim", nil
+		}
+		claim := claims[0]
+		if claim.Status != ClaimPending {
+			return "This claim was already " + claim.Status, nil
+		}
+
+		pebbleMirror := false
+		row := tx.QueryRow("SELECT pebbleMirror FROM users WHERE id=?", claim.DeveloperId)
+		err = row.Scan(&pebbleMirror)
+		if err != nil && err != sql.ErrNoRows {
+			return "Internal server error", err
+		}
+		if err == sql.ErrNoRows || !pebbleMirror {
+			return "This developer was already claimed", nil
+		}
+
+		disabled := false
+		row = tx.QueryRow("SELECT disabled FROM users WHERE id=?", claim.UserId)
+		err = row.Scan(&disabled)
+		if err != nil {
+			return "Internal server error", err
+		}
+		if disabled {
+			return "Account is disabled", nil
+		}
+
+		err = mergeAccounts(tx, claim.DeveloperId, claim.UserId, actorId, remoteIp)
+		if err == errDeletionScheduled {
+			return "This developer's account is scheduled for deletion", nil
+		}
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		now := time.Now().UnixNano()
+		_, err = tx.Exec("UPDATE developerClaims SET status=?, resolvedBy=?, resolved=? WHERE id=?", ClaimApproved, resolvedBy, now, claim.Id)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		result, err := tx.Exec("UPDATE users SET type=? WHERE id=? AND type=?", roleDeveloper, claim.UserId, roleUser)
+		if err != nil {
+			return "Internal server error", err
+		}
+		promoted, err := result.RowsAffected()
+		if err != nil {
+			return "Internal server error", err
+		}
+		if promoted > 0 {
+			err = audit(tx, AuditEntry{
+				ActorId:  actorId,
+				UserId:   claim.UserId,
+				Action:   AuditAccountRole,
+				Before:   auditValues(map[string]interface{}{"role": roleUser}),
+				After:    auditValues(map[string]interface{}{"role": roleDeveloper}),
+				RemoteIp: remoteIp,
+			})
+			if err != nil {
+				return "Internal server error", err
+			}
+		}
+
+		err = audit(tx, AuditEntry{
+			ActorId:  actorId,
+			UserId:   claim.UserId,
+			Action:   AuditClaimApprove,
+			After:    auditValues(map[string]interface{}{"claimId": claim.Id, "developerId": claim.DeveloperId, "resolvedBy": resolvedBy}),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		others, err := queryDeveloperClaims(tx.Query, "WHERE developerId=? AND status=?", claim.DeveloperId, ClaimPending)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		for _, other := range others {
+			_, err = tx.Exec("UPDATE developerClaims SET status=?, resolvedBy=?, resolved=? WHERE id=?", ClaimRejected, resolvedBy, now, other.Id)
+			if err != nil {
+				return "Internal server error", err
+			}
+
+			err = audit(tx, AuditEntry{
+				ActorId:  actorId,
+				UserId:   other.UserId,
+				Action:   AuditClaimReject,
+				After:    auditValues(map[string]interface{}{"claimId": other.Id, "developerId": other.DeveloperId, "resolvedBy": resolvedBy}),
+				RemoteIp: remoteIp,
+			})
+			if err != nil {
+				return "Internal server error", err
+			}
+		}
+
+		return "", nil
+	})
+}
+
+// RejectDeveloperClaim rejects a pending developer claim
+// Returns errorMessage, err
+func (handler Handler) RejectDeveloperClaim(ctx context.Context, claimId int64, actorId string, remoteIp string) (string, error) {
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		claims, err := queryDeveloperClaims(tx.Query, "WHERE id=? AND status=?", claimId, ClaimPending)
+		if err != nil {
+			return "Internal server error", err
+		}
+		if len(claims) == 0 {
+			return "No such pending claim", nil
+		}
+
+		_, err = tx.Exec("UPDATE developerClaims SET status=?, resolvedBy=?, resolved=? WHERE id=?", ClaimRejected, ClaimByAdmin, time.Now().UnixNano(), claimId)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		err = audit(tx, AuditEntry{
+			ActorId:  actorId,
+			UserId:   claims[0].UserId,
+			Action:   AuditClaimReject,
+			After:    auditValues(map[string]interface{}{"claimId": claimId, "developerId": claims[0].DeveloperId, "resolvedBy": ClaimByAdmin}),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+}
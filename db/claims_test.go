@@ -0,0 +1,182 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// importMirror imports the mirror account of a Pebble developer
+func importMirror(t *testing.T, store Store, id string) {
+	t.Helper()
+
+	_, err := store.ImportPebbleDevelopers(context.Background(), []PebbleDeveloper{{id, "Developer"}}, AuditActorAdmin)
+	if err != nil {
+		t.Fatalf("Could not import developer: %v", err)
+	}
+}
+
+func TestClaimDeveloper(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		importMirror(t, store, "dev1")
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		aliceId := testUserId(t, store, aliceToken)
+
+		claim, errorMessage, err := store.ClaimDeveloper(ctx, aliceToken, "dev1", "192.0.2.1")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not claim developer: %v (%v)", errorMessage, err)
+		}
+		if claim.UserId != aliceId || claim.DeveloperId != "dev1" || claim.Status != ClaimPending || !strings.HasPrefix(claim.Token, "rebble-claim-") {
+			t.Errorf("Got claim %+v, expected a pending claim of dev1 by alice", claim)
+		}
+
+		// Claiming again returns the pending claim
+		again, _, _ := store.ClaimDeveloper(ctx, aliceToken, "dev1", "192.0.2.1")
+		if again.Id != claim.Id || again.Token != claim.Token {
+			t.Errorf("Got claim %+v, expected the pending claim %+v", again, claim)
+		}
+
+		claims, errorMessage, err := store.AccountDeveloperClaims(ctx, aliceToken)
+		if errorMessage != "" || err != nil || len(claims) != 1 || claims[0].Id != claim.Id {
+			t.Errorf("AccountDeveloperClaims() = %+v, %q, %v, expected alice's claim", claims, errorMessage, err)
+		}
+
+		for _, id := range []string{"unknown", aliceId} {
+			_, errorMessage, err = store.ClaimDeveloper(ctx, aliceToken, id, "")
+			if errorMessage == "" || err != nil {
+				t.Errorf("ClaimDeveloper(%v) = %q, %v, expected only mirrors to be claimable", id, errorMessage, err)
+			}
+		}
+
+		_, errorMessage, err = store.ClaimDeveloper(ctx, "invalid", "dev1", "")
+		if errorMessage != "Invalid access token" || err != nil {
+			t.Errorf("ClaimDeveloper() = %q, %v with an invalid access token", errorMessage, err)
+		}
+	})
+}
+
+func TestApproveDeveloperClaim(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		// Approving a claim changes the role of the claimant, which the session cache must not hide
+		store = NewSessionCache(store, 10, time.Minute)
+
+		ctx := context.Background()
+		importMirror(t, store, "dev1")
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		aliceId := testUserId(t, store, aliceToken)
+		bobToken := testLogin(t, store, "bob", "Bob", "bob@example.com")
+
+		aliceClaim, _, _ := store.ClaimDeveloper(ctx, aliceToken, "dev1", "")
+		bobClaim, _, _ := store.ClaimDeveloper(ctx, bobToken, "dev1", "")
+		store.LookupSession(ctx, aliceToken)
+
+		pending, err := store.DeveloperClaims(ctx, ClaimPending, 0, 10)
+		if err != nil || len(pending) != 2 || pending[0].Id != aliceClaim.Id || pending[1].Id != bobClaim.Id {
+			t.Fatalf("DeveloperClaims() = %+v, %v, expected both claims, oldest first", pending, err)
+		}
+
+		errorMessage, err := store.ApproveDeveloperClaim(ctx, aliceClaim.Id, ClaimByAdmin, AuditActorAdmin, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not approve claim: %v (%v)", errorMessage, err)
+		}
+
+		// The mirror was merged into alice's account, alice became a developer, and bob's claim was rejected
+		userId, _, err := store.ResolveAlias(ctx, "dev1")
+		if userId != aliceId || err != nil {
+			t.Errorf("ResolveAlias(dev1) = %q, %v, expected alice's ID", userId, err)
+		}
+
+		session, _, err := store.LookupSession(ctx, aliceToken)
+		if session.Type != "developer" || err != nil {
+			t.Errorf("Got role %q (%v), expected alice to be a developer", session.Type, err)
+		}
+
+		claims, _, _ := store.AccountDeveloperClaims(ctx, bobToken)
+		if len(claims) != 1 || claims[0].Status != ClaimRejected || claims[0].ResolvedBy != ClaimByAdmin || claims[0].Resolved.IsZero() {
+			t.Errorf("Got claims %+v, expected bob's claim to be rejected", claims)
+		}
+
+		pending, _ = store.DeveloperClaims(ctx, ClaimPending, 0, 10)
+		if len(pending) != 0 {
+			t.Errorf("Got pending claims %+v, expected none", pending)
+		}
+
+		all, _ := store.DeveloperClaims(ctx, "", 1, 10)
+		if len(all) != 1 || all[0].Id != bobClaim.Id {
+			t.Errorf("Got claims %+v, expected the second page to hold bob's claim", all)
+		}
+
+		errorMessage, err = store.ApproveDeveloperClaim(ctx, aliceClaim.Id, ClaimByAdmin, AuditActorAdmin, "")
+		if errorMessage != "This claim was already approved" || err != nil {
+			t.Errorf("ApproveDeveloperClaim() = %q, %v for an approved claim", errorMessage, err)
+		}
+
+		// The developer can't be claimed anymore
+		_, errorMessage, _ = store.ClaimDeveloper(ctx, bobToken, "dev1", "")
+		if errorMessage == "" {
+			t.Errorf("Claimed a developer which was already claimed")
+		}
+	})
+}
+
+func TestRejectDeveloperClaim(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		importMirror(t, store, "dev1")
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		claim, _, _ := store.ClaimDeveloper(ctx, aliceToken, "dev1", "")
+
+		errorMessage, err := store.RejectDeveloperClaim(ctx, claim.Id, AuditActorAdmin, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not reject claim: %v (%v)", errorMessage, err)
+		}
+
+		errorMessage, err = store.RejectDeveloperClaim(ctx, claim.Id, AuditActorAdmin, "")
+		if errorMessage != "No such pending claim" || err != nil {
+			t.Errorf("RejectDeveloperClaim() = %q, %v for a rejected claim", errorMessage, err)
+		}
+
+		errorMessage, err = store.ApproveDeveloperClaim(ctx, claim.Id, ClaimByAdmin, AuditActorAdmin, "")
+		if errorMessage != "This claim was already rejected" || err != nil {
+			t.Errorf("ApproveDeveloperClaim() = %q, %v for a rejected claim", errorMessage, err)
+		}
+
+		errorMessage, err = store.ApproveDeveloperClaim(ctx, claim.Id+100, ClaimByAdmin, AuditActorAdmin, "")
+		if errorMessage != "No such claim" || err != nil {
+			t.Errorf("ApproveDeveloperClaim() = %q, %v for an unknown claim", errorMessage, err)
+		}
+
+		// The developer can be claimed again
+		again, errorMessage, _ := store.ClaimDeveloper(ctx, aliceToken, "dev1", "")
+		if errorMessage != "" || again.Id == claim.Id {
+			t.Errorf("Got claim %+v (%v), expected a new claim", again, errorMessage)
+		}
+	})
+}
+
+func TestApproveDeveloperClaimKeepsRole(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		importMirror(t, store, "dev1")
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		aliceId := testUserId(t, store, aliceToken)
+		errorMessage, err := store.SetUserRole(ctx, aliceId, "moderator", AuditActorAdmin, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not set role: %v (%v)", errorMessage, err)
+		}
+
+		claim, _, _ := store.ClaimDeveloper(ctx, aliceToken, "dev1", "")
+		errorMessage, err = store.ApproveDeveloperClaim(ctx, claim.Id, ClaimByAdmin, AuditActorAdmin, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not approve claim: %v (%v)", errorMessage, err)
+		}
+
+		// Only users become developers
+		session, _, _ := store.LookupSession(ctx, aliceToken)
+		if session.Type != "moderator" {
+			t.Errorf("Got role %q, expected alice to stay a moderator", session.Type)
+		}
+	})
+}
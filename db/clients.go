@@ -0,0 +1,125 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Clients returns the registered clients, ordered by name
+func (handler Handler) Clients(ctx context.Context) ([]Client, error) {
+	rows, err := handler.Query(ctx, "SELECT id, name, description, created, updated FROM clients ORDER BY name, id")
+	if err != nil {
+		return []Client{}, err
+	}
+	defer rows.Close()
+
+	clients := []Client{}
+	for rows.Next() {
+		var client Client
+		var created, updated int64
+		err = rows.Scan(&client.Id, &client.Name, &client.Description, &created, &updated)
+		if err != nil {
+			return []Client{}, err
+		}
+		client.Created = unixNanoTime(created)
+		client.Updated = unixNanoTime(updated)
+
+		clients = append(clients, client)
+	}
+
+	return clients, rows.Err()
+}
+
+// clientValues returns the fields of a client recorded in the audit log
+func clientValues(client Client) string {
+	return auditValues(map[string]interface{}{"client": client.Id, "name": client.Name, "description": client.Description})
+}
+
+// SaveClient registers a client, or updates it if it is already registered
+// Returns errorMessage, err
+func (handler Handler) SaveClient(ctx context.Context, client Client, actorId string, remoteIp string) (string, error) {
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		now := time.Now()
+		previous := Client{Id: client.Id}
+		row := tx.QueryRow("SELECT name, description FROM clients WHERE id=?", client.Id)
+		err := row.Scan(&previous.Name, &previous.Description)
+		if err == sql.ErrNoRows {
+			_, err = tx.Exec("INSERT INTO clients(id, name, description, created, updated) VALUES (?, ?, ?, ?, ?)", client.Id, client.Name, client.Description, now.UnixNano(), now.UnixNano())
+			if err != nil {
+				return "Internal server error", err
+			}
+
+			err = audit(tx, AuditEntry{
+				ActorId:  actorId,
+				Action:   AuditClientCreate,
+				After:    clientValues(client),
+				RemoteIp: remoteIp,
+			})
+			if err != nil {
+				return "Internal server error", err
+			}
+
+			return "", nil
+		}
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		if previous.Name == client.Name && previous.Description == client.Description {
+			return "", nil
+		}
+
+		_, err = tx.Exec("UPDATE clients SET name=?, description=?, updated=? WHERE id=?", client.Name, client.Description, now.UnixNano(), client.Id)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		err = audit(tx, AuditEntry{
+			ActorId:  actorId,
+			Action:   AuditClientUpdate,
+			Before:   clientValues(previous),
+			After:    clientValues(client),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+}
+
+// DeleteClient unregisters a client. The sessions users opened from it are left alone.
+// Returns errorMessage, err
+func (handler Handler) DeleteClient(ctx context.Context, id string, actorId string, remoteIp string) (string, error) {
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		previous := Client{Id: id}
+		row := tx.QueryRow("SELECT name, description FROM clients WHERE id=?", id)
+		err := row.Scan(&previous.Name, &previous.Description)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return "No such client", nil
+			}
+
+			return "Internal server error", err
+		}
+
+		_, err = tx.Exec("DELETE FROM clients WHERE id=?", id)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		err = audit(tx, AuditEntry{
+			ActorId:  actorId,
+			Action:   AuditClientDelete,
+			Before:   clientValues(previous),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+}
@@ -0,0 +1,221 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// postgresEnv names the environment variable holding the connection string of a PostgreSQL database to run the tests
+// against as well. Each test gets a schema of its own in that database, which is dropped once the test is over.
+// Without it, the tests start a PostgreSQL server of their own.
+const postgresEnv = "REBBLE_AUTH_TEST_POSTGRES"
+
+// ciEnv is set by continuous integration services, where the PostgreSQL tests must run rather than be skipped
+const ciEnv = "CI"
+
+func TestMain(m *testing.M) {
+	os.Exit(runTests(m))
+}
+
+// runTests runs the tests of the package, against an embedded PostgreSQL server unless postgresEnv is set
+func runTests(m *testing.M) int {
+	if os.Getenv(postgresEnv) == "" {
+		stop, err := startEmbeddedPostgres()
+		if err != nil {
+			log.Printf("Could not start an embedded PostgreSQL server: %v", err)
+		} else {
+			defer stop()
+		}
+	}
+
+	return m.Run()
+}
+
+// startEmbeddedPostgres starts a throwaway PostgreSQL server (downloading it the first time), and points postgresEnv
+// to it
+// Returns a function stopping the server
+func startEmbeddedPostgres() (func(), error) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		return nil, err
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	runtimePath, err := os.MkdirTemp("", "rebble-auth-postgres")
+	if err != nil {
+		return nil, err
+	}
+
+	config := embeddedpostgres.DefaultConfig().Port(uint32(port)).RuntimePath(runtimePath).Logger(io.Discard)
+	server := embeddedpostgres.NewDatabase(config)
+	err = server.Start()
+	if err != nil {
+		os.RemoveAll(runtimePath)
+		return nil, err
+	}
+
+	os.Setenv(postgresEnv, config.GetConnectionURL()+"?sslmode=disable")
+	return func() {
+		err := server.Stop()
+		if err != nil {
+			log.Printf("Could not stop the embedded PostgreSQL server: %v", err)
+		}
+		os.RemoveAll(runtimePath)
+	}, nil
+}
+
+// openTestDatabase returns a Handler for a new, empty database of the given dialect, which is removed once the test is
+// over. PostgreSQL tests are skipped if there is no server to run them against, unless ciEnv is set.
+func openTestDatabase(t *testing.T, driver string) Handler {
+	t.Helper()
+
+	dataSource := filepath.Join(t.TempDir(), "rebble-auth.db")
+	if driver == Postgres {
+		dataSource = os.Getenv(postgresEnv)
+		if dataSource == "" {
+			if os.Getenv(ciEnv) != "" {
+				t.Fatalf("No PostgreSQL server to test against: %v isn't set, and no embedded server could be started", postgresEnv)
+			}
+			t.Skipf("%v isn't set, and no embedded server could be started", postgresEnv)
+		}
+
+		dataSource = createTestSchema(t, dataSource)
+	}
+
+	handler, err := Open(driver, dataSource)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	t.Cleanup(func() {
+		handler.Close()
+	})
+
+	return handler
+}
+
+// createTestSchema creates a schema for a test in a PostgreSQL database, and returns a connection string which uses it
+func createTestSchema(t *testing.T, dataSource string) string {
+	t.Helper()
+
+	database, err := sql.Open(Postgres, dataSource)
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+
+	schema := fmt.Sprintf("rebble_auth_test_%d", time.Now().UnixNano())
+	_, err = database.Exec("CREATE SCHEMA " + schema)
+	if err != nil {
+		database.Close()
+		t.Fatalf("Could not create schema: %v", err)
+	}
+	t.Cleanup(func() {
+		database.Exec("DROP SCHEMA " + schema + " CASCADE")
+		database.Close()
+	})
+
+	// lib/pq hands unknown parameters to the server, for both URLs and key=value connection strings
+	if strings.HasPrefix(dataSource, "postgres://") || strings.HasPrefix(dataSource, "postgresql://") {
+		separator := "?"
+		if strings.Contains(dataSource, "?") {
+			separator = "&"
+		}
+		return dataSource + separator + "search_path=" + schema
+	}
+
+	return dataSource + " search_path=" + schema
+}
+
+// openMigratedDatabase returns a Handler for a new, fully migrated database of the given dialect
+func openMigratedDatabase(t *testing.T, driver string) Handler {
+	t.Helper()
+
+	handler := openTestDatabase(t, driver)
+	_, err := handler.Migrate()
+	if err != nil {
+		t.Fatalf("Could not migrate database: %v", err)
+	}
+
+	return handler
+}
+
+// openTestHandler returns a Handler for a new, fully migrated SQLite database, which is removed once the test is over
+func openTestHandler(t *testing.T) Handler {
+	t.Helper()
+
+	return openMigratedDatabase(t, SQLite)
+}
+
+// forEachDialect runs a test against a new database of each SQL dialect
+func forEachDialect(t *testing.T, test func(t *testing.T, handler Handler)) {
+	for _, driver := range []string{SQLite, Postgres} {
+		t.Run(driver, func(t *testing.T) {
+			test(t, openTestDatabase(t, driver))
+		})
+	}
+}
+
+// forEachStore runs a test against each Store implementation
+func forEachStore(t *testing.T, test func(t *testing.T, store Store)) {
+	t.Run(SQLite, func(t *testing.T) {
+		test(t, openTestHandler(t))
+	})
+	t.Run(Postgres, func(t *testing.T) {
+		test(t, openMigratedDatabase(t, Postgres))
+	})
+	t.Run(Memory, func(t *testing.T) {
+		test(t, NewMemoryStore())
+	})
+}
+
+// testLogin logs in (registering if needed) the given identity of the "test" provider, and returns the access token
+func testLogin(t *testing.T, store Store, sub string, name string, email string) string {
+	t.Helper()
+
+	accessToken, _, errorMessage, err := store.AccountLoginOrRegister(context.Background(), "test", sub, name, email, false, "{}", "sso-access-"+sub, "sso-refresh-"+sub, 0, SessionMetadata{RemoteIp: "192.0.2.1"})
+	if errorMessage != "" || err != nil {
+		t.Fatalf("Could not log in as %v: %v (%v)", sub, errorMessage, err)
+	}
+	if accessToken == "" {
+		t.Fatalf("Logging in as %v didn't return an access token", sub)
+	}
+
+	return accessToken
+}
+
+// testUserId returns the ID of the user an access token belongs to
+func testUserId(t *testing.T, store Store, accessToken string) string {
+	t.Helper()
+
+	userId, errorMessage, err := store.AccountId(context.Background(), accessToken)
+	if errorMessage != "" || err != nil {
+		t.Fatalf("Could not get user ID: %v (%v)", errorMessage, err)
+	}
+
+	return userId
+}
+
+// accountProviders returns the name of the account an access token belongs to, and the providers linked to it
+func accountProviders(t *testing.T, store Store, accessToken string) (string, string, []string) {
+	t.Helper()
+
+	loggedIn, name, email, providers, err := store.AccountInformation(context.Background(), accessToken)
+	if !loggedIn || err != nil {
+		t.Fatalf("Could not get account information: %v", err)
+	}
+
+	return name, email, providers
+}
@@ -0,0 +1,178 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// AccountScheduleDeletion schedules the deletion of the account the given access token belongs to, and logs it out
+// everywhere. Logging in again before the deletion date cancels the deletion.
+// The session has to have been created after authenticatedSince, to make sure the user is the one asking.
+// Returns errorMessage, error
+func (handler Handler) AccountScheduleDeletion(ctx context.Context, accessToken string, authenticatedSince time.Time, deletion time.Time, remoteIp string) (string, error) {
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		var userId string
+		var created int64
+		row := tx.QueryRow("SELECT userId, created FROM userSessions WHERE accessToken=?", hashToken(accessToken))
+		err := row.Scan(&userId, &created)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return "Invalid access token", nil
+			}
+
+			return "Internal server error", err
+		}
+
+		if created < authenticatedSince.UnixNano() {
+			return "Please log in again to delete your account", nil
+		}
+
+		_, err = tx.Exec("UPDATE users SET deletionScheduled=? WHERE id=?", deletion.UnixNano(), userId)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		_, err = tx.Exec("DELETE FROM userSessions WHERE userId=?", userId)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		err = audit(tx, AuditEntry{
+			ActorId:  userId,
+			UserId:   userId,
+			Action:   AuditDeletionSchedule,
+			After:    auditValues(map[string]interface{}{"deletionScheduled": deletion}),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+}
+
+// AccountsDueForDeletion returns the IDs of the accounts whose deletion date has passed
+func (handler Handler) AccountsDueForDeletion(ctx context.Context, now time.Time) ([]string, error) {
+	rows, err := handler.Query(ctx, "SELECT id FROM users WHERE deletionScheduled<>0 AND deletionScheduled<=?", now.UnixNano())
+	if err != nil {
+		return []string{}, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return []string{}, err
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// AccountProviderSessions returns the identities linked to an account, along with their tokens
+func (handler Handler) AccountProviderSessions(ctx context.Context, userId string) ([]ProviderSession, error) {
+	rows, err := handler.Query(ctx, "SELECT provider, sub, accessToken, refreshToken, expires FROM providerSessions WHERE userId=?", userId)
+	if err != nil {
+		return []ProviderSession{}, err
+	}
+	defer rows.Close()
+
+	sessions := []ProviderSession{}
+	for rows.Next() {
+		var session ProviderSession
+		err = rows.Scan(&session.Provider, &session.Sub, &session.AccessToken, &session.RefreshToken, &session.Expires)
+		if err != nil {
+			return []ProviderSession{}, err
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// AccountDelete deletes an account along with everything associated to it, provided its deletion is still scheduled
+// and due (the user might have logged in since it was listed by AccountsDueForDeletion). The notifications of the
+// deletion to the given hooks are queued in the same transaction, so that none is lost if sending them fails.
+// Returns whether the account was deleted
+func (handler Handler) AccountDelete(ctx context.Context, userId string, now time.Time, hookURLs []string) (bool, error) {
+	deleted := false
+	_, err := handler.transaction(ctx, func(tx *Tx) (string, error) {
+		// Everything referencing the user is deleted along with it (see the "Constraints" migration), except for the
+		// audit log
+		result, err := tx.Exec("DELETE FROM users WHERE id=? AND deletionScheduled<>0 AND deletionScheduled<=?", userId, now.UnixNano())
+		if err != nil {
+			return "", err
+		}
+
+		count, err := result.RowsAffected()
+		if err != nil {
+			return "", err
+		}
+
+		deleted = count != 0
+		if !deleted {
+			return "", nil
+		}
+
+		for _, url := range hookURLs {
+			_, err = tx.Exec("INSERT INTO deletionNotifications(userId, url, created, nextAttempt) VALUES (?, ?, ?, ?)", userId, url, now.UnixNano(), now.UnixNano())
+			if err != nil {
+				return "", err
+			}
+		}
+
+		return "", audit(tx, AuditEntry{
+			ActorId: AuditActorSystem,
+			UserId:  userId,
+			Action:  AuditAccountDelete,
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return deleted, nil
+}
+
+// DueDeletionNotifications returns the notifications of deleted accounts which are due to be sent, oldest attempt first
+func (handler Handler) DueDeletionNotifications(ctx context.Context, now time.Time, limit int) ([]DeletionNotification, error) {
+	rows, err := handler.Query(ctx, "SELECT id, userId, url, attempts, nextAttempt, lastError FROM deletionNotifications WHERE nextAttempt<=? ORDER BY nextAttempt, id LIMIT ?", now.UnixNano(), limit)
+	if err != nil {
+		return []DeletionNotification{}, err
+	}
+	defer rows.Close()
+
+	notifications := []DeletionNotification{}
+	for rows.Next() {
+		var notification DeletionNotification
+		var nextAttempt int64
+		err = rows.Scan(&notification.Id, &notification.UserId, &notification.URL, &notification.Attempts, &nextAttempt, &notification.LastError)
+		if err != nil {
+			return []DeletionNotification{}, err
+		}
+		notification.NextAttempt = unixNanoTime(nextAttempt)
+
+		notifications = append(notifications, notification)
+	}
+
+	return notifications, rows.Err()
+}
+
+// DeletionNotificationDone forgets a deletion notification, once it was sent
+func (handler Handler) DeletionNotificationDone(ctx context.Context, id int64) error {
+	_, err := handler.Exec(ctx, "DELETE FROM deletionNotifications WHERE id=?", id)
+	return err
+}
+
+// DeletionNotificationFailed records that sending a deletion notification failed, and when to try again
+func (handler Handler) DeletionNotificationFailed(ctx context.Context, id int64, lastError string, nextAttempt time.Time) error {
+	_, err := handler.Exec(ctx, "UPDATE deletionNotifications SET attempts=attempts+1, lastError=?, nextAttempt=? WHERE id=?", lastError, nextAttempt.UnixNano(), id)
+	return err
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestScheduleDeletion(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now()
+		accessToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		userId := testUserId(t, store, accessToken)
+
+		// Only users who logged in recently can delete their account
+		errorMessage, err := store.AccountScheduleDeletion(ctx, accessToken, now.Add(time.Hour), now, "")
+		if errorMessage == "" || err != nil {
+			t.Fatalf("AccountScheduleDeletion() = %q, %v, expected to have to log in again", errorMessage, err)
+		}
+
+		errorMessage, err = store.AccountScheduleDeletion(ctx, accessToken, now.Add(-time.Hour), now.Add(time.Hour), "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not schedule deletion: %v (%v)", errorMessage, err)
+		}
+
+		ids, err := store.AccountsDueForDeletion(ctx, now)
+		if err != nil || len(ids) != 0 {
+			t.Errorf("AccountsDueForDeletion(now) = %v, %v, expected the grace period to be respected", ids, err)
+		}
+
+		deleted, err := store.AccountDelete(ctx, userId, now, []string{"https://example.com/hook"})
+		if deleted || err != nil {
+			t.Errorf("AccountDelete(now) = %v, %v, expected the grace period to be respected", deleted, err)
+		}
+
+		ids, err = store.AccountsDueForDeletion(ctx, now.Add(2*time.Hour))
+		if err != nil || len(ids) != 1 || ids[0] != userId {
+			t.Errorf("AccountsDueForDeletion() = %v, %v, expected alice's account", ids, err)
+		}
+
+		notifications, err := store.DueDeletionNotifications(ctx, now.Add(2*time.Hour), 10)
+		if err != nil || len(notifications) != 0 {
+			t.Errorf("DueDeletionNotifications() = %+v, %v, expected none before the account is deleted", notifications, err)
+		}
+
+		deleted, err = store.AccountDelete(ctx, userId, now.Add(2*time.Hour), []string{"https://example.com/hook", "https://example.org/hook"})
+		if !deleted || err != nil {
+			t.Fatalf("AccountDelete() = %v, %v, expected the account to be deleted", deleted, err)
+		}
+
+		notifications, err = store.DueDeletionNotifications(ctx, now.Add(2*time.Hour), 10)
+		if err != nil || len(notifications) != 2 || notifications[0].UserId != userId || notifications[0].URL != "https://example.com/hook" {
+			t.Errorf("DueDeletionNotifications() = %+v, %v, expected a notification to each hook", notifications, err)
+		}
+
+		exists, _ := store.AccountExists(ctx, "test", "alice")
+		logins, _ := store.LoginLog(ctx, userId, "", 0, 10)
+		if exists || len(logins) != 0 {
+			t.Errorf("The identities or login history of the deleted account were kept")
+		}
+	})
+}
+
+func TestLoginCancelsDeletion(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now()
+		accessToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		userId := testUserId(t, store, accessToken)
+
+		errorMessage, err := store.AccountScheduleDeletion(ctx, accessToken, now.Add(-time.Hour), now, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not schedule deletion: %v (%v)", errorMessage, err)
+		}
+
+		testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		deleted, err := store.AccountDelete(ctx, userId, now.Add(time.Hour), []string{"https://example.com/hook"})
+		if deleted || err != nil {
+			t.Errorf("AccountDelete() = %v, %v, expected logging in to have cancelled the deletion", deleted, err)
+		}
+
+		notifications, err := store.DueDeletionNotifications(ctx, now.Add(time.Hour), 10)
+		if err != nil || len(notifications) != 0 {
+			t.Errorf("DueDeletionNotifications() = %+v, %v, expected no notification for an account which wasn't deleted", notifications, err)
+		}
+	})
+}
+
+func TestDeletionNotificationRetries(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now()
+		accessToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		userId := testUserId(t, store, accessToken)
+
+		errorMessage, err := store.AccountScheduleDeletion(ctx, accessToken, now.Add(-time.Hour), now, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not schedule deletion: %v (%v)", errorMessage, err)
+		}
+		deleted, err := store.AccountDelete(ctx, userId, now, []string{"https://example.com/hook", "https://example.org/hook"})
+		if !deleted || err != nil {
+			t.Fatalf("AccountDelete() = %v, %v, expected the account to be deleted", deleted, err)
+		}
+
+		notifications, err := store.DueDeletionNotifications(ctx, now, 10)
+		if err != nil || len(notifications) != 2 {
+			t.Fatalf("DueDeletionNotifications() = %+v, %v, expected 2 notifications", notifications, err)
+		}
+
+		// A failed notification waits until its next attempt, a sent one is forgotten
+		err = store.DeletionNotificationFailed(ctx, notifications[0].Id, "unreachable", now.Add(time.Hour))
+		if err != nil {
+			t.Fatalf("Could not record failure: %v", err)
+		}
+		err = store.DeletionNotificationDone(ctx, notifications[1].Id)
+		if err != nil {
+			t.Fatalf("Could not forget notification: %v", err)
+		}
+
+		due, err := store.DueDeletionNotifications(ctx, now, 10)
+		if err != nil || len(due) != 0 {
+			t.Errorf("DueDeletionNotifications(now) = %+v, %v, expected the failed notification to wait", due, err)
+		}
+
+		due, err = store.DueDeletionNotifications(ctx, now.Add(time.Hour), 10)
+		if err != nil || len(due) != 1 || due[0].Id != notifications[0].Id || due[0].Attempts != 1 || due[0].LastError != "unreachable" {
+			t.Errorf("DueDeletionNotifications() = %+v, %v, expected the failed notification to be retried", due, err)
+		}
+	})
+}
@@ -0,0 +1,328 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/mattn/go-sqlite3"
+)
+
+// Supported database dialects, named after the database/sql driver used for each of them
+const (
+	SQLite   = "sqlite3"
+	Postgres = "postgres"
+
+	// Memory isn't an SQL dialect, but selects the MemoryStore instead of a database
+	Memory = "memory"
+)
+
+// DefaultQueryTimeout is how long a query (or a whole transaction) may run by default before it is cancelled
+const DefaultQueryTimeout = 10 * time.Second
+
+// Queries which failed because the database was busy are attempted this many times at most, waiting retryDelay longer
+// after each attempt
+const (
+	maxAttempts = 3
+	retryDelay  = 50 * time.Millisecond
+)
+
+// Tx wraps sql.Tx so that queries can be written once with `?` placeholders, whatever the dialect of the database.
+// Upserts use `INSERT ... ON CONFLICT`, which both SQLite (3.24+) and PostgreSQL understand.
+// All the queries of a transaction run under the context it was started with.
+type Tx struct {
+	*sql.Tx
+	ctx    context.Context
+	driver string
+
+	sink     AuditSink
+	events   *EventWriter   // Writes the login and audit log entries of the transaction once it is committed, if set
+	attempts []LoginAttempt // Login log entries to hand to events once the transaction is committed
+	audits   []AuditEntry   // Audit log entries to hand to events, or to send to the sink, once the transaction is committed
+}
+
+// Open opens a database using the given driver (SQLite or Postgres) and returns a Handler for it
+func Open(driver string, dataSource string) (Handler, error) {
+	// SQLite only enforces foreign keys when asked to, which has to be done for each connection. It also waits for
+	// locks without heeding the context of the query, so it is only allowed to wait for a second before the query is
+	// retried (see retry), unless told otherwise.
+	if driver == SQLite {
+		separator := "?"
+		if strings.Contains(dataSource, "?") {
+			separator = "&"
+		}
+		dataSource += separator + "_foreign_keys=on"
+		if !strings.Contains(dataSource, "_busy_timeout=") && !strings.Contains(dataSource, "_timeout=") {
+			dataSource += "&_busy_timeout=1000"
+		}
+	}
+
+	database, err := sql.Open(driver, dataSource)
+	if err != nil {
+		return Handler{}, err
+	}
+
+	return NewHandler(database, driver)
+}
+
+// NewHandler returns a Handler for a database opened with the given driver (SQLite or Postgres)
+func NewHandler(database *sql.DB, driver string) (Handler, error) {
+	switch driver {
+	case SQLite, Postgres:
+		return Handler{DB: database, driver: driver, QueryTimeout: DefaultQueryTimeout}, nil
+	}
+
+	return Handler{}, fmt.Errorf("Unsupported database driver %v", driver)
+}
+
+// rebind translates the `?` placeholders of a query to the ones used by the given driver
+func rebind(driver string, query string) string {
+	if driver != Postgres {
+		return query
+	}
+
+	var b strings.Builder
+	n := 0
+	inString := false
+	for _, c := range query {
+		if c == '\'' {
+			inString = !inString
+		} else if c == '?' && !inString {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
+
+// Exec executes a query without returning any rows
+func (handler Handler) Exec(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	var result sql.Result
+	err := retry(ctx, func() error {
+		queryCtx, cancel := handler.withTimeout(ctx)
+		defer cancel()
+
+		var err error
+		result, err = handler.DB.ExecContext(queryCtx, rebind(handler.driver, query), args...)
+		return err
+	})
+
+	return result, err
+}
+
+// Query executes a query that returns rows. The query's deadline lasts until the rows are closed.
+func (handler Handler) Query(ctx context.Context, query string, args ...interface{}) (*Rows, error) {
+	var rows *Rows
+	err := retry(ctx, func() error {
+		queryCtx, cancel := handler.withTimeout(ctx)
+
+		r, err := handler.DB.QueryContext(queryCtx, rebind(handler.driver, query), args...)
+		if err != nil {
+			cancel()
+			return err
+		}
+
+		rows = &Rows{Rows: r, cancel: cancel}
+		return nil
+	})
+
+	return rows, err
+}
+
+// QueryRow executes a query that is expected to return at most one row. The query only runs once the row is scanned.
+func (handler Handler) QueryRow(ctx context.Context, query string, args ...interface{}) *Row {
+	return &Row{handler: handler, ctx: ctx, query: query, args: args}
+}
+
+// queryFunc returns Query bound to ctx, for the helpers whose queries can run either inside or outside of a transaction
+func (handler Handler) queryFunc(ctx context.Context) func(query string, args ...interface{}) (*Rows, error) {
+	return func(query string, args ...interface{}) (*Rows, error) {
+		return handler.Query(ctx, query, args...)
+	}
+}
+
+// withTimeout returns a context for a single query, which expires after the query timeout
+func (handler Handler) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if handler.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, handler.QueryTimeout)
+}
+
+// begin starts a transaction which runs its queries under ctx
+func (handler Handler) begin(ctx context.Context) (*Tx, error) {
+	tx, err := handler.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Tx{Tx: tx, ctx: ctx, driver: handler.driver, sink: handler.AuditSink, events: handler.Events}, nil
+}
+
+// transaction runs fn in a transaction, which is committed if fn returns neither an error message nor an error, and
+// rolled back otherwise. The whole transaction has to finish before the query timeout. It is run again from the start
+// if the database was busy or the transaction was aborted, up to maxAttempts times.
+// Returns errorMessage, err
+func (handler Handler) transaction(ctx context.Context, fn func(tx *Tx) (string, error)) (string, error) {
+	var errorMessage string
+	err := retry(ctx, func() error {
+		txCtx, cancel := handler.withTimeout(ctx)
+		defer cancel()
+
+		tx, err := handler.begin(txCtx)
+		if err != nil {
+			errorMessage = "Internal server error"
+			return err
+		}
+		defer tx.Rollback()
+
+		errorMessage, err = fn(tx)
+		if errorMessage == "" && err == nil {
+			err = tx.Commit()
+			if err != nil {
+				errorMessage = "Internal server error"
+			}
+		}
+
+		// A transaction which ran out of time is aborted, which mustn't be mistaken for a reason to try again
+		if err != nil && txCtx.Err() != nil {
+			return txCtx.Err()
+		}
+		return err
+	})
+
+	return errorMessage, err
+}
+
+// Commit commits the transaction, then hands the login and audit log entries it added to the event writer, or sends
+// the audit log entries to the audit sink if they were written as part of the transaction
+func (tx *Tx) Commit() error {
+	err := tx.Tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	if tx.events != nil {
+		tx.events.add(tx.attempts, tx.audits)
+		return nil
+	}
+
+	writeAudits(tx.sink, tx.audits)
+	return nil
+}
+
+// Exec executes a query without returning any rows
+func (tx *Tx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.Tx.ExecContext(tx.ctx, rebind(tx.driver, query), args...)
+}
+
+// Query executes a query that returns rows
+func (tx *Tx) Query(query string, args ...interface{}) (*Rows, error) {
+	rows, err := tx.Tx.QueryContext(tx.ctx, rebind(tx.driver, query), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Rows{Rows: rows}, nil
+}
+
+// QueryRow executes a query that is expected to return at most one row
+func (tx *Tx) QueryRow(query string, args ...interface{}) *sql.Row {
+	return tx.Tx.QueryRowContext(tx.ctx, rebind(tx.driver, query), args...)
+}
+
+// Rows wraps sql.Rows to end the deadline of their query once they are closed
+type Rows struct {
+	*sql.Rows
+	cancel context.CancelFunc
+}
+
+// Close closes the rows, and ends the deadline of their query
+func (rows *Rows) Close() error {
+	err := rows.Rows.Close()
+	if rows.cancel != nil {
+		rows.cancel()
+	}
+
+	return err
+}
+
+// Row is the result of Handler.QueryRow. Its query runs (and is retried) under its own deadline once it is scanned.
+type Row struct {
+	handler Handler
+	ctx     context.Context
+	query   string
+	args    []interface{}
+}
+
+// Scan runs the query, and copies the columns of the row it returned into dest
+func (row *Row) Scan(dest ...interface{}) error {
+	return retry(row.ctx, func() error {
+		ctx, cancel := row.handler.withTimeout(row.ctx)
+		defer cancel()
+
+		return row.handler.DB.QueryRowContext(ctx, rebind(row.handler.driver, row.query), row.args...).Scan(dest...)
+	})
+}
+
+// retryable reports whether an operation failed because the database was busy, or because its transaction was
+// aborted, in which case it is worth trying again
+func retryable(err error) bool {
+	if errors.Is(err, sql.ErrTxDone) {
+		return true
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+
+	return false
+}
+
+// uniqueViolation reports whether a query failed because it broke a unique constraint
+func uniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		return pqErr.Code == "23505" // unique_violation
+	}
+
+	return false
+}
+
+// retry runs op until it succeeds, fails with an error which isn't worth retrying, or has been attempted maxAttempts
+// times. It waits a little longer after each attempt, and gives up early once ctx is done.
+func retry(ctx context.Context, op func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || !retryable(err) || attempt == maxAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(time.Duration(attempt) * retryDelay):
+		}
+	}
+}
+
+// Unavailable reports whether err means the database couldn't answer in time: either a query ran out of time, or the
+// database stayed busy after being retried
+func Unavailable(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || retryable(err)
+}
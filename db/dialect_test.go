@@ -0,0 +1,205 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestRebind(t *testing.T) {
+	for _, test := range []struct {
+		driver   string
+		query    string
+		expected string
+	}{
+		{SQLite, "SELECT id FROM users WHERE id=? AND name=?", "SELECT id FROM users WHERE id=? AND name=?"},
+		{Postgres, "SELECT id FROM users WHERE id=? AND name=?", "SELECT id FROM users WHERE id=$1 AND name=$2"},
+		{Postgres, "SELECT id FROM users WHERE name='?' AND id=?", "SELECT id FROM users WHERE name='?' AND id=$1"},
+		{Postgres, "SELECT id FROM users", "SELECT id FROM users"},
+	} {
+		if query := rebind(test.driver, test.query); query != test.expected {
+			t.Errorf("rebind(%v, %q) = %q, expected %q", test.driver, test.query, query, test.expected)
+		}
+	}
+}
+
+func TestOpenUnsupportedDriver(t *testing.T) {
+	_, err := NewHandler(nil, "mysql")
+	if err == nil {
+		t.Errorf("NewHandler() accepted an unsupported driver")
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, handler Handler) {
+		count, err := handler.Migrate()
+		if err != nil {
+			t.Fatalf("Could not migrate database: %v", err)
+		}
+		if count != LatestSchemaVersion() {
+			t.Errorf("Ran %v migrations, expected %v", count, LatestSchemaVersion())
+		}
+
+		version, err := handler.SchemaVersion()
+		if err != nil || version != LatestSchemaVersion() {
+			t.Errorf("SchemaVersion() = %v, %v, expected %v", version, err, LatestSchemaVersion())
+		}
+
+		count, err = handler.Migrate()
+		if count != 0 || err != nil {
+			t.Errorf("Migrate() = %v, %v, expected nothing to be done", count, err)
+		}
+	})
+}
+
+func TestUpsert(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, handler Handler) {
+		_, err := handler.Migrate()
+		if err != nil {
+			t.Fatalf("Could not migrate database: %v", err)
+		}
+
+		job := AdminJob{Id: "job", Name: "test", Status: "running", Total: 2, Created: time.Now()}
+		err = handler.SaveAdminJob(context.Background(), job)
+		if err != nil {
+			t.Fatalf("Could not create job: %v", err)
+		}
+
+		job.Status = "done"
+		job.Progress = 2
+		job.Log = []string{"first", "second"}
+		job.Finished = time.Now()
+		err = handler.SaveAdminJob(context.Background(), job)
+		if err != nil {
+			t.Fatalf("Could not update job: %v", err)
+		}
+
+		jobs, err := handler.AdminJobs(context.Background(), 10)
+		if err != nil || len(jobs) != 1 {
+			t.Fatalf("Expected the job to be updated in place, got %+v (%v)", jobs, err)
+		}
+		if jobs[0].Status != "done" || jobs[0].Progress != 2 || len(jobs[0].Log) != 2 || jobs[0].Finished.IsZero() {
+			t.Errorf("Got %+v, expected the updated job", jobs[0])
+		}
+	})
+}
+
+// errBusy is the error SQLite returns when the database stays locked
+var errBusy = sqlite3.Error{Code: sqlite3.ErrBusy}
+
+func TestRetryable(t *testing.T) {
+	for _, test := range []struct {
+		err         error
+		retryable   bool
+		unavailable bool
+	}{
+		{errBusy, true, true},
+		{sqlite3.Error{Code: sqlite3.ErrLocked}, true, true},
+		{fmt.Errorf("Could not save: %w", errBusy), true, true},
+		{sql.ErrTxDone, true, true},
+		{sqlite3.Error{Code: sqlite3.ErrConstraint}, false, false},
+		{context.DeadlineExceeded, false, true},
+		{context.Canceled, false, false},
+		{sql.ErrNoRows, false, false},
+		{errors.New("failed"), false, false},
+	} {
+		if retryable(test.err) != test.retryable || Unavailable(test.err) != test.unavailable {
+			t.Errorf("retryable(%v) = %v and Unavailable() = %v, expected %v and %v", test.err, retryable(test.err), Unavailable(test.err), test.retryable, test.unavailable)
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	for _, test := range []struct {
+		failures []error // Returned by the successive attempts, which succeed once there are none left
+		attempts int
+		err      error
+	}{
+		{nil, 1, nil},
+		{[]error{errBusy}, 2, nil},
+		{[]error{errBusy, errBusy, errBusy, errBusy}, maxAttempts, errBusy},
+		{[]error{sql.ErrNoRows}, 1, sql.ErrNoRows},
+		{[]error{errBusy, sql.ErrNoRows}, 2, sql.ErrNoRows},
+	} {
+		attempts := 0
+		err := retry(context.Background(), func() error {
+			attempts++
+			if attempts > len(test.failures) {
+				return nil
+			}
+			return test.failures[attempts-1]
+		})
+		if attempts != test.attempts || err != test.err {
+			t.Errorf("Got %v attempts and %v for %v, expected %v attempts and %v", attempts, err, test.failures, test.attempts, test.err)
+		}
+	}
+}
+
+func TestRetryGivesUpOnceCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	attempts := 0
+	err := retry(ctx, func() error {
+		attempts++
+		return errBusy
+	})
+	if attempts != 1 || err != errBusy {
+		t.Errorf("Got %v attempts and %v, expected to give up after the first attempt", attempts, err)
+	}
+}
+
+func TestTransactionRetries(t *testing.T) {
+	handler := openTestHandler(t)
+	_, err := handler.DB.Exec("CREATE TABLE attempts (attempt integer)")
+	if err != nil {
+		t.Fatalf("Could not create table: %v", err)
+	}
+
+	attempts := 0
+	errorMessage, err := handler.transaction(context.Background(), func(tx *Tx) (string, error) {
+		attempts++
+		_, err := tx.Exec("INSERT INTO attempts(attempt) VALUES (?)", attempts)
+		if err != nil {
+			return "Internal server error", err
+		}
+		if attempts == 1 {
+			return "Internal server error", errBusy
+		}
+		return "", nil
+	})
+	if errorMessage != "" || err != nil || attempts != 2 {
+		t.Fatalf("transaction() = %q, %v after %v attempts, expected to succeed after 2", errorMessage, err, attempts)
+	}
+
+	// The first attempt was rolled back
+	var attempt int
+	err = handler.QueryRow(context.Background(), "SELECT attempt FROM attempts").Scan(&attempt)
+	if attempt != 2 || err != nil {
+		t.Errorf("Got attempt %v (%v), expected only the second attempt to be committed", attempt, err)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	handler := openTestHandler(t)
+	handler.QueryTimeout = time.Nanosecond
+
+	_, _, err := handler.AccountId(context.Background(), "invalid")
+	if !Unavailable(err) {
+		t.Errorf("AccountId() = %v, expected the query to time out", err)
+	}
+
+	_, err = handler.transaction(context.Background(), func(tx *Tx) (string, error) {
+		time.Sleep(time.Millisecond)
+		_, err := tx.Exec("SELECT 1")
+		return "", err
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("transaction() = %v, expected the transaction to time out", err)
+	}
+}
@@ -0,0 +1,173 @@
+package db
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Sizes of the EventWriter's buffer and batches, and how long events wait for a batch to fill up at most
+const (
+	eventBufferSize    = 10000
+	eventBatchSize     = 200
+	eventFlushInterval = time.Second
+)
+
+// EventWriter writes login log and audit log entries to the database in batches, from a goroutine of its own, so that
+// transactions don't hold the database's write lock for longer than their actual changes.
+//
+// When its buffer is full, login log entries are dropped (and counted), while audit log entries wait for room in the
+// buffer: the audit log must stay complete.
+type EventWriter struct {
+	dropped atomic.Int64
+
+	handler Handler // Writes entries right away, as it has no EventWriter of its own
+	events  chan event
+	done    chan struct{}
+
+	lock   sync.RWMutex // Held for writing while closing, so that no event is sent to a closed channel
+	closed bool
+}
+
+// event is either a login log entry or an audit log entry
+type event struct {
+	attempt *LoginAttempt
+	audit   *AuditEntry
+}
+
+// write adds the event to the database
+func (e event) write(tx *Tx) error {
+	if e.attempt != nil {
+		return logLoginAttempt(tx, *e.attempt)
+	}
+
+	return audit(tx, *e.audit)
+}
+
+// NewEventWriter starts writing events to the database of handler, until it is closed
+func NewEventWriter(handler Handler) *EventWriter {
+	handler.Events = nil
+	writer := &EventWriter{
+		handler: handler,
+		events:  make(chan event, eventBufferSize),
+		done:    make(chan struct{}),
+	}
+	go writer.run()
+
+	return writer
+}
+
+// Dropped returns how many login log entries were dropped because the buffer was full
+func (writer *EventWriter) Dropped() int64 {
+	return writer.dropped.Load()
+}
+
+// add queues the entries of a committed transaction
+func (writer *EventWriter) add(attempts []LoginAttempt, audits []AuditEntry) {
+	writer.lock.RLock()
+	defer writer.lock.RUnlock()
+
+	if writer.closed {
+		// Events coming in late are written right away rather than lost
+		var batch []event
+		for i := range attempts {
+			batch = append(batch, event{attempt: &attempts[i]})
+		}
+		for i := range audits {
+			batch = append(batch, event{audit: &audits[i]})
+		}
+		writer.write(batch)
+		return
+	}
+
+	for i := range attempts {
+		select {
+		case writer.events <- event{attempt: &attempts[i]}:
+		default:
+			writer.dropped.Add(1)
+		}
+	}
+	for i := range audits {
+		writer.events <- event{audit: &audits[i]}
+	}
+}
+
+// run writes events as they come, in batches
+func (writer *EventWriter) run() {
+	defer close(writer.done)
+
+	ticker := time.NewTicker(eventFlushInterval)
+	defer ticker.Stop()
+
+	var batch []event
+	var reported int64
+	for {
+		select {
+		case e, ok := <-writer.events:
+			if !ok {
+				writer.write(batch)
+				return
+			}
+
+			batch = append(batch, e)
+			if len(batch) >= eventBatchSize {
+				writer.write(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			writer.write(batch)
+			batch = nil
+
+			if dropped := writer.Dropped(); dropped > reported {
+				log.Printf("The event buffer is full: %v login log entries were dropped so far", dropped)
+				reported = dropped
+			}
+		}
+	}
+}
+
+// write adds a batch of events to the database in a single transaction. If that fails, the events are written one by
+// one, so that a single bad event (about a user deleted in the meantime, for instance) doesn't take the others down.
+func (writer *EventWriter) write(batch []event) {
+	if len(batch) == 0 {
+		return
+	}
+
+	_, err := writer.handler.transaction(context.Background(), func(tx *Tx) (string, error) {
+		for _, e := range batch {
+			err := e.write(tx)
+			if err != nil {
+				return "Internal server error", err
+			}
+		}
+
+		return "", nil
+	})
+	if err == nil {
+		return
+	}
+
+	for _, e := range batch {
+		_, err := writer.handler.transaction(context.Background(), func(tx *Tx) (string, error) {
+			return "", e.write(tx)
+		})
+		if err != nil {
+			log.Printf("Could not write event to the database: %v", err)
+		}
+	}
+}
+
+// Close writes the events which are still buffered, and stops the writer. Events added afterwards are written right
+// away.
+func (writer *EventWriter) Close() {
+	writer.lock.Lock()
+	if !writer.closed {
+		writer.closed = true
+		close(writer.events)
+	}
+	writer.lock.Unlock()
+
+	<-writer.done
+}
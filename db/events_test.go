@@ -0,0 +1,81 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEventWriter(t *testing.T) {
+	handler := openTestHandler(t)
+	sink := &recordingSink{}
+	handler.AuditSink = sink
+	writer := NewEventWriter(handler)
+	handler.Events = writer
+	ctx := context.Background()
+
+	accessToken := testLogin(t, handler, "alice", "Alice", "alice@example.com")
+	aliceId := testUserId(t, handler, accessToken)
+	writer.Close()
+
+	// Buffered events are written once the writer is closed, and sent to the sink only once
+	entries, err := handler.AuditLog(ctx, AuditFilter{UserId: aliceId}, 0, 10)
+	if err != nil || len(entries) != 1 || entries[0].Action != AuditAccountCreate {
+		t.Errorf("AuditLog() = %+v, %v, expected the creation of alice's account", entries, err)
+	}
+	attempts, err := handler.LoginLog(ctx, aliceId, "", 0, 10)
+	if err != nil || len(attempts) != 1 || !attempts[0].Success {
+		t.Errorf("LoginLog() = %+v, %v, expected alice's login", attempts, err)
+	}
+	if len(sink.entries) != 1 {
+		t.Errorf("The sink received %+v, expected the creation of alice's account", sink.entries)
+	}
+
+	// Events coming in once the writer is closed are written right away
+	errorMessage, err := handler.UpdateName(ctx, accessToken, "Alice Liddell", "")
+	if errorMessage != "" || err != nil {
+		t.Fatalf("Could not update name: %v (%v)", errorMessage, err)
+	}
+	entries, _ = handler.AuditLog(ctx, AuditFilter{UserId: aliceId}, 0, 10)
+	if len(entries) != 2 || entries[0].Action != AuditAccountName {
+		t.Errorf("Got %+v, expected the renaming to be written after the writer was closed", entries)
+	}
+	if writer.Dropped() != 0 {
+		t.Errorf("%v login log entries were dropped", writer.Dropped())
+	}
+}
+
+func TestEventWriterSkipsInvalidEvents(t *testing.T) {
+	handler := openTestHandler(t)
+	writer := NewEventWriter(handler)
+	defer writer.Close()
+
+	// The login log entry of an unknown user breaks the batch, which is written again one event at a time
+	writer.write([]event{
+		{attempt: &LoginAttempt{UserId: "unknown", Time: time.Now(), Success: true, Reason: LoginSucceeded}},
+		{audit: &AuditEntry{Time: time.Now(), ActorId: AuditActorSystem, UserId: "bob", Action: AuditAccountDelete}},
+	})
+
+	entries, err := handler.AuditLog(context.Background(), AuditFilter{}, 0, 10)
+	if err != nil || len(entries) != 1 || entries[0].UserId != "bob" {
+		t.Errorf("AuditLog() = %+v, %v, expected the valid event to be written", entries, err)
+	}
+	attempts, _ := handler.LoginLog(context.Background(), "", "", 0, 10)
+	if len(attempts) != 0 {
+		t.Errorf("Got login log %+v, expected the invalid event to be skipped", attempts)
+	}
+}
+
+func TestEventWriterDropsLoginsWhenFull(t *testing.T) {
+	// A writer which isn't running, with room for a single event
+	writer := &EventWriter{
+		handler: openTestHandler(t),
+		events:  make(chan event, 1),
+		done:    make(chan struct{}),
+	}
+
+	writer.add([]LoginAttempt{{Reason: LoginSucceeded}, {Reason: LoginSucceeded}, {Reason: LoginSucceeded}}, nil)
+	if writer.Dropped() != 2 {
+		t.Errorf("Dropped() = %v, expected the entries which didn't fit in the buffer to be dropped", writer.Dropped())
+	}
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// AccountId returns the ID of the user the given access token belongs to
+// Returns (id string, errMessage string, err error)
+func (handler Handler) AccountId(ctx context.Context, accessToken string) (string, string, error) {
+	userId, err := handler.getAccountId(ctx, accessToken)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", "Invalid access token", nil
+		}
+
+		return "", "Internal server error", err
+	}
+
+	return userId, "", nil
+}
+
+// UserExport returns everything stored about a user, except for secrets such as tokens
+// Returns (export UserExport, errMessage string, err error)
+func (handler Handler) UserExport(ctx context.Context, userId string) (UserExport, string, error) {
+	export := UserExport{Id: userId}
+	var deletionScheduled int64
+	row := handler.QueryRow(ctx, "SELECT name, email, type, pebbleMirror, disabled, profileProvider, syncName, deletionScheduled FROM users WHERE id=?", userId)
+	err := row.Scan(&export.Name, &export.Email, &export.Type, &export.PebbleMirror, &export.Disabled, &export.ProfileProvider, &export.SyncName, &deletionScheduled)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return UserExport{}, "No such user", nil
+		}
+
+		return UserExport{}, "Internal server error", err
+	}
+	export.DeletionScheduled = unixNanoTime(deletionScheduled)
+
+	rows, err := handler.Query(ctx, "SELECT provider, sub, profile, expires FROM providerSessions WHERE userId=? ORDER BY provider", userId)
+	if err != nil {
+		return UserExport{}, "Internal server error", err
+	}
+	defer rows.Close()
+
+	export.Providers = []ExportedProvider{}
+	for rows.Next() {
+		var provider ExportedProvider
+		err = rows.Scan(&provider.Provider, &provider.Sub, &provider.Profile, &provider.Expires)
+		if err != nil {
+			return UserExport{}, "Internal server error", err
+		}
+
+		export.Providers = append(export.Providers, provider)
+	}
+
+	export.Sessions, err = handler.userSessions(ctx, userId)
+	if err != nil {
+		return UserExport{}, "Internal server error", err
+	}
+
+	export.Logins, err = handler.queryLoginAttempts(ctx, "WHERE userId=? ORDER BY time DESC, id DESC", userId)
+	if err != nil {
+		return UserExport{}, "Internal server error", err
+	}
+
+	rows, err = handler.Query(ctx, "SELECT alias FROM userAliases WHERE userId=? ORDER BY created", userId)
+	if err != nil {
+		return UserExport{}, "Internal server error", err
+	}
+	defer rows.Close()
+
+	export.Aliases = []string{}
+	for rows.Next() {
+		var alias string
+		err = rows.Scan(&alias)
+		if err != nil {
+			return UserExport{}, "Internal server error", err
+		}
+
+		export.Aliases = append(export.Aliases, alias)
+	}
+
+	export.Audits, err = handler.queryAuditLog(ctx, "WHERE userId=? ORDER BY time DESC, id DESC", userId)
+	if err != nil {
+		return UserExport{}, "Internal server error", err
+	}
+
+	return export, "", nil
+}
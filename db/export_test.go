@@ -0,0 +1,45 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestUserExport(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		aliceId := testUserId(t, store, aliceToken)
+		bobToken, _ := loginOther(t, store, "bob", "Bob", "bob@example.com")
+		bobId := testUserId(t, store, bobToken)
+
+		errorMessage, err := store.AccountMerge(ctx, requestMerge(t, store, aliceToken), aliceToken, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not merge accounts: %v (%v)", errorMessage, err)
+		}
+
+		export, errorMessage, err := store.UserExport(ctx, aliceId)
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not export user: %v (%v)", errorMessage, err)
+		}
+		if export.Id != aliceId || export.Name != "Alice" || export.Email != "alice@example.com" || export.Type != "user" {
+			t.Errorf("Got %+v, expected alice's account", export)
+		}
+		if len(export.Providers) != 2 || len(export.Sessions) != 2 || len(export.Logins) != 2 || len(export.Aliases) != 1 || export.Aliases[0] != bobId {
+			t.Errorf("Got %+v, expected both identities, sessions and logins, and bob's account as an alias", export)
+		}
+		if len(export.Audits) < 2 || export.Audits[0].Action != AuditAccountMerge || export.Audits[len(export.Audits)-1].Action != AuditAccountCreate {
+			t.Errorf("Got audit log %+v, expected the changes made to alice's account, latest first", export.Audits)
+		}
+		for _, entry := range export.Audits {
+			if entry.UserId != aliceId {
+				t.Errorf("Got audit log entry %+v, which isn't about alice's account", entry)
+			}
+		}
+
+		_, errorMessage, _ = store.UserExport(ctx, "unknown")
+		if errorMessage == "" {
+			t.Errorf("An unknown user was exported")
+		}
+	})
+}
@@ -0,0 +1,144 @@
+package db
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Statuses of admin jobs
+const (
+	JobRunning     = "running"
+	JobSucceeded   = "succeeded"
+	JobFailed      = "failed"
+	JobCancelled   = "cancelled"
+	JobInterrupted = "interrupted" // rebble-auth stopped while the job was running
+)
+
+// AdminJob is a long operation started by an administrator, such as the Pebble developer import
+type AdminJob struct {
+	Id       string
+	Name     string
+	Status   string
+	Progress int
+	Total    int // 0 if unknown
+	Log      []string
+	Result   string // JSON summary of what the job did, empty if it didn't finish
+	Error    string // Empty unless the job failed
+	Created  time.Time
+	Finished time.Time // Zero if the job is still running
+
+	InstanceId string    // ID of the instance of rebble-auth running the job
+	Heartbeat  time.Time // When that instance last reported the job was still running
+}
+
+// finishedTime converts a time to its database representation, the zero time being stored as 0
+func finishedTime(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+
+	return t.UnixNano()
+}
+
+// SaveAdminJob creates or updates an admin job
+func (handler Handler) SaveAdminJob(ctx context.Context, job AdminJob) error {
+	_, err := handler.Exec(ctx, `INSERT INTO adminJobs(id, name, status, progress, total, log, result, error, created, finished, instanceId, heartbeat) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET status=excluded.status, progress=excluded.progress, total=excluded.total, log=excluded.log, result=excluded.result, error=excluded.error, finished=excluded.finished, heartbeat=excluded.heartbeat`,
+		job.Id, job.Name, job.Status, job.Progress, job.Total, strings.Join(job.Log, "\n"), job.Result, job.Error, job.Created.UnixNano(), finishedTime(job.Finished), job.InstanceId, finishedTime(job.Heartbeat))
+	return err
+}
+
+// StartAdminJob saves a new running job, unless a job with the same name is already running. Running jobs whose last
+// heartbeat is older than staleBefore are marked as interrupted first, as the instance running them must have stopped.
+// The unique index on the names of running jobs makes this hold across instances of rebble-auth.
+// Returns whether the job was started
+func (handler Handler) StartAdminJob(ctx context.Context, job AdminJob, staleBefore time.Time) (bool, error) {
+	started := false
+	_, err := handler.transaction(ctx, func(tx *Tx) (string, error) {
+		_, err := tx.Exec("UPDATE adminJobs SET status=?, finished=? WHERE name=? AND status=? AND heartbeat<?",
+			JobInterrupted, time.Now().UnixNano(), job.Name, JobRunning, staleBefore.UnixNano())
+		if err != nil {
+			return "", err
+		}
+
+		_, err = tx.Exec("INSERT INTO adminJobs(id, name, status, progress, total, log, result, error, created, finished, instanceId, heartbeat) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			job.Id, job.Name, JobRunning, job.Progress, job.Total, strings.Join(job.Log, "\n"), job.Result, job.Error, job.Created.UnixNano(), 0, job.InstanceId, finishedTime(job.Heartbeat))
+		if uniqueViolation(err) {
+			return "A job with the same name is already running", nil
+		}
+		if err != nil {
+			return "", err
+		}
+
+		started = true
+		return "", nil
+	})
+
+	return started, err
+}
+
+// HeartbeatAdminJob records that a job is still running along with its progress, unless it already stopped
+func (handler Handler) HeartbeatAdminJob(ctx context.Context, job AdminJob) error {
+	_, err := handler.Exec(ctx, "UPDATE adminJobs SET progress=?, total=?, log=?, heartbeat=? WHERE id=? AND status=?",
+		job.Progress, job.Total, strings.Join(job.Log, "\n"), finishedTime(job.Heartbeat), job.Id, JobRunning)
+	return err
+}
+
+// queryAdminJobs runs a query selecting admin jobs, and returns them
+func (handler Handler) queryAdminJobs(ctx context.Context, query string, args ...interface{}) ([]AdminJob, error) {
+	rows, err := handler.Query(ctx, "SELECT id, name, status, progress, total, log, result, error, created, finished, instanceId, heartbeat FROM adminJobs "+query, args...)
+	if err != nil {
+		return []AdminJob{}, err
+	}
+	defer rows.Close()
+
+	jobs := []AdminJob{}
+	for rows.Next() {
+		var job AdminJob
+		var log string
+		var created, finished, heartbeat int64
+		err = rows.Scan(&job.Id, &job.Name, &job.Status, &job.Progress, &job.Total, &log, &job.Result, &job.Error, &created, &finished, &job.InstanceId, &heartbeat)
+		if err != nil {
+			return []AdminJob{}, err
+		}
+		job.Log = []string{}
+		if log != "" {
+			job.Log = strings.Split(log, "\n")
+		}
+		job.Created = unixNanoTime(created)
+		job.Finished = unixNanoTime(finished)
+		job.Heartbeat = unixNanoTime(heartbeat)
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs, rows.Err()
+}
+
+// AdminJob returns an admin job, and whether it exists
+func (handler Handler) AdminJob(ctx context.Context, id string) (AdminJob, bool, error) {
+	jobs, err := handler.queryAdminJobs(ctx, "WHERE id=?", id)
+	if err != nil || len(jobs) == 0 {
+		return AdminJob{}, false, err
+	}
+
+	return jobs[0], true, nil
+}
+
+// AdminJobs returns the most recent admin jobs, latest first
+func (handler Handler) AdminJobs(ctx context.Context, limit int) ([]AdminJob, error) {
+	return handler.queryAdminJobs(ctx, "ORDER BY created DESC LIMIT ?", limit)
+}
+
+// InterruptAdminJobs marks the running jobs whose last heartbeat is older than staleBefore as interrupted, as the
+// instance of rebble-auth running them must have stopped
+// Returns the number of jobs interrupted
+func (handler Handler) InterruptAdminJobs(ctx context.Context, staleBefore time.Time) (int64, error) {
+	result, err := handler.Exec(ctx, "UPDATE adminJobs SET status=?, finished=? WHERE status=? AND heartbeat<?", JobInterrupted, time.Now().UnixNano(), JobRunning, staleBefore.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
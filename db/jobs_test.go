@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAdminJobs(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		created := time.Now().Truncate(time.Second)
+		for i, id := range []string{"first", "second", "third"} {
+			job := AdminJob{Id: id, Name: id, Status: JobRunning, Log: []string{}, Created: created.Add(time.Duration(i) * time.Minute)}
+			err := store.SaveAdminJob(ctx, job)
+			if err != nil {
+				t.Fatalf("Could not save job: %v", err)
+			}
+		}
+
+		finished := AdminJob{
+			Id:       "first",
+			Name:     "first",
+			Status:   JobSucceeded,
+			Progress: 2,
+			Total:    2,
+			Log:      []string{"one", "two"},
+			Result:   `{"done":2}`,
+			Created:  created,
+			Finished: created.Add(time.Hour),
+		}
+		err := store.SaveAdminJob(ctx, finished)
+		if err != nil {
+			t.Fatalf("Could not update job: %v", err)
+		}
+
+		job, ok, err := store.AdminJob(ctx, "first")
+		if !ok || err != nil || !job.Created.Equal(finished.Created) || !job.Finished.Equal(finished.Finished) {
+			t.Fatalf("AdminJob() = %+v, %v, %v, expected %+v", job, ok, err, finished)
+		}
+		job.Created, job.Finished = finished.Created, finished.Finished
+		if !reflect.DeepEqual(job, finished) {
+			t.Errorf("AdminJob() = %+v, expected %+v", job, finished)
+		}
+
+		_, ok, err = store.AdminJob(ctx, "unknown")
+		if ok || err != nil {
+			t.Errorf("AdminJob() = %v, %v for an unknown job", ok, err)
+		}
+
+		jobs, err := store.AdminJobs(ctx, 2)
+		if err != nil || len(jobs) != 2 || jobs[0].Id != "third" || jobs[1].Id != "second" {
+			t.Errorf("AdminJobs() = %+v, %v, expected the last 2 jobs, latest first", jobs, err)
+		}
+
+		// Only jobs without a recent heartbeat are interrupted
+		err = store.HeartbeatAdminJob(ctx, AdminJob{Id: "third", Progress: 1, Log: []string{"alive"}, Heartbeat: created.Add(time.Hour)})
+		if err != nil {
+			t.Fatalf("Could not save heartbeat: %v", err)
+		}
+		interrupted, err := store.InterruptAdminJobs(ctx, created.Add(time.Minute))
+		if interrupted != 1 || err != nil {
+			t.Errorf("InterruptAdminJobs() = %v, %v, expected the running job without a heartbeat to be interrupted", interrupted, err)
+		}
+		job, _, _ = store.AdminJob(ctx, "second")
+		if job.Status != JobInterrupted {
+			t.Errorf("Got status %v, expected %v", job.Status, JobInterrupted)
+		}
+		job, _, _ = store.AdminJob(ctx, "third")
+		if job.Status != JobRunning || job.Progress != 1 || len(job.Log) != 1 || !job.Heartbeat.Equal(created.Add(time.Hour)) {
+			t.Errorf("Got %+v, expected the job to still be running with its progress saved", job)
+		}
+
+		// Heartbeats don't resurrect jobs which stopped
+		err = store.HeartbeatAdminJob(ctx, AdminJob{Id: "first", Progress: 0, Log: []string{}, Heartbeat: created.Add(time.Hour)})
+		if err != nil {
+			t.Fatalf("Could not save heartbeat: %v", err)
+		}
+		job, _, _ = store.AdminJob(ctx, "first")
+		if job.Status != JobSucceeded || job.Progress != 2 {
+			t.Errorf("Got %+v, expected the finished job to be left alone", job)
+		}
+	})
+}
+
+func TestStartAdminJob(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		now := time.Now().Truncate(time.Second)
+		newJob := func(id string, instanceId string) AdminJob {
+			return AdminJob{Id: id, Name: "import", Status: JobRunning, Log: []string{}, Created: now, InstanceId: instanceId, Heartbeat: now}
+		}
+
+		started, err := store.StartAdminJob(ctx, newJob("first", "a"), now.Add(-time.Minute))
+		if !started || err != nil {
+			t.Fatalf("StartAdminJob() = %v, %v, expected the job to start", started, err)
+		}
+
+		// Another instance can't run a job with the same name while the first one is alive
+		started, err = store.StartAdminJob(ctx, newJob("second", "b"), now.Add(-time.Minute))
+		if started || err != nil {
+			t.Errorf("StartAdminJob() = %v, %v, expected the job to be refused", started, err)
+		}
+
+		// Once the first instance stops sending heartbeats, its job is interrupted and the name can be used again
+		started, err = store.StartAdminJob(ctx, newJob("third", "b"), now.Add(time.Minute))
+		if !started || err != nil {
+			t.Fatalf("StartAdminJob() = %v, %v, expected the stale job to be replaced", started, err)
+		}
+		job, _, _ := store.AdminJob(ctx, "first")
+		if job.Status != JobInterrupted || job.InstanceId != "a" {
+			t.Errorf("Got %+v, expected the stale job to be interrupted", job)
+		}
+		job, ok, _ := store.AdminJob(ctx, "second")
+		if ok {
+			t.Errorf("Got %+v, expected the refused job not to be saved", job)
+		}
+
+		// Finished jobs don't count
+		third := newJob("third", "b")
+		third.Status, third.Finished = JobSucceeded, now
+		err = store.SaveAdminJob(ctx, third)
+		if err != nil {
+			t.Fatalf("Could not save job: %v", err)
+		}
+		started, err = store.StartAdminJob(ctx, newJob("fourth", "a"), now.Add(-time.Minute))
+		if !started || err != nil {
+			t.Errorf("StartAdminJob() = %v, %v, expected the job to start once the previous one finished", started, err)
+		}
+	})
+}
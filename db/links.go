@@ -0,0 +1,185 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"pebble-dev/rebble-auth/common"
+)
+
+// pendingLinkLifetime is how long a user has to confirm an account link once it has been offered
+const pendingLinkLifetime = 15 * time.Minute
+
+// findAccountByEmail returns the ID of the account using the given e-mail address, or "" if there is none. If several
+// accounts use the same address, "" is returned as well, as we can't know which one the user wants to link to.
+func findAccountByEmail(tx *Tx, email string) (string, error) {
+	rows, err := tx.Query("SELECT id FROM users WHERE lower(email)=lower(?) AND pebbleMirror=0", email)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var userIds []string
+	for rows.Next() {
+		var userId string
+		err = rows.Scan(&userId)
+		if err != nil {
+			return "", err
+		}
+		userIds = append(userIds, userId)
+	}
+
+	if len(userIds) != 1 {
+		return "", nil
+	}
+
+	return userIds[0], nil
+}
+
+// createPendingLink stores a new identity until the owner of the given account confirms it should be linked to it, or
+// the user declines the link. The name and e-mail address are the ones the account is created with in the latter case,
+// and the user is then sent back to the redirect URI of the session they were logging in to.
+// Returns the link token which must be presented to confirm the link
+func createPendingLink(tx *Tx, userId string, provider string, sub string, name string, email string, profile string, ssoAccessToken string, ssoRefreshToken string, expires int64, session SessionMetadata) (string, error) {
+	linkToken := common.GenerateString(50)
+
+	_, err := tx.Exec("INSERT INTO pendingLinks(token, userId, provider, sub, name, email, profile, accessToken, refreshToken, expires, redirectUri, clientId, created) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", hashToken(linkToken), userId, provider, sub, name, email, profile, ssoAccessToken, ssoRefreshToken, expires, session.RedirectURI, session.ClientId, time.Now().UnixNano())
+	if err != nil {
+		return "", err
+	}
+
+	return linkToken, nil
+}
+
+// AccountConfirmLink links the identity stored in a pending link to the account associated to the given access token.
+// Having logged in to that account proves the user owns it, so the link is only made if it is the account the link
+// was offered for.
+// Returns errorMessage, error
+func (handler Handler) AccountConfirmLink(ctx context.Context, linkToken string, rebbleAccessToken string, remoteIp string) (string, error) {
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		var linkId int64
+		var linkUserId, provider, sub, profile, ssoAccessToken, ssoRefreshToken string
+		var expires int64
+		row := tx.QueryRow("SELECT id, userId, provider, sub, profile, accessToken, refreshToken, expires FROM pendingLinks WHERE token=? AND mergeUserId='' AND created>?", hashToken(linkToken), time.Now().Add(-pendingLinkLifetime).UnixNano())
+		err := row.Scan(&linkId, &linkUserId, &provider, &sub, &profile, &ssoAccessToken, &ssoRefreshToken, &expires)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return "Invalid or expired account link request", nil
+			}
+
+			return "Internal server error", err
+		}
+
+		var userId string
+		row = tx.QueryRow("SELECT userId FROM userSessions WHERE accessToken=?", hashToken(rebbleAccessToken))
+		err = row.Scan(&userId)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return "Invalid access token", nil
+			}
+
+			return "Internal server error", err
+		}
+
+		if userId != linkUserId {
+			return "You must log in to the account using the same e-mail address to link this identity to it", errors.New("Link confirmed from the wrong account")
+		}
+
+		err = addProvider(tx, provider, sub, userId, profile, ssoAccessToken, ssoRefreshToken, expires)
+		if err == errIdentityInUse {
+			return "This identity has been linked to another account in the meantime", nil
+		}
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		err = audit(tx, AuditEntry{
+			ActorId:  userId,
+			UserId:   userId,
+			Action:   AuditProviderLink,
+			After:    auditValues(map[string]interface{}{"provider": provider, "subHash": auditHash(sub)}),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		_, err = tx.Exec("DELETE FROM pendingLinks WHERE id=?", linkId)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+}
+
+// AccountDeclineLink creates a separate account for the identity stored in a pending link, for users who don't want it
+// linked to the account using the same e-mail address, and logs them in to it. Only the user who just logged in with
+// that identity was given the link token, so no other proof is needed. The identity then belongs to the new account,
+// and the link isn't offered again. The new session belongs to the client the user was logging in to when the link was
+// offered, and the redirect URI of that client is returned (even if the link can't be declined anymore) so that the
+// user can be sent back there; the one given by the client which declines the link isn't trusted.
+// Returns accessToken, redirectURI, errorMessage, error
+func (handler Handler) AccountDeclineLink(ctx context.Context, linkToken string, session SessionMetadata) (string, string, string, error) {
+	var accessToken, redirectURI string
+	errorMessage, err := handler.transaction(ctx, func(tx *Tx) (string, error) {
+		accessToken = ""
+		redirectURI = ""
+
+		var linkId int64
+		var provider, sub, name, email, profile, ssoAccessToken, ssoRefreshToken string
+		var expires int64
+		row := tx.QueryRow("SELECT id, provider, sub, name, email, profile, accessToken, refreshToken, expires, redirectUri, clientId FROM pendingLinks WHERE token=? AND mergeUserId='' AND created>?", hashToken(linkToken), time.Now().Add(-pendingLinkLifetime).UnixNano())
+		err := row.Scan(&linkId, &provider, &sub, &name, &email, &profile, &ssoAccessToken, &ssoRefreshToken, &expires, &redirectURI, &session.ClientId)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return "Invalid or expired account link request", nil
+			}
+
+			return "Internal server error", err
+		}
+
+		_, err = tx.Exec("DELETE FROM pendingLinks WHERE id=?", linkId)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		userId, err := createAccount(tx, provider, sub, name, email, session.RemoteIp)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		accessToken, err = createSession(tx, provider, sub, userId, profile, ssoAccessToken, ssoRefreshToken, expires, session)
+		if err == errIdentityInUse {
+			return "This identity has been linked to another account in the meantime", nil
+		}
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		err = logLoginAttempt(tx, LoginAttempt{
+			UserId:    userId,
+			Time:      time.Now(),
+			Success:   true,
+			Reason:    LoginSucceeded,
+			Provider:  provider,
+			UserAgent: session.UserAgent,
+			RemoteIp:  session.RemoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+	if err != nil {
+		return "", "", errorMessage, err
+	}
+	if errorMessage != "" {
+		return "", redirectURI, errorMessage, nil
+	}
+
+	return accessToken, redirectURI, "", nil
+}
@@ -0,0 +1,121 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+// loginOther logs in with an identity of the "other" provider whose e-mail address can be trusted, and returns the
+// access token and link token
+func loginOther(t *testing.T, store Store, sub string, name string, email string) (string, string) {
+	t.Helper()
+
+	accessToken, linkToken, errorMessage, err := store.AccountLoginOrRegister(context.Background(), "other", sub, name, email, true, "{}", "", "", 0, SessionMetadata{ClientId: "example.com", RedirectURI: "https://example.com/callback"})
+	if errorMessage != "" || err != nil {
+		t.Fatalf("Could not log in as %v: %v (%v)", sub, errorMessage, err)
+	}
+
+	return accessToken, linkToken
+}
+
+func TestLinkByVerifiedEmail(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		aliceId := testUserId(t, store, aliceToken)
+
+		// E-mail addresses are compared regardless of case
+		accessToken, linkToken := loginOther(t, store, "alice-other", "Alice O.", "Alice@Example.com")
+		if accessToken != "" || linkToken == "" {
+			t.Fatalf("Expected a link token and no access token, got %q and %q", accessToken, linkToken)
+		}
+
+		exists, err := store.AccountExists(ctx, "other", "alice-other")
+		if err != nil || exists {
+			t.Fatalf("The identity was linked before the link was confirmed")
+		}
+
+		// Only the owner of the existing account can confirm the link
+		bobToken := testLogin(t, store, "bob", "Bob", "bob@example.com")
+		errorMessage, _ := store.AccountConfirmLink(ctx, linkToken, bobToken, "")
+		if errorMessage == "" {
+			t.Fatalf("The link was confirmed from another account")
+		}
+
+		errorMessage, err = store.AccountConfirmLink(ctx, linkToken, aliceToken, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not confirm link: %v (%v)", errorMessage, err)
+		}
+
+		accessToken, linkToken = loginOther(t, store, "alice-other", "Alice O.", "alice@example.com")
+		if linkToken != "" || testUserId(t, store, accessToken) != aliceId {
+			t.Errorf("Logging in with the linked identity didn't log in to the existing account")
+		}
+	})
+}
+
+func TestLinkRequiresTrustedEmail(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		// testLogin doesn't vouch for the e-mail address
+		accessToken := testLogin(t, store, "alice2", "Alice", "alice@example.com")
+		if testUserId(t, store, accessToken) == testUserId(t, store, aliceToken) {
+			t.Errorf("An identity whose e-mail address can't be trusted was linked to an existing account")
+		}
+	})
+}
+
+func TestDeclineLink(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		_, linkToken := loginOther(t, store, "alice-other", "Alice O.", "alice@example.com")
+		accessToken, redirectURI, errorMessage, err := store.AccountDeclineLink(ctx, linkToken, SessionMetadata{RemoteIp: "192.0.2.2"})
+		if errorMessage != "" || err != nil || accessToken == "" {
+			t.Fatalf("Could not decline link: %v (%v)", errorMessage, err)
+		}
+		if redirectURI != "https://example.com/callback" {
+			t.Errorf("Got redirect URI %q, expected the one the link was offered with", redirectURI)
+		}
+
+		userId := testUserId(t, store, accessToken)
+		if userId == testUserId(t, store, aliceToken) {
+			t.Fatalf("Declining the link logged in to the existing account")
+		}
+
+		loggedIn, name, email, providers, err := store.AccountInformation(ctx, accessToken)
+		if !loggedIn || err != nil || name != "Alice O." || email != "alice@example.com" || len(providers) != 1 || providers[0] != "other" {
+			t.Errorf("Got account %v <%v> with providers %v, expected Alice O. <alice@example.com> with the other provider", name, email, providers)
+		}
+
+		// The link token can only be used once
+		_, _, errorMessage, _ = store.AccountDeclineLink(ctx, linkToken, SessionMetadata{})
+		if errorMessage == "" {
+			t.Errorf("A link was declined twice")
+		}
+
+		// The identity now has an account, so the link isn't offered anymore
+		accessToken, linkToken = loginOther(t, store, "alice-other", "Alice O.", "alice@example.com")
+		if linkToken != "" || testUserId(t, store, accessToken) != userId {
+			t.Errorf("Logging in again didn't log in to the new account")
+		}
+	})
+}
+
+func TestInvalidLinkToken(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		errorMessage, _ := store.AccountConfirmLink(context.Background(), "invalid", aliceToken, "")
+		if errorMessage == "" {
+			t.Errorf("An invalid link token was accepted to confirm a link")
+		}
+
+		_, redirectURI, errorMessage, _ := store.AccountDeclineLink(context.Background(), "invalid", SessionMetadata{})
+		if errorMessage == "" || redirectURI != "" {
+			t.Errorf("An invalid link token was accepted to decline a link")
+		}
+	})
+}
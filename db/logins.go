@@ -0,0 +1,179 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Reasons recorded in the login log for each login attempt
+const (
+	LoginSucceeded       = "success"
+	LoginInvalidProvider = "invalid_provider" // The user tried to log in with a provider we don't know about
+	LoginDenied          = "denied"           // The provider sent the user back without a code (consent denied)
+	LoginInvalidState    = "invalid_state"    // The state sent back by the provider doesn't match the user's cookie
+	LoginInvalidCode     = "invalid_code"     // The provider rejected the code
+	LoginProviderError   = "provider_error"   // The provider could not be reached or gave an unusable answer
+	LoginAccountDisabled = "account_disabled"
+)
+
+// LoginAttempt is an entry of the login log
+type LoginAttempt struct {
+	Id        int64
+	UserId    string // Empty if the attempt failed before the account could be identified
+	Time      time.Time
+	Success   bool
+	Reason    string
+	Provider  string
+	UserAgent string
+	RemoteIp  string
+}
+
+// logLoginAttempt adds an entry to the login log, or hands it to the event writer once the transaction is committed
+func logLoginAttempt(tx *Tx, attempt LoginAttempt) error {
+	if tx.events != nil {
+		tx.attempts = append(tx.attempts, attempt)
+		return nil
+	}
+
+	userId := sql.NullString{String: attempt.UserId, Valid: attempt.UserId != ""}
+
+	success := 0
+	if attempt.Success {
+		success = 1
+	}
+
+	_, err := tx.Exec("INSERT INTO userLoginLog(userId, remoteIp, time, success, reason, provider, userAgent) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		userId, attempt.RemoteIp, attempt.Time.UnixNano(), success, attempt.Reason, attempt.Provider, attempt.UserAgent)
+	return err
+}
+
+// queryLoginAttempts runs a query selecting login log entries, and returns them
+func (handler Handler) queryLoginAttempts(ctx context.Context, query string, args ...interface{}) ([]LoginAttempt, error) {
+	rows, err := handler.Query(ctx, "SELECT id, userId, time, success, reason, provider, userAgent, remoteIp FROM userLoginLog "+query, args...)
+	if err != nil {
+		return []LoginAttempt{}, err
+	}
+	defer rows.Close()
+
+	attempts := []LoginAttempt{}
+	for rows.Next() {
+		var attempt LoginAttempt
+		var userId sql.NullString
+		var t int64
+		err = rows.Scan(&attempt.Id, &userId, &t, &attempt.Success, &attempt.Reason, &attempt.Provider, &attempt.UserAgent, &attempt.RemoteIp)
+		if err != nil {
+			return []LoginAttempt{}, err
+		}
+		attempt.UserId = userId.String
+		attempt.Time = unixNanoTime(t)
+
+		attempts = append(attempts, attempt)
+	}
+
+	return attempts, rows.Err()
+}
+
+// LogLoginAttempt records a login attempt which failed before reaching the database, such as one the identity provider
+// refused. Attempts going through AccountLoginOrRegister are recorded by it.
+func (handler Handler) LogLoginAttempt(ctx context.Context, attempt LoginAttempt) error {
+	if handler.Events != nil {
+		handler.Events.add([]LoginAttempt{attempt}, nil)
+		return nil
+	}
+
+	_, err := handler.transaction(ctx, func(tx *Tx) (string, error) {
+		return "", logLoginAttempt(tx, attempt)
+	})
+	return err
+}
+
+// AccountLogins returns the most recent login attempts of the user the given access token belongs to, latest first
+// Returns (attempts []LoginAttempt, errMessage string, err error)
+func (handler Handler) AccountLogins(ctx context.Context, accessToken string, limit int) ([]LoginAttempt, string, error) {
+	userId, err := handler.getAccountId(ctx, accessToken)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return []LoginAttempt{}, "Invalid access token", nil
+		}
+
+		return []LoginAttempt{}, "Internal server error", err
+	}
+
+	attempts, err := handler.queryLoginAttempts(ctx, "WHERE userId=? ORDER BY time DESC, id DESC LIMIT ?", userId, limit)
+	if err != nil {
+		return []LoginAttempt{}, "Internal server error", err
+	}
+
+	return attempts, "", nil
+}
+
+// LoginLog returns a page of the login log, latest first, optionally only for the given user and/or IP address
+func (handler Handler) LoginLog(ctx context.Context, userId string, remoteIp string, offset int, limit int) ([]LoginAttempt, error) {
+	return handler.queryLoginAttempts(ctx, "WHERE (?='' OR userId=?) AND (?='' OR remoteIp=?) ORDER BY time DESC, id DESC LIMIT ? OFFSET ?",
+		userId, userId, remoteIp, remoteIp, limit, offset)
+}
+
+// ProviderStats counts the identities linked with each provider, and the logins made with it since the given time.
+// Providers which were never used aren't listed.
+func (handler Handler) ProviderStats(ctx context.Context, since time.Time) ([]ProviderStats, error) {
+	stats := []ProviderStats{}
+	index := make(map[string]int)
+	provider := func(name string) *ProviderStats {
+		i, ok := index[name]
+		if !ok {
+			i = len(stats)
+			index[name] = i
+			stats = append(stats, ProviderStats{Provider: name})
+		}
+
+		return &stats[i]
+	}
+
+	rows, err := handler.Query(ctx, "SELECT provider, COUNT(*) FROM providerSessions GROUP BY provider ORDER BY provider")
+	if err != nil {
+		return []ProviderStats{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var identities int64
+		err = rows.Scan(&name, &identities)
+		if err != nil {
+			return []ProviderStats{}, err
+		}
+
+		provider(name).Identities = identities
+	}
+	err = rows.Err()
+	if err != nil {
+		return []ProviderStats{}, err
+	}
+
+	rows, err = handler.Query(ctx, "SELECT provider, success, COUNT(*), MAX(time) FROM userLoginLog WHERE time>=? GROUP BY provider, success", since.UnixNano())
+	if err != nil {
+		return []ProviderStats{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		var success bool
+		var count, last int64
+		err = rows.Scan(&name, &success, &count, &last)
+		if err != nil {
+			return []ProviderStats{}, err
+		}
+
+		p := provider(name)
+		if success {
+			p.Logins = count
+			p.LastLogin = unixNanoTime(last)
+		} else {
+			p.FailedLogins = count
+		}
+	}
+
+	return stats, rows.Err()
+}
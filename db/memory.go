@@ -0,0 +1,2002 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nu7hatch/gouuid"
+
+	"pebble-dev/rebble-auth/common"
+)
+
+type memoryUser struct {
+	id              string
+	name            string
+	email           string
+	userType        string
+	pebbleMirror    bool
+	disabled        bool
+	profileProvider string
+	syncName        bool
+
+	deletionScheduled time.Time // Zero unless the deletion of the account is scheduled
+}
+
+type memorySession struct {
+	userId string
+	Session
+}
+
+type memoryProvider struct {
+	userId       string
+	provider     string
+	sub          string
+	profile      string
+	accessToken  string
+	refreshToken string
+	expires      int64
+}
+
+type memoryPendingLink struct {
+	userId      string
+	mergeUserId string
+	provider    memoryProvider
+	name        string // Name and e-mail address of the identity, for pending links
+	email       string
+	redirectURI string // Redirect URI and client of the session the user was logging in to, for pending links
+	clientId    string
+	created     time.Time
+}
+
+// MemoryStore is a Store which keeps everything in memory, and loses it when the process exits
+type MemoryStore struct {
+	lock sync.Mutex
+
+	users         map[string]*memoryUser
+	sessions      map[string]*memorySession // hashed access token => session
+	lastSessionId int64
+	providers     []*memoryProvider
+	logins        []LoginAttempt
+	lastLoginId   int64
+	pending       map[string]*memoryPendingLink // hashed token => pending link or merge
+	aliases       map[string]string             // alias => user ID
+
+	notifications      []DeletionNotification
+	lastNotificationId int64
+
+	pebbleImportCheckpoint string
+	jobs                   []AdminJob // Oldest first
+	claims                 []DeveloperClaim
+	lastClaimId            int64
+	audits                 []AuditEntry // Oldest first
+	lastAuditId            int64
+	clients                map[string]Client
+
+	// AuditSink receives the audit log entries as they are added, if set
+	AuditSink AuditSink
+	// SessionIdle is how long a session may stay unused before it expires. Zero means sessions don't expire.
+	SessionIdle time.Duration
+}
+
+// NewMemoryStore returns an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		users:    make(map[string]*memoryUser),
+		sessions: make(map[string]*memorySession),
+		pending:  make(map[string]*memoryPendingLink),
+		aliases:  make(map[string]string),
+		clients:  make(map[string]Client),
+	}
+}
+
+// The following helpers expect the lock to be held
+
+// audit adds an entry to the audit log, and sends it to the audit sink
+func (store *MemoryStore) audit(entry AuditEntry) {
+	store.lastAuditId++
+	entry.Id = store.lastAuditId
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+
+	store.audits = append(store.audits, entry)
+	writeAudits(store.AuditSink, []AuditEntry{entry})
+}
+
+func (store *MemoryStore) sessionUser(accessToken string) *memoryUser {
+	session, ok := store.sessions[hashToken(accessToken)]
+	if !ok {
+		return nil
+	}
+
+	return store.users[session.userId]
+}
+
+func (store *MemoryStore) findProvider(provider string, sub string) *memoryProvider {
+	for _, p := range store.providers {
+		if p.provider == provider && p.sub == sub {
+			return p
+		}
+	}
+
+	return nil
+}
+
+func (store *MemoryStore) userProviders(userId string) []string {
+	providers := []string{}
+	for _, p := range store.providers {
+		if p.userId == userId {
+			providers = append(providers, p.provider)
+		}
+	}
+
+	return providers
+}
+
+func (store *MemoryStore) addProvider(p memoryProvider) error {
+	existing := store.findProvider(p.provider, p.sub)
+	if existing == nil {
+		store.providers = append(store.providers, &p)
+		return nil
+	}
+
+	if existing.userId != p.userId {
+		return errIdentityInUse
+	}
+
+	*existing = p
+	return nil
+}
+
+func (store *MemoryStore) createSession(userId string, provider string, metadata SessionMetadata) string {
+	accessToken := common.GenerateString(50)
+
+	store.lastSessionId++
+	now := time.Now()
+	store.sessions[hashToken(accessToken)] = &memorySession{
+		userId: userId,
+		Session: Session{
+			Id:              store.lastSessionId,
+			Created:         now,
+			LastUsed:        now,
+			Provider:        provider,
+			SessionMetadata: metadata,
+		},
+	}
+
+	return accessToken
+}
+
+func (store *MemoryStore) createAccount(provider string, sub string, name string, email string, remoteIp string) (*memoryUser, error) {
+	var userId string
+	for {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return nil, err
+		}
+		userId = strings.Replace(id.String(), "-", "", -1)
+
+		if store.resolveAlias(userId) == "" {
+			break
+		}
+	}
+
+	if name == "" {
+		name = userId
+	}
+
+	user := &memoryUser{
+		id:              userId,
+		name:            name,
+		email:           email,
+		userType:        "user",
+		profileProvider: provider,
+	}
+	store.users[userId] = user
+
+	store.audit(AuditEntry{
+		ActorId:  userId,
+		UserId:   userId,
+		Action:   AuditAccountCreate,
+		After:    auditValues(map[string]interface{}{"provider": provider, "subHash": auditHash(sub)}),
+		RemoteIp: remoteIp,
+	})
+
+	return user, nil
+}
+
+func (store *MemoryStore) createPending(pending *memoryPendingLink) string {
+	token := common.GenerateString(50)
+	pending.created = time.Now()
+	store.pending[hashToken(token)] = pending
+
+	return token
+}
+
+func (store *MemoryStore) findPending(token string, merge bool) (string, *memoryPendingLink) {
+	hash := hashToken(token)
+	pending, ok := store.pending[hash]
+	if !ok || (pending.mergeUserId != "") != merge || time.Since(pending.created) > pendingLinkLifetime {
+		return "", nil
+	}
+
+	return hash, pending
+}
+
+func (store *MemoryStore) logLoginAttempt(attempt LoginAttempt) {
+	store.lastLoginId++
+	attempt.Id = store.lastLoginId
+	store.logins = append(store.logins, attempt)
+}
+
+// loginAttempts returns the login attempts matching the given filter, latest first
+func (store *MemoryStore) loginAttempts(match func(attempt LoginAttempt) bool) []LoginAttempt {
+	attempts := []LoginAttempt{}
+	for i := len(store.logins) - 1; i >= 0; i-- {
+		if match(store.logins[i]) {
+			attempts = append(attempts, store.logins[i])
+		}
+	}
+
+	return attempts
+}
+
+// mergeAccounts moves everything associated to account fromId to account intoId, then deletes fromId and keeps its ID
+// as an alias of intoId
+// See mergeAccounts
+func (store *MemoryStore) mergeAccounts(fromId string, intoId string, actorId string, remoteIp string) error {
+	from, into := store.users[fromId], store.users[intoId]
+	if !from.deletionScheduled.IsZero() {
+		return errDeletionScheduled
+	}
+	if roleRank(from.userType) > roleRank(into.userType) {
+		store.audit(AuditEntry{
+			ActorId:  actorId,
+			UserId:   intoId,
+			Action:   AuditAccountRole,
+			Before:   auditValues(map[string]interface{}{"role": into.userType}),
+			After:    auditValues(map[string]interface{}{"role": from.userType, "mergedId": fromId}),
+			RemoteIp: remoteIp,
+		})
+		into.userType = from.userType
+	}
+
+	for _, session := range store.sessions {
+		if session.userId == fromId {
+			session.userId = intoId
+		}
+	}
+	for _, p := range store.providers {
+		if p.userId == fromId {
+			p.userId = intoId
+		}
+	}
+	for i := range store.logins {
+		if store.logins[i].UserId == fromId {
+			store.logins[i].UserId = intoId
+		}
+	}
+	for _, p := range store.pending {
+		if p.userId == fromId {
+			p.userId = intoId
+			p.provider.userId = intoId
+		}
+		if p.mergeUserId == fromId {
+			p.mergeUserId = intoId
+		}
+	}
+	for alias, userId := range store.aliases {
+		if userId == fromId {
+			store.aliases[alias] = intoId
+		}
+	}
+	for i := range store.claims {
+		if store.claims[i].UserId == fromId {
+			store.claims[i].UserId = intoId
+		}
+	}
+	store.aliases[fromId] = intoId
+	delete(store.users, fromId)
+	return nil
+}
+
+func (store *MemoryStore) resolveAlias(id string) string {
+	if _, ok := store.users[id]; ok {
+		return id
+	}
+
+	return store.aliases[id]
+}
+
+// AccountExists checks if an account is linked to the given identity
+func (store *MemoryStore) AccountExists(ctx context.Context, provider string, sub string) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return store.findProvider(provider, sub) != nil, nil
+}
+
+// AccountInformation returns information about the account associated to the given access token
+// returns success, name, email, providers, err
+func (store *MemoryStore) AccountInformation(ctx context.Context, accessToken string) (bool, string, string, []string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user := store.sessionUser(accessToken)
+	if user == nil {
+		return false, "", "", []string{}, nil
+	}
+
+	name := user.name
+	if name == "" {
+		name = user.id
+	}
+
+	return true, name, user.email, store.userProviders(user.id), nil
+}
+
+// UpdateName updates a user's name and returns a human-readable error as well as an actual error
+func (store *MemoryStore) UpdateName(ctx context.Context, accessToken string, name string, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user := store.sessionUser(accessToken)
+	if user == nil {
+		return "Invalid access token", errors.New("Invalid access token")
+	}
+
+	store.audit(AuditEntry{
+		ActorId:  user.id,
+		UserId:   user.id,
+		Action:   AuditAccountName,
+		RemoteIp: remoteIp,
+	})
+	user.name = name
+	user.syncName = false
+
+	return "", nil
+}
+
+// SetUserRole changes the role (type) of a user
+// Returns errorMessage, err
+func (store *MemoryStore) SetUserRole(ctx context.Context, userId string, role string, actorId string, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user, ok := store.users[userId]
+	if !ok {
+		return "No such user", nil
+	}
+
+	if user.userType == role {
+		return "", nil
+	}
+
+	store.audit(AuditEntry{
+		ActorId:  actorId,
+		UserId:   userId,
+		Action:   AuditAccountRole,
+		Before:   auditValues(map[string]interface{}{"role": user.userType}),
+		After:    auditValues(map[string]interface{}{"role": role}),
+		RemoteIp: remoteIp,
+	})
+	user.userType = role
+
+	return "", nil
+}
+
+// SearchUsers returns a page of the users matching query, ordered by name
+// See Handler.SearchUsers
+func (store *MemoryStore) SearchUsers(ctx context.Context, query string, offset int, limit int) ([]UserSummary, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	lower := strings.ToLower(query)
+	matches := []*memoryUser{}
+	for _, user := range store.users {
+		match := query == "" || user.id == query || store.aliases[query] == user.id ||
+			strings.Contains(strings.ToLower(user.name), lower) || strings.Contains(strings.ToLower(user.email), lower)
+		for _, p := range store.providers {
+			match = match || (p.userId == user.id && p.sub == query)
+		}
+		if match {
+			matches = append(matches, user)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].name != matches[j].name {
+			return matches[i].name < matches[j].name
+		}
+		return matches[i].id < matches[j].id
+	})
+
+	users := []UserSummary{}
+	for _, user := range matches {
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(users) == limit {
+			break
+		}
+		users = append(users, UserSummary{
+			Id:                user.id,
+			Name:              user.name,
+			Email:             user.email,
+			Type:              user.userType,
+			PebbleMirror:      user.pebbleMirror,
+			Disabled:          user.disabled,
+			DeletionScheduled: user.deletionScheduled,
+		})
+	}
+
+	return users, nil
+}
+
+// SetUserDisabled disables or enables a user
+// See Handler.SetUserDisabled
+// Returns errorMessage, err
+func (store *MemoryStore) SetUserDisabled(ctx context.Context, userId string, disabled bool, actorId string, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user, ok := store.users[userId]
+	if !ok {
+		return "No such user", nil
+	}
+
+	if user.disabled == disabled {
+		return "", nil
+	}
+
+	action := AuditAccountEnable
+	if disabled {
+		action = AuditAccountDisable
+	}
+	store.audit(AuditEntry{
+		ActorId:  actorId,
+		UserId:   userId,
+		Action:   action,
+		Before:   auditValues(map[string]interface{}{"disabled": user.disabled}),
+		After:    auditValues(map[string]interface{}{"disabled": disabled}),
+		RemoteIp: remoteIp,
+	})
+	user.disabled = disabled
+
+	return "", nil
+}
+
+// LogoutUser logs out all of the sessions of a user
+// Returns (sessions int64, errorMessage string, err error)
+func (store *MemoryStore) LogoutUser(ctx context.Context, userId string, actorId string, remoteIp string) (int64, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.users[userId]; !ok {
+		return 0, "No such user", nil
+	}
+
+	var count int64
+	for hash, session := range store.sessions {
+		if session.userId == userId {
+			delete(store.sessions, hash)
+			count++
+		}
+	}
+
+	store.audit(AuditEntry{
+		ActorId:  actorId,
+		UserId:   userId,
+		Action:   AuditSessionLogout,
+		Before:   auditValues(map[string]interface{}{"sessions": count}),
+		RemoteIp: remoteIp,
+	})
+
+	return count, "", nil
+}
+
+// SetUserName changes the name of a user on their behalf
+// See Handler.SetUserName
+// Returns errorMessage, err
+func (store *MemoryStore) SetUserName(ctx context.Context, userId string, name string, actorId string, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user, ok := store.users[userId]
+	if !ok {
+		return "No such user", nil
+	}
+
+	store.audit(AuditEntry{
+		ActorId:  actorId,
+		UserId:   userId,
+		Action:   AuditAccountName,
+		RemoteIp: remoteIp,
+	})
+	user.name = name
+	user.syncName = false
+
+	return "", nil
+}
+
+// RevokeUserSession logs out one of the sessions of a user on their behalf
+// Returns errorMessage, err
+func (store *MemoryStore) RevokeUserSession(ctx context.Context, userId string, sessionId int64, actorId string, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for hash, session := range store.sessions {
+		if session.Id == sessionId && session.userId == userId {
+			delete(store.sessions, hash)
+			store.audit(AuditEntry{
+				ActorId:  actorId,
+				UserId:   userId,
+				Action:   AuditSessionRevoke,
+				Before:   auditValues(map[string]interface{}{"sessionId": sessionId}),
+				RemoteIp: remoteIp,
+			})
+			return "", nil
+		}
+	}
+
+	return "No such session", nil
+}
+
+// GetName returns (name bool, errMessage string, err error) about the user's name for the given id
+func (store *MemoryStore) GetName(ctx context.Context, id string) (string, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user, ok := store.users[store.resolveAlias(id)]
+	if !ok {
+		return "", "No user with this ID", nil
+	}
+
+	return user.name, "", nil
+}
+
+// ResolveAlias returns the current ID of an account, following aliases left behind by merged accounts
+// Returns (id string, errMessage string, err error)
+func (store *MemoryStore) ResolveAlias(ctx context.Context, id string) (string, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	userId := store.resolveAlias(id)
+	if userId == "" {
+		return "", "No user with this ID", nil
+	}
+
+	return userId, "", nil
+}
+
+// ProfileSettings returns which provider the user's profile is kept in sync with, and whether their name is
+// Returns (profileProvider string, syncName bool, errMessage string, err error)
+func (store *MemoryStore) ProfileSettings(ctx context.Context, accessToken string) (string, bool, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user := store.sessionUser(accessToken)
+	if user == nil {
+		return "", false, "Invalid access token", nil
+	}
+
+	return user.profileProvider, user.syncName, "", nil
+}
+
+// UpdateProfileSettings changes which provider the user's profile is kept in sync with, and whether their name is
+// Returns errorMessage, error
+func (store *MemoryStore) UpdateProfileSettings(ctx context.Context, accessToken string, profileProvider string, syncName bool, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user := store.sessionUser(accessToken)
+	if user == nil {
+		return "Invalid access token", nil
+	}
+
+	if profileProvider != "" {
+		linked := false
+		for _, p := range store.userProviders(user.id) {
+			if p == profileProvider {
+				linked = true
+			}
+		}
+
+		if !linked {
+			return "This provider isn't linked to your account", nil
+		}
+	}
+
+	store.audit(AuditEntry{
+		ActorId:  user.id,
+		UserId:   user.id,
+		Action:   AuditAccountProfile,
+		Before:   auditValues(map[string]interface{}{"profileProvider": user.profileProvider, "syncName": user.syncName}),
+		After:    auditValues(map[string]interface{}{"profileProvider": profileProvider, "syncName": syncName}),
+		RemoteIp: remoteIp,
+	})
+	user.profileProvider = profileProvider
+	user.syncName = syncName
+
+	return "", nil
+}
+
+// ImportPebbleDevelopers creates or renames the mirror accounts of a batch of Pebble developers
+// See Handler.ImportPebbleDevelopers
+func (store *MemoryStore) ImportPebbleDevelopers(ctx context.Context, developers []PebbleDeveloper, actorId string) (ImportReport, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var report ImportReport
+	for _, developer := range developers {
+		user, ok := store.users[developer.Id]
+		if !ok {
+			if _, merged := store.aliases[developer.Id]; merged {
+				report.Skipped++
+				continue
+			}
+
+			store.users[developer.Id] = &memoryUser{
+				id:           developer.Id,
+				name:         developer.Name,
+				userType:     "user",
+				pebbleMirror: true,
+			}
+			store.audit(AuditEntry{
+				ActorId: actorId,
+				UserId:  developer.Id,
+				Action:  AuditMirrorCreate,
+			})
+			report.Created++
+		} else if !user.pebbleMirror || user.name == developer.Name {
+			report.Skipped++
+		} else {
+			store.audit(AuditEntry{
+				ActorId: actorId,
+				UserId:  developer.Id,
+				Action:  AuditMirrorRename,
+			})
+			user.name = developer.Name
+			report.Updated++
+		}
+	}
+
+	if len(developers) > 0 {
+		store.pebbleImportCheckpoint = developers[len(developers)-1].Id
+	}
+
+	return report, nil
+}
+
+// PebbleImportCheckpoint returns the ID of the last developer imported by an import which didn't finish, if any
+func (store *MemoryStore) PebbleImportCheckpoint(ctx context.Context) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return store.pebbleImportCheckpoint, nil
+}
+
+// ClearPebbleImportCheckpoint forgets the checkpoint of the Pebble developer import, once it is done
+func (store *MemoryStore) ClearPebbleImportCheckpoint(ctx context.Context) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.pebbleImportCheckpoint = ""
+	return nil
+}
+
+// AccountLoginOrRegister attempts to login (or, if the user doesn't yet exist, create a user account)
+// See Handler.AccountLoginOrRegister
+// Returns accessToken, linkToken, errorMessage, error
+func (store *MemoryStore) AccountLoginOrRegister(ctx context.Context, provider string, sub string, name string, email string, linkEmail bool, profile string, ssoAccessToken string, ssoRefreshToken string, expires int64, session SessionMetadata) (string, string, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	identity := memoryProvider{
+		provider:     provider,
+		sub:          sub,
+		profile:      profile,
+		accessToken:  ssoAccessToken,
+		refreshToken: ssoRefreshToken,
+		expires:      expires,
+	}
+
+	var user *memoryUser
+	registered := false
+	if p := store.findProvider(provider, sub); p != nil {
+		user = store.users[p.userId]
+	} else {
+		// User doesn't exist, offer to link this identity to the account with the same e-mail address if there is one
+		if linkEmail && email != "" {
+			var matches []*memoryUser
+			for _, u := range store.users {
+				if !u.pebbleMirror && strings.ToLower(u.email) == strings.ToLower(email) {
+					matches = append(matches, u)
+				}
+			}
+
+			if len(matches) == 1 {
+				identity.userId = matches[0].id
+				pending := &memoryPendingLink{
+					userId:      matches[0].id,
+					provider:    identity,
+					name:        name,
+					email:       email,
+					redirectURI: session.RedirectURI,
+					clientId:    session.ClientId,
+				}
+				return "", store.createPending(pending), "", nil
+			}
+		}
+
+		// Otherwise, create account
+		var err error
+		user, err = store.createAccount(provider, sub, name, email, session.RemoteIp)
+		if err != nil {
+			return "", "", "Internal server error", err
+		}
+		registered = true
+	}
+
+	if user.disabled {
+		store.logLoginAttempt(LoginAttempt{
+			UserId:    user.id,
+			Time:      time.Now(),
+			Reason:    LoginAccountDisabled,
+			Provider:  provider,
+			UserAgent: session.UserAgent,
+			RemoteIp:  session.RemoteIp,
+		})
+		return "", "", "Account is disabled", errors.New("cannot login; account is disabled")
+	}
+
+	identity.userId = user.id
+	err := store.addProvider(identity)
+	if err != nil {
+		return "", "", "Internal server error", err
+	}
+	accessToken := store.createSession(user.id, provider, session)
+
+	if !registered && (user.profileProvider == "" || user.profileProvider == provider) {
+		var fields []string
+		if email != "" && email != user.email {
+			fields = append(fields, "email")
+			user.email = email
+		}
+		if user.syncName && name != "" && name != user.name {
+			fields = append(fields, "name")
+			user.name = name
+		}
+
+		// The user didn't make this change themselves, their identity provider did
+		if len(fields) > 0 {
+			store.audit(AuditEntry{
+				ActorId:  AuditActorSystem,
+				UserId:   user.id,
+				Action:   AuditAccountProfile,
+				After:    auditValues(map[string]interface{}{"fields": fields}),
+				RemoteIp: session.RemoteIp,
+			})
+		}
+	}
+
+	// Logging in cancels the deletion of the account, if it was scheduled
+	if !user.deletionScheduled.IsZero() {
+		store.audit(AuditEntry{
+			ActorId:  user.id,
+			UserId:   user.id,
+			Action:   AuditDeletionCancel,
+			Before:   auditValues(map[string]interface{}{"deletionScheduled": user.deletionScheduled}),
+			RemoteIp: session.RemoteIp,
+		})
+		user.deletionScheduled = time.Time{}
+	}
+
+	store.logLoginAttempt(LoginAttempt{
+		UserId:    user.id,
+		Time:      time.Now(),
+		Success:   true,
+		Reason:    LoginSucceeded,
+		Provider:  provider,
+		UserAgent: session.UserAgent,
+		RemoteIp:  session.RemoteIp,
+	})
+
+	return accessToken, "", "", nil
+}
+
+// DeleteIdleSessions deletes the sessions which weren't used since the given date
+// Returns the number of sessions deleted
+func (store *MemoryStore) DeleteIdleSessions(ctx context.Context, before time.Time) (int64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var count int64
+	for hash, session := range store.sessions {
+		if session.LastUsed.Before(before) {
+			delete(store.sessions, hash)
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// TrimLoginLog deletes the login log entries older than the given date
+// Returns the number of entries deleted
+func (store *MemoryStore) TrimLoginLog(ctx context.Context, before time.Time) (int64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	logins := []LoginAttempt{}
+	for _, attempt := range store.logins {
+		if !attempt.Time.Before(before) {
+			logins = append(logins, attempt)
+		}
+	}
+	count := int64(len(store.logins) - len(logins))
+	store.logins = logins
+
+	return count, nil
+}
+
+// DeleteExpiredPendingLinks deletes the account links and merges which can't be confirmed anymore
+// Returns the number of pending links deleted
+func (store *MemoryStore) DeleteExpiredPendingLinks(ctx context.Context) (int64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var count int64
+	for hash, pending := range store.pending {
+		if time.Since(pending.created) > pendingLinkLifetime {
+			delete(store.pending, hash)
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// AnonymizeIps anonymizes the IP addresses of the sessions created and the login attempts made before the given date
+// Returns the number of sessions and login log entries anonymized
+func (store *MemoryStore) AnonymizeIps(ctx context.Context, before time.Time) (int64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	// Anonymizing an address twice doesn't change it, so only the addresses which change are counted
+	var count int64
+	for _, session := range store.sessions {
+		if ip := common.AnonymizeIp(session.RemoteIp); session.Created.Before(before) && ip != session.RemoteIp {
+			session.RemoteIp = ip
+			count++
+		}
+	}
+	for i := range store.logins {
+		attempt := &store.logins[i]
+		if ip := common.AnonymizeIp(attempt.RemoteIp); attempt.Time.Before(before) && ip != attempt.RemoteIp {
+			attempt.RemoteIp = ip
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// SaveAdminJob creates or updates an admin job
+func (store *MemoryStore) SaveAdminJob(ctx context.Context, job AdminJob) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	job.Log = append([]string{}, job.Log...)
+	for i := range store.jobs {
+		if store.jobs[i].Id == job.Id {
+			job.Name = store.jobs[i].Name
+			job.Created = store.jobs[i].Created
+			job.InstanceId = store.jobs[i].InstanceId
+			store.jobs[i] = job
+			return nil
+		}
+	}
+
+	store.jobs = append(store.jobs, job)
+	return nil
+}
+
+// StartAdminJob saves a new running job, unless a job with the same name is already running. Running jobs whose last
+// heartbeat is older than staleBefore are marked as interrupted first.
+// Returns whether the job was started
+func (store *MemoryStore) StartAdminJob(ctx context.Context, job AdminJob, staleBefore time.Time) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.interruptAdminJobs(job.Name, staleBefore)
+	for _, other := range store.jobs {
+		if other.Name == job.Name && other.Status == JobRunning {
+			return false, nil
+		}
+	}
+
+	job.Status = JobRunning
+	job.Finished = time.Time{}
+	job.Log = append([]string{}, job.Log...)
+	store.jobs = append(store.jobs, job)
+	return true, nil
+}
+
+// HeartbeatAdminJob records that a job is still running along with its progress, unless it already stopped
+func (store *MemoryStore) HeartbeatAdminJob(ctx context.Context, job AdminJob) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for i := range store.jobs {
+		if store.jobs[i].Id == job.Id && store.jobs[i].Status == JobRunning {
+			store.jobs[i].Progress = job.Progress
+			store.jobs[i].Total = job.Total
+			store.jobs[i].Log = append([]string{}, job.Log...)
+			store.jobs[i].Heartbeat = job.Heartbeat
+		}
+	}
+
+	return nil
+}
+
+// AdminJob returns an admin job, and whether it exists
+func (store *MemoryStore) AdminJob(ctx context.Context, id string) (AdminJob, bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for _, job := range store.jobs {
+		if job.Id == id {
+			job.Log = append([]string{}, job.Log...)
+			return job, true, nil
+		}
+	}
+
+	return AdminJob{}, false, nil
+}
+
+// AdminJobs returns the most recent admin jobs, latest first
+func (store *MemoryStore) AdminJobs(ctx context.Context, limit int) ([]AdminJob, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	jobs := []AdminJob{}
+	for i := len(store.jobs) - 1; i >= 0 && len(jobs) < limit; i-- {
+		job := store.jobs[i]
+		job.Log = append([]string{}, job.Log...)
+		jobs = append(jobs, job)
+	}
+
+	return jobs, nil
+}
+
+// InterruptAdminJobs marks the running jobs whose last heartbeat is older than staleBefore as interrupted
+// Returns the number of jobs interrupted
+func (store *MemoryStore) InterruptAdminJobs(ctx context.Context, staleBefore time.Time) (int64, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	return store.interruptAdminJobs("", staleBefore), nil
+}
+
+// interruptAdminJobs marks the running jobs with the given name (or any name if it is empty) whose last heartbeat is
+// older than staleBefore as interrupted, and returns how many there were. The lock must be held.
+func (store *MemoryStore) interruptAdminJobs(name string, staleBefore time.Time) int64 {
+	var count int64
+	for i := range store.jobs {
+		if store.jobs[i].Status == JobRunning && (name == "" || store.jobs[i].Name == name) && store.jobs[i].Heartbeat.Before(staleBefore) {
+			store.jobs[i].Status = JobInterrupted
+			store.jobs[i].Finished = time.Now()
+			count++
+		}
+	}
+
+	return count
+}
+
+// ClaimDeveloper asks for the mirror account of a Pebble developer to be merged into the user's account
+// See Handler.ClaimDeveloper
+func (store *MemoryStore) ClaimDeveloper(ctx context.Context, accessToken string, developerId string, remoteIp string) (DeveloperClaim, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user := store.sessionUser(accessToken)
+	if user == nil {
+		return DeveloperClaim{}, "Invalid access token", nil
+	}
+
+	developer, ok := store.users[developerId]
+	if !ok || !developer.pebbleMirror {
+		return DeveloperClaim{}, "No unclaimed Pebble developer with this ID", nil
+	}
+
+	for _, claim := range store.claims {
+		if claim.UserId == user.id && claim.DeveloperId == developerId && claim.Status == ClaimPending {
+			return claim, "", nil
+		}
+	}
+
+	store.lastClaimId++
+	claim := DeveloperClaim{
+		Id:          store.lastClaimId,
+		UserId:      user.id,
+		DeveloperId: developerId,
+		Token:       "rebble-claim-" + common.GenerateString(32),
+		Status:      ClaimPending,
+		Created:     time.Now(),
+	}
+	store.claims = append(store.claims, claim)
+	store.audit(AuditEntry{
+		ActorId:  user.id,
+		UserId:   user.id,
+		Action:   AuditClaimCreate,
+		After:    auditValues(map[string]interface{}{"claimId": claim.Id, "developerId": developerId}),
+		RemoteIp: remoteIp,
+	})
+
+	return claim, "", nil
+}
+
+// AccountDeveloperClaims returns the developer claims made by the user, latest first
+// Returns (claims []DeveloperClaim, errMessage string, err error)
+func (store *MemoryStore) AccountDeveloperClaims(ctx context.Context, accessToken string) ([]DeveloperClaim, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user := store.sessionUser(accessToken)
+	if user == nil {
+		return []DeveloperClaim{}, "Invalid access token", nil
+	}
+
+	claims := []DeveloperClaim{}
+	for i := len(store.claims) - 1; i >= 0; i-- {
+		if store.claims[i].UserId == user.id {
+			claims = append(claims, store.claims[i])
+		}
+	}
+
+	return claims, "", nil
+}
+
+// DeveloperClaims returns a page of the developer claims with the given status (or all of them), oldest first
+func (store *MemoryStore) DeveloperClaims(ctx context.Context, status string, offset int, limit int) ([]DeveloperClaim, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	claims := []DeveloperClaim{}
+	for _, claim := range store.claims {
+		if status != "" && claim.Status != status {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(claims) == limit {
+			break
+		}
+		claims = append(claims, claim)
+	}
+
+	return claims, nil
+}
+
+// ApproveDeveloperClaim merges the mirror account of a claimed developer into the account of the claimant
+// See Handler.ApproveDeveloperClaim
+func (store *MemoryStore) ApproveDeveloperClaim(ctx context.Context, claimId int64, resolvedBy string, actorId string, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	var claim *DeveloperClaim
+	for i := range store.claims {
+		if store.claims[i].Id == claimId {
+			claim = &store.claims[i]
+		}
+	}
+	if claim == nil {
+		return "No such claim", nil
+	}
+	if claim.Status != ClaimPending {
+		return "This claim was already " + claim.Status, nil
+	}
+
+	developer, ok := store.users[claim.DeveloperId]
+	if !ok || !developer.pebbleMirror {
+		return "This developer was already claimed", nil
+	}
+
+	if store.users[claim.UserId].disabled {
+		return "Account is disabled", nil
+	}
+
+	err := store.mergeAccounts(claim.DeveloperId, claim.UserId, actorId, remoteIp)
+	if err == errDeletionScheduled {
+		return "This developer's account is scheduled for deletion", nil
+	}
+
+	if claimant := store.users[claim.UserId]; claimant.userType == roleUser {
+		claimant.userType = roleDeveloper
+		store.audit(AuditEntry{
+			ActorId:  actorId,
+			UserId:   claim.UserId,
+			Action:   AuditAccountRole,
+			Before:   auditValues(map[string]interface{}{"role": roleUser}),
+			After:    auditValues(map[string]interface{}{"role": roleDeveloper}),
+			RemoteIp: remoteIp,
+		})
+	}
+
+	now := time.Now()
+	for i := range store.claims {
+		other := &store.claims[i]
+		if other.DeveloperId != claim.DeveloperId || other.Status != ClaimPending {
+			continue
+		}
+
+		other.Status = ClaimRejected
+		action := AuditClaimReject
+		if other.Id == claim.Id {
+			other.Status = ClaimApproved
+			action = AuditClaimApprove
+		}
+		other.ResolvedBy = resolvedBy
+		other.Resolved = now
+
+		store.audit(AuditEntry{
+			ActorId:  actorId,
+			UserId:   other.UserId,
+			Action:   action,
+			After:    auditValues(map[string]interface{}{"claimId": other.Id, "developerId": other.DeveloperId, "resolvedBy": resolvedBy}),
+			RemoteIp: remoteIp,
+		})
+	}
+
+	return "", nil
+}
+
+// RejectDeveloperClaim rejects a pending developer claim
+// Returns errorMessage, err
+func (store *MemoryStore) RejectDeveloperClaim(ctx context.Context, claimId int64, actorId string, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for i := range store.claims {
+		claim := &store.claims[i]
+		if claim.Id == claimId && claim.Status == ClaimPending {
+			claim.Status = ClaimRejected
+			claim.ResolvedBy = ClaimByAdmin
+			claim.Resolved = time.Now()
+			store.audit(AuditEntry{
+				ActorId:  actorId,
+				UserId:   claim.UserId,
+				Action:   AuditClaimReject,
+				After:    auditValues(map[string]interface{}{"claimId": claim.Id, "developerId": claim.DeveloperId, "resolvedBy": ClaimByAdmin}),
+				RemoteIp: remoteIp,
+			})
+			return "", nil
+		}
+	}
+
+	return "No such pending claim", nil
+}
+
+// AccountId returns the ID of the user the given access token belongs to
+// Returns (id string, errMessage string, err error)
+func (store *MemoryStore) AccountId(ctx context.Context, accessToken string) (string, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user := store.sessionUser(accessToken)
+	if user == nil {
+		return "", "Invalid access token", nil
+	}
+
+	return user.id, "", nil
+}
+
+// UserExport returns everything stored about a user, except for secrets such as tokens
+// Returns (export UserExport, errMessage string, err error)
+func (store *MemoryStore) UserExport(ctx context.Context, userId string) (UserExport, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user, ok := store.users[userId]
+	if !ok {
+		return UserExport{}, "No such user", nil
+	}
+
+	export := UserExport{
+		Id:                user.id,
+		Name:              user.name,
+		Email:             user.email,
+		Type:              user.userType,
+		PebbleMirror:      user.pebbleMirror,
+		Disabled:          user.disabled,
+		ProfileProvider:   user.profileProvider,
+		SyncName:          user.syncName,
+		DeletionScheduled: user.deletionScheduled,
+		Providers:         []ExportedProvider{},
+		Sessions:          []Session{},
+		Aliases:           []string{},
+		Audits:            []AuditEntry{},
+	}
+
+	for _, p := range store.providers {
+		if p.userId == userId {
+			export.Providers = append(export.Providers, ExportedProvider{
+				Provider: p.provider,
+				Sub:      p.sub,
+				Profile:  p.profile,
+				Expires:  p.expires,
+			})
+		}
+	}
+	sort.Slice(export.Providers, func(i, j int) bool {
+		return export.Providers[i].Provider < export.Providers[j].Provider
+	})
+
+	for _, session := range store.sessions {
+		if session.userId == userId {
+			export.Sessions = append(export.Sessions, session.Session)
+		}
+	}
+	sort.Slice(export.Sessions, func(i, j int) bool {
+		return export.Sessions[i].LastUsed.After(export.Sessions[j].LastUsed)
+	})
+
+	export.Logins = store.loginAttempts(func(attempt LoginAttempt) bool {
+		return attempt.UserId == userId
+	})
+
+	for alias, id := range store.aliases {
+		if id == userId {
+			export.Aliases = append(export.Aliases, alias)
+		}
+	}
+	sort.Strings(export.Aliases)
+
+	for i := len(store.audits) - 1; i >= 0; i-- {
+		if store.audits[i].UserId == userId {
+			export.Audits = append(export.Audits, store.audits[i])
+		}
+	}
+
+	return export, "", nil
+}
+
+// AccountScheduleDeletion schedules the deletion of the account the given access token belongs to
+// See Handler.AccountScheduleDeletion
+// Returns errorMessage, error
+func (store *MemoryStore) AccountScheduleDeletion(ctx context.Context, accessToken string, authenticatedSince time.Time, deletion time.Time, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	session, ok := store.sessions[hashToken(accessToken)]
+	if !ok {
+		return "Invalid access token", nil
+	}
+
+	if session.Created.Before(authenticatedSince) {
+		return "Please log in again to delete your account", nil
+	}
+
+	store.users[session.userId].deletionScheduled = deletion
+	store.audit(AuditEntry{
+		ActorId:  session.userId,
+		UserId:   session.userId,
+		Action:   AuditDeletionSchedule,
+		After:    auditValues(map[string]interface{}{"deletionScheduled": deletion}),
+		RemoteIp: remoteIp,
+	})
+	for hash, s := range store.sessions {
+		if s.userId == session.userId {
+			delete(store.sessions, hash)
+		}
+	}
+
+	return "", nil
+}
+
+// AccountsDueForDeletion returns the IDs of the accounts whose deletion date has passed
+func (store *MemoryStore) AccountsDueForDeletion(ctx context.Context, now time.Time) ([]string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	ids := []string{}
+	for id, user := range store.users {
+		if !user.deletionScheduled.IsZero() && !user.deletionScheduled.After(now) {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// AccountDelete deletes an account along with everything associated to it, provided its deletion is still due, and
+// queues the notifications of the deletion to the given hooks
+// Returns whether the account was deleted
+func (store *MemoryStore) AccountDelete(ctx context.Context, userId string, now time.Time, hookURLs []string) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user, ok := store.users[userId]
+	if !ok || user.deletionScheduled.IsZero() || user.deletionScheduled.After(now) {
+		return false, nil
+	}
+
+	for hash, session := range store.sessions {
+		if session.userId == userId {
+			delete(store.sessions, hash)
+		}
+	}
+	providers := []*memoryProvider{}
+	for _, p := range store.providers {
+		if p.userId != userId {
+			providers = append(providers, p)
+		}
+	}
+	store.providers = providers
+	logins := []LoginAttempt{}
+	for _, attempt := range store.logins {
+		if attempt.UserId != userId {
+			logins = append(logins, attempt)
+		}
+	}
+	store.logins = logins
+	for hash, pending := range store.pending {
+		if pending.userId == userId {
+			delete(store.pending, hash)
+		}
+	}
+	for alias, id := range store.aliases {
+		if id == userId {
+			delete(store.aliases, alias)
+		}
+	}
+	claims := []DeveloperClaim{}
+	for _, claim := range store.claims {
+		if claim.UserId != userId {
+			claims = append(claims, claim)
+		}
+	}
+	store.claims = claims
+	delete(store.users, userId)
+
+	for _, url := range hookURLs {
+		store.lastNotificationId++
+		store.notifications = append(store.notifications, DeletionNotification{
+			Id:          store.lastNotificationId,
+			UserId:      userId,
+			URL:         url,
+			NextAttempt: now,
+		})
+	}
+	store.audit(AuditEntry{
+		ActorId: AuditActorSystem,
+		UserId:  userId,
+		Action:  AuditAccountDelete,
+	})
+
+	return true, nil
+}
+
+// DueDeletionNotifications returns the notifications of deleted accounts which are due to be sent, oldest attempt first
+func (store *MemoryStore) DueDeletionNotifications(ctx context.Context, now time.Time, limit int) ([]DeletionNotification, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	notifications := []DeletionNotification{}
+	for _, notification := range store.notifications {
+		if !notification.NextAttempt.After(now) {
+			notifications = append(notifications, notification)
+		}
+	}
+	sort.SliceStable(notifications, func(i, j int) bool {
+		return notifications[i].NextAttempt.Before(notifications[j].NextAttempt)
+	})
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+	}
+
+	return notifications, nil
+}
+
+// DeletionNotificationDone forgets a deletion notification, once it was sent
+func (store *MemoryStore) DeletionNotificationDone(ctx context.Context, id int64) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for i, notification := range store.notifications {
+		if notification.Id == id {
+			store.notifications = append(store.notifications[:i], store.notifications[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// DeletionNotificationFailed records that sending a deletion notification failed, and when to try again
+func (store *MemoryStore) DeletionNotificationFailed(ctx context.Context, id int64, lastError string, nextAttempt time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for i := range store.notifications {
+		if store.notifications[i].Id == id {
+			store.notifications[i].Attempts++
+			store.notifications[i].LastError = lastError
+			store.notifications[i].NextAttempt = nextAttempt
+		}
+	}
+
+	return nil
+}
+
+// LookupSession returns the session the given access token belongs to along with the state of its user
+// Returns (session SessionUser, errMessage string, err error)
+func (store *MemoryStore) LookupSession(ctx context.Context, accessToken string) (SessionUser, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	session, ok := store.sessions[hashToken(accessToken)]
+	if !ok {
+		return SessionUser{}, "Invalid session", nil
+	}
+	user := store.users[session.userId]
+
+	sessionUser := SessionUser{
+		SessionId: session.Id,
+		UserId:    user.id,
+		Type:      user.userType,
+		Disabled:  user.disabled,
+		LastUsed:  session.LastUsed,
+	}
+
+	expires := sessionUser.Expires(store.SessionIdle)
+	if !expires.IsZero() && time.Now().After(expires) {
+		return SessionUser{}, "Session expired", nil
+	}
+
+	return sessionUser, "", nil
+}
+
+// TouchSession records that a session was used
+func (store *MemoryStore) TouchSession(ctx context.Context, sessionId int64, now time.Time) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	for _, session := range store.sessions {
+		if session.Id == sessionId && now.Sub(session.LastUsed) >= sessionLastUsedPrecision {
+			session.LastUsed = now
+		}
+	}
+
+	return nil
+}
+
+// SessionInformation returns (loggedIn bool, errMessage string, err error) about the current user session
+func (store *MemoryStore) SessionInformation(ctx context.Context, accessToken string) (bool, string, error) {
+	session, errorMessage, err := store.LookupSession(ctx, accessToken)
+	if errorMessage != "" || err != nil {
+		return false, errorMessage, err
+	}
+
+	if session.Disabled {
+		return false, "Account is disabled", nil
+	}
+
+	return true, "", store.TouchSession(ctx, session.SessionId, time.Now())
+}
+
+// AccountSessions lists the sessions of the user the given access token belongs to
+// Returns (sessions []Session, currentSessionId int64, errMessage string, err error)
+func (store *MemoryStore) AccountSessions(ctx context.Context, accessToken string) ([]Session, int64, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	current, ok := store.sessions[hashToken(accessToken)]
+	if !ok {
+		return []Session{}, 0, "Invalid access token", nil
+	}
+
+	sessions := []Session{}
+	for _, session := range store.sessions {
+		if session.userId == current.userId {
+			sessions = append(sessions, session.Session)
+		}
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsed.After(sessions[j].LastUsed)
+	})
+
+	return sessions, current.Id, "", nil
+}
+
+// RevokeSession logs out one of the sessions of the user the given access token belongs to (possibly the current one)
+// Returns errorMessage, error
+func (store *MemoryStore) RevokeSession(ctx context.Context, accessToken string, sessionId int64, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	current, ok := store.sessions[hashToken(accessToken)]
+	if !ok {
+		return "Invalid access token", nil
+	}
+
+	for hash, session := range store.sessions {
+		if session.Id == sessionId && session.userId == current.userId {
+			delete(store.sessions, hash)
+			store.audit(AuditEntry{
+				ActorId:  current.userId,
+				UserId:   current.userId,
+				Action:   AuditSessionRevoke,
+				Before:   auditValues(map[string]interface{}{"sessionId": sessionId}),
+				RemoteIp: remoteIp,
+			})
+			return "", nil
+		}
+	}
+
+	return "No such session", nil
+}
+
+// LogLoginAttempt records a login attempt which failed before reaching the store
+func (store *MemoryStore) LogLoginAttempt(ctx context.Context, attempt LoginAttempt) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	store.logLoginAttempt(attempt)
+
+	return nil
+}
+
+// AccountLogins returns the most recent login attempts of the user the given access token belongs to, latest first
+// Returns (attempts []LoginAttempt, errMessage string, err error)
+func (store *MemoryStore) AccountLogins(ctx context.Context, accessToken string, limit int) ([]LoginAttempt, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user := store.sessionUser(accessToken)
+	if user == nil {
+		return []LoginAttempt{}, "Invalid access token", nil
+	}
+
+	attempts := store.loginAttempts(func(attempt LoginAttempt) bool {
+		return attempt.UserId == user.id
+	})
+	if len(attempts) > limit {
+		attempts = attempts[:limit]
+	}
+
+	return attempts, "", nil
+}
+
+// LoginLog returns a page of the login log, latest first, optionally only for the given user and/or IP address
+func (store *MemoryStore) LoginLog(ctx context.Context, userId string, remoteIp string, offset int, limit int) ([]LoginAttempt, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	attempts := store.loginAttempts(func(attempt LoginAttempt) bool {
+		return (userId == "" || attempt.UserId == userId) && (remoteIp == "" || attempt.RemoteIp == remoteIp)
+	})
+	if offset >= len(attempts) {
+		return []LoginAttempt{}, nil
+	}
+	attempts = attempts[offset:]
+	if len(attempts) > limit {
+		attempts = attempts[:limit]
+	}
+
+	return attempts, nil
+}
+
+// AccountAddProvider attempts to add a provider to a user's account
+// See Handler.AccountAddProvider
+// Returns mergeToken, errorMessage, error
+func (store *MemoryStore) AccountAddProvider(ctx context.Context, provider string, sub string, profile string, rebbleAccessToken string, ssoAccessToken string, ssoRefreshToken string, expires int64, remoteIp string) (string, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user := store.sessionUser(rebbleAccessToken)
+	if user == nil {
+		return "", "Invalid access token", nil
+	}
+
+	if user.disabled {
+		return "", "Account is disabled", errors.New("cannot login; account is disabled")
+	}
+
+	identity := memoryProvider{
+		userId:       user.id,
+		provider:     provider,
+		sub:          sub,
+		profile:      profile,
+		accessToken:  ssoAccessToken,
+		refreshToken: ssoRefreshToken,
+		expires:      expires,
+	}
+
+	err := store.addProvider(identity)
+	if err == errIdentityInUse {
+		mergeUserId := store.findProvider(provider, sub).userId
+		return store.createPending(&memoryPendingLink{userId: user.id, mergeUserId: mergeUserId, provider: identity}), "", nil
+	}
+	if err != nil {
+		return "", "Internal server error", err
+	}
+
+	store.audit(AuditEntry{
+		ActorId:  user.id,
+		UserId:   user.id,
+		Action:   AuditProviderLink,
+		After:    auditValues(map[string]interface{}{"provider": provider, "subHash": auditHash(sub)}),
+		RemoteIp: remoteIp,
+	})
+
+	return "", "", nil
+}
+
+// AccountRemoveProvider attempts to remove a provider from a user's account
+// Returns errorMessage, error
+func (store *MemoryStore) AccountRemoveProvider(ctx context.Context, provider string, rebbleAccessToken string, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	user := store.sessionUser(rebbleAccessToken)
+	if user == nil {
+		return "Invalid access token", nil
+	}
+
+	if len(store.userProviders(user.id)) == 1 {
+		return "Can't remove last identity provider!", errors.New("Can't remove last identity provider")
+	}
+
+	providers := store.providers[:0]
+	for _, p := range store.providers {
+		if p.userId != user.id || p.provider != provider {
+			providers = append(providers, p)
+			continue
+		}
+
+		store.audit(AuditEntry{
+			ActorId:  user.id,
+			UserId:   user.id,
+			Action:   AuditProviderUnlink,
+			Before:   auditValues(map[string]interface{}{"provider": provider, "subHash": auditHash(p.sub)}),
+			RemoteIp: remoteIp,
+		})
+	}
+	store.providers = providers
+
+	// Fall back to keeping the profile in sync with whichever provider the user logs in with
+	if user.profileProvider == provider {
+		user.profileProvider = ""
+	}
+
+	return "", nil
+}
+
+// AccountProviderSessions returns the identities linked to an account, along with their tokens
+func (store *MemoryStore) AccountProviderSessions(ctx context.Context, userId string) ([]ProviderSession, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	sessions := []ProviderSession{}
+	for _, p := range store.providers {
+		if p.userId == userId {
+			sessions = append(sessions, ProviderSession{
+				Provider:     p.provider,
+				Sub:          p.sub,
+				AccessToken:  p.accessToken,
+				RefreshToken: p.refreshToken,
+				Expires:      p.expires,
+			})
+		}
+	}
+
+	return sessions, nil
+}
+
+// AccountConfirmLink links the identity stored in a pending link to the account associated to the given access token
+// See Handler.AccountConfirmLink
+// Returns errorMessage, error
+func (store *MemoryStore) AccountConfirmLink(ctx context.Context, linkToken string, rebbleAccessToken string, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	hash, pending := store.findPending(linkToken, false)
+	if pending == nil {
+		return "Invalid or expired account link request", nil
+	}
+
+	user := store.sessionUser(rebbleAccessToken)
+	if user == nil {
+		return "Invalid access token", nil
+	}
+
+	if user.id != pending.userId {
+		return "You must log in to the account using the same e-mail address to link this identity to it", errors.New("Link confirmed from the wrong account")
+	}
+
+	err := store.addProvider(pending.provider)
+	if err == errIdentityInUse {
+		return "This identity has been linked to another account in the meantime", nil
+	}
+	if err != nil {
+		return "Internal server error", err
+	}
+
+	delete(store.pending, hash)
+	store.audit(AuditEntry{
+		ActorId:  user.id,
+		UserId:   user.id,
+		Action:   AuditProviderLink,
+		After:    auditValues(map[string]interface{}{"provider": pending.provider.provider, "subHash": auditHash(pending.provider.sub)}),
+		RemoteIp: remoteIp,
+	})
+
+	return "", nil
+}
+
+// AccountDeclineLink creates a separate account for the identity stored in a pending link, and logs the user in to it
+// See Handler.AccountDeclineLink
+// Returns accessToken, redirectURI, errorMessage, error
+func (store *MemoryStore) AccountDeclineLink(ctx context.Context, linkToken string, session SessionMetadata) (string, string, string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	hash, pending := store.findPending(linkToken, false)
+	if pending == nil {
+		return "", "", "Invalid or expired account link request", nil
+	}
+	session.ClientId = pending.clientId
+
+	if store.findProvider(pending.provider.provider, pending.provider.sub) != nil {
+		return "", pending.redirectURI, "This identity has been linked to another account in the meantime", nil
+	}
+
+	user, err := store.createAccount(pending.provider.provider, pending.provider.sub, pending.name, pending.email, session.RemoteIp)
+	if err != nil {
+		return "", pending.redirectURI, "Internal server error", err
+	}
+
+	identity := pending.provider
+	identity.userId = user.id
+	err = store.addProvider(identity)
+	if err != nil {
+		return "", pending.redirectURI, "Internal server error", err
+	}
+	accessToken := store.createSession(user.id, identity.provider, session)
+
+	delete(store.pending, hash)
+	store.logLoginAttempt(LoginAttempt{
+		UserId:    user.id,
+		Time:      time.Now(),
+		Success:   true,
+		Reason:    LoginSucceeded,
+		Provider:  identity.provider,
+		UserAgent: session.UserAgent,
+		RemoteIp:  session.RemoteIp,
+	})
+
+	return accessToken, pending.redirectURI, "", nil
+}
+
+// AccountMerge merges the account owning the identity of a pending merge into the account associated to the given
+// access token
+// See Handler.AccountMerge
+// Returns errorMessage, error
+func (store *MemoryStore) AccountMerge(ctx context.Context, mergeToken string, rebbleAccessToken string, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	hash, pending := store.findPending(mergeToken, true)
+	if pending == nil {
+		return "Invalid or expired account merge request", nil
+	}
+
+	user := store.sessionUser(rebbleAccessToken)
+	if user == nil {
+		return "Invalid access token", nil
+	}
+
+	if user.id != pending.userId {
+		return "This merge request was made from another account", errors.New("Merge confirmed from the wrong account")
+	}
+
+	// The identity might have been unlinked or moved since the merge was requested
+	owner := store.findProvider(pending.provider.provider, pending.provider.sub)
+	if owner == nil || owner.userId != pending.mergeUserId {
+		return "The account to merge has changed, please try linking this identity again", nil
+	}
+
+	if user.disabled || store.users[pending.mergeUserId].disabled {
+		return "Account is disabled", errors.New("cannot merge; account is disabled")
+	}
+
+	err := store.mergeAccounts(pending.mergeUserId, user.id, user.id, remoteIp)
+	if err == errDeletionScheduled {
+		return "The account to merge is scheduled for deletion, log in to it to cancel the deletion first", nil
+	}
+
+	identity := pending.provider
+	identity.userId = user.id
+	err = store.addProvider(identity)
+	if err != nil {
+		return "Internal server error", err
+	}
+
+	delete(store.pending, hash)
+	store.audit(AuditEntry{
+		ActorId:  user.id,
+		UserId:   user.id,
+		Action:   AuditAccountMerge,
+		After:    auditValues(map[string]interface{}{"mergedId": pending.mergeUserId, "provider": identity.provider, "subHash": auditHash(identity.sub)}),
+		RemoteIp: remoteIp,
+	})
+
+	return "", nil
+}
+
+// AuditLog returns a page of the audit log, latest first
+// See Handler.AuditLog
+func (store *MemoryStore) AuditLog(ctx context.Context, filter AuditFilter, offset int, limit int) ([]AuditEntry, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	entries := []AuditEntry{}
+	for i := len(store.audits) - 1; i >= 0 && len(entries) < limit; i-- {
+		entry := store.audits[i]
+		if filter.ActorId != "" && entry.ActorId != filter.ActorId {
+			continue
+		}
+		if filter.UserId != "" && entry.UserId != filter.UserId {
+			continue
+		}
+		if strings.HasSuffix(filter.Action, ".") && !strings.HasPrefix(entry.Action, filter.Action) {
+			continue
+		}
+		if filter.Action != "" && !strings.HasSuffix(filter.Action, ".") && entry.Action != filter.Action {
+			continue
+		}
+		if !filter.Since.IsZero() && entry.Time.Before(filter.Since) {
+			continue
+		}
+		if !filter.Until.IsZero() && !entry.Time.Before(filter.Until) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// ProviderStats counts the identities linked with each provider, and the logins made with it since the given time
+// See Handler.ProviderStats
+func (store *MemoryStore) ProviderStats(ctx context.Context, since time.Time) ([]ProviderStats, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	stats := []ProviderStats{}
+	index := make(map[string]int)
+	provider := func(name string) *ProviderStats {
+		i, ok := index[name]
+		if !ok {
+			i = len(stats)
+			index[name] = i
+			stats = append(stats, ProviderStats{Provider: name})
+		}
+
+		return &stats[i]
+	}
+
+	for _, p := range store.providers {
+		provider(p.provider).Identities++
+	}
+	for _, attempt := range store.logins {
+		if attempt.Time.Before(since) {
+			continue
+		}
+
+		p := provider(attempt.Provider)
+		if attempt.Success {
+			p.Logins++
+			if attempt.Time.After(p.LastLogin) {
+				p.LastLogin = attempt.Time
+			}
+		} else {
+			p.FailedLogins++
+		}
+	}
+
+	return stats, nil
+}
+
+// Clients returns the registered clients, ordered by name
+func (store *MemoryStore) Clients(ctx context.Context) ([]Client, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	clients := []Client{}
+	for _, client := range store.clients {
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		if clients[i].Name != clients[j].Name {
+			return clients[i].Name < clients[j].Name
+		}
+		return clients[i].Id < clients[j].Id
+	})
+
+	return clients, nil
+}
+
+// SaveClient registers a client, or updates it if it is already registered
+// Returns errorMessage, err
+func (store *MemoryStore) SaveClient(ctx context.Context, client Client, actorId string, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	now := time.Now()
+	previous, ok := store.clients[client.Id]
+	if !ok {
+		client.Created = now
+		client.Updated = now
+		store.clients[client.Id] = client
+		store.audit(AuditEntry{
+			ActorId:  actorId,
+			Action:   AuditClientCreate,
+			After:    clientValues(client),
+			RemoteIp: remoteIp,
+		})
+		return "", nil
+	}
+
+	if previous.Name == client.Name && previous.Description == client.Description {
+		return "", nil
+	}
+
+	client.Created = previous.Created
+	client.Updated = now
+	store.clients[client.Id] = client
+	store.audit(AuditEntry{
+		ActorId:  actorId,
+		Action:   AuditClientUpdate,
+		Before:   clientValues(previous),
+		After:    clientValues(client),
+		RemoteIp: remoteIp,
+	})
+
+	return "", nil
+}
+
+// DeleteClient unregisters a client
+// Returns errorMessage, err
+func (store *MemoryStore) DeleteClient(ctx context.Context, id string, actorId string, remoteIp string) (string, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	previous, ok := store.clients[id]
+	if !ok {
+		return "No such client", nil
+	}
+
+	delete(store.clients, id)
+	store.audit(AuditEntry{
+		ActorId:  actorId,
+		Action:   AuditClientDelete,
+		Before:   clientValues(previous),
+		RemoteIp: remoteIp,
+	})
+
+	return "", nil
+}
@@ -0,0 +1,219 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"pebble-dev/rebble-auth/common"
+)
+
+// The roles defined by auth, which builds on db and whose constants can't be used here
+const (
+	roleUser      = "user"
+	roleDeveloper = "developer"
+	roleService   = "service"
+	roleModerator = "moderator"
+	roleAdmin     = "admin"
+)
+
+// roleRank returns how privileged a role is, as ordered by auth.Roles. Unknown roles come first.
+func roleRank(role string) int {
+	for i, r := range []string{roleUser, roleDeveloper, roleService, roleModerator, roleAdmin} {
+		if r == role {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// errDeletionScheduled is returned by mergeAccounts when the account to merge is scheduled for deletion: merging it
+// would either silently cancel the deletion its owner asked for, or delete the account it is merged into
+var errDeletionScheduled = errors.New("The account to merge is scheduled for deletion")
+
+// createPendingMerge stores an identity which belongs to another account until the user confirms they want to merge
+// that other account into theirs
+// Returns the merge token which must be presented to confirm the merge
+func createPendingMerge(tx *Tx, userId string, provider string, sub string, profile string, ssoAccessToken string, ssoRefreshToken string, expires int64) (string, error) {
+	var mergeUserId string
+	row := tx.QueryRow("SELECT userId FROM providerSessions WHERE provider=? AND sub=?", provider, sub)
+	err := row.Scan(&mergeUserId)
+	if err != nil {
+		return "", err
+	}
+
+	mergeToken := common.GenerateString(50)
+
+	_, err = tx.Exec("INSERT INTO pendingLinks(token, userId, mergeUserId, provider, sub, profile, accessToken, refreshToken, expires, created) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", hashToken(mergeToken), userId, mergeUserId, provider, sub, profile, ssoAccessToken, ssoRefreshToken, expires, time.Now().UnixNano())
+	if err != nil {
+		return "", err
+	}
+
+	return mergeToken, nil
+}
+
+// mergeAccounts moves the sessions, linked providers and login history of account fromId to account intoId, then
+// deletes fromId. The old ID is kept as an alias of intoId, so that other Rebble services can still resolve data
+// they stored under it. intoId keeps the higher of both roles, which is audited as changed by actorId.
+// Accounts scheduled for deletion can't be merged (see errDeletionScheduled).
+func mergeAccounts(tx *Tx, fromId string, intoId string, actorId string, remoteIp string) error {
+	var fromRole, intoRole string
+	var deletionScheduled int64
+	row := tx.QueryRow("SELECT type, deletionScheduled FROM users WHERE id=?", fromId)
+	err := row.Scan(&fromRole, &deletionScheduled)
+	if err != nil {
+		return err
+	}
+	if deletionScheduled != 0 {
+		return errDeletionScheduled
+	}
+
+	row = tx.QueryRow("SELECT type FROM users WHERE id=?", intoId)
+	err = row.Scan(&intoRole)
+	if err != nil {
+		return err
+	}
+	if roleRank(fromRole) > roleRank(intoRole) {
+		_, err = tx.Exec("UPDATE users SET type=? WHERE id=?", fromRole, intoId)
+		if err != nil {
+			return err
+		}
+
+		err = audit(tx, AuditEntry{
+			ActorId:  actorId,
+			UserId:   intoId,
+			Action:   AuditAccountRole,
+			Before:   auditValues(map[string]interface{}{"role": intoRole}),
+			After:    auditValues(map[string]interface{}{"role": fromRole, "mergedId": fromId}),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	statements := []string{
+		"UPDATE userSessions SET userId=? WHERE userId=?",
+		"UPDATE providerSessions SET userId=? WHERE userId=?",
+		"UPDATE userLoginLog SET userId=? WHERE userId=?",
+		"UPDATE pendingLinks SET userId=? WHERE userId=?",
+		"UPDATE pendingLinks SET mergeUserId=? WHERE mergeUserId=?",
+		"UPDATE userAliases SET userId=? WHERE userId=?",
+		"UPDATE developerClaims SET userId=? WHERE userId=?",
+	}
+	for _, statement := range statements {
+		_, err := tx.Exec(statement, intoId, fromId)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO userAliases(alias, userId, created) VALUES (?, ?, ?)", fromId, intoId, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("DELETE FROM users WHERE id=?", fromId)
+	return err
+}
+
+// AccountMerge merges the account owning the identity of a pending merge into the account associated to the given
+// access token. Having authenticated with that identity proves the user owns the other account.
+// Returns errorMessage, error
+func (handler Handler) AccountMerge(ctx context.Context, mergeToken string, rebbleAccessToken string, remoteIp string) (string, error) {
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		var mergeId int64
+		var linkUserId, mergeUserId, provider, sub, profile, ssoAccessToken, ssoRefreshToken string
+		var expires int64
+		row := tx.QueryRow("SELECT id, userId, mergeUserId, provider, sub, profile, accessToken, refreshToken, expires FROM pendingLinks WHERE token=? AND mergeUserId!='' AND created>?", hashToken(mergeToken), time.Now().Add(-pendingLinkLifetime).UnixNano())
+		err := row.Scan(&mergeId, &linkUserId, &mergeUserId, &provider, &sub, &profile, &ssoAccessToken, &ssoRefreshToken, &expires)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return "Invalid or expired account merge request", nil
+			}
+
+			return "Internal server error", err
+		}
+
+		var userId string
+		disabled := false
+		row = tx.QueryRow("SELECT users.id, users.disabled FROM userSessions JOIN users ON users.id = userSessions.userId WHERE accessToken=?", hashToken(rebbleAccessToken))
+		err = row.Scan(&userId, &disabled)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return "Invalid access token", nil
+			}
+
+			return "Internal server error", err
+		}
+
+		if userId != linkUserId {
+			return "This merge request was made from another account", errors.New("Merge confirmed from the wrong account")
+		}
+
+		// The identity might have been unlinked or moved since the merge was requested
+		var ownerId string
+		mergeDisabled := false
+		row = tx.QueryRow("SELECT users.id, users.disabled FROM providerSessions JOIN users ON users.id = providerSessions.userId WHERE providerSessions.provider=? AND providerSessions.sub=?", provider, sub)
+		err = row.Scan(&ownerId, &mergeDisabled)
+		if err != nil && err != sql.ErrNoRows {
+			return "Internal server error", err
+		}
+		if err == sql.ErrNoRows || ownerId != mergeUserId {
+			return "The account to merge has changed, please try linking this identity again", nil
+		}
+
+		if disabled || mergeDisabled {
+			return "Account is disabled", errors.New("cannot merge; account is disabled")
+		}
+
+		err = mergeAccounts(tx, mergeUserId, userId, userId, remoteIp)
+		if err == errDeletionScheduled {
+			return "The account to merge is scheduled for deletion, log in to it to cancel the deletion first", nil
+		}
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		err = addProvider(tx, provider, sub, userId, profile, ssoAccessToken, ssoRefreshToken, expires)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		err = audit(tx, AuditEntry{
+			ActorId:  userId,
+			UserId:   userId,
+			Action:   AuditAccountMerge,
+			After:    auditValues(map[string]interface{}{"mergedId": mergeUserId, "provider": provider, "subHash": auditHash(sub)}),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		_, err = tx.Exec("DELETE FROM pendingLinks WHERE id=?", mergeId)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+}
+
+// ResolveAlias returns the current ID of an account, following aliases left behind by merged accounts
+// Returns (id string, errMessage string, err error)
+func (handler Handler) ResolveAlias(ctx context.Context, id string) (string, string, error) {
+	var userId string
+	row := handler.QueryRow(ctx, "SELECT id FROM users WHERE id=? UNION SELECT userId FROM userAliases WHERE alias=?", id, id)
+	err := row.Scan(&userId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", "No user with this ID", nil
+		}
+		return "", "Internal Server Error", err
+	}
+
+	return userId, "", nil
+}
@@ -0,0 +1,221 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// requestMerge makes alice link bob's identity of the "other" provider, and returns the merge token
+func requestMerge(t *testing.T, store Store, aliceToken string) string {
+	t.Helper()
+
+	mergeToken, errorMessage, err := store.AccountAddProvider(context.Background(), "other", "bob", "{}", aliceToken, "", "", 0, "")
+	if errorMessage != "" || err != nil {
+		t.Fatalf("Could not add provider: %v (%v)", errorMessage, err)
+	}
+	if mergeToken == "" {
+		t.Fatalf("Linking an identity of another account didn't return a merge token")
+	}
+
+	return mergeToken
+}
+
+func TestAddProviderWithoutMerge(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		mergeToken, errorMessage, err := store.AccountAddProvider(context.Background(), "other", "alice", "{}", aliceToken, "", "", 0, "")
+		if mergeToken != "" || errorMessage != "" || err != nil {
+			t.Fatalf("AccountAddProvider() = %q, %q, %v, expected the identity to be linked", mergeToken, errorMessage, err)
+		}
+
+		_, _, providers := accountProviders(t, store, aliceToken)
+		if len(providers) != 2 {
+			t.Errorf("Expected 2 identities linked to the account, got %v", providers)
+		}
+	})
+}
+
+func TestMerge(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		aliceId := testUserId(t, store, aliceToken)
+		bobToken, _ := loginOther(t, store, "bob", "Bob", "bob@example.com")
+		bobId := testUserId(t, store, bobToken)
+
+		mergeToken := requestMerge(t, store, aliceToken)
+
+		// Nothing changes until the merge is confirmed
+		if testUserId(t, store, bobToken) != bobId {
+			t.Fatalf("The accounts were merged before the merge was confirmed")
+		}
+
+		errorMessage, err := store.AccountMerge(ctx, mergeToken, aliceToken, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not merge accounts: %v (%v)", errorMessage, err)
+		}
+
+		// The sessions, identities and login history of bob's account now belong to alice's
+		if testUserId(t, store, bobToken) != aliceId {
+			t.Errorf("The sessions of the merged account weren't moved")
+		}
+
+		name, _, providers := accountProviders(t, store, aliceToken)
+		if name != "Alice" || len(providers) != 2 {
+			t.Errorf("Got %v with providers %v, expected Alice with 2 providers", name, providers)
+		}
+
+		logins, err := store.LoginLog(ctx, aliceId, "", 0, 10)
+		if err != nil || len(logins) != 2 {
+			t.Errorf("Expected the login history of both accounts, got %+v (%v)", logins, err)
+		}
+
+		// Other services can still find the account under the old ID
+		userId, errorMessage, err := store.ResolveAlias(ctx, bobId)
+		if userId != aliceId || errorMessage != "" || err != nil {
+			t.Errorf("ResolveAlias(bobId) = %q, %q, %v, expected alice's ID", userId, errorMessage, err)
+		}
+
+		userId, _, _ = store.ResolveAlias(ctx, aliceId)
+		if userId != aliceId {
+			t.Errorf("ResolveAlias(aliceId) = %q, expected alice's ID", userId)
+		}
+
+		// The merge token can only be used once
+		errorMessage, _ = store.AccountMerge(ctx, mergeToken, aliceToken, "")
+		if errorMessage == "" {
+			t.Errorf("Two accounts were merged twice")
+		}
+	})
+}
+
+func TestMergeFromAnotherAccount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		bobToken, _ := loginOther(t, store, "bob", "Bob", "bob@example.com")
+		bobId := testUserId(t, store, bobToken)
+		mergeToken := requestMerge(t, store, aliceToken)
+
+		carolToken := testLogin(t, store, "carol", "Carol", "carol@example.com")
+		errorMessage, _ := store.AccountMerge(context.Background(), mergeToken, carolToken, "")
+		if errorMessage == "" {
+			t.Errorf("A merge was confirmed from another account")
+		}
+
+		if testUserId(t, store, bobToken) != bobId {
+			t.Errorf("The accounts were merged by another account")
+		}
+	})
+}
+
+func TestMergeOfChangedAccount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		bobToken, _ := loginOther(t, store, "bob", "Bob", "bob@example.com")
+		mergeToken := requestMerge(t, store, aliceToken)
+
+		// bob unlinks the identity before alice confirms the merge
+		_, errorMessage, err := store.AccountAddProvider(ctx, "test", "bob", "{}", bobToken, "", "", 0, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not add provider: %v (%v)", errorMessage, err)
+		}
+		errorMessage, err = store.AccountRemoveProvider(ctx, "other", bobToken, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not remove provider: %v (%v)", errorMessage, err)
+		}
+
+		errorMessage, _ = store.AccountMerge(ctx, mergeToken, aliceToken, "")
+		if errorMessage == "" {
+			t.Errorf("An account was merged after the identity was unlinked from it")
+		}
+	})
+}
+
+func TestResolveUnknownAlias(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		userId, errorMessage, err := store.ResolveAlias(context.Background(), "unknown")
+		if userId != "" || errorMessage == "" || err != nil {
+			t.Errorf("ResolveAlias(\"unknown\") = %q, %q, %v, expected no user", userId, errorMessage, err)
+		}
+	})
+}
+
+func TestMergeKeepsHigherRole(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		aliceId := testUserId(t, store, aliceToken)
+		bobToken, _ := loginOther(t, store, "bob", "Bob", "bob@example.com")
+		errorMessage, err := store.SetUserRole(ctx, testUserId(t, store, bobToken), "moderator", AuditActorAdmin, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not set role: %v (%v)", errorMessage, err)
+		}
+
+		errorMessage, err = store.AccountMerge(ctx, requestMerge(t, store, aliceToken), aliceToken, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not merge accounts: %v (%v)", errorMessage, err)
+		}
+
+		session, _, _ := store.LookupSession(ctx, aliceToken)
+		if session.Type != "moderator" {
+			t.Errorf("Got role %q, expected alice to get the role of the merged account", session.Type)
+		}
+
+		entries, err := store.AuditLog(ctx, AuditFilter{UserId: aliceId, Action: AuditAccountRole}, 0, 10)
+		if err != nil || len(entries) != 1 || entries[0].ActorId != aliceId {
+			t.Errorf("Got audit log entries %+v (%v), expected the role change to be audited", entries, err)
+		}
+	})
+}
+
+func TestMergeKeepsRoleOfAccount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		errorMessage, err := store.SetUserRole(ctx, testUserId(t, store, aliceToken), "admin", AuditActorAdmin, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not set role: %v (%v)", errorMessage, err)
+		}
+		loginOther(t, store, "bob", "Bob", "bob@example.com")
+
+		errorMessage, err = store.AccountMerge(ctx, requestMerge(t, store, aliceToken), aliceToken, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not merge accounts: %v (%v)", errorMessage, err)
+		}
+
+		session, _, _ := store.LookupSession(ctx, aliceToken)
+		if session.Type != "admin" {
+			t.Errorf("Got role %q, expected alice to stay an admin", session.Type)
+		}
+	})
+}
+
+func TestMergeAccountScheduledForDeletion(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		bobToken, _ := loginOther(t, store, "bob", "Bob", "bob@example.com")
+		bobId := testUserId(t, store, bobToken)
+		mergeToken := requestMerge(t, store, aliceToken)
+
+		now := time.Now()
+		errorMessage, err := store.AccountScheduleDeletion(ctx, bobToken, now.Add(-time.Hour), now.Add(time.Hour), "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not schedule deletion: %v (%v)", errorMessage, err)
+		}
+
+		// The deletion bob asked for is neither cancelled nor carried over to alice's account
+		errorMessage, err = store.AccountMerge(ctx, mergeToken, aliceToken, "")
+		if errorMessage == "" || err != nil {
+			t.Errorf("AccountMerge() = %q, %v, expected the merge to be refused", errorMessage, err)
+		}
+
+		userId, _, _ := store.ResolveAlias(ctx, bobId)
+		if userId != bobId {
+			t.Errorf("ResolveAlias(bobId) = %q, expected bob's account to be left alone", userId)
+		}
+	})
+}
@@ -0,0 +1,702 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration is a forward-only change to the database schema. It runs Go code for changes which can't be expressed in
+// SQL alone (such as repairing data before a constraint is added), then the SQL statements written for the database's
+// dialect.
+type migration struct {
+	version     int
+	description string
+	sqlite      string
+	postgres    string
+	apply       func(tx *Tx) error
+}
+
+// migrations lists all schema changes, in order. A migration must never be modified once it has been released; any
+// further change to the schema needs a new migration instead.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Initial schema",
+		// The schema created by the old /admin/rebuild/db; `if not exists` allows its databases to be adopted as-is
+		sqlite: `
+			create table if not exists users (
+				id text not null primary key,
+				name text not null,
+				email text not null,
+				type text not null default 'user',
+				pebbleMirror integer not null,
+				disabled integer not null
+			);
+
+			create table if not exists userSessions (
+				id integer not null primary key,
+				userId text not null,
+				accessToken text not null
+			);
+
+			create table if not exists providerSessions (
+				id integer not null primary key,
+				userId text not null,
+				provider text not null,
+				sub text not null,
+				accessToken text not null,
+				refreshToken text not null,
+				expires integer not null
+			);
+
+			create table if not exists userLoginLog (
+				id integer not null primary key,
+				userId text not null,
+				remoteIp text not null,
+				time integer not null,
+				success integer not null
+			);
+		`,
+		postgres: `
+			create table if not exists users (
+				id text not null primary key,
+				name text not null,
+				email text not null,
+				type text not null default 'user',
+				pebbleMirror integer not null,
+				disabled integer not null
+			);
+
+			create table if not exists userSessions (
+				id bigserial primary key,
+				userId text not null,
+				accessToken text not null
+			);
+
+			create table if not exists providerSessions (
+				id bigserial primary key,
+				userId text not null,
+				provider text not null,
+				sub text not null,
+				accessToken text not null,
+				refreshToken text not null,
+				expires bigint not null
+			);
+
+			create table if not exists userLoginLog (
+				id bigserial primary key,
+				userId text not null,
+				remoteIp text not null,
+				time bigint not null,
+				success integer not null
+			);
+		`,
+	},
+	{
+		version:     2,
+		description: "Account linking and profile sync",
+		sqlite: `
+			alter table users add column profileProvider text not null default '';
+			alter table users add column syncName integer not null default 0;
+			alter table providerSessions add column profile text not null default '{}';
+
+			create table pendingLinks (
+				id integer not null primary key,
+				token text not null,
+				userId text not null,
+				mergeUserId text not null default '',
+				provider text not null,
+				sub text not null,
+				name text not null default '',
+				email text not null default '',
+				profile text not null default '{}',
+				accessToken text not null,
+				refreshToken text not null,
+				expires integer not null,
+				redirectUri text not null default '',
+				created integer not null
+			);
+
+			create table userAliases (
+				alias text not null primary key,
+				userId text not null,
+				created integer not null
+			);
+		`,
+		postgres: `
+			alter table users add column profileProvider text not null default '';
+			alter table users add column syncName integer not null default 0;
+			alter table providerSessions add column profile text not null default '{}';
+
+			create table pendingLinks (
+				id bigserial primary key,
+				token text not null,
+				userId text not null,
+				mergeUserId text not null default '',
+				provider text not null,
+				sub text not null,
+				name text not null default '',
+				email text not null default '',
+				profile text not null default '{}',
+				accessToken text not null,
+				refreshToken text not null,
+				expires bigint not null,
+				redirectUri text not null default '',
+				created bigint not null
+			);
+
+			create table userAliases (
+				alias text not null primary key,
+				userId text not null,
+				created bigint not null
+			);
+		`,
+	},
+	{
+		version:     3,
+		description: "Hash plaintext session tokens",
+		apply:       hashSessionTokens,
+	},
+	{
+		version:     4,
+		description: "Constraints, indexes and foreign keys",
+		apply:       repairIntegrity,
+		// SQLite can't add constraints to existing tables, so they have to be rebuilt
+		sqlite: `
+			create table userSessions_new (
+				id integer not null primary key,
+				userId text not null references users(id) on delete cascade,
+				accessToken text not null unique
+			);
+			insert into userSessions_new(id, userId, accessToken) select id, userId, accessToken from userSessions;
+			drop table userSessions;
+			alter table userSessions_new rename to userSessions;
+
+			create table providerSessions_new (
+				id integer not null primary key,
+				userId text not null references users(id) on delete cascade,
+				provider text not null,
+				sub text not null,
+				profile text not null default '{}',
+				accessToken text not null,
+				refreshToken text not null,
+				expires integer not null,
+				unique (provider, sub)
+			);
+			insert into providerSessions_new(id, userId, provider, sub, profile, accessToken, refreshToken, expires) select id, userId, provider, sub, profile, accessToken, refreshToken, expires from providerSessions;
+			drop table providerSessions;
+			alter table providerSessions_new rename to providerSessions;
+
+			create table userLoginLog_new (
+				id integer not null primary key,
+				userId text not null references users(id) on delete cascade,
+				remoteIp text not null,
+				time integer not null,
+				success integer not null
+			);
+			insert into userLoginLog_new(id, userId, remoteIp, time, success) select id, userId, remoteIp, time, success from userLoginLog;
+			drop table userLoginLog;
+			alter table userLoginLog_new rename to userLoginLog;
+
+			create table pendingLinks_new (
+				id integer not null primary key,
+				token text not null unique,
+				userId text not null references users(id) on delete cascade,
+				mergeUserId text not null default '',
+				provider text not null,
+				sub text not null,
+				name text not null default '',
+				email text not null default '',
+				profile text not null default '{}',
+				accessToken text not null,
+				refreshToken text not null,
+				expires integer not null,
+				redirectUri text not null default '',
+				created integer not null
+			);
+			insert into pendingLinks_new(id, token, userId, mergeUserId, provider, sub, name, email, profile, accessToken, refreshToken, expires, redirectUri, created) select id, token, userId, mergeUserId, provider, sub, name, email, profile, accessToken, refreshToken, expires, redirectUri, created from pendingLinks;
+			drop table pendingLinks;
+			alter table pendingLinks_new rename to pendingLinks;
+
+			create table userAliases_new (
+				alias text not null primary key,
+				userId text not null references users(id) on delete cascade,
+				created integer not null
+			);
+			insert into userAliases_new(alias, userId, created) select alias, userId, created from userAliases;
+			drop table userAliases;
+			alter table userAliases_new rename to userAliases;
+
+			create index users_email on users(lower(email));
+			create index userSessions_userId on userSessions(userId);
+			create index providerSessions_userId on providerSessions(userId);
+			create index userLoginLog_userId on userLoginLog(userId, time);
+			create index pendingLinks_created on pendingLinks(created);
+			create index userAliases_userId on userAliases(userId);
+		`,
+		postgres: `
+			alter table userSessions add constraint userSessions_userId_fkey foreign key (userId) references users(id) on delete cascade;
+			alter table userSessions add constraint userSessions_accessToken_key unique (accessToken);
+
+			alter table providerSessions add constraint providerSessions_userId_fkey foreign key (userId) references users(id) on delete cascade;
+			alter table providerSessions add constraint providerSessions_provider_sub_key unique (provider, sub);
+
+			alter table userLoginLog add constraint userLoginLog_userId_fkey foreign key (userId) references users(id) on delete cascade;
+
+			alter table pendingLinks add constraint pendingLinks_userId_fkey foreign key (userId) references users(id) on delete cascade;
+			alter table pendingLinks add constraint pendingLinks_token_key unique (token);
+
+			alter table userAliases add constraint userAliases_userId_fkey foreign key (userId) references users(id) on delete cascade;
+
+			create index users_email on users(lower(email));
+			create index userSessions_userId on userSessions(userId);
+			create index providerSessions_userId on providerSessions(userId);
+			create index userLoginLog_userId on userLoginLog(userId, time);
+			create index pendingLinks_created on pendingLinks(created);
+			create index userAliases_userId on userAliases(userId);
+		`,
+	},
+	{
+		version:     5,
+		description: "Session metadata",
+		sqlite: `
+			alter table userSessions add column created integer not null default 0;
+			alter table userSessions add column lastUsed integer not null default 0;
+			alter table userSessions add column clientId text not null default '';
+			alter table userSessions add column userAgent text not null default '';
+			alter table userSessions add column remoteIp text not null default '';
+			alter table userSessions add column provider text not null default '';
+			alter table pendingLinks add column clientId text not null default '';
+		`,
+		postgres: `
+			alter table userSessions add column created bigint not null default 0;
+			alter table userSessions add column lastUsed bigint not null default 0;
+			alter table userSessions add column clientId text not null default '';
+			alter table userSessions add column userAgent text not null default '';
+			alter table userSessions add column remoteIp text not null default '';
+			alter table userSessions add column provider text not null default '';
+			alter table pendingLinks add column clientId text not null default '';
+		`,
+	},
+	{
+		version:     6,
+		description: "Failed logins",
+		// Failed login attempts don't always belong to a known user, so userId becomes nullable
+		sqlite: `
+			create table userLoginLog_new (
+				id integer not null primary key,
+				userId text references users(id) on delete cascade,
+				remoteIp text not null,
+				time integer not null,
+				success integer not null,
+				reason text not null default '',
+				provider text not null default '',
+				userAgent text not null default ''
+			);
+			insert into userLoginLog_new(id, userId, remoteIp, time, success) select id, userId, remoteIp, time, success from userLoginLog;
+			drop table userLoginLog;
+			alter table userLoginLog_new rename to userLoginLog;
+
+			update userLoginLog set reason='success' where success=1;
+			create index userLoginLog_userId on userLoginLog(userId, time);
+			create index userLoginLog_remoteIp on userLoginLog(remoteIp, time);
+		`,
+		postgres: `
+			alter table userLoginLog alter column userId drop not null;
+			alter table userLoginLog add column reason text not null default '';
+			alter table userLoginLog add column provider text not null default '';
+			alter table userLoginLog add column userAgent text not null default '';
+
+			update userLoginLog set reason='success' where success=1;
+			create index userLoginLog_remoteIp on userLoginLog(remoteIp, time);
+		`,
+	},
+	{
+		version:     7,
+		description: "Account deletion",
+		// Deletion notifications don't reference users, as they are sent once the account is gone
+		sqlite: `
+			alter table users add column deletionScheduled integer not null default 0;
+			create index users_deletionScheduled on users(deletionScheduled);
+
+			create table deletionNotifications (
+				id integer not null primary key,
+				userId text not null,
+				url text not null,
+				created integer not null,
+				attempts integer not null default 0,
+				nextAttempt integer not null,
+				lastError text not null default ''
+			);
+			create index deletionNotifications_nextAttempt on deletionNotifications(nextAttempt);
+		`,
+		postgres: `
+			alter table users add column deletionScheduled bigint not null default 0;
+			create index users_deletionScheduled on users(deletionScheduled);
+
+			create table deletionNotifications (
+				id bigserial primary key,
+				userId text not null,
+				url text not null,
+				created bigint not null,
+				attempts integer not null default 0,
+				nextAttempt bigint not null,
+				lastError text not null default ''
+			);
+			create index deletionNotifications_nextAttempt on deletionNotifications(nextAttempt);
+		`,
+	},
+	{
+		version:     8,
+		description: "Retention",
+		apply:       startSessionRetention,
+		sqlite: `
+			alter table userSessions add column ipAnonymized integer not null default 0;
+			alter table userLoginLog add column ipAnonymized integer not null default 0;
+			create index userSessions_lastUsed on userSessions(lastUsed);
+			create index userLoginLog_time on userLoginLog(time);
+		`,
+		postgres: `
+			alter table userSessions add column ipAnonymized integer not null default 0;
+			alter table userLoginLog add column ipAnonymized integer not null default 0;
+			create index userSessions_lastUsed on userSessions(lastUsed);
+			create index userLoginLog_time on userLoginLog(time);
+		`,
+	},
+	{
+		version:     9,
+		description: "Incremental Pebble developer import",
+		// Mirrors used to be created with the 'users' type, which isn't a type
+		sqlite: `
+			create table importCheckpoints (
+				name text not null primary key,
+				cursor text not null,
+				updated integer not null
+			);
+			update users set type='user' where type='users' and pebbleMirror=1;
+		`,
+		postgres: `
+			create table importCheckpoints (
+				name text not null primary key,
+				cursor text not null,
+				updated bigint not null
+			);
+			update users set type='user' where type='users' and pebbleMirror=1;
+		`,
+	},
+	{
+		version:     10,
+		description: "Admin jobs",
+		// Only one job of a given name can run at once, whichever instance of rebble-auth runs it
+		sqlite: `
+			create table adminJobs (
+				id text not null primary key,
+				name text not null,
+				status text not null,
+				progress integer not null default 0,
+				total integer not null default 0,
+				log text not null default '',
+				result text not null default '',
+				error text not null default '',
+				created integer not null,
+				finished integer not null default 0,
+				instanceId text not null default '',
+				heartbeat integer not null default 0
+			);
+			create index adminJobs_created on adminJobs(created);
+			create unique index adminJobs_running on adminJobs(name) where status='running';
+		`,
+		postgres: `
+			create table adminJobs (
+				id text not null primary key,
+				name text not null,
+				status text not null,
+				progress integer not null default 0,
+				total integer not null default 0,
+				log text not null default '',
+				result text not null default '',
+				error text not null default '',
+				created bigint not null,
+				finished bigint not null default 0,
+				instanceId text not null default '',
+				heartbeat bigint not null default 0
+			);
+			create index adminJobs_created on adminJobs(created);
+			create unique index adminJobs_running on adminJobs(name) where status='running';
+		`,
+	},
+	{
+		version:     11,
+		description: "Developer claims",
+		// developerId doesn't reference users, as the mirror is deleted once it is merged into the claimant's account
+		sqlite: `
+			create table developerClaims (
+				id integer not null primary key,
+				userId text not null references users(id) on delete cascade,
+				developerId text not null,
+				token text not null unique,
+				status text not null,
+				resolvedBy text not null default '',
+				created integer not null,
+				resolved integer not null default 0
+			);
+			create index developerClaims_userId on developerClaims(userId);
+			create index developerClaims_developerId on developerClaims(developerId);
+			create index developerClaims_status on developerClaims(status, created);
+		`,
+		postgres: `
+			create table developerClaims (
+				id bigserial primary key,
+				userId text not null references users(id) on delete cascade,
+				developerId text not null,
+				token text not null unique,
+				status text not null,
+				resolvedBy text not null default '',
+				created bigint not null,
+				resolved bigint not null default 0
+			);
+			create index developerClaims_userId on developerClaims(userId);
+			create index developerClaims_developerId on developerClaims(developerId);
+			create index developerClaims_status on developerClaims(status, created);
+		`,
+	},
+	{
+		version:     12,
+		description: "Audit log",
+		// The audit log is append-only, and outlives the accounts it is about
+		sqlite: `
+			create table auditLog (
+				id integer not null primary key,
+				time integer not null,
+				actorId text not null,
+				userId text not null default '',
+				action text not null,
+				oldValue text not null default '',
+				newValue text not null default '',
+				remoteIp text not null default ''
+			);
+			create index auditLog_time on auditLog(time);
+			create index auditLog_actorId on auditLog(actorId, time);
+			create index auditLog_userId on auditLog(userId, time);
+			create index auditLog_action on auditLog(action, time);
+
+			create trigger auditLog_noUpdate before update on auditLog begin
+				select raise(abort, 'auditLog is append-only');
+			end;
+			create trigger auditLog_noDelete before delete on auditLog begin
+				select raise(abort, 'auditLog is append-only');
+			end;
+		`,
+		postgres: `
+			create table auditLog (
+				id bigserial primary key,
+				time bigint not null,
+				actorId text not null,
+				userId text not null default '',
+				action text not null,
+				oldValue text not null default '',
+				newValue text not null default '',
+				remoteIp text not null default ''
+			);
+			create index auditLog_time on auditLog(time);
+			create index auditLog_actorId on auditLog(actorId, time);
+			create index auditLog_userId on auditLog(userId, time);
+			create index auditLog_action on auditLog(action, time);
+
+			create function auditLog_appendOnly() returns trigger as $$
+			begin
+				raise exception 'auditLog is append-only';
+			end;
+			$$ language plpgsql;
+			create trigger auditLog_noChange before update or delete on auditLog
+				for each row execute procedure auditLog_appendOnly();
+		`,
+	},
+	{
+		version:     13,
+		description: "Registered clients",
+		// Clients are identified the same way as in userSessions.clientId: by the origin of their redirect URI
+		sqlite: `
+			create table clients (
+				id text not null primary key,
+				name text not null,
+				description text not null default '',
+				created integer not null,
+				updated integer not null
+			);
+		`,
+		postgres: `
+			create table clients (
+				id text primary key,
+				name text not null,
+				description text not null default '',
+				created bigint not null,
+				updated bigint not null
+			);
+		`,
+	},
+}
+
+// LatestSchemaVersion is the schema version this build of rebble-auth expects
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the current version of the database schema, or 0 if no migration was ever run
+func (handler Handler) SchemaVersion() (int, error) {
+	_, err := handler.Exec(context.Background(), "CREATE TABLE IF NOT EXISTS schema_migrations (version integer not null primary key, description text not null, applied bigint not null)")
+	if err != nil {
+		return 0, err
+	}
+
+	var version sql.NullInt64
+	row := handler.QueryRow(context.Background(), "SELECT MAX(version) FROM schema_migrations")
+	err = row.Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	return int(version.Int64), nil
+}
+
+// Migrate brings the database schema up to date by running every migration it hasn't seen yet, each in its own
+// transaction. It refuses to touch a database whose schema is newer than this build, as it was most likely upgraded
+// by a newer version of rebble-auth.
+// Returns the number of migrations run
+func (handler Handler) Migrate() (int, error) {
+	version, err := handler.SchemaVersion()
+	if err != nil {
+		return 0, fmt.Errorf("Could not get schema version: %v", err)
+	}
+
+	if version > LatestSchemaVersion() {
+		return 0, fmt.Errorf("Database schema version %v is newer than the latest version known to this build (%v)", version, LatestSchemaVersion())
+	}
+
+	count := 0
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		err = handler.runMigration(m)
+		if err != nil {
+			return count, fmt.Errorf("Could not run migration %v (%v): %v", m.version, m.description, err)
+		}
+		count++
+	}
+
+	return count, nil
+}
+
+func (handler Handler) runMigration(m migration) error {
+	// Migrations can take a while on large databases, so they aren't subject to the query timeout
+	tx, err := handler.begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.apply != nil {
+		err = m.apply(tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	statements := m.sqlite
+	if handler.driver == Postgres {
+		statements = m.postgres
+	}
+
+	if statements != "" {
+		_, err = tx.Exec(statements)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec("INSERT INTO schema_migrations(version, description, applied) VALUES (?, ?, ?)", m.version, m.description, time.Now().UnixNano())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// hashSessionTokens replaces any plaintext access token left in the database (from before tokens were hashed) with
+// its hash. Existing sessions keep working, as lookups are always done using the hash of the token presented by the
+// user.
+func hashSessionTokens(tx *Tx) error {
+	// Hashes are always 64 hex characters long, while generated tokens are 50 characters long
+	rows, err := tx.Query("SELECT id, accessToken FROM userSessions WHERE length(accessToken) != 64")
+	if err != nil {
+		return err
+	}
+
+	tokens := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var accessToken string
+		err = rows.Scan(&id, &accessToken)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		tokens[id] = accessToken
+	}
+	rows.Close()
+
+	for id, accessToken := range tokens {
+		_, err = tx.Exec("UPDATE userSessions SET accessToken=? WHERE id=?", hashToken(accessToken), id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startSessionRetention pretends sessions created before their use was recorded (migration 5) were last used now, so
+// that they aren't all deleted as idle right away
+func startSessionRetention(tx *Tx) error {
+	_, err := tx.Exec("UPDATE userSessions SET lastUsed=? WHERE lastUsed=0", time.Now().UnixNano())
+	return err
+}
+
+// repairIntegrity removes the rows which would violate the constraints added by migration 4: duplicate identities and
+// session tokens, as well as rows referencing accounts which don't exist anymore. Everything it does is logged.
+func repairIntegrity(tx *Tx) error {
+	repairs := []struct {
+		description string
+		statement   string
+	}{
+		// When an identity was added several times, the latest row holds the freshest tokens
+		{"duplicate provider sessions", "DELETE FROM providerSessions WHERE id NOT IN (SELECT MAX(id) FROM providerSessions GROUP BY provider, sub)"},
+		{"duplicate user sessions", "DELETE FROM userSessions WHERE id NOT IN (SELECT MAX(id) FROM userSessions GROUP BY accessToken)"},
+		{"duplicate pending links", "DELETE FROM pendingLinks WHERE id NOT IN (SELECT MAX(id) FROM pendingLinks GROUP BY token)"},
+		{"orphaned user sessions", "DELETE FROM userSessions WHERE userId NOT IN (SELECT id FROM users)"},
+		{"orphaned provider sessions", "DELETE FROM providerSessions WHERE userId NOT IN (SELECT id FROM users)"},
+		{"orphaned login log entries", "DELETE FROM userLoginLog WHERE userId NOT IN (SELECT id FROM users)"},
+		{"orphaned pending links", "DELETE FROM pendingLinks WHERE userId NOT IN (SELECT id FROM users) OR (mergeUserId != '' AND mergeUserId NOT IN (SELECT id FROM users))"},
+		{"orphaned user aliases", "DELETE FROM userAliases WHERE userId NOT IN (SELECT id FROM users)"},
+	}
+
+	for _, repair := range repairs {
+		result, err := tx.Exec(repair.statement)
+		if err != nil {
+			return fmt.Errorf("Could not remove %v: %v", repair.description, err)
+		}
+
+		count, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		log.Printf("Integrity repair: removed %v %v", count, repair.description)
+	}
+
+	return nil
+}
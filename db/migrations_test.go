@@ -0,0 +1,191 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+// baselineSchema is the schema created by the old /admin/rebuild/db, typo included
+const baselineSchema = `
+	create table users (
+		id text not null primary key,
+		name text not null,
+		email text not null,
+		type text nont null default 'user',
+		pebbleMirror integer not null,
+		disabled integer not null
+	);
+
+	create table userSessions (
+		id integer not null primary key,
+		userId text not null,
+		accessToken text not null
+	);
+
+	create table providerSessions (
+		id integer not null primary key,
+		userId text not null,
+		provider text not null,
+		sub text not null,
+		accessToken text not null,
+		refreshToken text not null,
+		expires integer not null
+	);
+
+	create table userLoginLog (
+		id integer not null primary key,
+		userId text not null,
+		remoteIp text not null,
+		time integer not null,
+		success integer not null
+	);
+`
+
+// openBaselineHandler returns a Handler for a SQLite database with the baseline schema and the given rows, which
+// hasn't been migrated yet
+func openBaselineHandler(t *testing.T, data string) Handler {
+	t.Helper()
+
+	handler := openTestDatabase(t, SQLite)
+	_, err := handler.Exec(context.Background(), baselineSchema+data)
+	if err != nil {
+		t.Fatalf("Could not create baseline schema: %v", err)
+	}
+
+	return handler
+}
+
+func TestMigrateBaselineDatabase(t *testing.T) {
+	ctx := context.Background()
+	handler := openBaselineHandler(t, `
+		insert into users(id, name, email, pebbleMirror, disabled) values ('alice', 'Alice', 'alice@example.com', 0, 0);
+		insert into userSessions(userId, accessToken) values ('alice', 'plaintext-token');
+		insert into providerSessions(userId, provider, sub, accessToken, refreshToken, expires) values ('alice', 'test', 'alice', '', '', 0);
+		insert into userLoginLog(userId, remoteIp, time, success) values ('alice', '192.0.2.1', 0, 1);
+	`)
+
+	count, err := handler.Migrate()
+	if err != nil {
+		t.Fatalf("Could not migrate the baseline schema: %v", err)
+	}
+	if count != LatestSchemaVersion() {
+		t.Errorf("Ran %v migrations, expected %v", count, LatestSchemaVersion())
+	}
+
+	version, err := handler.SchemaVersion()
+	if err != nil || version != LatestSchemaVersion() {
+		t.Errorf("SchemaVersion() = %v, %v, expected %v", version, err, LatestSchemaVersion())
+	}
+
+	// Plaintext tokens were hashed, and keep working
+	var stored string
+	err = handler.QueryRow(ctx, "SELECT accessToken FROM userSessions").Scan(&stored)
+	if err != nil || stored != hashToken("plaintext-token") {
+		t.Errorf("Stored token %v (%v), expected the hash of the plaintext token", stored, err)
+	}
+
+	loggedIn, name, _, providers, err := handler.AccountInformation(ctx, "plaintext-token")
+	if !loggedIn || err != nil || name != "Alice" || len(providers) != 1 {
+		t.Errorf("AccountInformation() = %v, %v, %v, %v, expected Alice with 1 provider", loggedIn, name, providers, err)
+	}
+
+	// Logging in with the existing identity finds the existing account
+	accessToken := testLogin(t, handler, "alice", "Alice", "alice@example.com")
+	if testUserId(t, handler, accessToken) != "alice" {
+		t.Errorf("Logging in after the migration didn't find the existing account")
+	}
+
+	// Running the migrations again doesn't do anything
+	count, err = handler.Migrate()
+	if count != 0 || err != nil {
+		t.Errorf("Migrate() = %v, %v, expected nothing to be done", count, err)
+	}
+}
+
+func TestMigrateRepairsIntegrity(t *testing.T) {
+	ctx := context.Background()
+	handler := openBaselineHandler(t, `
+		insert into users(id, name, email, pebbleMirror, disabled) values ('alice', 'Alice', 'alice@example.com', 0, 0);
+		insert into providerSessions(userId, provider, sub, accessToken, refreshToken, expires) values ('alice', 'test', 'alice', 'old', '', 0);
+		insert into providerSessions(userId, provider, sub, accessToken, refreshToken, expires) values ('alice', 'test', 'alice', 'new', '', 0);
+		insert into userSessions(userId, accessToken) values ('deleted', 'orphaned-token');
+		insert into userLoginLog(userId, remoteIp, time, success) values ('deleted', '192.0.2.1', 0, 1);
+	`)
+
+	_, err := handler.Migrate()
+	if err != nil {
+		t.Fatalf("Could not migrate: %v", err)
+	}
+
+	// The most recent of duplicate identities is kept
+	var accessToken string
+	err = handler.QueryRow(ctx, "SELECT accessToken FROM providerSessions WHERE provider='test' AND sub='alice'").Scan(&accessToken)
+	if err != nil || accessToken != "new" {
+		t.Errorf("Kept identity with token %v (%v), expected the most recent one", accessToken, err)
+	}
+
+	for _, table := range []string{"userSessions", "userLoginLog"} {
+		count := 0
+		err = handler.QueryRow(ctx, "SELECT COUNT(*) FROM "+table).Scan(&count)
+		if err != nil || count != 0 {
+			t.Errorf("%v has %v rows (%v), expected the orphaned rows to be removed", table, count, err)
+		}
+	}
+}
+
+func TestMigrateRefusesNewerSchema(t *testing.T) {
+	handler := openTestHandler(t)
+
+	_, err := handler.Exec(context.Background(), "INSERT INTO schema_migrations(version, description, applied) VALUES (?, 'From the future', 0)", LatestSchemaVersion()+1)
+	if err != nil {
+		t.Fatalf("Could not insert migration: %v", err)
+	}
+
+	count, err := handler.Migrate()
+	if count != 0 || err == nil {
+		t.Errorf("Migrate() = %v, %v, expected it to refuse a newer schema", count, err)
+	}
+}
+
+func TestSchemaConstraints(t *testing.T) {
+	forEachDialect(t, func(t *testing.T, handler Handler) {
+		ctx := context.Background()
+		_, err := handler.Migrate()
+		if err != nil {
+			t.Fatalf("Could not migrate database: %v", err)
+		}
+
+		accessToken := testLogin(t, handler, "alice", "Alice", "alice@example.com")
+		userId := testUserId(t, handler, accessToken)
+
+		// An identity can only be linked to a single account
+		_, err = handler.Exec(ctx, "INSERT INTO users(id, name, email, type, pebbleMirror, disabled) VALUES ('bob', 'Bob', '', 'user', 0, 0)")
+		if err != nil {
+			t.Fatalf("Could not create user: %v", err)
+		}
+		_, err = handler.Exec(ctx, "INSERT INTO providerSessions(userId, provider, sub, accessToken, refreshToken, expires) VALUES ('bob', 'test', 'alice', '', '', 0)")
+		if err == nil {
+			t.Errorf("An identity was linked to two accounts")
+		}
+
+		// Sessions must belong to an existing account
+		_, err = handler.Exec(ctx, "INSERT INTO userSessions(userId, accessToken) VALUES ('nobody', 'token')")
+		if err == nil {
+			t.Errorf("A session was created for an account which doesn't exist")
+		}
+
+		// Deleting an account deletes everything belonging to it
+		_, err = handler.Exec(ctx, "DELETE FROM users WHERE id=?", userId)
+		if err != nil {
+			t.Fatalf("Could not delete user: %v", err)
+		}
+
+		for _, table := range []string{"userSessions", "providerSessions", "userLoginLog"} {
+			count := 0
+			err = handler.QueryRow(ctx, "SELECT COUNT(*) FROM "+table+" WHERE userId=?", userId).Scan(&count)
+			if err != nil || count != 0 {
+				t.Errorf("%v has %v rows (%v) of the deleted account, expected none", table, count, err)
+			}
+		}
+	})
+}
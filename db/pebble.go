@@ -0,0 +1,107 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// pebbleImportCheckpoint is the name of the checkpoint of the Pebble developer import
+const pebbleImportCheckpoint = "pebble-developers"
+
+// ImportPebbleDevelopers creates or renames the mirror accounts of a batch of Pebble developers, in a single
+// transaction. Real accounts are never touched, and neither are mirrors which were merged into a real account.
+// The ID of the last developer of the batch is saved as the import checkpoint, along with the changes, which are
+// audited as made by actorId.
+func (handler Handler) ImportPebbleDevelopers(ctx context.Context, developers []PebbleDeveloper, actorId string) (ImportReport, error) {
+	var report ImportReport
+	_, err := handler.transaction(ctx, func(tx *Tx) (string, error) {
+		report = ImportReport{}
+		for _, developer := range developers {
+			var name string
+			pebbleMirror := false
+			row := tx.QueryRow("SELECT name, pebbleMirror FROM users WHERE id=?", developer.Id)
+			err := row.Scan(&name, &pebbleMirror)
+			if err != nil && err != sql.ErrNoRows {
+				return "", err
+			}
+
+			if err == sql.ErrNoRows {
+				var alias string
+				row = tx.QueryRow("SELECT alias FROM userAliases WHERE alias=?", developer.Id)
+				err = row.Scan(&alias)
+				if err == nil {
+					report.Skipped++
+					continue
+				} else if err != sql.ErrNoRows {
+					return "", err
+				}
+
+				_, err = tx.Exec("INSERT INTO users(id, name, email, type, pebbleMirror, disabled) VALUES (?, ?, '', 'user', 1, 0)", developer.Id, developer.Name)
+				if err != nil {
+					return "", err
+				}
+
+				err = audit(tx, AuditEntry{
+					ActorId: actorId,
+					UserId:  developer.Id,
+					Action:  AuditMirrorCreate,
+				})
+				if err != nil {
+					return "", err
+				}
+				report.Created++
+			} else if !pebbleMirror || name == developer.Name {
+				report.Skipped++
+			} else {
+				_, err = tx.Exec("UPDATE users SET name=? WHERE id=? AND pebbleMirror=1", developer.Name, developer.Id)
+				if err != nil {
+					return "", err
+				}
+
+				err = audit(tx, AuditEntry{
+					ActorId: actorId,
+					UserId:  developer.Id,
+					Action:  AuditMirrorRename,
+				})
+				if err != nil {
+					return "", err
+				}
+				report.Updated++
+			}
+		}
+
+		if len(developers) > 0 {
+			_, err := tx.Exec("INSERT INTO importCheckpoints(name, cursor, updated) VALUES (?, ?, ?) ON CONFLICT (name) DO UPDATE SET cursor=excluded.cursor, updated=excluded.updated",
+				pebbleImportCheckpoint, developers[len(developers)-1].Id, time.Now().UnixNano())
+			if err != nil {
+				return "", err
+			}
+		}
+
+		return "", nil
+	})
+	if err != nil {
+		return ImportReport{}, err
+	}
+
+	return report, nil
+}
+
+// PebbleImportCheckpoint returns the ID of the last developer imported by an import which didn't finish, if any
+func (handler Handler) PebbleImportCheckpoint(ctx context.Context) (string, error) {
+	var cursor string
+	row := handler.QueryRow(ctx, "SELECT cursor FROM importCheckpoints WHERE name=?", pebbleImportCheckpoint)
+	err := row.Scan(&cursor)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return cursor, err
+}
+
+// ClearPebbleImportCheckpoint forgets the checkpoint of the Pebble developer import, once it is done
+func (handler Handler) ClearPebbleImportCheckpoint(ctx context.Context) error {
+	_, err := handler.Exec(ctx, "DELETE FROM importCheckpoints WHERE name=?", pebbleImportCheckpoint)
+	return err
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestImportPebbleDevelopers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		accessToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		aliceId := testUserId(t, store, accessToken)
+
+		report, err := store.ImportPebbleDevelopers(ctx, []PebbleDeveloper{{"dev1", "Developer 1"}, {"dev2", "Developer 2"}}, AuditActorAdmin)
+		if err != nil || report != (ImportReport{Created: 2}) {
+			t.Fatalf("ImportPebbleDevelopers() = %+v, %v, expected 2 mirrors to be created", report, err)
+		}
+
+		checkpoint, err := store.PebbleImportCheckpoint(ctx)
+		if checkpoint != "dev2" || err != nil {
+			t.Errorf("PebbleImportCheckpoint() = %q, %v, expected the last developer imported", checkpoint, err)
+		}
+
+		// Real accounts are never touched
+		report, err = store.ImportPebbleDevelopers(ctx, []PebbleDeveloper{{"dev1", "Developer 1"}, {"dev2", "Renamed"}, {aliceId, "Mallory"}}, aliceId)
+		if err != nil || report != (ImportReport{Updated: 1, Skipped: 2}) {
+			t.Errorf("ImportPebbleDevelopers() = %+v, %v, expected 1 mirror to be renamed", report, err)
+		}
+
+		for id, expected := range map[string]string{"dev1": "Developer 1", "dev2": "Renamed", aliceId: "Alice"} {
+			name, _, err := store.GetName(ctx, id)
+			if name != expected || err != nil {
+				t.Errorf("GetName(%v) = %q, %v, expected %q", id, name, err, expected)
+			}
+		}
+
+		// The changes are audited as made by whoever ran the import
+		for action, actorId := range map[string]string{AuditMirrorCreate: AuditActorAdmin, AuditMirrorRename: aliceId} {
+			entries, err := store.AuditLog(ctx, AuditFilter{Action: action}, 0, 10)
+			if err != nil || len(entries) == 0 || entries[0].ActorId != actorId {
+				t.Errorf("Got %v entries %+v (%v), expected them to be made by %v", action, entries, err, actorId)
+			}
+		}
+
+		err = store.ClearPebbleImportCheckpoint(ctx)
+		if err != nil {
+			t.Fatalf("Could not clear checkpoint: %v", err)
+		}
+		checkpoint, err = store.PebbleImportCheckpoint(ctx)
+		if checkpoint != "" || err != nil {
+			t.Errorf("PebbleImportCheckpoint() = %q, %v, expected no checkpoint", checkpoint, err)
+		}
+	})
+}
@@ -0,0 +1,138 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+)
+
+// syncProfile refreshes the e-mail address of an account (and its name, if the user asked for it) from the profile
+// the given provider just returned, if that provider is the one the account's profile comes from.
+// An empty profileProvider means the profile is kept in sync with whichever provider the user logs in with.
+func syncProfile(tx *Tx, userId string, provider string, name string, email string, remoteIp string) error {
+	var profileProvider, oldName, oldEmail string
+	syncName := false
+	row := tx.QueryRow("SELECT profileProvider, syncName, name, email FROM users WHERE id=?", userId)
+	err := row.Scan(&profileProvider, &syncName, &oldName, &oldEmail)
+	if err != nil {
+		return err
+	}
+
+	if profileProvider != "" && profileProvider != provider {
+		return nil
+	}
+
+	// Only which fields changed is audited, so that the audit log doesn't keep the user's details once they are deleted
+	var fields []string
+
+	if email != "" && email != oldEmail {
+		_, err = tx.Exec("UPDATE users SET email=? WHERE id=?", email, userId)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, "email")
+	}
+
+	if syncName && name != "" && name != oldName {
+		_, err = tx.Exec("UPDATE users SET name=? WHERE id=?", name, userId)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, "name")
+	}
+
+	if len(fields) == 0 {
+		return nil
+	}
+
+	// The user didn't make this change themselves, their identity provider did
+	return audit(tx, AuditEntry{
+		ActorId:  AuditActorSystem,
+		UserId:   userId,
+		Action:   AuditAccountProfile,
+		After:    auditValues(map[string]interface{}{"fields": fields}),
+		RemoteIp: remoteIp,
+	})
+}
+
+// ProfileSettings returns which provider the user's profile is kept in sync with, and whether their name is
+// Returns (profileProvider string, syncName bool, errMessage string, err error)
+func (handler Handler) ProfileSettings(ctx context.Context, accessToken string) (string, bool, string, error) {
+	userId, err := handler.getAccountId(ctx, accessToken)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "", false, "Invalid access token", nil
+		}
+
+		return "", false, "Internal server error", err
+	}
+
+	var profileProvider string
+	syncName := false
+	row := handler.QueryRow(ctx, "SELECT profileProvider, syncName FROM users WHERE id=?", userId)
+	err = row.Scan(&profileProvider, &syncName)
+	if err != nil {
+		return "", false, "Internal server error", err
+	}
+
+	return profileProvider, syncName, "", nil
+}
+
+// UpdateProfileSettings changes which provider the user's profile is kept in sync with, and whether their name is
+// Returns errorMessage, error
+func (handler Handler) UpdateProfileSettings(ctx context.Context, accessToken string, profileProvider string, syncName bool, remoteIp string) (string, error) {
+	userId, err := handler.getAccountId(ctx, accessToken)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "Invalid access token", nil
+		}
+
+		return "Internal server error", err
+	}
+
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		if profileProvider != "" {
+			count := 0
+			row := tx.QueryRow("SELECT COUNT(*) FROM providerSessions WHERE userId=? AND provider=?", userId, profileProvider)
+			err := row.Scan(&count)
+			if err != nil {
+				return "Internal server error", err
+			}
+
+			if count == 0 {
+				return "This provider isn't linked to your account", nil
+			}
+		}
+
+		var oldProfileProvider string
+		oldSyncName := false
+		row := tx.QueryRow("SELECT profileProvider, syncName FROM users WHERE id=?", userId)
+		err := row.Scan(&oldProfileProvider, &oldSyncName)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		syncNameInt := 0
+		if syncName {
+			syncNameInt = 1
+		}
+
+		_, err = tx.Exec("UPDATE users SET profileProvider=?, syncName=? WHERE id=?", profileProvider, syncNameInt, userId)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		err = audit(tx, AuditEntry{
+			ActorId:  userId,
+			UserId:   userId,
+			Action:   AuditAccountProfile,
+			Before:   auditValues(map[string]interface{}{"profileProvider": oldProfileProvider, "syncName": oldSyncName}),
+			After:    auditValues(map[string]interface{}{"profileProvider": profileProvider, "syncName": syncName}),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+}
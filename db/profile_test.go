@@ -0,0 +1,108 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestProfileSyncsEmail(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		// The name isn't kept in sync unless the user asks for it
+		accessToken := testLogin(t, store, "alice", "Alicia", "alicia@example.com")
+		name, email, _ := accountProviders(t, store, accessToken)
+		if name != "Alice" || email != "alicia@example.com" {
+			t.Errorf("Got %v <%v>, expected Alice <alicia@example.com>", name, email)
+		}
+
+		// Only which fields changed is audited, not the e-mail addresses
+		entries, err := store.AuditLog(context.Background(), AuditFilter{Action: AuditAccountProfile}, 0, 10)
+		if err != nil || len(entries) != 1 || entries[0].Before != "" || entries[0].After != `{"fields":["email"]}` {
+			t.Errorf("AuditLog() = %+v, %v, expected the e-mail address change without the addresses", entries, err)
+		}
+
+		// Profiles without an e-mail address don't clear it
+		accessToken = testLogin(t, store, "alice", "Alicia", "")
+		_, email, _ = accountProviders(t, store, accessToken)
+		if email != "alicia@example.com" {
+			t.Errorf("Got <%v>, expected the e-mail address to be kept", email)
+		}
+	})
+}
+
+func TestProfileSyncsName(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		accessToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		errorMessage, err := store.UpdateProfileSettings(ctx, accessToken, "", true, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not update profile settings: %v (%v)", errorMessage, err)
+		}
+
+		testLogin(t, store, "alice", "Alicia", "alice@example.com")
+		name, _, _ := accountProviders(t, store, accessToken)
+		if name != "Alicia" {
+			t.Errorf("Got %v, expected the name to be synced", name)
+		}
+
+		// Choosing a name stops syncing it
+		errorMessage, err = store.UpdateName(ctx, accessToken, "Ali", "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not update name: %v (%v)", errorMessage, err)
+		}
+
+		testLogin(t, store, "alice", "Alicia", "alice@example.com")
+		name, _, _ = accountProviders(t, store, accessToken)
+		_, syncName, _, _ := store.ProfileSettings(ctx, accessToken)
+		if name != "Ali" || syncName {
+			t.Errorf("Got %v (synced: %v), expected the chosen name to be kept", name, syncName)
+		}
+	})
+}
+
+func TestProfileProvider(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		accessToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		errorMessage, _ := store.UpdateProfileSettings(ctx, accessToken, "other", false, "")
+		if errorMessage == "" {
+			t.Fatalf("The profile was synced with a provider which isn't linked to the account")
+		}
+
+		_, errorMessage, err := store.AccountAddProvider(ctx, "other", "alice", "{}", accessToken, "", "", 0, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not add provider: %v (%v)", errorMessage, err)
+		}
+
+		errorMessage, err = store.UpdateProfileSettings(ctx, accessToken, "other", false, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not update profile settings: %v (%v)", errorMessage, err)
+		}
+
+		profileProvider, syncName, errorMessage, err := store.ProfileSettings(ctx, accessToken)
+		if profileProvider != "other" || syncName || errorMessage != "" || err != nil {
+			t.Errorf("ProfileSettings() = %q, %v, %q, %v, expected other without the name", profileProvider, syncName, errorMessage, err)
+		}
+
+		// Logging in with another provider doesn't change the profile anymore
+		testLogin(t, store, "alice", "Alice", "alice@work.example.com")
+		_, email, _ := accountProviders(t, store, accessToken)
+		if email != "alice@example.com" {
+			t.Errorf("Got <%v>, expected the e-mail address to be kept", email)
+		}
+
+		// Unlinking the profile provider goes back to syncing with any provider
+		errorMessage, err = store.AccountRemoveProvider(ctx, "other", accessToken, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not remove provider: %v (%v)", errorMessage, err)
+		}
+
+		profileProvider, _, _, _ = store.ProfileSettings(ctx, accessToken)
+		if profileProvider != "" {
+			t.Errorf("Got profile provider %q after unlinking it, expected none", profileProvider)
+		}
+	})
+}
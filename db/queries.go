@@ -1,7 +1,10 @@
 package db
 
 import (
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"strings"
@@ -15,23 +18,58 @@ import (
 // Handler contains reference to the database client
 type Handler struct {
 	*sql.DB
+	driver string
+
+	// AuditSink receives the audit log entries once they are committed, if set
+	AuditSink AuditSink
+	// QueryTimeout is how long a query, or a whole transaction, may run before it is cancelled. Zero means no timeout.
+	QueryTimeout time.Duration
+	// Events writes the login and audit log entries in the background, if set. Otherwise, they are written as part of
+	// the transaction which adds them.
+	Events *EventWriter
+	// SessionIdle is how long a session may stay unused before it expires. Zero means sessions don't expire.
+	SessionIdle time.Duration
 }
 
-func addProvider(tx *sql.Tx, provider string, sub string, userId string, ssoAccessToken string, ssoRefreshToken string, expires int64) error {
-	count := 0
-	row := tx.QueryRow("SELECT COUNT(*) FROM providerSessions WHERE provider=? AND sub=?", provider, sub)
-	err := row.Scan(&count)
+// hashToken returns the hex-encoded SHA-256 hash of a token. Tokens we hand out are never stored as-is, only their hash
+// is, so that a leaked database can't be used to impersonate users.
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// errIdentityInUse is returned by addProvider when the identity is already linked to another account
+var errIdentityInUse = errors.New("Identity is already linked to another account")
+
+func addProvider(tx *Tx, provider string, sub string, userId string, profile string, ssoAccessToken string, ssoRefreshToken string, expires int64) error {
+	rows, err := tx.Query("SELECT userId FROM providerSessions WHERE provider=? AND sub=?", provider, sub)
 	if err != nil {
 		return err
 	}
 
-	if count == 0 {
-		_, err = tx.Exec("INSERT INTO providerSessions(userId, provider, sub, accessToken, refreshToken, expires) VALUES (?, ?, ?, ?, ?, ?)", userId, provider, sub, ssoAccessToken, ssoRefreshToken, expires)
+	var ownerIds []string
+	for rows.Next() {
+		var ownerId string
+		err = rows.Scan(&ownerId)
 		if err != nil {
+			rows.Close()
 			return err
 		}
-	} else if count == 1 {
-		_, err = tx.Exec("UPDATE providerSessions SET accessToken=?, refreshToken=?, expires=? WHERE provider=? AND sub=?", ssoAccessToken, ssoRefreshToken, expires, provider, sub)
+		ownerIds = append(ownerIds, ownerId)
+	}
+	rows.Close()
+
+	if len(ownerIds) == 0 {
+		_, err = tx.Exec("INSERT INTO providerSessions(userId, provider, sub, profile, accessToken, refreshToken, expires) VALUES (?, ?, ?, ?, ?, ?, ?)", userId, provider, sub, profile, ssoAccessToken, ssoRefreshToken, expires)
+		if err != nil {
+			return err
+		}
+	} else if len(ownerIds) == 1 {
+		if ownerIds[0] != userId {
+			return errIdentityInUse
+		}
+
+		_, err = tx.Exec("UPDATE providerSessions SET profile=?, accessToken=?, refreshToken=?, expires=? WHERE provider=? AND sub=?", profile, ssoAccessToken, ssoRefreshToken, expires, provider, sub)
 		if err != nil {
 			return err
 		}
@@ -42,15 +80,16 @@ func addProvider(tx *sql.Tx, provider string, sub string, userId string, ssoAcce
 	return nil
 }
 
-func createSession(tx *sql.Tx, provider string, sub string, userId string, ssoAccessToken string, ssoRefreshToken string, expires int64) (string, error) {
+func createSession(tx *Tx, provider string, sub string, userId string, profile string, ssoAccessToken string, ssoRefreshToken string, expires int64, session SessionMetadata) (string, error) {
 	accessToken := common.GenerateString(50)
 
-	_, err := tx.Exec("INSERT INTO userSessions(userId, accessToken) VALUES (?, ?)", userId, accessToken)
+	now := time.Now().UnixNano()
+	_, err := tx.Exec("INSERT INTO userSessions(userId, accessToken, created, lastUsed, clientId, userAgent, remoteIp, provider) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", userId, hashToken(accessToken), now, now, session.ClientId, session.UserAgent, session.RemoteIp, provider)
 	if err != nil {
 		return "", err
 	}
 
-	err = addProvider(tx, provider, sub, userId, ssoAccessToken, ssoRefreshToken, expires)
+	err = addProvider(tx, provider, sub, userId, profile, ssoAccessToken, ssoRefreshToken, expires)
 	if err != nil {
 		return "", err
 	}
@@ -58,154 +97,324 @@ func createSession(tx *sql.Tx, provider string, sub string, userId string, ssoAc
 	return accessToken, nil
 }
 
-// AccountLoginOrRegister attempts to login (or, if the user doesn't yet exist, create a user account)
-// Returns accessToken, errorMessage, error
-func (handler Handler) AccountLoginOrRegister(provider string, sub string, name string, email string, ssoAccessToken string, ssoRefreshToken string, expires int64, remoteIp string) (string, string, error) {
-	tx, err := handler.DB.Begin()
-	if err != nil {
-		return "", "Internal server error", err
+// createAccount creates the account of a new user, who registered with the given identity. The provider used to
+// register is the one the profile of the account will be kept in sync with.
+// Returns the ID of the new account
+func createAccount(tx *Tx, provider string, sub string, name string, email string, remoteIp string) (string, error) {
+	var userId string
+	for {
+		id, err := uuid.NewV4()
+		if err != nil {
+			return "", err
+		}
+		userId = strings.Replace(id.String(), "-", "", -1)
+
+		row := tx.QueryRow("SELECT id FROM users WHERE id=?", userId)
+		if err := row.Scan(); err != nil {
+			if err == sql.ErrNoRows {
+				break
+			} else {
+				return "", err
+			}
+		}
 	}
-	defer tx.Rollback()
 
-	row := tx.QueryRow("SELECT users.id, users.disabled FROM providerSessions JOIN users ON users.id = providerSessions.userId WHERE providerSessions.provider=? AND providerSessions.sub=?", provider, sub)
+	if name == "" {
+		name = userId
+	}
 
-	var userId string
-	disabled := false
-	err = row.Scan(&userId, &disabled)
-	if err != nil && err != sql.ErrNoRows {
-		return "", "Internal server error", err
+	_, err := tx.Exec("INSERT INTO users(id, name, email, type, pebbleMirror, disabled, profileProvider, syncName) VALUES (?, ?, ?, 'user', 0, 0, ?, 0)", userId, name, email, provider)
+	if err != nil {
+		return "", err
 	}
 
+	err = audit(tx, AuditEntry{
+		ActorId:  userId,
+		UserId:   userId,
+		Action:   AuditAccountCreate,
+		After:    auditValues(map[string]interface{}{"provider": provider, "subHash": auditHash(sub)}),
+		RemoteIp: remoteIp,
+	})
 	if err != nil {
-		// User doesn't exist, create account
+		return "", err
+	}
 
-		for {
-			id, err := uuid.NewV4()
-			if err != nil {
-				return "", "Internal server error", err
-			}
-			userId = strings.Replace(id.String(), "-", "", -1)
-
-			row = tx.QueryRow("SELECT id FROM users WHERE id=?", userId)
-			if err := row.Scan(); err != nil {
-				if err == sql.ErrNoRows {
-					break
-				} else {
-					return "", "Internal server error", err
+	return userId, nil
+}
+
+// AccountLoginOrRegister attempts to login (or, if the user doesn't yet exist, create a user account)
+// If linkEmail is set (the identity provider vouches for the e-mail address) and another account already uses the same
+// e-mail address, no account is created. Instead, a link token is returned, and the link has to be confirmed by logging
+// in to the existing account (see AccountConfirmLink).
+// Returns accessToken, linkToken, errorMessage, error
+func (handler Handler) AccountLoginOrRegister(ctx context.Context, provider string, sub string, name string, email string, linkEmail bool, profile string, ssoAccessToken string, ssoRefreshToken string, expires int64, session SessionMetadata) (string, string, string, error) {
+	var accessToken, linkToken string
+	disabled := false
+	errorMessage, err := handler.transaction(ctx, func(tx *Tx) (string, error) {
+		accessToken, linkToken = "", ""
+
+		row := tx.QueryRow("SELECT users.id, users.disabled FROM providerSessions JOIN users ON users.id = providerSessions.userId WHERE providerSessions.provider=? AND providerSessions.sub=?", provider, sub)
+
+		var userId string
+		disabled = false
+		err := row.Scan(&userId, &disabled)
+		if err != nil && err != sql.ErrNoRows {
+			return "Internal server error", err
+		}
+
+		registered := err != nil
+		if registered {
+			// User doesn't exist, offer to link this identity to the account with the same e-mail address if there is one
+			if linkEmail && email != "" {
+				linkUserId, err := findAccountByEmail(tx, email)
+				if err != nil {
+					return "Internal server error", err
+				}
+
+				if linkUserId != "" {
+					linkToken, err = createPendingLink(tx, linkUserId, provider, sub, name, email, profile, ssoAccessToken, ssoRefreshToken, expires, session)
+					if err != nil {
+						return "Internal server error", err
+					}
+
+					return "", nil
 				}
 			}
+
+			// Otherwise, create account
+			userId, err = createAccount(tx, provider, sub, name, email, session.RemoteIp)
+			if err != nil {
+				return "Internal server error", err
+			}
 		}
 
-		if name == "" {
-			name = userId
+		if disabled {
+			// The failed attempt is committed, even though the login fails
+			err = logLoginAttempt(tx, LoginAttempt{
+				UserId:    userId,
+				Time:      time.Now(),
+				Reason:    LoginAccountDisabled,
+				Provider:  provider,
+				UserAgent: session.UserAgent,
+				RemoteIp:  session.RemoteIp,
+			})
+			if err != nil {
+				return "Internal server error", err
+			}
+
+			return "", nil
 		}
 
-		// Create user
-		_, err := tx.Exec("INSERT INTO users(id, name, email, type, pebbleMirror, disabled) VALUES (?, ?, ?, 'user', 0, 0)", userId, name, email)
+		// Create user session
+
+		accessToken, err = createSession(tx, provider, sub, userId, profile, ssoAccessToken, ssoRefreshToken, expires, session)
 		if err != nil {
-			return "", "Internal server error", err
+			return "Internal server error", err
 		}
-	}
 
-	if disabled {
-		return "", "Account is disabled", errors.New("cannot login; account is disabled")
-	}
+		if !registered {
+			err = syncProfile(tx, userId, provider, name, email, session.RemoteIp)
+			if err != nil {
+				return "Internal server error", err
+			}
 
-	// Create user session
+			// Logging in cancels the deletion of the account, if it was scheduled
+			var deletionScheduled int64
+			row = tx.QueryRow("SELECT deletionScheduled FROM users WHERE id=?", userId)
+			err = row.Scan(&deletionScheduled)
+			if err != nil {
+				return "Internal server error", err
+			}
 
-	accessToken, err := createSession(tx, provider, sub, userId, ssoAccessToken, ssoRefreshToken, expires)
-	if err != nil {
-		return "", "Internal server error", err
-	}
+			if deletionScheduled != 0 {
+				_, err = tx.Exec("UPDATE users SET deletionScheduled=0 WHERE id=?", userId)
+				if err != nil {
+					return "Internal server error", err
+				}
 
-	// Log successful login attempt
-	_, err = tx.Exec("INSERT INTO userLoginLog(userId, remoteIp, time, success) VALUES (?, ?, ?, 1)", userId, remoteIp, time.Now().UnixNano())
-	if err != nil {
-		return "", "Internal server error", err
+				err = audit(tx, AuditEntry{
+					ActorId:  userId,
+					UserId:   userId,
+					Action:   AuditDeletionCancel,
+					Before:   auditValues(map[string]interface{}{"deletionScheduled": time.Unix(0, deletionScheduled)}),
+					RemoteIp: session.RemoteIp,
+				})
+				if err != nil {
+					return "Internal server error", err
+				}
+			}
+		}
+
+		// Log successful login attempt
+		err = logLoginAttempt(tx, LoginAttempt{
+			UserId:    userId,
+			Time:      time.Now(),
+			Success:   true,
+			Reason:    LoginSucceeded,
+			Provider:  provider,
+			UserAgent: session.UserAgent,
+			RemoteIp:  session.RemoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+	if errorMessage != "" || err != nil {
+		return "", "", errorMessage, err
 	}
 
-	tx.Commit()
+	if disabled {
+		return "", "", "Account is disabled", errors.New("cannot login; account is disabled")
+	}
 
-	return accessToken, "", nil
+	return accessToken, linkToken, "", nil
 }
 
 // AccountAddProvider attempts to add a provider to a user's account
-// Returns errorMessage, error
-func (handler Handler) AccountAddProvider(provider string, sub string, rebbleAccessToken string, ssoAccessToken string, ssoRefreshToken string, expires int64, remoteIp string) (string, error) {
-	tx, err := handler.DB.Begin()
-	if err != nil {
-		return "Internal server error", err
-	}
-	defer tx.Rollback()
-
-	loggedIn, _, _, _, err := handler.AccountInformation(rebbleAccessToken)
+// If the identity is already linked to another account, nothing is changed and a merge token is returned instead. The
+// user can then choose to merge the other account in theirs (see AccountMerge).
+// Returns mergeToken, errorMessage, error
+func (handler Handler) AccountAddProvider(ctx context.Context, provider string, sub string, profile string, rebbleAccessToken string, ssoAccessToken string, ssoRefreshToken string, expires int64, remoteIp string) (string, string, error) {
+	loggedIn, _, _, _, err := handler.AccountInformation(ctx, rebbleAccessToken)
 	if !loggedIn {
-		return "Invalid access token", err
+		return "", "Invalid access token", err
 	}
 
-	row := tx.QueryRow("SELECT users.id, users.disabled FROM userSessions JOIN users ON users.id = userSessions.userId WHERE accessToken=?", rebbleAccessToken)
+	var mergeToken string
+	errorMessage, err := handler.transaction(ctx, func(tx *Tx) (string, error) {
+		mergeToken = ""
 
-	var userId string
-	disabled := false
-	err = row.Scan(&userId, &disabled)
-	if err != nil && err != sql.ErrNoRows {
-		if err == sql.ErrNoRows {
-			return "User doesn't exist", nil
+		row := tx.QueryRow("SELECT users.id, users.disabled FROM userSessions JOIN users ON users.id = userSessions.userId WHERE accessToken=?", hashToken(rebbleAccessToken))
+
+		var userId string
+		disabled := false
+		err := row.Scan(&userId, &disabled)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return "User doesn't exist", nil
+			}
+
+			return "Internal server error", err
 		}
 
-		return "Internal server error", err
-	}
+		if disabled {
+			return "Account is disabled", errors.New("cannot login; account is disabled")
+		}
 
-	if disabled {
-		return "Account is disabled", errors.New("cannot login; account is disabled")
-	}
+		err = addProvider(tx, provider, sub, userId, profile, ssoAccessToken, ssoRefreshToken, expires)
+		if err == errIdentityInUse {
+			mergeToken, err = createPendingMerge(tx, userId, provider, sub, profile, ssoAccessToken, ssoRefreshToken, expires)
+			if err != nil {
+				return "Internal server error", err
+			}
 
-	err = addProvider(tx, provider, sub, userId, ssoAccessToken, ssoRefreshToken, expires)
-	if err != nil {
-		return "Internal server error", err
-	}
+			return "", nil
+		}
+		if err != nil {
+			return "Internal server error", err
+		}
 
-	tx.Commit()
+		err = audit(tx, AuditEntry{
+			ActorId:  userId,
+			UserId:   userId,
+			Action:   AuditProviderLink,
+			After:    auditValues(map[string]interface{}{"provider": provider, "subHash": auditHash(sub)}),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
 
-	return "", nil
+		return "", nil
+	})
+	if errorMessage != "" || err != nil {
+		return "", errorMessage, err
+	}
+
+	return mergeToken, "", nil
 }
 
 // AccountRemoveProvider attempts to remove a provider from a user's account
 // Returns errorMessage, error
-func (handler Handler) AccountRemoveProvider(provider string, rebbleAccessToken string) (string, error) {
-	tx, err := handler.DB.Begin()
-	if err != nil {
-		return "Internal server error", err
+func (handler Handler) AccountRemoveProvider(ctx context.Context, provider string, rebbleAccessToken string, remoteIp string) (string, error) {
+	loggedIn, _, _, _, err := handler.AccountInformation(ctx, rebbleAccessToken)
+	if !loggedIn {
+		return "Invalid access token", err
 	}
-	defer tx.Rollback()
 
-	count := 0
-	row := tx.QueryRow("SELECT COUNT(*) FROM providerSessions WHERE userId = (SELECT userId FROM userSessions WHERE accessToken=?)", rebbleAccessToken)
-	err = row.Scan(&count)
-	if err != nil {
-		return "", err
-	}
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		var userId string
+		row := tx.QueryRow("SELECT userId FROM userSessions WHERE accessToken=?", hashToken(rebbleAccessToken))
+		err := row.Scan(&userId)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return "Invalid access token", nil
+			}
 
-	if count == 1 {
-		return "Can't remove last identity provider!", errors.New("Can't remove last identity provider")
-	}
+			return "Internal server error", err
+		}
 
-	loggedIn, _, _, _, err := handler.AccountInformation(rebbleAccessToken)
-	if !loggedIn {
-		return "Invalid access token", err
-	}
+		count := 0
+		row = tx.QueryRow("SELECT COUNT(*) FROM providerSessions WHERE userId=?", userId)
+		err = row.Scan(&count)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		if count == 1 {
+			return "Can't remove last identity provider!", errors.New("Can't remove last identity provider")
+		}
+
+		var subs []string
+		rows, err := tx.Query("SELECT sub FROM providerSessions WHERE userId=? AND provider=?", userId, provider)
+		if err != nil {
+			return "Internal server error", err
+		}
+		for rows.Next() {
+			var sub string
+			err = rows.Scan(&sub)
+			if err != nil {
+				rows.Close()
+				return "Internal server error", err
+			}
+			subs = append(subs, sub)
+		}
+		rows.Close()
 
-	_, err = tx.Exec("DELETE FROM providerSessions WHERE providerSessions.userId = (SELECT userId FROM userSessions WHERE accessToken=?) AND provider=?", rebbleAccessToken, provider)
+		_, err = tx.Exec("DELETE FROM providerSessions WHERE userId=? AND provider=?", userId, provider)
+		if err != nil {
+			return "Internal server error", err
+		}
 
-	tx.Commit()
+		for _, sub := range subs {
+			err = audit(tx, AuditEntry{
+				ActorId:  userId,
+				UserId:   userId,
+				Action:   AuditProviderUnlink,
+				Before:   auditValues(map[string]interface{}{"provider": provider, "subHash": auditHash(sub)}),
+				RemoteIp: remoteIp,
+			})
+			if err != nil {
+				return "Internal server error", err
+			}
+		}
 
-	return "", nil
+		// Fall back to keeping the profile in sync with whichever provider the user logs in with
+		_, err = tx.Exec("UPDATE users SET profileProvider='' WHERE id=? AND profileProvider=?", userId, provider)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
 }
 
-// AccountExists checks if an account exists
-func (handler Handler) AccountExists(provider string, sub string) (bool, error) {
+// AccountExists checks if an account is linked to the given identity
+func (handler Handler) AccountExists(ctx context.Context, provider string, sub string) (bool, error) {
 	var userId string
-	row := handler.DB.QueryRow("SELECT id FROM users WHERE provider=? AND sub=?", provider, sub)
+	row := handler.QueryRow(ctx, "SELECT userId FROM providerSessions WHERE provider=? AND sub=?", provider, sub)
 	err := row.Scan(&userId)
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -218,9 +427,9 @@ func (handler Handler) AccountExists(provider string, sub string) (bool, error)
 	return true, nil
 }
 
-func (handler Handler) getAccountId(accessToken string) (string, error) {
+func (handler Handler) getAccountId(ctx context.Context, accessToken string) (string, error) {
 	var userId string
-	row := handler.DB.QueryRow("SELECT userId FROM userSessions WHERE accessToken=?", accessToken)
+	row := handler.QueryRow(ctx, "SELECT userId FROM userSessions WHERE accessToken=?", hashToken(accessToken))
 	err := row.Scan(&userId)
 	if err != nil {
 		return "", err
@@ -231,8 +440,12 @@ func (handler Handler) getAccountId(accessToken string) (string, error) {
 
 // AccountInformation returns information about the account associated to the given access token
 // returns success, name, email, providers, err
-func (handler Handler) AccountInformation(accessToken string) (bool, string, string, []string, error) {
-	userId, err := handler.getAccountId(accessToken)
+func (handler Handler) AccountInformation(ctx context.Context, accessToken string) (bool, string, string, []string, error) {
+	var userId string
+	var name string
+	var email string
+	row := handler.QueryRow(ctx, "SELECT users.id, users.name, users.email FROM userSessions JOIN users ON users.id = userSessions.userId WHERE userSessions.accessToken=?", hashToken(accessToken))
+	err := row.Scan(&userId, &name, &email)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return false, "", "", []string{}, nil
@@ -241,19 +454,12 @@ func (handler Handler) AccountInformation(accessToken string) (bool, string, str
 		return false, "", "", []string{}, err
 	}
 
-	var name string
-	var email string
-	row := handler.DB.QueryRow("SELECT name, email FROM users WHERE id=?", userId)
-	err = row.Scan(&name, &email)
-	if err != nil {
-		return false, "", "", []string{}, err
-	}
-
 	var linkedProviders []string
-	rows, err := handler.DB.Query("SELECT provider FROM providerSessions WHERE userid=?", userId)
+	rows, err := handler.Query(ctx, "SELECT provider FROM providerSessions WHERE userid=?", userId)
 	if err != nil {
 		return false, "", "", []string{}, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		provider := ""
@@ -272,40 +478,30 @@ func (handler Handler) AccountInformation(accessToken string) (bool, string, str
 }
 
 // SessionInformation returns (loggedIn bool, errMessage string, err error) about the current user session
-func (handler Handler) SessionInformation(accessToken string) (bool, string, error) {
-	userId, err := handler.getAccountId(accessToken)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return false, "Invalid session", nil
-		}
-
-		return false, "Internal server error", err
+func (handler Handler) SessionInformation(ctx context.Context, accessToken string) (bool, string, error) {
+	session, errorMessage, err := handler.LookupSession(ctx, accessToken)
+	if errorMessage != "" || err != nil {
+		return false, errorMessage, err
 	}
 
-	var disabled bool
-	rows, err := handler.DB.Query("SELECT users.disabled FROM userSessions JOIN users ON users.id = userSessions.userId WHERE users.id=? AND userSessions.accessToken=?", userId, accessToken)
-	if err != nil {
-		return false, "Internal server error", err
+	if session.Disabled {
+		return false, "Account is disabled", nil
 	}
-	sessionFound := false
-	for rows.Next() {
-		sessionFound = true
-		err = rows.Scan(&disabled)
+
+	now := time.Now()
+	if session.touchDue(now) {
+		err = handler.TouchSession(ctx, session.SessionId, now)
 		if err != nil {
 			return false, "Internal server error", err
 		}
 	}
 
-	if !sessionFound {
-		return false, "Session not found (expired?)", nil
-	}
-
 	return true, "", nil
 }
 
 // UpdateName updates a user's name and returns a human-readable error as well as an actual error
-func (handler Handler) UpdateName(accessToken string, name string) (string, error) {
-	userId, err := handler.getAccountId(accessToken)
+func (handler Handler) UpdateName(ctx context.Context, accessToken string, name string, remoteIp string) (string, error) {
+	userId, err := handler.getAccountId(ctx, accessToken)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return "Invalid access token", errors.New("Invalid access token")
@@ -314,7 +510,7 @@ func (handler Handler) UpdateName(accessToken string, name string) (string, erro
 		return "Internal server error", err
 	}
 
-	loggedIn, errorMessage, err := handler.SessionInformation(accessToken)
+	loggedIn, errorMessage, err := handler.SessionInformation(ctx, accessToken)
 	if !loggedIn {
 		if err != nil {
 			return fmt.Sprintf("Internal Server Error: %v", errorMessage), err
@@ -323,29 +519,71 @@ func (handler Handler) UpdateName(accessToken string, name string) (string, erro
 		return errorMessage, nil
 	}
 
-	tx, err := handler.DB.Begin()
-	if err != nil {
-		return "Internal server error", err
-	}
-	defer tx.Rollback()
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		// The user chose their name, so it shouldn't be overwritten by the one from their identity provider anymore
+		_, err := tx.Exec("UPDATE users SET name=?, syncName=0 WHERE id=?", name, userId)
+		if err != nil {
+			return "Internal server error", err
+		}
 
-	tx.Exec("UPDATE users SET name=? WHERE id=?", name, userId)
-	if err != nil {
-		return "Internal server error", err
-	}
+		err = audit(tx, AuditEntry{
+			ActorId:  userId,
+			UserId:   userId,
+			Action:   AuditAccountName,
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
 
-	err = tx.Commit()
-	if err != nil {
-		return "Internal server error", err
-	}
+		return "", nil
+	})
+}
+
+// SetUserRole changes the role (type) of a user
+// Returns errorMessage, err
+func (handler Handler) SetUserRole(ctx context.Context, userId string, role string, actorId string, remoteIp string) (string, error) {
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		var previous string
+		row := tx.QueryRow("SELECT type FROM users WHERE id=?", userId)
+		err := row.Scan(&previous)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return "No such user", nil
+			}
+
+			return "Internal server error", err
+		}
+
+		if previous == role {
+			return "", nil
+		}
+
+		_, err = tx.Exec("UPDATE users SET type=? WHERE id=?", role, userId)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		err = audit(tx, AuditEntry{
+			ActorId:  actorId,
+			UserId:   userId,
+			Action:   AuditAccountRole,
+			Before:   auditValues(map[string]interface{}{"role": previous}),
+			After:    auditValues(map[string]interface{}{"role": role}),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
 
-	return "", nil
+		return "", nil
+	})
 }
 
 // GetName returns (name bool, errMessage string, err error) about the user's name for the given id
-func (handler Handler) GetName(id string) (string, string, error) {
+func (handler Handler) GetName(ctx context.Context, id string) (string, string, error) {
 	var name string
-	row := handler.DB.QueryRow("SELECT name FROM users WHERE id=?", id)
+	row := handler.QueryRow(ctx, "SELECT name FROM users WHERE id=? OR id=(SELECT userId FROM userAliases WHERE alias=?)", id, id)
 	err := row.Scan(&name)
 	if err != nil {
 		if err == sql.ErrNoRows {
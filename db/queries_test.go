@@ -0,0 +1,49 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestHashToken(t *testing.T) {
+	// echo -n token | sha256sum
+	const expected = "3c469e9d6c5875d37a43f353d4f88e61fcf812c66eee3457465a40b0da4153e0"
+
+	if hash := hashToken("token"); hash != expected {
+		t.Errorf("hashToken(\"token\") = %v, expected %v", hash, expected)
+	}
+}
+
+func TestSessionTokensAreHashed(t *testing.T) {
+	ctx := context.Background()
+	handler := openTestHandler(t)
+	accessToken := testLogin(t, handler, "alice", "Alice", "alice@example.com")
+
+	var stored string
+	err := handler.QueryRow(ctx, "SELECT accessToken FROM userSessions").Scan(&stored)
+	if err != nil {
+		t.Fatalf("Could not read session: %v", err)
+	}
+	if stored == accessToken {
+		t.Fatalf("The access token was stored as-is")
+	}
+	if stored != hashToken(accessToken) {
+		t.Errorf("Stored token %v, expected the hash of the access token %v", stored, hashToken(accessToken))
+	}
+
+	loggedIn, name, _, _, err := handler.AccountInformation(ctx, accessToken)
+	if err != nil || !loggedIn || name != "Alice" {
+		t.Errorf("AccountInformation(accessToken) = %v, %v, %v, expected to be logged in as Alice", loggedIn, name, err)
+	}
+
+	// The hash is what a leaked database would reveal, and must not be usable as a token
+	loggedIn, _, _, _, err = handler.AccountInformation(ctx, stored)
+	if err != nil || loggedIn {
+		t.Errorf("AccountInformation(hash) = %v, %v, expected not to be logged in", loggedIn, err)
+	}
+
+	loggedIn, errorMessage, err := handler.SessionInformation(ctx, stored)
+	if err != nil || loggedIn || errorMessage == "" {
+		t.Errorf("SessionInformation(hash) = %v, %v, %v, expected an invalid session", loggedIn, errorMessage, err)
+	}
+}
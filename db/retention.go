@@ -0,0 +1,104 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"pebble-dev/rebble-auth/common"
+)
+
+// DeleteIdleSessions deletes the sessions which weren't used since the given date
+// Returns the number of sessions deleted
+func (handler Handler) DeleteIdleSessions(ctx context.Context, before time.Time) (int64, error) {
+	result, err := handler.Exec(ctx, "DELETE FROM userSessions WHERE lastUsed<?", before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// TrimLoginLog deletes the login log entries older than the given date
+// Returns the number of entries deleted
+func (handler Handler) TrimLoginLog(ctx context.Context, before time.Time) (int64, error) {
+	result, err := handler.Exec(ctx, "DELETE FROM userLoginLog WHERE time<?", before.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// DeleteExpiredPendingLinks deletes the account links and merges which can't be confirmed anymore
+// Returns the number of pending links deleted
+func (handler Handler) DeleteExpiredPendingLinks(ctx context.Context) (int64, error) {
+	result, err := handler.Exec(ctx, "DELETE FROM pendingLinks WHERE created<?", time.Now().Add(-pendingLinkLifetime).UnixNano())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// anonymizeBatchSize is how many rows anonymizeIps updates per transaction, so that a large backlog doesn't make for a
+// transaction holding the write lock for long, or running into the query timeout
+var anonymizeBatchSize = 500
+
+// anonymizeIps anonymizes the IP addresses of a table, in the rows whose timestamp column is older than the given date.
+// Each batch is committed on its own, so that the rows anonymized so far stay anonymized if a later batch fails.
+func (handler Handler) anonymizeIps(ctx context.Context, table string, timeColumn string, before time.Time) (int64, error) {
+	var count int64
+	for {
+		var batch int
+		_, err := handler.transaction(ctx, func(tx *Tx) (string, error) {
+			rows, err := tx.Query("SELECT id, remoteIp FROM "+table+" WHERE ipAnonymized=0 AND "+timeColumn+"<? ORDER BY id LIMIT ?", before.UnixNano(), anonymizeBatchSize)
+			if err != nil {
+				return "", err
+			}
+
+			ips := make(map[int64]string)
+			for rows.Next() {
+				var id int64
+				var ip string
+				err = rows.Scan(&id, &ip)
+				if err != nil {
+					rows.Close()
+					return "", err
+				}
+				ips[id] = ip
+			}
+			rows.Close()
+
+			for id, ip := range ips {
+				_, err = tx.Exec("UPDATE "+table+" SET remoteIp=?, ipAnonymized=1 WHERE id=?", common.AnonymizeIp(ip), id)
+				if err != nil {
+					return "", err
+				}
+			}
+
+			batch = len(ips)
+			return "", nil
+		})
+		if err != nil {
+			return count, err
+		}
+
+		count += int64(batch)
+		if batch < anonymizeBatchSize {
+			return count, nil
+		}
+	}
+}
+
+// AnonymizeIps anonymizes the IP addresses of the sessions created and the login attempts made before the given date
+// (see common.AnonymizeIp)
+// Returns the number of sessions and login log entries anonymized
+func (handler Handler) AnonymizeIps(ctx context.Context, before time.Time) (int64, error) {
+	sessions, err := handler.anonymizeIps(ctx, "userSessions", "created", before)
+	if err != nil {
+		return 0, err
+	}
+
+	logins, err := handler.anonymizeIps(ctx, "userLoginLog", "time", before)
+	return sessions + logins, err
+}
@@ -0,0 +1,149 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDeleteIdleSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		accessToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		count, err := store.DeleteIdleSessions(ctx, time.Now().Add(-time.Hour))
+		if count != 0 || err != nil {
+			t.Errorf("DeleteIdleSessions() = %v, %v, expected the session to be kept", count, err)
+		}
+
+		count, err = store.DeleteIdleSessions(ctx, time.Now().Add(time.Hour))
+		if count != 1 || err != nil {
+			t.Errorf("DeleteIdleSessions() = %v, %v, expected the session to be deleted", count, err)
+		}
+
+		loggedIn, _, _ := store.SessionInformation(ctx, accessToken)
+		if loggedIn {
+			t.Errorf("An idle session could still be used")
+		}
+	})
+}
+
+func TestTrimLoginLog(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		err := store.LogLoginAttempt(ctx, LoginAttempt{Time: time.Now().Add(-48 * time.Hour), Reason: LoginInvalidCode, Provider: "test"})
+		if err != nil {
+			t.Fatalf("Could not log login attempt: %v", err)
+		}
+		testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		count, err := store.TrimLoginLog(ctx, time.Now().Add(-24*time.Hour))
+		if count != 1 || err != nil {
+			t.Errorf("TrimLoginLog() = %v, %v, expected the old entry to be deleted", count, err)
+		}
+
+		logins, err := store.LoginLog(ctx, "", "", 0, 10)
+		if err != nil || len(logins) != 1 || !logins[0].Success {
+			t.Errorf("Got %+v (%v), expected the recent login to be kept", logins, err)
+		}
+	})
+}
+
+func TestAnonymizeIps(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		accessToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		// Sessions and login log entries are each anonymized once
+		for _, expected := range []int64{2, 0} {
+			count, err := store.AnonymizeIps(ctx, time.Now().Add(time.Hour))
+			if count != expected || err != nil {
+				t.Errorf("AnonymizeIps() = %v, %v, expected %v", count, err, expected)
+			}
+		}
+
+		sessions, _, _, _ := store.AccountSessions(ctx, accessToken)
+		logins, _, _ := store.AccountLogins(ctx, accessToken, 10)
+		if len(sessions) != 1 || sessions[0].RemoteIp != "192.0.2.0" || len(logins) != 1 || logins[0].RemoteIp != "192.0.2.0" {
+			t.Errorf("Got sessions %+v and logins %+v, expected their IP addresses to be anonymized", sessions, logins)
+		}
+	})
+}
+
+func TestAnonymizeIpsInBatches(t *testing.T) {
+	defer func(size int) { anonymizeBatchSize = size }(anonymizeBatchSize)
+	anonymizeBatchSize = 2
+
+	ctx := context.Background()
+	handler := openTestHandler(t)
+	for i := 0; i < 5; i++ {
+		err := handler.LogLoginAttempt(ctx, LoginAttempt{Time: time.Now().Add(-time.Hour), Reason: LoginInvalidCode, Provider: "test", RemoteIp: "192.0.2.1"})
+		if err != nil {
+			t.Fatalf("Could not log login attempt: %v", err)
+		}
+	}
+
+	count, err := handler.AnonymizeIps(ctx, time.Now())
+	if count != 5 || err != nil {
+		t.Errorf("AnonymizeIps() = %v, %v, expected all of the login attempts to be anonymized", count, err)
+	}
+
+	var remaining int
+	err = handler.QueryRow(ctx, "SELECT COUNT(*) FROM userLoginLog WHERE ipAnonymized=0 OR remoteIp<>'192.0.2.0'").Scan(&remaining)
+	if remaining != 0 || err != nil {
+		t.Errorf("Got %v (%v) login attempts left, expected all of them to be anonymized", remaining, err)
+	}
+}
+
+func TestSessionIdleExpiry(t *testing.T) {
+	handler := openTestHandler(t)
+	handler.SessionIdle = time.Hour
+	memory := NewMemoryStore()
+	memory.SessionIdle = time.Hour
+
+	stores := []struct {
+		name  string
+		store Store
+		age   func(lastUsed time.Time)
+	}{
+		{"Handler", handler, func(lastUsed time.Time) {
+			_, err := handler.Exec(context.Background(), "UPDATE userSessions SET lastUsed=?", lastUsed.UnixNano())
+			if err != nil {
+				t.Fatalf("Could not age sessions: %v", err)
+			}
+		}},
+		{"Memory", memory, func(lastUsed time.Time) {
+			memory.lock.Lock()
+			defer memory.lock.Unlock()
+			for _, session := range memory.sessions {
+				session.LastUsed = lastUsed
+			}
+		}},
+	}
+	for _, s := range stores {
+		t.Run(s.name, func(t *testing.T) {
+			ctx := context.Background()
+			accessToken := testLogin(t, s.store, "alice", "Alice", "alice@example.com")
+
+			s.age(time.Now().Add(-30 * time.Minute))
+			_, errorMessage, err := s.store.LookupSession(ctx, accessToken)
+			if errorMessage != "" || err != nil {
+				t.Errorf("Could not look up a session used recently: %v (%v)", errorMessage, err)
+			}
+
+			// The cache only remembers what the store says
+			s.age(time.Now().Add(-2 * time.Hour))
+			for _, store := range []Store{s.store, NewSessionCache(s.store, 10, time.Minute)} {
+				_, errorMessage, err = store.LookupSession(ctx, accessToken)
+				if errorMessage != "Session expired" || err != nil {
+					t.Errorf("LookupSession() = %q, %v, expected the idle session to be expired", errorMessage, err)
+				}
+
+				loggedIn, _, _ := store.SessionInformation(ctx, accessToken)
+				if loggedIn {
+					t.Errorf("An idle session could still be used")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,344 @@
+package db
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// SessionCache is a Store which remembers session lookups for a little while, so that validating an access token
+// usually doesn't hit the database. Only valid sessions are cached, for ttl at most; they are forgotten as soon as
+// they are revoked, or when their account is disabled, changes role, is scheduled for deletion, deleted or merged.
+//
+// Other instances of rebble-auth sharing the database don't tell the cache about the changes they make, so the TTL
+// should be kept short in that case.
+type SessionCache struct {
+	Store
+
+	size int
+	ttl  time.Duration
+
+	lock       sync.Mutex
+	entries    *list.List               // Most recently used first
+	byToken    map[string]*list.Element // hashed access token => entry
+	generation int64                    // Bumped on every invalidation, so that lookups racing with one aren't cached
+
+	hits   int64
+	misses int64
+}
+
+type sessionCacheEntry struct {
+	token   string
+	session SessionUser
+	fetched time.Time
+}
+
+// SessionCacheStats tells how well the cache does
+type SessionCacheStats struct {
+	Size   int
+	Hits   int64
+	Misses int64
+}
+
+// NewSessionCache returns a cache of up to size sessions of store, each of them kept for ttl at most. A size of 0
+// disables caching.
+func NewSessionCache(store Store, size int, ttl time.Duration) *SessionCache {
+	return &SessionCache{
+		Store:   store,
+		size:    size,
+		ttl:     ttl,
+		entries: list.New(),
+		byToken: make(map[string]*list.Element),
+	}
+}
+
+// Stats returns how many sessions are cached, and how many lookups were served from the cache or not
+func (cache *SessionCache) Stats() SessionCacheStats {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	return SessionCacheStats{
+		Size:   cache.entries.Len(),
+		Hits:   cache.hits,
+		Misses: cache.misses,
+	}
+}
+
+// cached returns the cached session of a hashed access token, if it is still fresh, and the current generation
+func (cache *SessionCache) cached(token string, now time.Time) (SessionUser, bool, int64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	element, ok := cache.byToken[token]
+	if ok && now.Sub(element.Value.(*sessionCacheEntry).fetched) >= cache.ttl {
+		cache.remove(element)
+		ok = false
+	}
+	if !ok {
+		cache.misses++
+		return SessionUser{}, false, cache.generation
+	}
+
+	cache.hits++
+	cache.entries.MoveToFront(element)
+	return element.Value.(*sessionCacheEntry).session, true, cache.generation
+}
+
+// add caches the session of a hashed access token, unless the cache was invalidated since generation
+func (cache *SessionCache) add(token string, session SessionUser, fetched time.Time, generation int64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if generation != cache.generation {
+		return
+	}
+
+	if element, ok := cache.byToken[token]; ok {
+		cache.remove(element)
+	}
+
+	cache.byToken[token] = cache.entries.PushFront(&sessionCacheEntry{token: token, session: session, fetched: fetched})
+	for cache.entries.Len() > cache.size {
+		cache.remove(cache.entries.Back())
+	}
+}
+
+// remove drops an entry from the cache. The lock must be held.
+func (cache *SessionCache) remove(element *list.Element) {
+	cache.entries.Remove(element)
+	delete(cache.byToken, element.Value.(*sessionCacheEntry).token)
+}
+
+// invalidate drops the entries matching the given function from the cache
+func (cache *SessionCache) invalidate(match func(session SessionUser) bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	cache.generation++
+	for element := cache.entries.Front(); element != nil; {
+		next := element.Next()
+		if match(element.Value.(*sessionCacheEntry).session) {
+			cache.remove(element)
+		}
+		element = next
+	}
+}
+
+// InvalidateUser drops the sessions of a user from the cache, which must be done whenever they can't be used as they
+// are anymore (the user was disabled or changed type, for instance)
+func (cache *SessionCache) InvalidateUser(userId string) {
+	cache.invalidate(func(session SessionUser) bool {
+		return session.UserId == userId
+	})
+}
+
+// Flush empties the cache
+func (cache *SessionCache) Flush() {
+	cache.invalidate(func(session SessionUser) bool {
+		return true
+	})
+}
+
+// LookupSession returns the session the given access token belongs to along with the state of its user, from the
+// cache if possible
+// Returns (session SessionUser, errMessage string, err error)
+func (cache *SessionCache) LookupSession(ctx context.Context, accessToken string) (SessionUser, string, error) {
+	if cache.size <= 0 {
+		return cache.Store.LookupSession(ctx, accessToken)
+	}
+
+	token := hashToken(accessToken)
+	now := time.Now()
+	session, ok, generation := cache.cached(token, now)
+	if ok {
+		return session, "", nil
+	}
+
+	session, errorMessage, err := cache.Store.LookupSession(ctx, accessToken)
+	if errorMessage != "" || err != nil {
+		return SessionUser{}, errorMessage, err
+	}
+
+	cache.add(token, session, now, generation)
+	return session, "", nil
+}
+
+// SessionInformation returns (loggedIn bool, errMessage string, err error) about the current user session
+func (cache *SessionCache) SessionInformation(ctx context.Context, accessToken string) (bool, string, error) {
+	session, errorMessage, err := cache.LookupSession(ctx, accessToken)
+	if errorMessage != "" || err != nil {
+		return false, errorMessage, err
+	}
+
+	if session.Disabled {
+		return false, "Account is disabled", nil
+	}
+
+	now := time.Now()
+	if session.touchDue(now) {
+		err = cache.Store.TouchSession(ctx, session.SessionId, now)
+		if err != nil {
+			return false, "Internal server error", err
+		}
+
+		cache.touched(hashToken(accessToken), now)
+	}
+
+	return true, "", nil
+}
+
+// touched updates the last use of a cached session
+func (cache *SessionCache) touched(token string, now time.Time) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	if element, ok := cache.byToken[token]; ok {
+		element.Value.(*sessionCacheEntry).session.LastUsed = now
+	}
+}
+
+// AccountId returns the ID of the user the given access token belongs to, from the cache if possible
+// Returns (id string, errMessage string, err error)
+func (cache *SessionCache) AccountId(ctx context.Context, accessToken string) (string, string, error) {
+	session, errorMessage, err := cache.LookupSession(ctx, accessToken)
+	if err != nil {
+		return "", "Internal server error", err
+	}
+	if errorMessage != "" {
+		return "", "Invalid access token", nil
+	}
+
+	return session.UserId, "", nil
+}
+
+// RevokeSession logs out one of the sessions of the user the given access token belongs to, and forgets it
+// Returns errorMessage, error
+func (cache *SessionCache) RevokeSession(ctx context.Context, accessToken string, sessionId int64, remoteIp string) (string, error) {
+	errorMessage, err := cache.Store.RevokeSession(ctx, accessToken, sessionId, remoteIp)
+	if errorMessage == "" && err == nil {
+		cache.invalidate(func(session SessionUser) bool {
+			return session.SessionId == sessionId
+		})
+	}
+
+	return errorMessage, err
+}
+
+// AccountScheduleDeletion schedules the deletion of an account, which logs out all of its sessions
+// Returns errorMessage, err
+func (cache *SessionCache) AccountScheduleDeletion(ctx context.Context, accessToken string, authenticatedSince time.Time, deletion time.Time, remoteIp string) (string, error) {
+	// Once the sessions are logged out, there is no telling whose they were
+	session, _, _ := cache.LookupSession(ctx, accessToken)
+
+	errorMessage, err := cache.Store.AccountScheduleDeletion(ctx, accessToken, authenticatedSince, deletion, remoteIp)
+	if errorMessage == "" && err == nil && session.UserId != "" {
+		cache.InvalidateUser(session.UserId)
+	}
+
+	return errorMessage, err
+}
+
+// AccountDelete deletes an account, and forgets its sessions
+func (cache *SessionCache) AccountDelete(ctx context.Context, userId string, now time.Time, hookURLs []string) (bool, error) {
+	deleted, err := cache.Store.AccountDelete(ctx, userId, now, hookURLs)
+	if deleted {
+		cache.InvalidateUser(userId)
+	}
+
+	return deleted, err
+}
+
+// AccountMerge merges another account into the one of the given access token
+// Returns errorMessage, err
+func (cache *SessionCache) AccountMerge(ctx context.Context, mergeToken string, rebbleAccessToken string, remoteIp string) (string, error) {
+	errorMessage, err := cache.Store.AccountMerge(ctx, mergeToken, rebbleAccessToken, remoteIp)
+	if errorMessage == "" && err == nil {
+		// The sessions of the merged account now belong to another user, and we don't know which ones they were
+		cache.Flush()
+	}
+
+	return errorMessage, err
+}
+
+// ApproveDeveloperClaim approves a developer claim, which merges a mirror account into the claimant's and may change
+// their role
+// Returns errorMessage, err
+func (cache *SessionCache) ApproveDeveloperClaim(ctx context.Context, claimId int64, resolvedBy string, actorId string, remoteIp string) (string, error) {
+	errorMessage, err := cache.Store.ApproveDeveloperClaim(ctx, claimId, resolvedBy, actorId, remoteIp)
+	if errorMessage == "" && err == nil {
+		// We don't know whose claim it was
+		cache.Flush()
+	}
+
+	return errorMessage, err
+}
+
+// SetUserRole changes the role of a user, which its cached sessions don't know about
+// Returns errorMessage, err
+func (cache *SessionCache) SetUserRole(ctx context.Context, userId string, role string, actorId string, remoteIp string) (string, error) {
+	errorMessage, err := cache.Store.SetUserRole(ctx, userId, role, actorId, remoteIp)
+	if errorMessage == "" && err == nil {
+		cache.InvalidateUser(userId)
+	}
+
+	return errorMessage, err
+}
+
+// SetUserDisabled disables or enables a user, whose cached sessions would still be let in otherwise
+// Returns errorMessage, err
+func (cache *SessionCache) SetUserDisabled(ctx context.Context, userId string, disabled bool, actorId string, remoteIp string) (string, error) {
+	errorMessage, err := cache.Store.SetUserDisabled(ctx, userId, disabled, actorId, remoteIp)
+	if errorMessage == "" && err == nil {
+		cache.InvalidateUser(userId)
+	}
+
+	return errorMessage, err
+}
+
+// LogoutUser logs out all of the sessions of a user, and forgets them
+// Returns (sessions int64, errorMessage string, err error)
+func (cache *SessionCache) LogoutUser(ctx context.Context, userId string, actorId string, remoteIp string) (int64, string, error) {
+	count, errorMessage, err := cache.Store.LogoutUser(ctx, userId, actorId, remoteIp)
+	if errorMessage == "" && err == nil {
+		cache.InvalidateUser(userId)
+	}
+
+	return count, errorMessage, err
+}
+
+// RevokeUserSession logs out one of the sessions of a user, and forgets it
+// Returns errorMessage, err
+func (cache *SessionCache) RevokeUserSession(ctx context.Context, userId string, sessionId int64, actorId string, remoteIp string) (string, error) {
+	errorMessage, err := cache.Store.RevokeUserSession(ctx, userId, sessionId, actorId, remoteIp)
+	if errorMessage == "" && err == nil {
+		cache.invalidate(func(session SessionUser) bool {
+			return session.SessionId == sessionId
+		})
+	}
+
+	return errorMessage, err
+}
+
+// DeleteIdleSessions deletes the sessions unused since before, and forgets them
+func (cache *SessionCache) DeleteIdleSessions(ctx context.Context, before time.Time) (int64, error) {
+	deleted, err := cache.Store.DeleteIdleSessions(ctx, before)
+	if deleted > 0 {
+		cache.invalidate(func(session SessionUser) bool {
+			return session.LastUsed.Before(before)
+		})
+	}
+
+	return deleted, err
+}
+
+// WriteBackup writes a snapshot of the cached store, if it can be backed up
+func (cache *SessionCache) WriteBackup(w io.Writer, compress bool) error {
+	backuper, ok := cache.Store.(Backuper)
+	if !ok {
+		return ErrBackupUnsupported
+	}
+
+	return backuper.WriteBackup(w, compress)
+}
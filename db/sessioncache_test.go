@@ -0,0 +1,156 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessionCache(t *testing.T) {
+	ctx := context.Background()
+	cache := NewSessionCache(NewMemoryStore(), 10, time.Minute)
+	accessToken := testLogin(t, cache, "alice", "Alice", "alice@example.com")
+
+	for i := 0; i < 3; i++ {
+		loggedIn, errorMessage, err := cache.SessionInformation(ctx, accessToken)
+		if !loggedIn || err != nil {
+			t.Fatalf("SessionInformation() = %v, %q, %v, expected alice to be logged in", loggedIn, errorMessage, err)
+		}
+	}
+
+	// Invalid access tokens are never cached
+	for i := 0; i < 2; i++ {
+		loggedIn, _, _ := cache.SessionInformation(ctx, "invalid")
+		if loggedIn {
+			t.Errorf("Logged in with an invalid access token")
+		}
+	}
+
+	stats := cache.Stats()
+	if stats != (SessionCacheStats{Size: 1, Hits: 2, Misses: 3}) {
+		t.Errorf("Got %+v, expected only alice's session to be cached", stats)
+	}
+}
+
+func TestSessionCacheExpiry(t *testing.T) {
+	ctx := context.Background()
+	cache := NewSessionCache(NewMemoryStore(), 1, 20*time.Millisecond)
+	aliceToken := testLogin(t, cache, "alice", "Alice", "alice@example.com")
+	bobToken := testLogin(t, cache, "bob", "Bob", "bob@example.com")
+
+	// The cache only has room for one session, so bob's replaces alice's
+	cache.LookupSession(ctx, aliceToken)
+	cache.LookupSession(ctx, bobToken)
+	cache.LookupSession(ctx, aliceToken)
+	if stats := cache.Stats(); stats.Size != 1 || stats.Hits != 0 {
+		t.Errorf("Got %+v, expected alice's session to have been evicted", stats)
+	}
+
+	// Sessions are looked up again once they are stale
+	time.Sleep(20 * time.Millisecond)
+	cache.LookupSession(ctx, aliceToken)
+	if stats := cache.Stats(); stats.Hits != 0 || stats.Misses != 4 {
+		t.Errorf("Got %+v, expected the stale session to be looked up again", stats)
+	}
+}
+
+func TestSessionCacheInvalidation(t *testing.T) {
+	ctx := context.Background()
+	cache := NewSessionCache(NewMemoryStore(), 10, time.Minute)
+	aliceToken := testLogin(t, cache, "alice", "Alice", "alice@example.com")
+	aliceId := testUserId(t, cache, aliceToken)
+	bobToken := testLogin(t, cache, "bob", "Bob", "bob@example.com")
+	bobSession, _, _ := cache.LookupSession(ctx, bobToken)
+
+	errorMessage, err := cache.SetUserRole(ctx, aliceId, "admin", AuditActorSystem, "")
+	if errorMessage != "" || err != nil {
+		t.Fatalf("Could not set role: %v (%v)", errorMessage, err)
+	}
+	session, _, _ := cache.LookupSession(ctx, aliceToken)
+	if session.Type != "admin" {
+		t.Errorf("Got type %q, expected the new role to show up right away", session.Type)
+	}
+
+	errorMessage, err = cache.SetUserDisabled(ctx, aliceId, true, AuditActorSystem, "")
+	if errorMessage != "" || err != nil {
+		t.Fatalf("Could not disable account: %v (%v)", errorMessage, err)
+	}
+	loggedIn, _, _ := cache.SessionInformation(ctx, aliceToken)
+	if loggedIn {
+		t.Errorf("alice is still logged in after her account was disabled")
+	}
+
+	errorMessage, err = cache.RevokeSession(ctx, bobToken, bobSession.SessionId, "")
+	if errorMessage != "" || err != nil {
+		t.Fatalf("Could not revoke session: %v (%v)", errorMessage, err)
+	}
+	loggedIn, _, _ = cache.SessionInformation(ctx, bobToken)
+	if loggedIn {
+		t.Errorf("bob is still logged in after revoking his session")
+	}
+
+	cache.Flush()
+	if stats := cache.Stats(); stats.Size != 0 {
+		t.Errorf("Got %+v after flushing the cache, expected it to be empty", stats)
+	}
+}
+
+func TestSessionCacheBackup(t *testing.T) {
+	var buffer bytes.Buffer
+	err := NewSessionCache(NewMemoryStore(), 10, time.Minute).WriteBackup(&buffer, false)
+	if err != ErrBackupUnsupported {
+		t.Errorf("WriteBackup() = %v for a memory store, expected ErrBackupUnsupported", err)
+	}
+
+	err = NewSessionCache(openTestHandler(t), 10, time.Minute).WriteBackup(&buffer, false)
+	if err != nil || !bytes.HasPrefix(buffer.Bytes(), []byte("SQLite format 3\x00")) {
+		t.Errorf("WriteBackup() = %v, expected the cached database to be backed up", err)
+	}
+}
+
+// BenchmarkSessionLookup measures how long validating an access token takes with and without the session cache, on
+// an SQLite database holding 1000 sessions
+func BenchmarkSessionLookup(b *testing.B) {
+	handler, err := Open(SQLite, filepath.Join(b.TempDir(), "rebble-auth.db"))
+	if err != nil {
+		b.Fatalf("Could not open database: %v", err)
+	}
+	defer handler.Close()
+
+	_, err = handler.Migrate()
+	if err != nil {
+		b.Fatalf("Could not migrate database: %v", err)
+	}
+
+	ctx := context.Background()
+	tokens := make([]string, 1000)
+	for i := range tokens {
+		sub := fmt.Sprintf("benchmark-%v", i)
+		accessToken, _, errorMessage, err := handler.AccountLoginOrRegister(ctx, "benchmark", sub, sub, sub+"@example.com", false, "{}", "", "", 0, SessionMetadata{})
+		if errorMessage != "" || err != nil {
+			b.Fatalf("Could not create session: %v (%v)", errorMessage, err)
+		}
+		tokens[i] = accessToken
+	}
+
+	for _, benchmark := range []struct {
+		name  string
+		store Store
+	}{
+		{"Uncached", handler},
+		{"Cached", NewSessionCache(handler, 10000, time.Minute)},
+	} {
+		b.Run(benchmark.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				loggedIn, errorMessage, err := benchmark.store.SessionInformation(ctx, tokens[rand.Intn(len(tokens))])
+				if !loggedIn {
+					b.Fatalf("Could not validate session: %v (%v)", errorMessage, err)
+				}
+			}
+		})
+	}
+}
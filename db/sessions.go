@@ -0,0 +1,145 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// sessionLastUsedPrecision is how often the last use of a session is recorded
+const sessionLastUsedPrecision = time.Minute
+
+// unixNanoTime converts a timestamp stored in the database to a time.Time, 0 meaning it is unknown
+func unixNanoTime(t int64) time.Time {
+	if t == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(0, t)
+}
+
+// LookupSession returns the session the given access token belongs to along with the state of its user, in a single
+// query
+// Returns (session SessionUser, errMessage string, err error)
+func (handler Handler) LookupSession(ctx context.Context, accessToken string) (SessionUser, string, error) {
+	var session SessionUser
+	var lastUsed int64
+	row := handler.QueryRow(ctx, "SELECT userSessions.id, userSessions.lastUsed, users.id, users.type, users.disabled FROM userSessions JOIN users ON users.id = userSessions.userId WHERE userSessions.accessToken=?", hashToken(accessToken))
+	err := row.Scan(&session.SessionId, &lastUsed, &session.UserId, &session.Type, &session.Disabled)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return SessionUser{}, "Invalid session", nil
+		}
+
+		return SessionUser{}, "Internal server error", err
+	}
+	session.LastUsed = unixNanoTime(lastUsed)
+
+	expires := session.Expires(handler.SessionIdle)
+	if !expires.IsZero() && time.Now().After(expires) {
+		return SessionUser{}, "Session expired", nil
+	}
+
+	return session, "", nil
+}
+
+// TouchSession records that a session was used. To avoid a write on every request, this is only done once per minute.
+func (handler Handler) TouchSession(ctx context.Context, sessionId int64, now time.Time) error {
+	_, err := handler.Exec(ctx, "UPDATE userSessions SET lastUsed=? WHERE id=? AND lastUsed<?", now.UnixNano(), sessionId, now.Add(-sessionLastUsedPrecision).UnixNano())
+	return err
+}
+
+// touchDue reports whether the last use of the session should be recorded again
+func (session SessionUser) touchDue(now time.Time) bool {
+	return now.Sub(session.LastUsed) >= sessionLastUsedPrecision
+}
+
+// userSessions lists the sessions of a user, most recently used first
+func (handler Handler) userSessions(ctx context.Context, userId string) ([]Session, error) {
+	rows, err := handler.Query(ctx, "SELECT id, created, lastUsed, provider, clientId, userAgent, remoteIp FROM userSessions WHERE userId=? ORDER BY lastUsed DESC", userId)
+	if err != nil {
+		return []Session{}, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		var created, lastUsed int64
+		err = rows.Scan(&session.Id, &created, &lastUsed, &session.Provider, &session.ClientId, &session.UserAgent, &session.RemoteIp)
+		if err != nil {
+			return []Session{}, err
+		}
+		session.Created = unixNanoTime(created)
+		session.LastUsed = unixNanoTime(lastUsed)
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, rows.Err()
+}
+
+// AccountSessions lists the sessions of the user the given access token belongs to
+// Returns (sessions []Session, currentSessionId int64, errMessage string, err error)
+func (handler Handler) AccountSessions(ctx context.Context, accessToken string) ([]Session, int64, string, error) {
+	var userId string
+	var currentSessionId int64
+	row := handler.QueryRow(ctx, "SELECT userId, id FROM userSessions WHERE accessToken=?", hashToken(accessToken))
+	err := row.Scan(&userId, &currentSessionId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return []Session{}, 0, "Invalid access token", nil
+		}
+
+		return []Session{}, 0, "Internal server error", err
+	}
+
+	sessions, err := handler.userSessions(ctx, userId)
+	if err != nil {
+		return []Session{}, 0, "Internal server error", err
+	}
+
+	return sessions, currentSessionId, "", nil
+}
+
+// RevokeSession logs out one of the sessions of the user the given access token belongs to (possibly the current one)
+// Returns errorMessage, error
+func (handler Handler) RevokeSession(ctx context.Context, accessToken string, sessionId int64, remoteIp string) (string, error) {
+	userId, err := handler.getAccountId(ctx, accessToken)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return "Invalid access token", nil
+		}
+
+		return "Internal server error", err
+	}
+
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		result, err := tx.Exec("DELETE FROM userSessions WHERE id=? AND userId=?", sessionId, userId)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		count, err := result.RowsAffected()
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		if count == 0 {
+			return "No such session", nil
+		}
+
+		err = audit(tx, AuditEntry{
+			ActorId:  userId,
+			UserId:   userId,
+			Action:   AuditSessionRevoke,
+			Before:   auditValues(map[string]interface{}{"sessionId": sessionId}),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+}
@@ -0,0 +1,167 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Store is the storage backend of rebble-auth. Handler implements it on top of an SQL database, while MemoryStore
+// keeps everything in memory, which is mostly useful for tests and development.
+//
+// Methods which take an access token expect the token as handed to the user; hashing it is up to the Store.
+// As with the rest of rebble-auth, methods return a human-readable errorMessage along with an error, the latter only
+// being set if the error was unexpected (internal server error vs bad request).
+//
+// Every method takes the context of the request it is made for. The SQL implementation cancels its queries once the
+// context is done, and gives each of them a deadline (see Handler.QueryTimeout); see Unavailable for telling such
+// errors apart.
+type Store interface {
+	// Users
+
+	// AccountExists checks if an account is linked to the given identity
+	AccountExists(ctx context.Context, provider string, sub string) (bool, error)
+	// AccountId returns id, errorMessage, err
+	AccountId(ctx context.Context, accessToken string) (string, string, error)
+	// AccountInformation returns success, name, email, providers, err
+	AccountInformation(ctx context.Context, accessToken string) (bool, string, string, []string, error)
+	// UpdateName returns errorMessage, err
+	UpdateName(ctx context.Context, accessToken string, name string, remoteIp string) (string, error)
+	// SetUserRole returns errorMessage, err
+	SetUserRole(ctx context.Context, userId string, role string, actorId string, remoteIp string) (string, error)
+	// SearchUsers returns a page of the users matching query, or of all users if query is empty
+	SearchUsers(ctx context.Context, query string, offset int, limit int) ([]UserSummary, error)
+	// SetUserDisabled returns errorMessage, err
+	SetUserDisabled(ctx context.Context, userId string, disabled bool, actorId string, remoteIp string) (string, error)
+	// SetUserName returns errorMessage, err
+	SetUserName(ctx context.Context, userId string, name string, actorId string, remoteIp string) (string, error)
+	// GetName returns name, errorMessage, err
+	GetName(ctx context.Context, id string) (string, string, error)
+	// ResolveAlias returns id, errorMessage, err
+	ResolveAlias(ctx context.Context, id string) (string, string, error)
+	// ProfileSettings returns profileProvider, syncName, errorMessage, err
+	ProfileSettings(ctx context.Context, accessToken string) (string, bool, string, error)
+	// UpdateProfileSettings returns errorMessage, err
+	UpdateProfileSettings(ctx context.Context, accessToken string, profileProvider string, syncName bool, remoteIp string) (string, error)
+	// ImportPebbleDevelopers creates or renames the mirror accounts of a batch of Pebble developers
+	ImportPebbleDevelopers(ctx context.Context, developers []PebbleDeveloper, actorId string) (ImportReport, error)
+	// PebbleImportCheckpoint returns the ID of the last developer imported by an unfinished import, if any
+	PebbleImportCheckpoint(ctx context.Context) (string, error)
+	// ClearPebbleImportCheckpoint forgets the checkpoint of the Pebble developer import
+	ClearPebbleImportCheckpoint(ctx context.Context) error
+	// UserExport returns everything stored about a user, errorMessage, err
+	UserExport(ctx context.Context, userId string) (UserExport, string, error)
+	// AccountScheduleDeletion returns errorMessage, err
+	AccountScheduleDeletion(ctx context.Context, accessToken string, authenticatedSince time.Time, deletion time.Time, remoteIp string) (string, error)
+	// AccountsDueForDeletion returns the IDs of the accounts whose deletion date has passed
+	AccountsDueForDeletion(ctx context.Context, now time.Time) ([]string, error)
+	// AccountDelete returns whether the account was deleted. If it was, a notification is queued for each of hookURLs.
+	AccountDelete(ctx context.Context, userId string, now time.Time, hookURLs []string) (bool, error)
+	// DueDeletionNotifications returns the deletion notifications to send, oldest attempt first
+	DueDeletionNotifications(ctx context.Context, now time.Time, limit int) ([]DeletionNotification, error)
+	// DeletionNotificationDone forgets a deletion notification once it was sent
+	DeletionNotificationDone(ctx context.Context, id int64) error
+	// DeletionNotificationFailed records that sending a deletion notification failed, and when to try again
+	DeletionNotificationFailed(ctx context.Context, id int64, lastError string, nextAttempt time.Time) error
+
+	// Sessions and login log
+
+	// AccountLoginOrRegister returns accessToken, linkToken, errorMessage, err
+	AccountLoginOrRegister(ctx context.Context, provider string, sub string, name string, email string, linkEmail bool, profile string, ssoAccessToken string, ssoRefreshToken string, expires int64, session SessionMetadata) (string, string, string, error)
+	// SessionInformation returns loggedIn, errorMessage, err
+	SessionInformation(ctx context.Context, accessToken string) (bool, string, error)
+	// LookupSession returns session, errorMessage, err
+	LookupSession(ctx context.Context, accessToken string) (SessionUser, string, error)
+	// TouchSession records that a session was used
+	TouchSession(ctx context.Context, sessionId int64, now time.Time) error
+	// AccountSessions returns sessions, currentSessionId, errorMessage, err
+	AccountSessions(ctx context.Context, accessToken string) ([]Session, int64, string, error)
+	// RevokeSession returns errorMessage, err
+	RevokeSession(ctx context.Context, accessToken string, sessionId int64, remoteIp string) (string, error)
+	// LogoutUser returns the number of sessions logged out, errorMessage, err
+	LogoutUser(ctx context.Context, userId string, actorId string, remoteIp string) (int64, string, error)
+	// RevokeUserSession returns errorMessage, err
+	RevokeUserSession(ctx context.Context, userId string, sessionId int64, actorId string, remoteIp string) (string, error)
+	// LogLoginAttempt records a login attempt which failed before reaching the Store
+	LogLoginAttempt(ctx context.Context, attempt LoginAttempt) error
+	// AccountLogins returns the user's most recent login attempts, errorMessage, err
+	AccountLogins(ctx context.Context, accessToken string, limit int) ([]LoginAttempt, string, error)
+	// LoginLog returns a page of the login log, optionally filtered by user and/or IP address
+	LoginLog(ctx context.Context, userId string, remoteIp string, offset int, limit int) ([]LoginAttempt, error)
+	// ProviderStats returns how each identity provider is used, counting the logins made since the given time
+	ProviderStats(ctx context.Context, since time.Time) ([]ProviderStats, error)
+
+	// Retention
+
+	// DeleteIdleSessions returns the number of sessions deleted
+	DeleteIdleSessions(ctx context.Context, before time.Time) (int64, error)
+	// TrimLoginLog returns the number of login log entries deleted
+	TrimLoginLog(ctx context.Context, before time.Time) (int64, error)
+	// DeleteExpiredPendingLinks returns the number of pending links deleted
+	DeleteExpiredPendingLinks(ctx context.Context) (int64, error)
+	// AnonymizeIps returns the number of sessions and login log entries anonymized
+	AnonymizeIps(ctx context.Context, before time.Time) (int64, error)
+
+	// Pebble developer claims
+
+	// ClaimDeveloper returns claim, errorMessage, err
+	ClaimDeveloper(ctx context.Context, accessToken string, developerId string, remoteIp string) (DeveloperClaim, string, error)
+	// AccountDeveloperClaims returns the claims made by the user, errorMessage, err
+	AccountDeveloperClaims(ctx context.Context, accessToken string) ([]DeveloperClaim, string, error)
+	// DeveloperClaims returns a page of the claims with the given status, or of all claims if status is empty
+	DeveloperClaims(ctx context.Context, status string, offset int, limit int) ([]DeveloperClaim, error)
+	// ApproveDeveloperClaim returns errorMessage, err
+	ApproveDeveloperClaim(ctx context.Context, claimId int64, resolvedBy string, actorId string, remoteIp string) (string, error)
+	// RejectDeveloperClaim returns errorMessage, err
+	RejectDeveloperClaim(ctx context.Context, claimId int64, actorId string, remoteIp string) (string, error)
+
+	// Admin jobs
+
+	// SaveAdminJob creates or updates an admin job
+	SaveAdminJob(ctx context.Context, job AdminJob) error
+	// AdminJob returns job, exists, err
+	AdminJob(ctx context.Context, id string) (AdminJob, bool, error)
+	// AdminJobs returns the most recent admin jobs, latest first
+	AdminJobs(ctx context.Context, limit int) ([]AdminJob, error)
+	// StartAdminJob returns whether the job was started, which it isn't if a job with the same name is running
+	StartAdminJob(ctx context.Context, job AdminJob, staleBefore time.Time) (bool, error)
+	// HeartbeatAdminJob records that a running job is still running, along with its progress
+	HeartbeatAdminJob(ctx context.Context, job AdminJob) error
+	// InterruptAdminJobs returns the number of running jobs without a heartbeat since staleBefore marked as interrupted
+	InterruptAdminJobs(ctx context.Context, staleBefore time.Time) (int64, error)
+
+	// Audit log
+
+	// AuditLog returns a page of the audit log, latest first
+	AuditLog(ctx context.Context, filter AuditFilter, offset int, limit int) ([]AuditEntry, error)
+
+	// Registered clients
+
+	// Clients returns the registered clients
+	Clients(ctx context.Context) ([]Client, error)
+	// SaveClient returns errorMessage, err
+	SaveClient(ctx context.Context, client Client, actorId string, remoteIp string) (string, error)
+	// DeleteClient returns errorMessage, err
+	DeleteClient(ctx context.Context, id string, actorId string, remoteIp string) (string, error)
+
+	// Provider links
+
+	// AccountAddProvider returns mergeToken, errorMessage, err
+	AccountAddProvider(ctx context.Context, provider string, sub string, profile string, rebbleAccessToken string, ssoAccessToken string, ssoRefreshToken string, expires int64, remoteIp string) (string, string, error)
+	// AccountRemoveProvider returns errorMessage, err
+	AccountRemoveProvider(ctx context.Context, provider string, rebbleAccessToken string, remoteIp string) (string, error)
+	// AccountProviderSessions returns the identities linked to an account, along with their tokens
+	AccountProviderSessions(ctx context.Context, userId string) ([]ProviderSession, error)
+	// AccountConfirmLink returns errorMessage, err
+	AccountConfirmLink(ctx context.Context, linkToken string, rebbleAccessToken string, remoteIp string) (string, error)
+	// AccountDeclineLink returns accessToken, redirectURI, errorMessage, err
+	AccountDeclineLink(ctx context.Context, linkToken string, session SessionMetadata) (string, string, string, error)
+	// AccountMerge returns errorMessage, err
+	AccountMerge(ctx context.Context, mergeToken string, rebbleAccessToken string, remoteIp string) (string, error)
+}
+
+// Make sure both implementations stay in sync with the interface
+var (
+	_ Store = Handler{}
+	_ Store = &MemoryStore{}
+	_ Store = &SessionCache{}
+)
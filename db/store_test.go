@@ -0,0 +1,240 @@
+package db
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// The tests in this file check that every Store implementation behaves the same way
+
+func TestStoreAccountExists(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		exists, err := store.AccountExists(ctx, "test", "alice")
+		if !exists || err != nil {
+			t.Errorf("AccountExists(test, alice) = %v, %v, expected true", exists, err)
+		}
+
+		exists, err = store.AccountExists(ctx, "other", "alice")
+		if exists || err != nil {
+			t.Errorf("AccountExists(other, alice) = %v, %v, expected false", exists, err)
+		}
+	})
+}
+
+func TestStoreInvalidAccessToken(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+
+		loggedIn, _, _, _, err := store.AccountInformation(ctx, "invalid")
+		if loggedIn || err != nil {
+			t.Errorf("AccountInformation() = %v, %v, expected not to be logged in", loggedIn, err)
+		}
+
+		loggedIn, errorMessage, err := store.SessionInformation(ctx, "invalid")
+		if loggedIn || errorMessage == "" || err != nil {
+			t.Errorf("SessionInformation() = %v, %q, %v, expected an invalid session", loggedIn, errorMessage, err)
+		}
+
+		userId, errorMessage, err := store.AccountId(ctx, "invalid")
+		if userId != "" || errorMessage == "" || err != nil {
+			t.Errorf("AccountId() = %q, %q, %v, expected an invalid session", userId, errorMessage, err)
+		}
+
+		errorMessage, _ = store.UpdateName(ctx, "invalid", "Mallory", "")
+		if errorMessage == "" {
+			t.Errorf("UpdateName() succeeded with an invalid session")
+		}
+	})
+}
+
+func TestStoreNames(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		accessToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		userId := testUserId(t, store, accessToken)
+
+		errorMessage, err := store.UpdateName(ctx, accessToken, "Ali", "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not update name: %v (%v)", errorMessage, err)
+		}
+
+		name, errorMessage, err := store.GetName(ctx, userId)
+		if name != "Ali" || errorMessage != "" || err != nil {
+			t.Errorf("GetName() = %q, %q, %v, expected Ali", name, errorMessage, err)
+		}
+
+		_, errorMessage, err = store.GetName(ctx, "unknown")
+		if errorMessage == "" || err != nil {
+			t.Errorf("GetName(\"unknown\") = %q, %v, expected no user", errorMessage, err)
+		}
+	})
+}
+
+func TestStoreSessions(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		firstToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		secondToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		sessions, currentId, errorMessage, err := store.AccountSessions(ctx, secondToken)
+		if errorMessage != "" || err != nil || len(sessions) != 2 {
+			t.Fatalf("Expected 2 sessions, got %+v: %v (%v)", sessions, errorMessage, err)
+		}
+		if sessions[0].Provider != "test" || sessions[0].RemoteIp != "192.0.2.1" {
+			t.Errorf("Got session %+v, expected the provider and IP address it was created with", sessions[0])
+		}
+
+		var otherId int64
+		for _, session := range sessions {
+			if session.Id != currentId {
+				otherId = session.Id
+			}
+		}
+
+		errorMessage, err = store.RevokeSession(ctx, secondToken, otherId, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not revoke session: %v (%v)", errorMessage, err)
+		}
+
+		loggedIn, _, _ := store.SessionInformation(ctx, firstToken)
+		if loggedIn {
+			t.Errorf("A revoked session could still be used")
+		}
+
+		loggedIn, _, _ = store.SessionInformation(ctx, secondToken)
+		if !loggedIn {
+			t.Errorf("Revoking a session logged out of another one")
+		}
+
+		// Users can only revoke their own sessions
+		bobToken := testLogin(t, store, "bob", "Bob", "bob@example.com")
+		errorMessage, _ = store.RevokeSession(ctx, bobToken, currentId, "")
+		loggedIn, _, _ = store.SessionInformation(ctx, secondToken)
+		if errorMessage == "" || !loggedIn {
+			t.Errorf("A session was revoked by another user")
+		}
+	})
+}
+
+func TestStoreLookupSession(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		accessToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		session, errorMessage, err := store.LookupSession(ctx, accessToken)
+		if errorMessage != "" || err != nil || session.UserId != testUserId(t, store, accessToken) || session.Type != "user" {
+			t.Fatalf("LookupSession() = %+v, %q, %v, expected alice's session", session, errorMessage, err)
+		}
+
+		// Uses are only recorded once in a while
+		for _, test := range []struct {
+			now      time.Time
+			recorded bool
+		}{
+			{time.Now(), false},
+			{time.Now().Add(2 * sessionLastUsedPrecision), true},
+		} {
+			err = store.TouchSession(ctx, session.SessionId, test.now)
+			if err != nil {
+				t.Fatalf("Could not touch session: %v", err)
+			}
+
+			sessions, _, _, _ := store.AccountSessions(ctx, accessToken)
+			if len(sessions) != 1 || (sessions[0].LastUsed.UnixNano() == test.now.UnixNano()) != test.recorded {
+				t.Errorf("Got sessions %+v after using it at %v, expected the use to be recorded: %v", sessions, test.now, test.recorded)
+			}
+		}
+
+		_, errorMessage, _ = store.LookupSession(ctx, "invalid")
+		if errorMessage == "" {
+			t.Errorf("LookupSession() found a session for an invalid token")
+		}
+	})
+}
+
+func TestStoreRemoveProvider(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		accessToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		errorMessage, _ := store.AccountRemoveProvider(ctx, "test", accessToken, "")
+		if errorMessage == "" {
+			t.Fatalf("The last identity of an account was removed")
+		}
+
+		_, errorMessage, err := store.AccountAddProvider(ctx, "other", "alice", "{}", accessToken, "sso-access", "sso-refresh", 0, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not add provider: %v (%v)", errorMessage, err)
+		}
+
+		providerSessions, err := store.AccountProviderSessions(ctx, testUserId(t, store, accessToken))
+		if err != nil || len(providerSessions) != 2 {
+			t.Errorf("Expected 2 provider sessions, got %+v (%v)", providerSessions, err)
+		}
+
+		errorMessage, err = store.AccountRemoveProvider(ctx, "test", accessToken, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not remove provider: %v (%v)", errorMessage, err)
+		}
+
+		exists, _ := store.AccountExists(ctx, "test", "alice")
+		_, _, providers := accountProviders(t, store, accessToken)
+		if exists || len(providers) != 1 || providers[0] != "other" {
+			t.Errorf("Got providers %v, expected only other to be left", providers)
+		}
+	})
+}
+
+func TestStoreDisabledAccount(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		accessToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		errorMessage, err := store.SetUserDisabled(ctx, testUserId(t, store, accessToken), true, AuditActorSystem, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not disable account: %v (%v)", errorMessage, err)
+		}
+
+		accessToken, _, errorMessage, _ = store.AccountLoginOrRegister(ctx, "test", "alice", "Alice", "alice@example.com", false, "{}", "", "", 0, SessionMetadata{})
+		if accessToken != "" || errorMessage == "" {
+			t.Errorf("Logged in to a disabled account")
+		}
+	})
+}
+
+func TestStoreLoginLog(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		accessToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		userId := testUserId(t, store, accessToken)
+
+		err := store.LogLoginAttempt(ctx, LoginAttempt{Time: time.Now(), Reason: LoginProviderError, Provider: "test", RemoteIp: "192.0.2.2"})
+		if err != nil {
+			t.Fatalf("Could not log login attempt: %v", err)
+		}
+
+		logins, errorMessage, err := store.AccountLogins(ctx, accessToken, 10)
+		if errorMessage != "" || err != nil || len(logins) != 1 || !logins[0].Success || logins[0].UserId != userId {
+			t.Errorf("Expected alice's successful login, got %+v: %v (%v)", logins, errorMessage, err)
+		}
+
+		logins, err = store.LoginLog(ctx, "", "", 0, 10)
+		if err != nil || len(logins) != 2 || logins[0].Success || logins[0].Reason != LoginProviderError {
+			t.Errorf("Expected both logins, latest first, got %+v (%v)", logins, err)
+		}
+
+		logins, err = store.LoginLog(ctx, "", "192.0.2.2", 0, 10)
+		if err != nil || len(logins) != 1 || logins[0].UserId != "" {
+			t.Errorf("Expected the failed login only, got %+v (%v)", logins, err)
+		}
+
+		logins, err = store.LoginLog(ctx, "", "", 1, 10)
+		if err != nil || len(logins) != 1 || logins[0].UserId != userId {
+			t.Errorf("Expected the second page to hold alice's login, got %+v (%v)", logins, err)
+		}
+	})
+}
@@ -28,3 +28,126 @@ func (self *JSONTime) UnmarshalJSON(b []byte) (err error) {
 	self.Time = t
 	return
 }
+
+// SessionMetadata describes where a session was created from
+type SessionMetadata struct {
+	ClientId    string // Origin of the redirect_uri the user was sent back to after logging in
+	RedirectURI string // Only kept along with pending links, to send the user back there if they decline the link
+	UserAgent   string
+	RemoteIp    string
+}
+
+// Session is a user session, as shown to the user in their list of devices
+type Session struct {
+	Id       int64
+	Created  time.Time // Zero for sessions created before this was recorded
+	LastUsed time.Time // Zero if the session was never used since this is recorded
+	Provider string    // The identity provider the user logged in with
+	SessionMetadata
+}
+
+// SessionUser is what is needed to validate an access token: the session it belongs to, and the state of its user
+type SessionUser struct {
+	SessionId int64
+	UserId    string
+	Type      string // The type of the user
+	Disabled  bool
+	LastUsed  time.Time // Zero if the session was never used since this is recorded
+}
+
+// Expires returns when the session expires if it stays unused for idle, or the zero time if it doesn't
+func (session SessionUser) Expires(idle time.Duration) time.Time {
+	if idle <= 0 || session.LastUsed.IsZero() {
+		return time.Time{}
+	}
+
+	return session.LastUsed.Add(idle)
+}
+
+// UserSummary is a user as listed by SearchUsers
+type UserSummary struct {
+	Id                string
+	Name              string
+	Email             string
+	Type              string
+	PebbleMirror      bool
+	Disabled          bool
+	DeletionScheduled time.Time // Zero unless the user asked for their account to be deleted
+}
+
+// Client is an application registered to let users log in with rebble-auth
+type Client struct {
+	Id          string // Origin of the redirect URIs of the client, as recorded in Session.ClientId
+	Name        string
+	Description string
+	Created     time.Time
+	Updated     time.Time
+}
+
+// ProviderStats tells how an identity provider is used
+type ProviderStats struct {
+	Provider     string
+	Identities   int64     // Identities linked to accounts
+	Logins       int64     // Successful logins since the given time
+	FailedLogins int64     // Failed logins since the given time
+	LastLogin    time.Time // Last successful login since the given time, if any
+}
+
+// DeletionNotification is a Rebble service which still has to be told that an account was deleted
+type DeletionNotification struct {
+	Id          int64
+	UserId      string
+	URL         string // URL of the deletion hook
+	Attempts    int    // How many times sending it failed
+	NextAttempt time.Time
+	LastError   string
+}
+
+// ProviderSession holds the tokens of an identity linked to an account
+type ProviderSession struct {
+	Provider     string
+	Sub          string
+	AccessToken  string
+	RefreshToken string
+	Expires      int64
+}
+
+// ExportedProvider is an identity linked to an account, as included in a UserExport
+type ExportedProvider struct {
+	Provider string
+	Sub      string
+	Profile  string // The claims the provider last returned, as JSON
+	Expires  int64
+}
+
+// UserExport is everything rebble-auth stores about a user, except for secrets such as tokens
+type UserExport struct {
+	Id                string
+	Name              string
+	Email             string
+	Type              string
+	PebbleMirror      bool
+	Disabled          bool
+	ProfileProvider   string
+	SyncName          bool
+	DeletionScheduled time.Time // Zero unless the user asked for their account to be deleted
+
+	Providers []ExportedProvider
+	Sessions  []Session
+	Logins    []LoginAttempt
+	Aliases   []string     // IDs of the accounts merged into this one
+	Audits    []AuditEntry // Changes made to the account, latest first
+}
+
+// PebbleDeveloper is a developer of the original Pebble appstore
+type PebbleDeveloper struct {
+	Id   string
+	Name string
+}
+
+// ImportReport counts what happened to the developers given to ImportPebbleDevelopers
+type ImportReport struct {
+	Created int
+	Updated int // Mirrors whose name changed
+	Skipped int // Mirrors which didn't change, and real accounts (or mirrors merged into one) which were left alone
+}
@@ -0,0 +1,203 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+)
+
+// likePattern returns a LIKE pattern matching the strings which contain query, ignoring case. The pattern must be used
+// with `ESCAPE '\'`.
+func likePattern(query string) string {
+	query = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(strings.ToLower(query))
+	return "%" + query + "%"
+}
+
+// SearchUsers returns a page of the users whose name or email contains query, or whose ID, merged account ID or
+// linked identity (sub) is query, ordered by name. All users are listed if query is empty.
+func (handler Handler) SearchUsers(ctx context.Context, query string, offset int, limit int) ([]UserSummary, error) {
+	pattern := likePattern(query)
+	rows, err := handler.Query(ctx, `SELECT id, name, email, type, pebbleMirror, disabled, deletionScheduled FROM users
+		WHERE ?='' OR id=? OR lower(name) LIKE ? ESCAPE '\' OR lower(email) LIKE ? ESCAPE '\'
+			OR id IN (SELECT userId FROM providerSessions WHERE sub=?) OR id IN (SELECT userId FROM userAliases WHERE alias=?)
+		ORDER BY name, id LIMIT ? OFFSET ?`, query, query, pattern, pattern, query, query, limit, offset)
+	if err != nil {
+		return []UserSummary{}, err
+	}
+	defer rows.Close()
+
+	users := []UserSummary{}
+	for rows.Next() {
+		var user UserSummary
+		var deletionScheduled int64
+		err = rows.Scan(&user.Id, &user.Name, &user.Email, &user.Type, &user.PebbleMirror, &user.Disabled, &deletionScheduled)
+		if err != nil {
+			return []UserSummary{}, err
+		}
+		user.DeletionScheduled = unixNanoTime(deletionScheduled)
+
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// SetUserDisabled disables or enables a user. The sessions of a disabled user are kept, but they are refused until
+// the user is enabled again, and so are their logins.
+// Returns errorMessage, err
+func (handler Handler) SetUserDisabled(ctx context.Context, userId string, disabled bool, actorId string, remoteIp string) (string, error) {
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		var previous bool
+		row := tx.QueryRow("SELECT disabled FROM users WHERE id=?", userId)
+		err := row.Scan(&previous)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return "No such user", nil
+			}
+
+			return "Internal server error", err
+		}
+
+		if previous == disabled {
+			return "", nil
+		}
+
+		disabledInt := 0
+		if disabled {
+			disabledInt = 1
+		}
+
+		_, err = tx.Exec("UPDATE users SET disabled=? WHERE id=?", disabledInt, userId)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		action := AuditAccountEnable
+		if disabled {
+			action = AuditAccountDisable
+		}
+		err = audit(tx, AuditEntry{
+			ActorId:  actorId,
+			UserId:   userId,
+			Action:   action,
+			Before:   auditValues(map[string]interface{}{"disabled": previous}),
+			After:    auditValues(map[string]interface{}{"disabled": disabled}),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+}
+
+// LogoutUser logs out all of the sessions of a user
+// Returns (sessions int64, errorMessage string, err error), sessions being the number of sessions logged out
+func (handler Handler) LogoutUser(ctx context.Context, userId string, actorId string, remoteIp string) (int64, string, error) {
+	var count int64
+	errorMessage, err := handler.transaction(ctx, func(tx *Tx) (string, error) {
+		var exists bool
+		row := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE id=?)", userId)
+		err := row.Scan(&exists)
+		if err != nil {
+			return "Internal server error", err
+		}
+		if !exists {
+			return "No such user", nil
+		}
+
+		result, err := tx.Exec("DELETE FROM userSessions WHERE userId=?", userId)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		count, err = result.RowsAffected()
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		err = audit(tx, AuditEntry{
+			ActorId:  actorId,
+			UserId:   userId,
+			Action:   AuditSessionLogout,
+			Before:   auditValues(map[string]interface{}{"sessions": count}),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+
+	return count, errorMessage, err
+}
+
+// SetUserName changes the name of a user on their behalf. As with UpdateName, the name isn't synced with the user's
+// identity provider anymore afterwards.
+// Returns errorMessage, err
+func (handler Handler) SetUserName(ctx context.Context, userId string, name string, actorId string, remoteIp string) (string, error) {
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		var exists bool
+		row := tx.QueryRow("SELECT 1 FROM users WHERE id=?", userId)
+		err := row.Scan(&exists)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				return "No such user", nil
+			}
+
+			return "Internal server error", err
+		}
+
+		_, err = tx.Exec("UPDATE users SET name=?, syncName=0 WHERE id=?", name, userId)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		err = audit(tx, AuditEntry{
+			ActorId:  actorId,
+			UserId:   userId,
+			Action:   AuditAccountName,
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+}
+
+// RevokeUserSession logs out one of the sessions of a user on their behalf
+// Returns errorMessage, err
+func (handler Handler) RevokeUserSession(ctx context.Context, userId string, sessionId int64, actorId string, remoteIp string) (string, error) {
+	return handler.transaction(ctx, func(tx *Tx) (string, error) {
+		result, err := tx.Exec("DELETE FROM userSessions WHERE id=? AND userId=?", sessionId, userId)
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		count, err := result.RowsAffected()
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		if count == 0 {
+			return "No such session", nil
+		}
+
+		err = audit(tx, AuditEntry{
+			ActorId:  actorId,
+			UserId:   userId,
+			Action:   AuditSessionRevoke,
+			Before:   auditValues(map[string]interface{}{"sessionId": sessionId}),
+			RemoteIp: remoteIp,
+		})
+		if err != nil {
+			return "Internal server error", err
+		}
+
+		return "", nil
+	})
+}
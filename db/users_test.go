@@ -0,0 +1,112 @@
+package db
+
+import (
+	"context"
+	"testing"
+)
+
+func TestSearchUsers(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		aliceId := testUserId(t, store, aliceToken)
+		testLogin(t, store, "bob", "Bob", "bob@example.org")
+		testLogin(t, store, "percent", "100% Carol", "carol@example.org")
+
+		for _, test := range []struct {
+			query    string
+			expected []string
+		}{
+			{"", []string{"100% Carol", "Alice", "Bob"}},
+			{"ALI", []string{"Alice"}},
+			{"example.org", []string{"100% Carol", "Bob"}},
+			{aliceId, []string{"Alice"}},
+			{"bob", []string{"Bob"}}, // sub
+			{"%", []string{"100% Carol"}},
+			{"_", []string{}},
+			{"nobody", []string{}},
+		} {
+			users, err := store.SearchUsers(ctx, test.query, 0, 10)
+			names := []string{}
+			for _, user := range users {
+				names = append(names, user.Name)
+			}
+			if err != nil || len(names) != len(test.expected) {
+				t.Errorf("SearchUsers(%q) = %q, %v, expected %q", test.query, names, err, test.expected)
+				continue
+			}
+			for i := range names {
+				if names[i] != test.expected[i] {
+					t.Errorf("SearchUsers(%q) = %q, expected %q", test.query, names, test.expected)
+					break
+				}
+			}
+		}
+
+		users, _ := store.SearchUsers(ctx, "", 1, 1)
+		if len(users) != 1 || users[0].Name != "Alice" || users[0].Email != "alice@example.com" || users[0].Id != aliceId {
+			t.Errorf("Got %+v, expected the second page to hold alice", users)
+		}
+	})
+}
+
+func TestManageUser(t *testing.T) {
+	forEachStore(t, func(t *testing.T, store Store) {
+		ctx := context.Background()
+		aliceToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+		aliceId := testUserId(t, store, aliceToken)
+		secondToken := testLogin(t, store, "alice", "Alice", "alice@example.com")
+
+		errorMessage, err := store.SetUserDisabled(ctx, aliceId, true, AuditActorAdmin, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not disable account: %v (%v)", errorMessage, err)
+		}
+		loggedIn, _, _ := store.SessionInformation(ctx, aliceToken)
+		if loggedIn {
+			t.Errorf("alice is still logged in after her account was disabled")
+		}
+		_, _, errorMessage, _ = store.AccountLoginOrRegister(ctx, "test", "alice", "Alice", "alice@example.com", false, "{}", "", "", 0, SessionMetadata{})
+		if errorMessage == "" {
+			t.Errorf("alice could log in after her account was disabled")
+		}
+
+		errorMessage, err = store.SetUserDisabled(ctx, aliceId, false, AuditActorAdmin, "")
+		if errorMessage != "" || err != nil {
+			t.Fatalf("Could not enable account: %v (%v)", errorMessage, err)
+		}
+		loggedIn, _, _ = store.SessionInformation(ctx, aliceToken)
+		if !loggedIn {
+			t.Errorf("alice isn't logged in anymore after her account was enabled again")
+		}
+
+		errorMessage, err = store.SetUserName(ctx, aliceId, "Alice Liddell", AuditActorAdmin, "")
+		name, _, _ := store.GetName(ctx, aliceId)
+		if errorMessage != "" || err != nil || name != "Alice Liddell" {
+			t.Errorf("SetUserName() = %q, %v, and the name is %q", errorMessage, err, name)
+		}
+
+		session, _, _ := store.LookupSession(ctx, secondToken)
+		errorMessage, err = store.RevokeUserSession(ctx, aliceId, session.SessionId, AuditActorAdmin, "")
+		if errorMessage != "" || err != nil {
+			t.Errorf("Could not revoke session: %v (%v)", errorMessage, err)
+		}
+		loggedIn, _, _ = store.SessionInformation(ctx, secondToken)
+		if loggedIn {
+			t.Errorf("The revoked session still works")
+		}
+
+		sessions, errorMessage, err := store.LogoutUser(ctx, aliceId, AuditActorAdmin, "")
+		if sessions != 1 || errorMessage != "" || err != nil {
+			t.Errorf("LogoutUser() = %v, %q, %v, expected the remaining session to be logged out", sessions, errorMessage, err)
+		}
+
+		errorMessage, _ = store.SetUserDisabled(ctx, "unknown", true, AuditActorAdmin, "")
+		if errorMessage != "No such user" {
+			t.Errorf("SetUserDisabled() = %q for an unknown user", errorMessage)
+		}
+		errorMessage, _ = store.SetUserName(ctx, "unknown", "Mallory", AuditActorAdmin, "")
+		if errorMessage == "" {
+			t.Errorf("Renamed an unknown user")
+		}
+	})
+}
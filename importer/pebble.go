@@ -0,0 +1,205 @@
+package importer
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"pebble-dev/rebble-auth/db"
+	"sort"
+	"strings"
+)
+
+// DefaultRoot is where the Pebble appstore dump is read from by default
+const DefaultRoot = "PebbleAppStore/"
+
+// batchSize is how many developers are imported per transaction. The checkpoint is saved after each batch, so an
+// interrupted import resumes from the last batch which was committed.
+const batchSize = 500
+
+// PebbleApplication is an application of the original Pebble appstore
+type PebbleApplication struct {
+	Author   string `json:"author"`
+	AuthorId string `json:"developer_id"`
+}
+
+// PebbleAppList contains a list of PebbleApplication. It matches the format of Pebble API answers.
+type PebbleAppList struct {
+	Apps []*PebbleApplication `json:"data"`
+}
+
+// Report describes what an import did
+type Report struct {
+	Files        int    `json:"files"`
+	InvalidFiles int    `json:"invalidFiles"` // Files which couldn't be read or parsed, and were ignored
+	Developers   int    `json:"developers"`   // Distinct developers found in the files
+	Created      int    `json:"created"`
+	Updated      int    `json:"updated"`
+	Skipped      int    `json:"skipped"`
+	ResumedAfter string `json:"resumedAfter"` // ID of the last developer imported by the interrupted import this one resumed, if any
+}
+
+// Progress receives the progress of an import, as a number of developers imported. *jobs.Progress implements it.
+type Progress interface {
+	SetTotal(total int)
+	Add(n int)
+	Printf(format string, v ...interface{})
+}
+
+// logProgress only logs what the import does
+type logProgress struct{}
+
+func (logProgress) SetTotal(total int) {}
+func (logProgress) Add(n int)          {}
+func (logProgress) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// LogProgress is the Progress to use when nobody is watching the import, for instance from the command line
+var LogProgress Progress = logProgress{}
+
+// walkFiles is intended to quickly crawl the pebble application folder
+// in-order to import the developers.
+// It stops once ctx is cancelled.
+func walkFiles(ctx context.Context, root string) (<-chan string, <-chan error) {
+	// Create a couple of channels to communicate with the main process.
+	// (multi-threading FTW!)
+	paths := make(chan string)
+	errf := make(chan error, 1)
+
+	// Crawl the directory in the background.
+	go func() {
+		defer close(paths)
+		errf <- filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				// The root itself has to be readable, anything below it is skipped
+				if path == root {
+					return err
+				}
+				log.Println(err)
+				return nil
+			}
+			if info.IsDir() {
+				return nil
+			}
+			if strings.HasSuffix(info.Name(), ".json") {
+				select {
+				case paths <- path:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			return nil
+		})
+	}()
+
+	// Return the channels so that our goroutine can communicate with the main
+	// thread.
+	return paths, errf
+}
+
+// developers reads the developers of every application found under root, by ID
+func developers(ctx context.Context, root string, report *Report, progress Progress) (map[string]string, error) {
+	developers := make(map[string]string)
+
+	paths, errc := walkFiles(ctx, root)
+	for path := range paths {
+		report.Files++
+
+		f, err := ioutil.ReadFile(path)
+		if err != nil {
+			progress.Printf("Could not read %v: %v", path, err)
+			report.InvalidFiles++
+			continue
+		}
+
+		data := PebbleAppList{}
+		err = json.Unmarshal(f, &data)
+		if err != nil || len(data.Apps) != 1 || data.Apps[0] == nil || data.Apps[0].AuthorId == "" {
+			progress.Printf("Ignoring %v: not a single Pebble application", path)
+			report.InvalidFiles++
+			continue
+		}
+
+		app := data.Apps[0]
+		if _, ok := developers[app.AuthorId]; !ok {
+			developers[app.AuthorId] = app.Author
+		}
+	}
+
+	if err := <-errc; err != nil {
+		return nil, err
+	}
+
+	return developers, nil
+}
+
+// ImportPebbleDevelopers creates mirror accounts for the Pebble developers found in the appstore dump under root, and
+// renames the existing mirrors whose developer changed their name. Real accounts are never touched.
+// Developers are imported in order of ID, and the import resumes where it was interrupted (or cancelled through ctx)
+// unless asked to restart. The changes are audited as made by actorId.
+func ImportPebbleDevelopers(ctx context.Context, store db.Store, root string, restart bool, actorId string, progress Progress) (Report, error) {
+	var report Report
+
+	progress.Printf("Reading Pebble applications from %v", root)
+	byId, err := developers(ctx, root, &report, progress)
+	if err != nil {
+		return report, err
+	}
+	report.Developers = len(byId)
+	progress.Printf("Found %v developers in %v files (%v invalid)", report.Developers, report.Files, report.InvalidFiles)
+
+	if !restart {
+		report.ResumedAfter, err = store.PebbleImportCheckpoint(ctx)
+		if err != nil {
+			return report, err
+		}
+	}
+
+	ids := make([]string, 0, len(byId))
+	for id := range byId {
+		if report.ResumedAfter == "" || id > report.ResumedAfter {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	if report.ResumedAfter != "" {
+		progress.Printf("Resuming the import after developer %v", report.ResumedAfter)
+	}
+	progress.SetTotal(len(ids))
+
+	for start := 0; start < len(ids); start += batchSize {
+		if err := ctx.Err(); err != nil {
+			if start > 0 {
+				progress.Printf("Import cancelled, it will resume after developer %v", ids[start-1])
+			}
+			return report, err
+		}
+
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		batch := make([]db.PebbleDeveloper, 0, end-start)
+		for _, id := range ids[start:end] {
+			batch = append(batch, db.PebbleDeveloper{Id: id, Name: byId[id]})
+		}
+
+		imported, err := store.ImportPebbleDevelopers(ctx, batch, actorId)
+		if err != nil {
+			return report, err
+		}
+		report.Created += imported.Created
+		report.Updated += imported.Updated
+		report.Skipped += imported.Skipped
+		progress.Add(len(batch))
+	}
+
+	progress.Printf("%v developers created, %v updated, %v skipped", report.Created, report.Updated, report.Skipped)
+
+	return report, store.ClearPebbleImportCheckpoint(ctx)
+}
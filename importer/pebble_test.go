@@ -0,0 +1,114 @@
+package importer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"pebble-dev/rebble-auth/db"
+)
+
+// writeAppStore writes a fake Pebble appstore dump, and returns its root
+func writeAppStore(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		err := os.MkdirAll(filepath.Dir(path), 0700)
+		if err != nil {
+			t.Fatalf("Could not create directory: %v", err)
+		}
+		err = os.WriteFile(path, []byte(content), 0600)
+		if err != nil {
+			t.Fatalf("Could not write %v: %v", name, err)
+		}
+	}
+
+	return root
+}
+
+func TestImportPebbleDevelopers(t *testing.T) {
+	root := writeAppStore(t, map[string]string{
+		"apps/1.json":    `{"data": [{"author": "Developer 1", "developer_id": "dev1"}]}`,
+		"apps/2.json":    `{"data": [{"author": "Developer 1", "developer_id": "dev1"}]}`,
+		"faces/3.json":   `{"data": [{"author": "Developer 2", "developer_id": "dev2"}]}`,
+		"two-apps.json":  `{"data": [{"author": "A", "developer_id": "a"}, {"author": "B", "developer_id": "b"}]}`,
+		"no-apps.json":   `{"data": []}`,
+		"invalid.json":   `{"data": `,
+		"no-author.json": `{"data": [{"author": "Nobody"}]}`,
+		"README.md":      "Not an application",
+	})
+	store := db.NewMemoryStore()
+
+	report, err := ImportPebbleDevelopers(context.Background(), store, root, false, db.AuditActorAdmin, LogProgress)
+	if err != nil {
+		t.Fatalf("Could not import developers: %v", err)
+	}
+	expected := Report{Files: 7, InvalidFiles: 4, Developers: 2, Created: 2}
+	if report != expected {
+		t.Errorf("Got report %+v, expected %+v", report, expected)
+	}
+
+	name, _, _ := store.GetName(context.Background(), "dev1")
+	if name != "Developer 1" {
+		t.Errorf("Got mirror named %q, expected Developer 1", name)
+	}
+
+	// Importing again doesn't change anything, as the previous import finished
+	report, err = ImportPebbleDevelopers(context.Background(), store, root, false, db.AuditActorAdmin, LogProgress)
+	if err != nil || report.Skipped != 2 || report.ResumedAfter != "" {
+		t.Errorf("Got report %+v (%v), expected both developers to be skipped", report, err)
+	}
+}
+
+func TestImportResumes(t *testing.T) {
+	root := writeAppStore(t, map[string]string{
+		"1.json": `{"data": [{"author": "Developer 1", "developer_id": "dev1"}]}`,
+		"2.json": `{"data": [{"author": "Developer 2", "developer_id": "dev2"}]}`,
+	})
+	store := db.NewMemoryStore()
+
+	// An import interrupted after the first developer
+	_, err := store.ImportPebbleDevelopers(context.Background(), []db.PebbleDeveloper{{Id: "dev1", Name: "Developer 1"}}, db.AuditActorAdmin)
+	if err != nil {
+		t.Fatalf("Could not import developer: %v", err)
+	}
+
+	report, err := ImportPebbleDevelopers(context.Background(), store, root, false, db.AuditActorAdmin, LogProgress)
+	if err != nil || report.ResumedAfter != "dev1" || report.Created != 1 || report.Skipped != 0 {
+		t.Errorf("Got report %+v (%v), expected the import to resume after dev1", report, err)
+	}
+
+	checkpoint, _ := store.PebbleImportCheckpoint(context.Background())
+	if checkpoint != "" {
+		t.Errorf("The checkpoint %q was kept after the import finished", checkpoint)
+	}
+
+	// Restarting imports everything again
+	report, err = ImportPebbleDevelopers(context.Background(), store, root, true, db.AuditActorAdmin, LogProgress)
+	if err != nil || report.Skipped != 2 {
+		t.Errorf("Got report %+v (%v), expected both developers to be imported again", report, err)
+	}
+}
+
+func TestImportCancelled(t *testing.T) {
+	root := writeAppStore(t, map[string]string{
+		"1.json": `{"data": [{"author": "Developer 1", "developer_id": "dev1"}]}`,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := ImportPebbleDevelopers(ctx, db.NewMemoryStore(), root, false, db.AuditActorAdmin, LogProgress)
+	if err == nil {
+		t.Errorf("A cancelled import succeeded")
+	}
+}
+
+func TestImportMissingRoot(t *testing.T) {
+	_, err := ImportPebbleDevelopers(context.Background(), db.NewMemoryStore(), filepath.Join(t.TempDir(), "missing"), false, db.AuditActorAdmin, LogProgress)
+	if err == nil {
+		t.Errorf("Importing from a missing directory succeeded")
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"pebble-dev/rebble-auth/auth"
+	"pebble-dev/rebble-auth/db"
+	"pebble-dev/rebble-auth/scheduler"
+	"pebble-dev/rebble-auth/sso"
+)
+
+// cleanupInterval is how often the cleanup jobs run
+const cleanupInterval = time.Hour
+
+// notifyInterval is how often the Rebble services which couldn't be notified of a deletion are tried again
+const notifyInterval = 5 * time.Minute
+
+// retentionConfig sets how long data is kept, in days. 0 means it is kept forever.
+type retentionConfig struct {
+	SessionIdleDays int `json:"session_idle_days"` // Sessions unused for that long are logged out
+	LoginLogDays    int `json:"login_log_days"`    // Login log entries are deleted after that long
+	AnonymizeIpDays int `json:"anonymize_ip_days"` // IP addresses of sessions and login log entries are anonymized after that long
+}
+
+// days returns the date the given number of days ago
+func days(n int) time.Time {
+	return time.Now().Add(-time.Duration(n) * 24 * time.Hour)
+}
+
+// sessionIdle returns how long sessions can stay unused before they expire, 0 meaning they don't
+func sessionIdle(retention retentionConfig) time.Duration {
+	return time.Duration(retention.SessionIdleDays) * 24 * time.Hour
+}
+
+// cleanupJobs returns the jobs keeping the database from growing forever and enforcing the retention settings
+func cleanupJobs(ssos []sso.Sso, store db.Store, deletion auth.DeletionConfig, retention retentionConfig) []scheduler.Job {
+	jobs := []scheduler.Job{
+		{
+			Name:     "purge-deleted-accounts",
+			Interval: cleanupInterval,
+			Run: func() (string, error) {
+				deleted, err := auth.PurgeDeletedAccounts(context.Background(), ssos, store, deletion)
+				return fmt.Sprintf("Deleted %v accounts", deleted), err
+			},
+		},
+		{
+			Name:     "notify-deleted-accounts",
+			Interval: notifyInterval,
+			Run: func() (string, error) {
+				sent, err := auth.NotifyDeletions(context.Background(), store, deletion)
+				return fmt.Sprintf("Sent %v deletion notifications", sent), err
+			},
+		},
+		{
+			Name:     "delete-expired-pending-links",
+			Interval: cleanupInterval,
+			Run: func() (string, error) {
+				deleted, err := store.DeleteExpiredPendingLinks(context.Background())
+				return fmt.Sprintf("Deleted %v pending links", deleted), err
+			},
+		},
+	}
+
+	if retention.SessionIdleDays > 0 {
+		jobs = append(jobs, scheduler.Job{
+			Name:     "delete-idle-sessions",
+			Interval: cleanupInterval,
+			Run: func() (string, error) {
+				deleted, err := store.DeleteIdleSessions(context.Background(), days(retention.SessionIdleDays))
+				return fmt.Sprintf("Deleted %v sessions", deleted), err
+			},
+		})
+	}
+
+	if retention.LoginLogDays > 0 {
+		jobs = append(jobs, scheduler.Job{
+			Name:     "trim-login-log",
+			Interval: cleanupInterval,
+			Run: func() (string, error) {
+				deleted, err := store.TrimLoginLog(context.Background(), days(retention.LoginLogDays))
+				return fmt.Sprintf("Deleted %v login log entries", deleted), err
+			},
+		})
+	}
+
+	if retention.AnonymizeIpDays > 0 {
+		jobs = append(jobs, scheduler.Job{
+			Name:     "anonymize-ips",
+			Interval: cleanupInterval,
+			Run: func() (string, error) {
+				anonymized, err := store.AnonymizeIps(context.Background(), days(retention.AnonymizeIpDays))
+				return fmt.Sprintf("Anonymized %v IP addresses", anonymized), err
+			},
+		})
+	}
+
+	return jobs
+}
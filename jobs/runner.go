@@ -0,0 +1,316 @@
+package jobs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"pebble-dev/rebble-auth/common"
+	"pebble-dev/rebble-auth/db"
+)
+
+// maxLogLines is how many log lines are kept per job; older lines are dropped first
+const maxLogLines = 1000
+
+// Running jobs are saved along with a heartbeat every heartbeatInterval. A job whose heartbeat is older than jobLease
+// was left running by an instance of rebble-auth which stopped, and is marked as interrupted.
+const (
+	heartbeatInterval = 30 * time.Second
+	jobLease          = 4 * heartbeatInterval
+)
+
+// ErrAlreadyRunning is returned when submitting a job while another job with the same name is running
+var ErrAlreadyRunning = errors.New("A job with the same name is already running")
+
+// Task is the work done by a job. It should stop early, returning ctx.Err(), once ctx is cancelled. The result is
+// saved as JSON along with the job.
+type Task func(ctx context.Context, progress *Progress) (interface{}, error)
+
+// Progress lets a task report how far along it is, and log what it does
+type Progress struct {
+	runner *Runner
+	job    *runningJob
+}
+
+// SetTotal sets how many steps the task has
+func (progress *Progress) SetTotal(total int) {
+	progress.runner.lock.Lock()
+	defer progress.runner.lock.Unlock()
+
+	progress.job.Total = total
+}
+
+// Add records that n more steps were done
+func (progress *Progress) Add(n int) {
+	progress.runner.lock.Lock()
+	defer progress.runner.lock.Unlock()
+
+	progress.job.Progress += n
+}
+
+// Printf adds a line to the job log, and to the server log
+func (progress *Progress) Printf(format string, v ...interface{}) {
+	line := fmt.Sprintf(format, v...)
+	log.Printf("Job %v (%v): %v", progress.job.Name, progress.job.Id, line)
+
+	progress.runner.lock.Lock()
+	defer progress.runner.lock.Unlock()
+
+	progress.job.Log = append(progress.job.Log, time.Now().Format(time.RFC3339)+" "+line)
+	if len(progress.job.Log) > maxLogLines {
+		progress.job.Log = progress.job.Log[len(progress.job.Log)-maxLogLines:]
+	}
+}
+
+type runningJob struct {
+	db.AdminJob
+	cancel context.CancelFunc
+}
+
+// Runner runs the jobs submitted by administrators in the background. Running jobs are tracked in memory, and saved
+// to the Store when they start, along with their progress on each heartbeat, and when they finish. Several instances
+// of rebble-auth can share a Store: each runs the jobs submitted to it, and the Store makes sure that only one job of
+// a given name runs at once across all of them.
+type Runner struct {
+	store      db.Store
+	instanceId string
+	stop       context.CancelFunc // Stops the heartbeats
+
+	lock    sync.Mutex
+	running map[string]*runningJob // ID => job
+	wg      sync.WaitGroup
+}
+
+// New returns a Runner saving its jobs to store. Jobs which were left running by an instance of rebble-auth which
+// stopped are marked as interrupted, now and on each heartbeat.
+func New(store db.Store) (*Runner, error) {
+	interrupted, err := store.InterruptAdminJobs(context.Background(), time.Now().Add(-jobLease))
+	if err != nil {
+		return nil, err
+	}
+	if interrupted > 0 {
+		log.Printf("%v admin jobs were interrupted by the shutdown of the instance running them", interrupted)
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	runner := &Runner{
+		store:      store,
+		instanceId: common.GenerateString(16),
+		stop:       stop,
+		running:    make(map[string]*runningJob),
+	}
+
+	runner.wg.Add(1)
+	go runner.beat(ctx)
+
+	return runner, nil
+}
+
+// beat saves the progress of the running jobs every heartbeatInterval until ctx is cancelled, and interrupts the jobs
+// of the instances which stopped
+func (runner *Runner) beat(ctx context.Context) {
+	defer runner.wg.Done()
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			runner.heartbeat(now)
+		}
+	}
+}
+
+// heartbeat saves the progress of the running jobs, and interrupts the jobs of the instances which stopped
+func (runner *Runner) heartbeat(now time.Time) {
+	runner.lock.Lock()
+	jobs := []db.AdminJob{}
+	for _, job := range runner.running {
+		job.Heartbeat = now
+		jobs = append(jobs, job.snapshot())
+	}
+	runner.lock.Unlock()
+
+	for _, job := range jobs {
+		err := runner.store.HeartbeatAdminJob(context.Background(), job)
+		if err != nil {
+			log.Printf("Could not save the heartbeat of job %v (%v): %v", job.Name, job.Id, err)
+		}
+	}
+
+	interrupted, err := runner.store.InterruptAdminJobs(context.Background(), now.Add(-jobLease))
+	if err != nil {
+		log.Printf("Could not interrupt stale admin jobs: %v", err)
+	}
+	if interrupted > 0 {
+		log.Printf("%v admin jobs were interrupted by the shutdown of the instance running them", interrupted)
+	}
+}
+
+// Submit starts a job in the background, and returns it right away. Only one job of a given name can run at once,
+// on any instance of rebble-auth sharing the Store. ctx is only used to save the job; the job itself runs until it is
+// done or cancelled.
+func (runner *Runner) Submit(ctx context.Context, name string, task Task) (db.AdminJob, error) {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+
+	now := time.Now()
+	jobCtx, cancel := context.WithCancel(context.Background())
+	job := &runningJob{
+		AdminJob: db.AdminJob{
+			Id:         common.GenerateString(16),
+			Name:       name,
+			Status:     db.JobRunning,
+			Log:        []string{},
+			Created:    now,
+			InstanceId: runner.instanceId,
+			Heartbeat:  now,
+		},
+		cancel: cancel,
+	}
+
+	started, err := runner.store.StartAdminJob(ctx, job.AdminJob, now.Add(-jobLease))
+	if err != nil || !started {
+		cancel()
+		if err == nil {
+			err = ErrAlreadyRunning
+		}
+		return db.AdminJob{}, err
+	}
+
+	runner.running[job.Id] = job
+	runner.wg.Add(1)
+	go runner.run(jobCtx, job, task)
+
+	return job.snapshot(), nil
+}
+
+// snapshot returns a copy of the job which doesn't change as the job runs. The runner must be locked.
+func (job *runningJob) snapshot() db.AdminJob {
+	snapshot := job.AdminJob
+	snapshot.Log = append([]string{}, job.Log...)
+	return snapshot
+}
+
+func (runner *Runner) run(ctx context.Context, job *runningJob, task Task) {
+	defer runner.wg.Done()
+	defer job.cancel()
+
+	progress := &Progress{runner, job}
+	result, err := runTask(ctx, task, progress)
+
+	var data []byte
+	if result != nil {
+		var marshalErr error
+		data, marshalErr = json.Marshal(result)
+		if marshalErr != nil && err == nil {
+			err = marshalErr
+		}
+	}
+
+	runner.lock.Lock()
+	job.Result = string(data)
+	job.Finished = time.Now()
+	switch {
+	case err == nil:
+		job.Status = db.JobSucceeded
+	case ctx.Err() != nil:
+		job.Status = db.JobCancelled
+	default:
+		job.Status = db.JobFailed
+		job.Error = err.Error()
+		log.Printf("Job %v (%v) failed: %v", job.Name, job.Id, err)
+	}
+	final := job.snapshot()
+	runner.lock.Unlock()
+
+	// The job is kept in memory until it is saved, so that it can't disappear while it is being polled. It is saved
+	// even if it was cancelled.
+	err = runner.store.SaveAdminJob(context.Background(), final)
+	if err != nil {
+		log.Printf("Could not save job %v (%v): %v", job.Name, job.Id, err)
+	}
+
+	runner.lock.Lock()
+	delete(runner.running, job.Id)
+	runner.lock.Unlock()
+}
+
+// runTask runs a task, turning a panic into an error
+func runTask(ctx context.Context, task Task, progress *Progress) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return task(ctx, progress)
+}
+
+// Job returns a job, running or not, and whether it exists
+func (runner *Runner) Job(ctx context.Context, id string) (db.AdminJob, bool, error) {
+	runner.lock.Lock()
+	job, ok := runner.running[id]
+	if ok {
+		defer runner.lock.Unlock()
+		return job.snapshot(), true, nil
+	}
+	runner.lock.Unlock()
+
+	return runner.store.AdminJob(ctx, id)
+}
+
+// Jobs returns the most recent jobs, latest first, with the current progress of those which are running
+func (runner *Runner) Jobs(ctx context.Context, limit int) ([]db.AdminJob, error) {
+	jobs, err := runner.store.AdminJobs(ctx, limit)
+	if err != nil {
+		return []db.AdminJob{}, err
+	}
+
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+
+	for i := range jobs {
+		if job, ok := runner.running[jobs[i].Id]; ok {
+			jobs[i] = job.snapshot()
+		}
+	}
+
+	return jobs, nil
+}
+
+// Cancel asks a running job to stop. The job is only marked as cancelled once its task returns. Only the jobs running
+// on this instance of rebble-auth can be cancelled.
+// Returns whether the job was running
+func (runner *Runner) Cancel(id string) bool {
+	runner.lock.Lock()
+	defer runner.lock.Unlock()
+
+	job, ok := runner.running[id]
+	if !ok {
+		return false
+	}
+
+	job.cancel()
+	return true
+}
+
+// Stop cancels every running job, and waits for them to stop
+func (runner *Runner) Stop() {
+	runner.stop()
+
+	runner.lock.Lock()
+	for _, job := range runner.running {
+		job.cancel()
+	}
+	runner.lock.Unlock()
+
+	runner.wg.Wait()
+}
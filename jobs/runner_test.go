@@ -0,0 +1,225 @@
+package jobs
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"pebble-dev/rebble-auth/db"
+)
+
+// wait waits for a job to finish, and returns it as it was saved
+func wait(t *testing.T, runner *Runner, id string) db.AdminJob {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		runner.lock.Lock()
+		_, running := runner.running[id]
+		runner.lock.Unlock()
+
+		if !running {
+			job, ok, err := runner.Job(context.Background(), id)
+			if !ok || err != nil {
+				t.Fatalf("Could not get job %v: %v, %v", id, ok, err)
+			}
+			return job
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatalf("Job %v didn't finish", id)
+	return db.AdminJob{}
+}
+
+func newTestRunner(t *testing.T, store db.Store) *Runner {
+	t.Helper()
+
+	runner, err := New(store)
+	if err != nil {
+		t.Fatalf("Could not create runner: %v", err)
+	}
+	t.Cleanup(runner.Stop)
+
+	return runner
+}
+
+func TestSubmit(t *testing.T) {
+	runner := newTestRunner(t, db.NewMemoryStore())
+
+	job, err := runner.Submit(context.Background(), "test", func(ctx context.Context, progress *Progress) (interface{}, error) {
+		progress.SetTotal(2)
+		progress.Add(1)
+		progress.Printf("Step %v", 1)
+		progress.Add(1)
+		return map[string]int{"done": 2}, nil
+	})
+	if err != nil || job.Status != db.JobRunning || job.Name != "test" {
+		t.Fatalf("Submit() = %+v, %v, expected a running job", job, err)
+	}
+
+	job = wait(t, runner, job.Id)
+	if job.Status != db.JobSucceeded || job.Progress != 2 || job.Total != 2 || job.Result != `{"done":2}` || job.Finished.IsZero() {
+		t.Errorf("Got %+v, expected the job to have succeeded", job)
+	}
+	if len(job.Log) != 1 || !strings.HasSuffix(job.Log[0], " Step 1") {
+		t.Errorf("Got log %q, expected the line printed by the job", job.Log)
+	}
+
+	list, err := runner.Jobs(context.Background(), 10)
+	if err != nil || len(list) != 1 || list[0].Id != job.Id {
+		t.Errorf("Jobs() = %+v, %v, expected the finished job", list, err)
+	}
+}
+
+func TestFailedJob(t *testing.T) {
+	runner := newTestRunner(t, db.NewMemoryStore())
+
+	failing, _ := runner.Submit(context.Background(), "fail", func(ctx context.Context, progress *Progress) (interface{}, error) {
+		return nil, errors.New("failed")
+	})
+	panicking, _ := runner.Submit(context.Background(), "panic", func(ctx context.Context, progress *Progress) (interface{}, error) {
+		panic("oops")
+	})
+
+	if job := wait(t, runner, failing.Id); job.Status != db.JobFailed || job.Error != "failed" {
+		t.Errorf("Got %+v, expected the job to have failed", job)
+	}
+	if job := wait(t, runner, panicking.Id); job.Status != db.JobFailed || job.Error != "panic: oops" {
+		t.Errorf("Got %+v, expected the panic to be reported", job)
+	}
+}
+
+func TestCancel(t *testing.T) {
+	runner := newTestRunner(t, db.NewMemoryStore())
+
+	started := make(chan struct{})
+	job, err := runner.Submit(context.Background(), "test", func(ctx context.Context, progress *Progress) (interface{}, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("Could not submit job: %v", err)
+	}
+	<-started
+
+	_, err = runner.Submit(context.Background(), "test", func(ctx context.Context, progress *Progress) (interface{}, error) {
+		return nil, nil
+	})
+	if err != ErrAlreadyRunning {
+		t.Errorf("Submitting a job which is already running returned %v, expected ErrAlreadyRunning", err)
+	}
+
+	running, ok, err := runner.Job(context.Background(), job.Id)
+	if !ok || err != nil || running.Status != db.JobRunning {
+		t.Errorf("Job() = %+v, %v, %v, expected the job to be running", running, ok, err)
+	}
+
+	if !runner.Cancel(job.Id) {
+		t.Errorf("Could not cancel the running job")
+	}
+	if job := wait(t, runner, job.Id); job.Status != db.JobCancelled || job.Error != "" {
+		t.Errorf("Got %+v, expected the job to be cancelled", job)
+	}
+	if runner.Cancel(job.Id) {
+		t.Errorf("Cancelled a job which already stopped")
+	}
+}
+
+func TestInterruptedJobs(t *testing.T) {
+	store := db.NewMemoryStore()
+	err := store.SaveAdminJob(context.Background(), db.AdminJob{Id: "old", Name: "test", Status: db.JobRunning, Log: []string{}, Created: time.Now()})
+	if err != nil {
+		t.Fatalf("Could not save job: %v", err)
+	}
+
+	runner := newTestRunner(t, store)
+	job, ok, err := runner.Job(context.Background(), "old")
+	if !ok || err != nil || job.Status != db.JobInterrupted {
+		t.Errorf("Job() = %+v, %v, %v, expected the job to be interrupted", job, ok, err)
+	}
+
+	// The interrupted job doesn't prevent running it again
+	_, err = runner.Submit(context.Background(), "test", func(ctx context.Context, progress *Progress) (interface{}, error) {
+		return nil, nil
+	})
+	if err != nil {
+		t.Errorf("Could not run an interrupted job again: %v", err)
+	}
+}
+
+func TestJobOnOtherInstance(t *testing.T) {
+	store := db.NewMemoryStore()
+	err := store.SaveAdminJob(context.Background(), db.AdminJob{Id: "other", Name: "test", Status: db.JobRunning, Log: []string{}, Created: time.Now(), InstanceId: "other", Heartbeat: time.Now()})
+	if err != nil {
+		t.Fatalf("Could not save job: %v", err)
+	}
+
+	// A job which is still alive on another instance is left alone, and keeps the name busy
+	runner := newTestRunner(t, store)
+	_, err = runner.Submit(context.Background(), "test", func(ctx context.Context, progress *Progress) (interface{}, error) {
+		return nil, nil
+	})
+	if err != ErrAlreadyRunning {
+		t.Errorf("Submitting a job running on another instance returned %v, expected ErrAlreadyRunning", err)
+	}
+
+	job, _, _ := runner.Job(context.Background(), "other")
+	if job.Status != db.JobRunning {
+		t.Errorf("Got %+v, expected the job of the other instance to be running", job)
+	}
+
+	// Once the other instance stops sending heartbeats, the job is interrupted
+	runner.heartbeat(time.Now().Add(jobLease + time.Second))
+	job, _, _ = runner.Job(context.Background(), "other")
+	if job.Status != db.JobInterrupted {
+		t.Errorf("Got %+v, expected the job of the stopped instance to be interrupted", job)
+	}
+}
+
+func TestHeartbeat(t *testing.T) {
+	store := db.NewMemoryStore()
+	runner := newTestRunner(t, store)
+
+	started := make(chan struct{})
+	job, err := runner.Submit(context.Background(), "test", func(ctx context.Context, progress *Progress) (interface{}, error) {
+		progress.SetTotal(10)
+		progress.Add(3)
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if err != nil {
+		t.Fatalf("Could not submit job: %v", err)
+	}
+	<-started
+
+	// Heartbeats save the progress of running jobs, and keep them from being interrupted
+	later := time.Now().Add(jobLease + time.Second)
+	runner.heartbeat(later)
+	saved, _, _ := store.AdminJob(context.Background(), job.Id)
+	if saved.Status != db.JobRunning || saved.Progress != 3 || saved.Total != 10 || !saved.Heartbeat.Equal(later) || saved.InstanceId == "" {
+		t.Errorf("Got %+v, expected the progress of the running job to be saved", saved)
+	}
+
+	runner.Cancel(job.Id)
+	wait(t, runner, job.Id)
+}
+
+func TestLogSize(t *testing.T) {
+	runner := newTestRunner(t, db.NewMemoryStore())
+
+	job, _ := runner.Submit(context.Background(), "test", func(ctx context.Context, progress *Progress) (interface{}, error) {
+		for i := 0; i < maxLogLines+10; i++ {
+			progress.Printf("Line %v", i)
+		}
+		return nil, nil
+	})
+
+	if job := wait(t, runner, job.Id); len(job.Log) != maxLogLines || !strings.HasSuffix(job.Log[0], " Line 10") {
+		t.Errorf("Got %v log lines starting with %q, expected only the last %v", len(job.Log), job.Log[0], maxLogLines)
+	}
+}
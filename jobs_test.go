@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"pebble-dev/rebble-auth/auth"
+	"pebble-dev/rebble-auth/db"
+)
+
+func TestCleanupJobs(t *testing.T) {
+	store := db.NewMemoryStore()
+
+	// Data is kept forever unless told otherwise
+	jobs := cleanupJobs(nil, store, auth.DeletionConfig{}, retentionConfig{})
+	if len(jobs) != 3 {
+		t.Errorf("Got %v jobs without retention settings, expected 3", len(jobs))
+	}
+
+	jobs = cleanupJobs(nil, store, auth.DeletionConfig{}, retentionConfig{SessionIdleDays: 90, LoginLogDays: 365, AnonymizeIpDays: 30})
+	if len(jobs) != 6 {
+		t.Fatalf("Got %v jobs with retention settings, expected 6", len(jobs))
+	}
+
+	for _, job := range jobs {
+		result, err := job.Run()
+		if result == "" || err != nil {
+			t.Errorf("Job %v returned %q, %v, expected a summary", job.Name, result, err)
+		}
+	}
+}
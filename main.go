@@ -1,36 +1,104 @@
 package main
 
 import (
-	"database/sql"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"pebble-dev/rebble-auth/auth"
 	"pebble-dev/rebble-auth/common"
 	"pebble-dev/rebble-auth/db"
+	"pebble-dev/rebble-auth/importer"
+	"pebble-dev/rebble-auth/jobs"
 	"pebble-dev/rebble-auth/rebbleHandlers"
+	"pebble-dev/rebble-auth/scheduler"
 	"pebble-dev/rebble-auth/sso"
 
 	"github.com/gorilla/handlers"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/pborman/getopt"
 )
 
 type config struct {
-	Ssos           []sso.Sso `json":ssos"`
-	AllowedDomains []string  `json:"allowed_domains"`
-	HTTPS          bool      `json:"https"`
-	Database       string    `json:"database"`
+	Ssos            []sso.Sso `json":ssos"`
+	AllowedDomains  []string  `json:"allowed_domains"`
+	HTTPS           bool      `json:"https"`
+	DatabaseDriver  string    `json:"database_driver"`
+	Database        string    `json:"database"`
+	DatabaseTimeout int       `json:"database_timeout_seconds"` // How long a query may run before it fails, defaults to 10
+
+	AccountDeletion auth.DeletionConfig `json:"account_deletion"`
+	Retention       retentionConfig     `json:"retention"`
+	DeveloperClaims auth.ClaimConfig    `json:"developer_claims"`
+	Audit           auditConfig         `json:"audit_log"`
+	SessionCache    sessionCacheConfig  `json:"session_cache"`
+}
+
+// auditConfig configures where the audit log is shipped to, in addition to the database
+type auditConfig struct {
+	// File is appended the audit log entries as JSON lines, if set
+	File string `json:"file"`
+}
+
+// shutdownTimeout is how long requests in progress are given to complete when the server is asked to stop
+const shutdownTimeout = 30 * time.Second
+
+// sessionCacheConfig sets how many sessions are kept in memory to validate access tokens, and for how long
+type sessionCacheConfig struct {
+	Size       int `json:"size"` // 0 disables the cache
+	TTLSeconds int `json:"ttl_seconds"`
+}
+
+// backup writes a snapshot of the database to the given file
+func backup(driver string, database string, path string, compress bool) error {
+	dbHandler, err := db.Open(driver, database)
+	if err != nil {
+		return err
+	}
+	defer dbHandler.Close()
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	err = dbHandler.WriteBackup(f, compress || strings.HasSuffix(path, ".gz"))
+	if err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+
+	return f.Close()
 }
 
 func main() {
 	config := config{
 		AllowedDomains: []string{"http://localhost:8080, http://localhost:8081"},
 		HTTPS:          true,
+		DatabaseDriver: db.SQLite,
 		Database:       "./rebble-auth.db",
+		AccountDeletion: auth.DeletionConfig{
+			GracePeriodDays: 30,
+		},
+		Retention: retentionConfig{
+			SessionIdleDays: 180,
+			LoginLogDays:    365,
+			AnonymizeIpDays: 30,
+		},
+		SessionCache: sessionCacheConfig{
+			Size:       10000,
+			TTLSeconds: 30,
+		},
 	}
 
 	file, err := ioutil.ReadFile("./rebble-auth.json")
@@ -43,16 +111,71 @@ func main() {
 	}
 
 	var version bool
+	var compress bool
+	var restartImport bool
 
 	getopt.BoolVarLong(&version, "version", 'V', "Get the current version info")
 	getopt.BoolVarLong(&config.HTTPS, "https", 'h', "Set whether or not to use HTTPS (defaults to true)")
-	getopt.StringVarLong(&config.Database, "database", 'd', "Specify a specific SQLite database path (defaults to ./rebble-auth.db)")
+	getopt.StringVarLong(&config.DatabaseDriver, "database-driver", 0, "Specify the database driver, sqlite3, postgres or memory (defaults to sqlite3)")
+	getopt.StringVarLong(&config.Database, "database", 'd', "Specify a specific SQLite database path or PostgreSQL connection string (defaults to ./rebble-auth.db)")
+	getopt.BoolVarLong(&compress, "compress", 'z', "Compress backups with gzip (always done if the file name ends with .gz)")
+	getopt.BoolVarLong(&restartImport, "restart", 0, "Restart the Pebble developer import from the beginning instead of resuming it")
+	getopt.SetParameters("[migrate | import-developers [<directory>] | backup <file> | restore <file> | set-role <user id> <role>]")
 	getopt.Parse()
 	if version {
 		fmt.Fprintf(os.Stderr, "Version %s\nBuild Host: %s\nBuild Date: %s\nBuild Hash: %s\n", common.Buildversionstring, common.Buildhost, common.Buildstamp, common.Buildgithash)
 		return
 	}
 
+	command := ""
+	if len(getopt.Args()) > 0 {
+		command = getopt.Arg(0)
+	}
+
+	switch command {
+	case "", "migrate":
+	case "backup", "restore":
+		if len(getopt.Args()) != 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %v %v <file>\n", os.Args[0], command)
+			os.Exit(1)
+		}
+	case "import-developers":
+		if len(getopt.Args()) > 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %v %v [<directory>]\n", os.Args[0], command)
+			os.Exit(1)
+		}
+	case "set-role":
+		if len(getopt.Args()) != 3 {
+			fmt.Fprintf(os.Stderr, "Usage: %v %v <user id> <role>\n", os.Args[0], command)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %v\n", command)
+		getopt.Usage()
+		os.Exit(1)
+	}
+
+	// Backups are made from the live database, without migrating it first
+	if command == "backup" {
+		err = backup(config.DatabaseDriver, config.Database, getopt.Arg(1), compress)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not back up database: %v\n", err)
+			os.Exit(1)
+		}
+		log.Printf("Database backed up to %v.", getopt.Arg(1))
+		return
+	}
+
+	if command == "restore" {
+		schemaVersion, err := db.Restore(config.DatabaseDriver, config.Database, getopt.Arg(1))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not restore database: %v\n", err)
+			os.Exit(1)
+		}
+		log.Printf("Database restored from %v (schema version %v).", getopt.Arg(1), schemaVersion)
+		return
+	}
+
 	rebbleHandlers.AllowedDomains = config.AllowedDomains
 
 	log.Println("Initializing SSO providers...")
@@ -66,26 +189,151 @@ func main() {
 	}
 	log.Println("Done.")
 
-	database, err := sql.Open("sqlite3", config.Database)
-	if err != nil {
-		panic("Could not connect to database" + err.Error())
+	var auditSink db.AuditSink
+	if config.Audit.File != "" {
+		auditFile, err := db.OpenAuditFile(config.Audit.File)
+		if err != nil {
+			panic("Could not open audit log file: " + err.Error())
+		}
+		defer auditFile.Close()
+
+		auditSink = auditFile
 	}
 
-	dbHandler := db.Handler{database}
+	var store db.Store
+	var events *db.EventWriter
+	if config.DatabaseDriver == db.Memory {
+		log.Println("Using in-memory storage, nothing will be persisted!")
+		memoryStore := db.NewMemoryStore()
+		memoryStore.AuditSink = auditSink
+		memoryStore.SessionIdle = sessionIdle(config.Retention)
+		store = memoryStore
+	} else {
+		dbHandler, err := db.Open(config.DatabaseDriver, config.Database)
+		if err != nil {
+			panic("Could not connect to database: " + err.Error())
+		}
+
+		log.Println("Migrating database...")
+		migrated, err := dbHandler.Migrate()
+		if err != nil {
+			panic("Could not migrate database: " + err.Error())
+		}
+		log.Printf("Done (%v migrations run, schema version %v).", migrated, db.LatestSchemaVersion())
+
+		dbHandler.AuditSink = auditSink
+		dbHandler.SessionIdle = sessionIdle(config.Retention)
+		if config.DatabaseTimeout > 0 {
+			dbHandler.QueryTimeout = time.Duration(config.DatabaseTimeout) * time.Second
+		}
+
+		// While serving, the login and audit logs are written in the background so that logins don't hold the
+		// database's write lock for longer than needed
+		if command == "" {
+			events = db.NewEventWriter(dbHandler)
+			dbHandler.Events = events
+		}
+		store = dbHandler
+	}
+
+	if command == "migrate" {
+		// Migrations have already been run, we only want to run them without starting the server
+		return
+	}
+
+	if command == "import-developers" {
+		root := importer.DefaultRoot
+		if len(getopt.Args()) == 2 {
+			root = getopt.Arg(1)
+		}
+
+		report, err := importer.ImportPebbleDevelopers(context.Background(), store, root, restartImport, db.AuditActorAdmin, importer.LogProgress)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not import Pebble developers: %v\n", err)
+			os.Exit(1)
+		}
+		log.Printf("Done (%v files, %v invalid, %v developers: %v created, %v updated, %v skipped).",
+			report.Files, report.InvalidFiles, report.Developers, report.Created, report.Updated, report.Skipped)
+		return
+	}
+
+	// This is how the first administrator is appointed
+	if command == "set-role" {
+		success, errorMessage, err := auth.SetRole(context.Background(), store, getopt.Arg(1), getopt.Arg(2), db.AuditActorAdmin, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Could not set role: %v\n", err)
+			os.Exit(1)
+		}
+		if !success {
+			fmt.Fprintf(os.Stderr, "Could not set role: %v\n", errorMessage)
+			os.Exit(1)
+		}
+		log.Printf("%v is now %v.", getopt.Arg(1), getopt.Arg(2))
+		return
+	}
+
+	// Access tokens are validated on every request to a Rebble service, so their sessions are cached
+	store = db.NewSessionCache(store, config.SessionCache.Size, time.Duration(config.SessionCache.TTLSeconds)*time.Second)
+
+	// Cleanup jobs run in the background for as long as the server is up
+	cleanup := scheduler.New(cleanupJobs(config.Ssos, store, config.AccountDeletion, config.Retention)...)
+	cleanup.Start()
+
+	// Long operations started by administrators run in the background too
+	adminJobs, err := jobs.New(store)
+	if err != nil {
+		panic("Could not start the admin job runner: " + err.Error())
+	}
 
 	// construct the context that will be injected in to handlers
-	context := &rebbleHandlers.HandlerContext{&dbHandler, config.Ssos}
+	handlerContext := &rebbleHandlers.HandlerContext{
+		Database:        store,
+		SSos:            config.Ssos,
+		AccountDeletion: config.AccountDeletion,
+		DeveloperClaims: config.DeveloperClaims,
+		Scheduler:       cleanup,
+		Jobs:            adminJobs,
+	}
 
-	r := rebbleHandlers.Handlers(context)
+	r := rebbleHandlers.Handlers(handlerContext)
 	loggedRouter := handlers.LoggingHandler(os.Stdout, r)
 	http.Handle("/", r)
+	server := &http.Server{Addr: ":8082", Handler: loggedRouter}
+
+	// Stop gracefully when asked to, so that requests, jobs and buffered events aren't cut short
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+
+		log.Println("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Printf("Could not shut down the server gracefully: %v", err)
+		}
+
+		adminJobs.Stop()
+		cleanup.Stop()
+		if events != nil {
+			events.Close()
+			log.Printf("Event log flushed (%v login log entries were dropped).", events.Dropped())
+		}
+		close(stopped)
+	}()
+
 	log.Println("Serving HTTP(S)")
 	if config.HTTPS {
-		err = http.ListenAndServeTLS(":8082", "server.crt", "server.key", loggedRouter)
+		err = server.ListenAndServeTLS("server.crt", "server.key")
 	} else {
-		err = http.ListenAndServe(":8082", loggedRouter)
+		err = server.ListenAndServe()
 	}
-	if err != nil {
+	if err != http.ErrServerClosed {
 		panic("Could not listen and serve TLS: " + err.Error())
 	}
+
+	<-stopped
+	log.Println("Done.")
 }
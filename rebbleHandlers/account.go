@@ -6,6 +6,8 @@ import (
 	"net/http"
 	"pebble-dev/rebble-auth/auth"
 	"pebble-dev/rebble-auth/common"
+	"pebble-dev/rebble-auth/db"
+	"time"
 
 	"github.com/gorilla/mux"
 )
@@ -31,6 +33,69 @@ type updateAccountStatus struct {
 	ErrorMessage string `json:"errorMessage"`
 }
 
+type profileSettings struct {
+	ProfileProvider string `json:"profileProvider"`
+	SyncName        bool   `json:"syncName"`
+}
+
+type profileSettingsStatus struct {
+	ProfileProvider string `json:"profileProvider"`
+	SyncName        bool   `json:"syncName"`
+	Success         bool   `json:"success"`
+	ErrorMessage    string `json:"errorMessage"`
+}
+
+type mergeAccount struct {
+	MergeToken string `json:"mergeToken"`
+}
+
+type revokeSession struct {
+	Id int64 `json:"id"`
+}
+
+type sessionInfo struct {
+	Id        int64     `json:"id"`
+	Created   time.Time `json:"created"`
+	LastUsed  time.Time `json:"lastUsed"`
+	Provider  string    `json:"provider"`
+	ClientId  string    `json:"clientId"`
+	UserAgent string    `json:"userAgent"`
+	RemoteIp  string    `json:"remoteIp"`
+	Current   bool      `json:"current"`
+}
+
+type sessionsStatus struct {
+	Sessions     []sessionInfo `json:"sessions"`
+	Success      bool          `json:"success"`
+	ErrorMessage string        `json:"errorMessage"`
+}
+
+type loginAttempt struct {
+	Time      time.Time `json:"time"`
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason"`
+	Provider  string    `json:"provider"`
+	UserAgent string    `json:"userAgent"`
+	RemoteIp  string    `json:"remoteIp"`
+}
+
+type loginsStatus struct {
+	Logins       []loginAttempt `json:"logins"`
+	Success      bool           `json:"success"`
+	ErrorMessage string         `json:"errorMessage"`
+}
+
+type deleteAccountStatus struct {
+	DeletionDate time.Time `json:"deletionDate"`
+	Success      bool      `json:"success"`
+	ErrorMessage string    `json:"errorMessage"`
+}
+
+type idStatus struct {
+	Id           string `json:"id"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
 type nameStatus struct {
 	Name         string `json:"name"`
 	ErrorMessage string `json:"errorMessage"`
@@ -51,9 +116,12 @@ func AccountInfoHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Requ
 		return http.StatusBadRequest, err
 	}
 
-	loggedIn, errorMessage, name, email, linkedProviders, err := auth.Info(ctx.Database, accessToken)
+	loggedIn, errorMessage, name, email, linkedProviders, err := auth.Info(r.Context(), ctx.Database, accessToken)
 
 	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
 		log.Println(err)
 	}
 
@@ -91,9 +159,12 @@ func AccountUpdateNameHandler(ctx *HandlerContext, w http.ResponseWriter, r *htt
 	}
 	defer r.Body.Close()
 
-	success, errorMessage, err := auth.UpdateName(ctx.Database, accessToken, info.Name)
+	success, errorMessage, err := auth.UpdateName(r.Context(), ctx.Database, accessToken, info.Name, remoteIp(r))
 
 	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
 		log.Println(err)
 	}
 
@@ -114,9 +185,12 @@ func AccountUpdateNameHandler(ctx *HandlerContext, w http.ResponseWriter, r *htt
 
 // AccountGetnameHandler returns a user's name
 func AccountGetNameHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
-	name, errorMessage, err := ctx.Database.GetName(mux.Vars(r)["id"])
+	name, errorMessage, err := ctx.Database.GetName(r.Context(), mux.Vars(r)["id"])
 
 	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
 		log.Println(err)
 	}
 
@@ -151,9 +225,236 @@ func AccountRemoveLinkedProviderHandler(ctx *HandlerContext, w http.ResponseWrit
 	}
 	defer r.Body.Close()
 
-	success, errorMessage, err := auth.RemoveLinkedProvider(ctx.Database, accessToken, info.Provider)
+	success, errorMessage, err := auth.RemoveLinkedProvider(r.Context(), ctx.Database, accessToken, info.Provider, remoteIp(r))
+
+	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
+		log.Println(err)
+	}
+
+	status := updateAccountStatus{
+		Success:      success,
+		ErrorMessage: errorMessage,
+	}
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Send the JSON object back to the user
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+	return http.StatusOK, nil
+}
+
+// AccountMergeHandler merges the account owning an identity the user tried to link into the user's account
+func AccountMergeHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	accessToken, err := common.GetAccessToken(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	decoder := json.NewDecoder(r.Body)
+
+	var info mergeAccount
+	err = decoder.Decode(&info)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	defer r.Body.Close()
+
+	success, errorMessage, err := auth.Merge(r.Context(), ctx.Database, accessToken, info.MergeToken, remoteIp(r))
+
+	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
+		log.Println(err)
+	}
+
+	status := updateAccountStatus{
+		Success:      success,
+		ErrorMessage: errorMessage,
+	}
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Send the JSON object back to the user
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+	return http.StatusOK, nil
+}
+
+// AccountGetIdHandler returns the current ID of a user, which differs from the given ID if the account was merged
+// into another one
+func AccountGetIdHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	id, errorMessage, err := ctx.Database.ResolveAlias(r.Context(), mux.Vars(r)["id"])
+
+	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
+		log.Println(err)
+	}
+
+	status := idStatus{
+		Id:           id,
+		ErrorMessage: errorMessage,
+	}
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Send the JSON object back to the user
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+	return http.StatusOK, nil
+}
+
+// AccountProfileSettingsHandler returns which provider the user's profile is kept in sync with
+func AccountProfileSettingsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	accessToken, err := common.GetAccessToken(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	success, errorMessage, profileProvider, syncName, err := auth.ProfileSettings(r.Context(), ctx.Database, accessToken)
+
+	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
+		log.Println(err)
+	}
+
+	status := profileSettingsStatus{
+		ProfileProvider: profileProvider,
+		SyncName:        syncName,
+		Success:         success,
+		ErrorMessage:    errorMessage,
+	}
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Send the JSON object back to the user
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+	return http.StatusOK, nil
+}
+
+// AccountUpdateProfileSettingsHandler changes which provider the user's profile is kept in sync with
+func AccountUpdateProfileSettingsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	accessToken, err := common.GetAccessToken(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	decoder := json.NewDecoder(r.Body)
+
+	var info profileSettings
+	err = decoder.Decode(&info)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	defer r.Body.Close()
+
+	success, errorMessage, err := auth.UpdateProfileSettings(r.Context(), ctx.Database, accessToken, info.ProfileProvider, info.SyncName, remoteIp(r))
+
+	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
+		log.Println(err)
+	}
+
+	status := updateAccountStatus{
+		Success:      success,
+		ErrorMessage: errorMessage,
+	}
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Send the JSON object back to the user
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+	return http.StatusOK, nil
+}
+
+// AccountSessionsHandler lists the sessions a user is logged in with, flagging the one used to make the request
+func AccountSessionsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	accessToken, err := common.GetAccessToken(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	success, errorMessage, sessions, currentSessionId, err := auth.Sessions(r.Context(), ctx.Database, accessToken)
+
+	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
+		log.Println(err)
+	}
+
+	status := sessionsStatus{
+		Sessions:     []sessionInfo{},
+		Success:      success,
+		ErrorMessage: errorMessage,
+	}
+	for _, session := range sessions {
+		status.Sessions = append(status.Sessions, sessionInfo{
+			Id:        session.Id,
+			Created:   session.Created,
+			LastUsed:  session.LastUsed,
+			Provider:  session.Provider,
+			ClientId:  session.ClientId,
+			UserAgent: session.UserAgent,
+			RemoteIp:  session.RemoteIp,
+			Current:   session.Id == currentSessionId,
+		})
+	}
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Send the JSON object back to the user
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+	return http.StatusOK, nil
+}
+
+// AccountRevokeSessionHandler logs out one of the user's sessions
+func AccountRevokeSessionHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	accessToken, err := common.GetAccessToken(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	decoder := json.NewDecoder(r.Body)
+
+	var info revokeSession
+	err = decoder.Decode(&info)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	defer r.Body.Close()
+
+	success, errorMessage, err := auth.RevokeSession(r.Context(), ctx.Database, accessToken, info.Id, remoteIp(r))
 
 	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
 		log.Println(err)
 	}
 
@@ -171,3 +472,80 @@ func AccountRemoveLinkedProviderHandler(ctx *HandlerContext, w http.ResponseWrit
 	w.Write(data)
 	return http.StatusOK, nil
 }
+
+// accountLoginsLimit is how many login attempts users get to see in their login history
+const accountLoginsLimit = 50
+
+// AccountLoginsHandler shows the user's recent login history, including failed attempts
+func AccountLoginsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	accessToken, err := common.GetAccessToken(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	success, errorMessage, attempts, err := auth.Logins(r.Context(), ctx.Database, accessToken, accountLoginsLimit)
+
+	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
+		log.Println(err)
+	}
+
+	status := loginsStatus{
+		Logins:       []loginAttempt{},
+		Success:      success,
+		ErrorMessage: errorMessage,
+	}
+	for _, attempt := range attempts {
+		status.Logins = append(status.Logins, loginAttempt{
+			Time:      attempt.Time,
+			Success:   attempt.Success,
+			Reason:    attempt.Reason,
+			Provider:  attempt.Provider,
+			UserAgent: attempt.UserAgent,
+			RemoteIp:  attempt.RemoteIp,
+		})
+	}
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Send the JSON object back to the user
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+	return http.StatusOK, nil
+}
+
+// AccountDeleteHandler schedules the deletion of the user's account, which can be cancelled by logging in again
+func AccountDeleteHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	accessToken, err := common.GetAccessToken(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	success, errorMessage, deletionDate, err := auth.ScheduleDeletion(r.Context(), ctx.Database, ctx.AccountDeletion, accessToken, remoteIp(r))
+
+	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
+		log.Println(err)
+	}
+
+	status := deleteAccountStatus{
+		DeletionDate: deletionDate,
+		Success:      success,
+		ErrorMessage: errorMessage,
+	}
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Send the JSON object back to the user
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+	return http.StatusOK, nil
+}
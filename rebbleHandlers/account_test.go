@@ -0,0 +1,132 @@
+package rebbleHandlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"pebble-dev/rebble-auth/auth"
+	"pebble-dev/rebble-auth/db"
+)
+
+func TestAccountInfo(t *testing.T) {
+	ctx := newTestContext()
+	accessToken := testLogin(t, ctx, "alice", "Alice")
+
+	var info accountInfo
+	decode(t, serve(ctx, newRequest("GET", "/user/info", accessToken, "")), &info)
+	if !info.LoggedIn || info.Name != "Alice" || len(info.LinkedProviders) != 1 || info.LinkedProviders[0] != "test" {
+		t.Errorf("Got %+v, expected Alice with the test provider", info)
+	}
+
+	info = accountInfo{}
+	decode(t, serve(ctx, newRequest("GET", "/user/info", "invalid", "")), &info)
+	if info.LoggedIn || info.ErrorMessage == "" {
+		t.Errorf("Got %+v for an invalid access token, expected an error", info)
+	}
+
+	w := serve(ctx, newRequest("GET", "/user/info", "", ""))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got HTTP %v without an access token, expected %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestAccountUpdateName(t *testing.T) {
+	ctx := newTestContext()
+	accessToken := testLogin(t, ctx, "alice", "Alice")
+
+	var status updateAccountStatus
+	decode(t, serve(ctx, newRequest("POST", "/user/update/name", accessToken, `{"name": "Ali"}`)), &status)
+	if !status.Success {
+		t.Fatalf("Could not update name: %v", status.ErrorMessage)
+	}
+
+	var id idStatus
+	decode(t, serve(ctx, newRequest("GET", "/user/id/"+testUserId(t, ctx, accessToken), "", "")), &id)
+
+	var name nameStatus
+	decode(t, serve(ctx, newRequest("GET", "/user/name/"+id.Id, "", "")), &name)
+	if name.Name != "Ali" || name.ErrorMessage != "" {
+		t.Errorf("Got %+v, expected the new name", name)
+	}
+
+	w := serve(ctx, newRequest("POST", "/user/update/name", accessToken, "{"))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got HTTP %v for an invalid body, expected %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestAccountGetUnknownName(t *testing.T) {
+	ctx := newTestContext()
+
+	var name nameStatus
+	decode(t, serve(ctx, newRequest("GET", "/user/name/unknown", "", "")), &name)
+	if name.ErrorMessage == "" {
+		t.Errorf("Got %+v for an unknown user, expected an error", name)
+	}
+}
+
+func TestAccountSessions(t *testing.T) {
+	ctx := newTestContext()
+	for _, userAgent := range []string{"Pebble app", "Firefox"} {
+		_, _, _, err := ctx.Database.AccountLoginOrRegister(context.Background(), "test", "alice", "Alice", "", false, "{}", "", "", 0, db.SessionMetadata{ClientId: "https://example.com", UserAgent: userAgent, RemoteIp: "192.0.2.1"})
+		if err != nil {
+			t.Fatalf("Could not log in: %v", err)
+		}
+	}
+	accessToken := testLogin(t, ctx, "alice", "Alice")
+
+	var status sessionsStatus
+	decode(t, serve(ctx, newRequest("GET", "/user/sessions", accessToken, "")), &status)
+	if !status.Success || len(status.Sessions) != 3 {
+		t.Fatalf("Expected 3 sessions, got %+v", status)
+	}
+
+	var current, other sessionInfo
+	currentCount := 0
+	for _, session := range status.Sessions {
+		if session.Current {
+			current = session
+			currentCount++
+		} else if session.UserAgent == "Pebble app" {
+			other = session
+		}
+	}
+	if currentCount != 1 || current.UserAgent != "" {
+		t.Errorf("Expected the session of the request to be flagged as current, got %+v", status.Sessions)
+	}
+	if other.ClientId != "https://example.com" || other.RemoteIp != "192.0.2.1" || other.Provider != "test" || other.Created.IsZero() {
+		t.Errorf("Got session %+v, expected the metadata it was created with", other)
+	}
+
+	var revoked updateAccountStatus
+	decode(t, serve(ctx, newRequest("POST", "/user/sessions/revoke", accessToken, fmt.Sprintf(`{"id": %d}`, other.Id))), &revoked)
+	if !revoked.Success {
+		t.Fatalf("Could not revoke session: %v", revoked.ErrorMessage)
+	}
+
+	status = sessionsStatus{}
+	decode(t, serve(ctx, newRequest("GET", "/user/sessions", accessToken, "")), &status)
+	for _, session := range status.Sessions {
+		if session.Id == other.Id {
+			t.Errorf("The revoked session is still listed")
+		}
+	}
+	if len(status.Sessions) != 2 {
+		t.Errorf("Expected 2 sessions to be left, got %+v", status.Sessions)
+	}
+}
+
+func TestAccountLogins(t *testing.T) {
+	ctx := newTestContext()
+	auth.LogFailedLogin(context.Background(), ctx.Database, "test", db.LoginInvalidCode, db.SessionMetadata{RemoteIp: "192.0.2.2"})
+	accessToken := testLogin(t, ctx, "alice", "Alice")
+
+	// Failed attempts which couldn't be tied to the user aren't theirs to see
+	var status loginsStatus
+	decode(t, serve(ctx, newRequest("GET", "/user/logins", accessToken, "")), &status)
+	if !status.Success || len(status.Logins) != 1 || !status.Logins[0].Success || status.Logins[0].Provider != "test" {
+		t.Errorf("Expected the successful login only, got %+v", status)
+	}
+}
@@ -1,150 +1,370 @@
 package rebbleHandlers
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net/http"
-	"os"
-	"path/filepath"
-	"strings"
+	"pebble-dev/rebble-auth/auth"
+	"pebble-dev/rebble-auth/db"
+	"pebble-dev/rebble-auth/importer"
+	"pebble-dev/rebble-auth/jobs"
+	"strconv"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/gorilla/mux"
 )
 
-type PebbleApplication struct {
-	Author   string `json:"author"`
-	AuthorId string `json:"developer_id"`
-}
-
-// PebbleAppList contains a list of PebbleApplication. It matches the format of Pebble API answers.
-type PebbleAppList struct {
-	Apps []*PebbleApplication `json:"data"`
-}
-
-// walkFiles is intended to quickly crawl the pebble application folder
-// in-order to re-build the users database.
-func walkFiles(root string) (<-chan string, <-chan error) {
-	// Create a couple of channels to communicate with the main process.
-	// (multi-threading FTW!)
-	paths := make(chan string)
-	errf := make(chan error, 1)
-
-	// Crawl the directory in the background.
-	go func() {
-		defer close(paths)
-		errf <- filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				log.Println(err)
-			}
-			if info.IsDir() {
-				return nil
-			}
-			if strings.HasSuffix(info.Name(), ".json") {
-				paths <- path
-			}
-			return nil
-		})
-	}()
-
-	// Return the channels so that our goroutine can communicate with the main
-	// thread.
-	return paths, errf
-}
-
-// AdminRebuildDBHandler allows an administrator to rebuild the database from
-// the application directory after hitting a single API end point.
-func AdminRebuildDBHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
-	dbHandler := ctx.Database
-
-	sqlStmt := `
-			drop table if exists users;
-			create table users (
-				id text not null primary key,
-				name text not null,
-				email text not null,
-				type text nont null default 'user',
-				pebbleMirror integer not null,
-				disabled integer not null
-			);
-			delete from users;
-
-			drop table if exists userSessions;
-			create table userSessions (
-				id integer not null primary key,
-				userId text not null,
-				accessToken text not null
-			);
-			delete from userSessions;
-
-			drop table if exists providerSessions;
-			create table providerSessions (
-				id integer not null primary key,
-				userId text not null,
-				provider text not null,
-				sub text not null,
-				accessToken text not null,
-				refreshToken text not null,
-				expires integer not null
-			);
-			delete from providerSessions;
-
-			drop table if exists userLoginLog;
-			create table userLoginLog (
-				id integer not null primary key,
-				userId text not null,
-				remoteIp text not null,
-				time integer not null,
-				success integer not null
-			);
-			delete from userLoginLog;
-		`
-	_, err := dbHandler.Exec(sqlStmt)
-	if err != nil {
-		return http.StatusInternalServerError, fmt.Errorf("%q: %s", err, sqlStmt)
-	}
-
-	users := make(map[string]string)
-
-	path, errc := walkFiles("PebbleAppStore/")
-	for item := range path {
-		f, err := ioutil.ReadFile(item)
-		if err != nil {
-			return http.StatusInternalServerError, err
-		}
+// Default and maximum page sizes of the admin login log
+const (
+	adminLoginsDefaultLimit = 100
+	adminLoginsMaxLimit     = 1000
+)
 
-		data := PebbleAppList{}
+// Default and maximum number of admin jobs listed
+const (
+	adminJobsDefaultLimit = 50
+	adminJobsMaxLimit     = 1000
+)
 
-		err = json.Unmarshal(f, &data)
-		if err != nil {
-			return http.StatusInternalServerError, err
-		}
+type adminLoginAttempt struct {
+	Id        int64     `json:"id"`
+	UserId    string    `json:"userId"`
+	Time      time.Time `json:"time"`
+	Success   bool      `json:"success"`
+	Reason    string    `json:"reason"`
+	Provider  string    `json:"provider"`
+	UserAgent string    `json:"userAgent"`
+	RemoteIp  string    `json:"remoteIp"`
+}
 
-		if len(data.Apps) != 1 {
-			panic("Data is not the size of 1")
-		}
+type adminLoginsStatus struct {
+	Logins []adminLoginAttempt `json:"logins"`
+	Offset int                 `json:"offset"`
+	Limit  int                 `json:"limit"`
+}
 
-		// Create author if it doesn't exist
-		if _, ok := users[data.Apps[0].Author]; !ok {
-			users[data.Apps[0].AuthorId] = data.Apps[0].Author
-		}
+// importDevelopersJob is the name of the Pebble developer import job
+const importDevelopersJob = "import-developers"
+
+// AdminImportDevelopersHandler allows an administrator to import the Pebble developers from the application directory
+// after hitting a single API end point. The import runs as a background job, which can be followed at
+// `/admin/jobs/{id}`. Existing accounts are updated rather than replaced, and an interrupted or cancelled import
+// resumes where it stopped unless `restart=1` is given. The schema itself is managed by the migrations in
+// db/migrations.go.
+func AdminImportDevelopersHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	restart := r.URL.Query().Get("restart") == "1"
+	actorId := sessionUser(r).UserId
+
+	job, err := ctx.Jobs.Submit(r.Context(), importDevelopersJob, func(c context.Context, progress *jobs.Progress) (interface{}, error) {
+		return importer.ImportPebbleDevelopers(c, ctx.Database, importer.DefaultRoot, restart, actorId, progress)
+	})
+	if err == jobs.ErrAlreadyRunning {
+		return http.StatusConflict, err
+	}
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	data, err := json.MarshalIndent(newAdminJob(job), "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Send the JSON object back to the user
+	w.Header().Add("content-type", "application/json")
+	w.Header().Add("location", "/admin/jobs/"+job.Id)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(data)
+
+	return http.StatusAccepted, nil
+}
+
+// queryInt returns the value of an integer query parameter, or the given default if it is missing
+func queryInt(r *http.Request, name string, def int) (int, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil || i < 0 {
+		return 0, fmt.Errorf("Invalid value for '%v': %v", name, value)
+	}
+
+	return i, nil
+}
+
+// AdminLoginsHandler lets an administrator browse the login log, optionally only for a given user (`user`) and/or IP
+// address (`ip`). Results are paginated using `offset` and `limit`.
+func AdminLoginsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	limit, err := queryInt(r, "limit", adminLoginsDefaultLimit)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if limit > adminLoginsMaxLimit {
+		limit = adminLoginsMaxLimit
+	}
+
+	attempts, err := ctx.Database.LoginLog(r.Context(), r.URL.Query().Get("user"), r.URL.Query().Get("ip"), offset, limit)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	status := adminLoginsStatus{
+		Logins: []adminLoginAttempt{},
+		Offset: offset,
+		Limit:  limit,
+	}
+	for _, attempt := range attempts {
+		status.Logins = append(status.Logins, adminLoginAttempt(attempt))
+	}
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
 	}
 
-	if err := <-errc; err != nil {
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+	return http.StatusOK, nil
+}
+
+// AdminBackupHandler sends a consistent snapshot of the database back, compressed with gzip if `compress` is set
+func AdminBackupHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	backuper, ok := ctx.Database.(db.Backuper)
+	if !ok {
+		return http.StatusNotImplemented, db.ErrBackupUnsupported
+	}
+
+	compress := r.URL.Query().Get("compress") != ""
+	name := "rebble-auth.db"
+	if compress {
+		name += ".gz"
+		w.Header().Add("content-type", "application/gzip")
+	} else {
+		w.Header().Add("content-type", "application/vnd.sqlite3")
+	}
+	w.Header().Add("content-disposition", "attachment; filename=\""+name+"\"")
+
+	err := backuper.WriteBackup(w, compress)
+	if err != nil {
+		w.Header().Del("content-disposition")
+	}
+	if err == db.ErrBackupUnsupported {
+		return http.StatusNotImplemented, err
+	}
+	if err != nil {
 		return http.StatusInternalServerError, err
 	}
 
-	tx, err := dbHandler.Begin()
-	defer tx.Rollback()
-	for id, user := range users {
-		_, err := tx.Exec("INSERT INTO users(id, name, email, type, pebbleMirror, disabled) VALUES (?, ?, '', 'users', 1, 0)", id, user)
-		if err != nil {
-			log.Printf("Could not insert user into database: %v", err)
+	return http.StatusOK, nil
+}
+
+type schedulerJob struct {
+	Name     string    `json:"name"`
+	Interval float64   `json:"interval"` // In seconds
+	Running  bool      `json:"running"`
+	LastRun  time.Time `json:"lastRun"`
+	NextRun  time.Time `json:"nextRun"`
+}
+
+type schedulerRun struct {
+	Job      string    `json:"job"`
+	Started  time.Time `json:"started"`
+	Duration float64   `json:"duration"` // In seconds
+	Result   string    `json:"result"`
+	Error    string    `json:"error"`
+}
+
+type schedulerStatus struct {
+	Jobs    []schedulerJob `json:"jobs"`
+	History []schedulerRun `json:"history"`
+}
+
+// AdminSchedulerHandler shows the background jobs, and how their most recent runs went
+func AdminSchedulerHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	status := schedulerStatus{
+		Jobs:    []schedulerJob{},
+		History: []schedulerRun{},
+	}
+	if ctx.Scheduler != nil {
+		for _, job := range ctx.Scheduler.Jobs() {
+			status.Jobs = append(status.Jobs, schedulerJob{
+				Name:     job.Name,
+				Interval: job.Interval.Seconds(),
+				Running:  job.Running,
+				LastRun:  job.LastRun,
+				NextRun:  job.NextRun,
+			})
+		}
+		for _, run := range ctx.Scheduler.History() {
+			status.History = append(status.History, schedulerRun{
+				Job:      run.Job,
+				Started:  run.Started,
+				Duration: run.Duration.Seconds(),
+				Result:   run.Result,
+				Error:    run.Error,
+			})
 		}
 	}
-	tx.Commit()
 
-	log.Print("Rebble Auth Database rebuilt successfully.")
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+	return http.StatusOK, nil
+}
+
+type adminJob struct {
+	Id       string          `json:"id"`
+	Name     string          `json:"name"`
+	Status   string          `json:"status"`
+	Progress int             `json:"progress"`
+	Total    int             `json:"total"`
+	Log      []string        `json:"log"`
+	Result   json.RawMessage `json:"result"`
+	Error    string          `json:"error"`
+	Created  time.Time       `json:"created"`
+	Finished time.Time       `json:"finished"`
+}
+
+type adminJobsStatus struct {
+	Jobs []adminJob `json:"jobs"`
+}
+
+type adminJobCancelStatus struct {
+	Success      bool   `json:"success"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+// newAdminJob converts an admin job to the format it is shown in
+func newAdminJob(job db.AdminJob) adminJob {
+	var result json.RawMessage
+	if job.Result != "" {
+		result = json.RawMessage(job.Result)
+	}
+
+	return adminJob{
+		Id:       job.Id,
+		Name:     job.Name,
+		Status:   job.Status,
+		Progress: job.Progress,
+		Total:    job.Total,
+		Log:      job.Log,
+		Result:   result,
+		Error:    job.Error,
+		Created:  job.Created,
+		Finished: job.Finished,
+	}
+}
+
+// AdminJobsHandler lists the most recent admin jobs, latest first. `limit` sets how many are listed.
+func AdminJobsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	limit, err := queryInt(r, "limit", adminJobsDefaultLimit)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if limit > adminJobsMaxLimit {
+		limit = adminJobsMaxLimit
+	}
+
+	list, err := ctx.Jobs.Jobs(r.Context(), limit)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	status := adminJobsStatus{
+		Jobs: []adminJob{},
+	}
+	for _, job := range list {
+		status.Jobs = append(status.Jobs, newAdminJob(job))
+	}
+
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Send the JSON object back to the user
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+
 	return http.StatusOK, nil
 }
+
+// AdminJobHandler shows the status, progress and log of admin job `{id}`
+func AdminJobHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	job, ok, err := ctx.Jobs.Job(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !ok {
+		return http.StatusNotFound, fmt.Errorf("No such job: %v", mux.Vars(r)["id"])
+	}
+
+	data, err := json.MarshalIndent(newAdminJob(job), "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Send the JSON object back to the user
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+
+	return http.StatusOK, nil
+}
+
+// AdminJobCancelHandler asks admin job `{id}` to stop. The job shows up as cancelled once it actually stopped.
+func AdminJobCancelHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	status := adminJobCancelStatus{
+		Success: ctx.Jobs.Cancel(mux.Vars(r)["id"]),
+	}
+	if !status.Success {
+		status.ErrorMessage = "This job isn't running"
+	}
+
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Send the JSON object back to the user
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+
+	return http.StatusOK, nil
+}
+
+type adminSetRole struct {
+	Role string `json:"role"`
+}
+
+// AdminSetRoleHandler gives the role in the body of the request to user `{id}`
+func AdminSetRoleHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	decoder := json.NewDecoder(r.Body)
+
+	var info adminSetRole
+	err := decoder.Decode(&info)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	defer r.Body.Close()
+
+	success, errorMessage, err := auth.SetRole(r.Context(), ctx.Database, mux.Vars(r)["id"], info.Role, sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return writeJSON(w, updateAccountStatus{
+		Success:      success,
+		ErrorMessage: errorMessage,
+	})
+}
@@ -0,0 +1,208 @@
+package rebbleHandlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"pebble-dev/rebble-auth/auth"
+	"pebble-dev/rebble-auth/db"
+	"pebble-dev/rebble-auth/jobs"
+	"pebble-dev/rebble-auth/scheduler"
+)
+
+func TestAdminLogins(t *testing.T) {
+	ctx := newTestContext()
+	for i := 0; i < 3; i++ {
+		auth.LogFailedLogin(context.Background(), ctx.Database, "test", db.LoginInvalidCode, db.SessionMetadata{RemoteIp: fmt.Sprintf("192.0.2.%d", i)})
+	}
+	aliceToken := testLogin(t, ctx, "alice", "Alice")
+	adminToken := testAdmin(t, ctx, auth.RoleAdmin)
+
+	var status adminLoginsStatus
+	decode(t, serve(ctx, newRequest("GET", "/admin/logins?offset=1&limit=2", adminToken, "")), &status)
+	if len(status.Logins) != 2 || status.Offset != 1 || status.Limit != 2 {
+		t.Errorf("Expected the second page of 2 logins, got %+v", status)
+	}
+
+	status = adminLoginsStatus{}
+	decode(t, serve(ctx, newRequest("GET", "/admin/logins?ip=192.0.2.1", adminToken, "")), &status)
+	if len(status.Logins) != 1 || status.Logins[0].RemoteIp != "192.0.2.1" || status.Logins[0].Reason != db.LoginInvalidCode {
+		t.Errorf("Expected the failed login from 192.0.2.1, got %+v", status)
+	}
+
+	status = adminLoginsStatus{}
+	decode(t, serve(ctx, newRequest("GET", "/admin/logins?user="+testUserId(t, ctx, aliceToken), adminToken, "")), &status)
+	if len(status.Logins) != 1 || !status.Logins[0].Success {
+		t.Errorf("Expected alice's login, got %+v", status)
+	}
+
+	w := serve(ctx, newRequest("GET", "/admin/logins?limit=many", adminToken, ""))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got HTTP %v for an invalid limit, expected %v", w.Code, http.StatusBadRequest)
+	}
+
+	w = serve(ctx, newRequest("GET", "/admin/logins", aliceToken, ""))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Got HTTP %v for a user, expected %v", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestAdminScheduler(t *testing.T) {
+	ctx := newTestContext()
+	adminToken := testAdmin(t, ctx, auth.RoleAdmin)
+
+	// Without a scheduler, there is nothing to show
+	var status schedulerStatus
+	decode(t, serve(ctx, newRequest("GET", "/admin/scheduler", adminToken, "")), &status)
+	if len(status.Jobs) != 0 || len(status.History) != 0 {
+		t.Errorf("Got %+v without a scheduler, expected nothing", status)
+	}
+
+	ctx.Scheduler = scheduler.New(scheduler.Job{Name: "test", Interval: time.Hour, Run: func() (string, error) { return "done", nil }})
+	ctx.Scheduler.Start()
+	ctx.Scheduler.Stop()
+
+	status = schedulerStatus{}
+	decode(t, serve(ctx, newRequest("GET", "/admin/scheduler", adminToken, "")), &status)
+	if len(status.Jobs) != 1 || status.Jobs[0].Name != "test" || status.Jobs[0].Interval != 3600 {
+		t.Errorf("Got jobs %+v, expected the test job", status.Jobs)
+	}
+	if len(status.History) != 1 || status.History[0].Result != "done" {
+		t.Errorf("Got history %+v, expected the run of the test job", status.History)
+	}
+}
+
+func TestAdminJobs(t *testing.T) {
+	ctx := newTestContext()
+	runner, err := jobs.New(ctx.Database)
+	if err != nil {
+		t.Fatalf("Could not create job runner: %v", err)
+	}
+	defer runner.Stop()
+	ctx.Jobs = runner
+	adminToken := testAdmin(t, ctx, auth.RoleAdmin)
+
+	started := make(chan struct{})
+	job, err := runner.Submit(context.Background(), "test", func(c context.Context, progress *jobs.Progress) (interface{}, error) {
+		progress.SetTotal(10)
+		close(started)
+		<-c.Done()
+		return nil, c.Err()
+	})
+	if err != nil {
+		t.Fatalf("Could not submit job: %v", err)
+	}
+	<-started
+
+	var list adminJobsStatus
+	decode(t, serve(ctx, newRequest("GET", "/admin/jobs", adminToken, "")), &list)
+	if len(list.Jobs) != 1 || list.Jobs[0].Id != job.Id || list.Jobs[0].Total != 10 {
+		t.Errorf("Got jobs %+v, expected the running job", list.Jobs)
+	}
+
+	var cancel adminJobCancelStatus
+	decode(t, serve(ctx, newRequest("POST", "/admin/jobs/"+job.Id+"/cancel", adminToken, "")), &cancel)
+	if !cancel.Success {
+		t.Errorf("Could not cancel the job: %v", cancel.ErrorMessage)
+	}
+	runner.Stop()
+
+	var status adminJob
+	decode(t, serve(ctx, newRequest("GET", "/admin/jobs/"+job.Id, adminToken, "")), &status)
+	if status.Status != db.JobCancelled {
+		t.Errorf("Got status %v, expected the job to be cancelled", status.Status)
+	}
+
+	cancel = adminJobCancelStatus{}
+	decode(t, serve(ctx, newRequest("POST", "/admin/jobs/"+job.Id+"/cancel", adminToken, "")), &cancel)
+	if cancel.Success || cancel.ErrorMessage == "" {
+		t.Errorf("Cancelled a job which isn't running")
+	}
+
+	w := serve(ctx, newRequest("GET", "/admin/jobs/unknown", adminToken, ""))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Got HTTP %v for an unknown job, expected %v", w.Code, http.StatusNotFound)
+	}
+
+	w = serve(ctx, newRequest("POST", "/admin/import/developers", adminToken, ""))
+	if w.Code != http.StatusAccepted || !strings.HasPrefix(w.Header().Get("location"), "/admin/jobs/") {
+		t.Errorf("Got HTTP %v with location %q, expected the import to be started", w.Code, w.Header().Get("location"))
+	}
+
+	for _, path := range []string{"/admin/import/developers", "/admin/rebuild/db"} {
+		w = serve(ctx, newRequest("GET", path, adminToken, ""))
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Errorf("Got HTTP %v for GET %v, expected %v", w.Code, path, http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func TestAdminBackup(t *testing.T) {
+	handler, err := db.Open(db.SQLite, filepath.Join(t.TempDir(), "rebble-auth.db"))
+	if err != nil {
+		t.Fatalf("Could not open database: %v", err)
+	}
+	defer handler.Close()
+	_, err = handler.Migrate()
+	if err != nil {
+		t.Fatalf("Could not migrate database: %v", err)
+	}
+
+	// The store is wrapped in the session cache, as it is in main
+	ctx := newTestContext()
+	ctx.Database = db.NewSessionCache(handler, 100, time.Minute)
+	adminToken := testAdmin(t, ctx, auth.RoleAdmin)
+
+	w := serve(ctx, newRequest("GET", "/admin/backup", adminToken, ""))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Body.String(), "SQLite format 3\x00") {
+		t.Errorf("Got HTTP %v, expected an SQLite database", w.Code)
+	}
+
+	w = serve(ctx, newRequest("GET", "/admin/backup?compress=1", adminToken, ""))
+	if w.Code != http.StatusOK || w.Header().Get("content-type") != "application/gzip" || !strings.HasPrefix(w.Body.String(), "\x1f\x8b") {
+		t.Errorf("Got HTTP %v (%v), expected a compressed database", w.Code, w.Header().Get("content-type"))
+	}
+
+	// Other stores can't be backed up
+	ctx = newTestContext()
+	ctx.Database = db.NewSessionCache(ctx.Database, 100, time.Minute)
+	adminToken = testAdmin(t, ctx, auth.RoleAdmin)
+	w = serve(ctx, newRequest("GET", "/admin/backup", adminToken, ""))
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Got HTTP %v for a memory store, expected %v", w.Code, http.StatusNotImplemented)
+	}
+}
+
+func TestAdminSetRole(t *testing.T) {
+	ctx := newTestContext()
+	adminToken := testAdmin(t, ctx, auth.RoleAdmin)
+	aliceToken := testLogin(t, ctx, "alice", "Alice")
+	aliceId := testUserId(t, ctx, aliceToken)
+
+	var status updateAccountStatus
+	decode(t, serve(ctx, newRequest("POST", "/admin/users/"+aliceId+"/role", adminToken, `{"role": "moderator"}`)), &status)
+	if !status.Success {
+		t.Fatalf("Could not set role: %v", status.ErrorMessage)
+	}
+
+	// alice can now browse the logs, but still not give roles
+	w := serve(ctx, newRequest("GET", "/admin/logins", aliceToken, ""))
+	if w.Code != http.StatusOK {
+		t.Errorf("Got HTTP %v, expected the moderator to be able to browse the logs", w.Code)
+	}
+	w = serve(ctx, newRequest("POST", "/admin/users/"+aliceId+"/role", aliceToken, `{"role": "admin"}`))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Got HTTP %v for a moderator giving roles, expected %v", w.Code, http.StatusForbidden)
+	}
+
+	status = updateAccountStatus{}
+	decode(t, serve(ctx, newRequest("POST", "/admin/users/"+testUserId(t, ctx, adminToken)+"/role", adminToken, `{"role": "user"}`)), &status)
+	if status.Success || status.ErrorMessage == "" {
+		t.Errorf("The admin could drop their own role")
+	}
+}
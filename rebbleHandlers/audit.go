@@ -0,0 +1,117 @@
+package rebbleHandlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"pebble-dev/rebble-auth/db"
+	"time"
+)
+
+// Default and maximum page sizes of the audit log
+const (
+	adminAuditDefaultLimit = 100
+	adminAuditMaxLimit     = 1000
+)
+
+type auditEntry struct {
+	Id       int64           `json:"id"`
+	Time     time.Time       `json:"time"`
+	ActorId  string          `json:"actorId"`
+	UserId   string          `json:"userId"`
+	Action   string          `json:"action"`
+	Before   json.RawMessage `json:"before"`
+	After    json.RawMessage `json:"after"`
+	RemoteIp string          `json:"remoteIp"`
+}
+
+type adminAuditStatus struct {
+	Entries []auditEntry `json:"entries"`
+	Offset  int          `json:"offset"`
+	Limit   int          `json:"limit"`
+}
+
+// newAuditEntry converts an audit log entry to the format it is shown in
+func newAuditEntry(entry db.AuditEntry) auditEntry {
+	e := auditEntry{
+		Id:       entry.Id,
+		Time:     entry.Time,
+		ActorId:  entry.ActorId,
+		UserId:   entry.UserId,
+		Action:   entry.Action,
+		RemoteIp: entry.RemoteIp,
+	}
+	if entry.Before != "" {
+		e.Before = json.RawMessage(entry.Before)
+	}
+	if entry.After != "" {
+		e.After = json.RawMessage(entry.After)
+	}
+
+	return e
+}
+
+// queryTime returns the value of an RFC 3339 date query parameter, or the zero time if it isn't set
+func queryTime(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("Invalid value for '%v': %v", name, value)
+	}
+
+	return t, nil
+}
+
+// AdminAuditHandler lets an administrator browse the audit log, latest first. Entries can be filtered by `actor`,
+// `user`, `action` (a trailing `.` matches a group of actions, such as `account.`) and by date using `since` and
+// `until`, and results are paginated using `offset` and `limit`.
+func AdminAuditHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	limit, err := queryInt(r, "limit", adminAuditDefaultLimit)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if limit > adminAuditMaxLimit {
+		limit = adminAuditMaxLimit
+	}
+
+	filter := db.AuditFilter{
+		ActorId: r.URL.Query().Get("actor"),
+		UserId:  r.URL.Query().Get("user"),
+		Action:  r.URL.Query().Get("action"),
+	}
+
+	filter.Since, err = queryTime(r, "since")
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	filter.Until, err = queryTime(r, "until")
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	entries, err := ctx.Database.AuditLog(r.Context(), filter, offset, limit)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	status := adminAuditStatus{
+		Entries: []auditEntry{},
+		Offset:  offset,
+		Limit:   limit,
+	}
+	for _, entry := range entries {
+		status.Entries = append(status.Entries, newAuditEntry(entry))
+	}
+
+	return writeJSON(w, status)
+}
@@ -0,0 +1,52 @@
+package rebbleHandlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"pebble-dev/rebble-auth/auth"
+	"pebble-dev/rebble-auth/db"
+)
+
+func TestAdminAudit(t *testing.T) {
+	ctx := newTestContext()
+	aliceToken := testLogin(t, ctx, "alice", "Alice")
+	aliceId := testUserId(t, ctx, aliceToken)
+	serve(ctx, newRequest("POST", "/user/update/name", aliceToken, `{"name": "Alice Liddell"}`))
+	moderatorToken := testAdmin(t, ctx, auth.RoleModerator)
+
+	var status adminAuditStatus
+	decode(t, serve(ctx, newRequest("GET", "/admin/audit?user="+aliceId, moderatorToken, "")), &status)
+	if len(status.Entries) != 2 || status.Entries[0].Action != db.AuditAccountName || strings.Contains(string(status.Entries[0].After), "Alice") {
+		t.Fatalf("Got %+v, expected alice's changes, latest first", status.Entries)
+	}
+	if status.Entries[1].Action != db.AuditAccountCreate || string(status.Entries[1].Before) != "null" {
+		t.Errorf("Got %+v, expected the creation of alice's account", status.Entries[1])
+	}
+
+	status = adminAuditStatus{}
+	decode(t, serve(ctx, newRequest("GET", "/admin/audit?action=account.&actor=system&limit=5000", moderatorToken, "")), &status)
+	if len(status.Entries) != 1 || status.Entries[0].Action != db.AuditAccountRole || status.Limit != adminAuditMaxLimit {
+		t.Errorf("Got %+v, expected the role given to the moderator", status)
+	}
+
+	since := url.QueryEscape(time.Now().Add(time.Hour).Format(time.RFC3339))
+	status = adminAuditStatus{}
+	decode(t, serve(ctx, newRequest("GET", "/admin/audit?since="+since, moderatorToken, "")), &status)
+	if len(status.Entries) != 0 {
+		t.Errorf("Got %+v, expected no changes in the future", status.Entries)
+	}
+
+	w := serve(ctx, newRequest("GET", "/admin/audit?since=yesterday", moderatorToken, ""))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Got HTTP %v for an invalid date, expected %v", w.Code, http.StatusBadRequest)
+	}
+
+	w = serve(ctx, newRequest("GET", "/admin/audit", aliceToken, ""))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Got HTTP %v for a user, expected %v", w.Code, http.StatusForbidden)
+	}
+}
@@ -3,14 +3,18 @@ package rebbleHandlers
 import (
 	"encoding/base64"
 	"fmt"
+	"html"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 
 	"pebble-dev/rebble-auth/auth"
 	"pebble-dev/rebble-auth/common"
+	"pebble-dev/rebble-auth/db"
 	"pebble-dev/rebble-auth/sso"
 
 	"github.com/gorilla/mux"
@@ -24,6 +28,16 @@ func authorizationFail(message string, redirectURI string, err error, w *http.Re
 	return nil
 }
 
+// remoteIp returns the IP address a request comes from, without the port
+func remoteIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
 // AuthorizeHandler provides the authorization page directly shown to the user
 func AuthorizeHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
 	urlquery := r.URL.Query()
@@ -73,6 +87,20 @@ func AuthorizeHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Reques
 		return http.StatusBadRequest, nil
 	}
 
+	linkToken := ""
+	if l, ok := urlquery["linkToken"]; ok {
+		if len(l) != 1 {
+			fmt.Fprintln(w, "Too many values for linkToken query parameter")
+			return http.StatusBadRequest, nil
+		}
+		linkToken = l[0]
+	}
+
+	if linkToken != "" && addProvider {
+		fmt.Fprintln(w, "Can't have both `linkToken` and `addProvider` query parameters")
+		return http.StatusBadRequest, nil
+	}
+
 	data, err := ioutil.ReadFile("static/authorize.html")
 	if err != nil {
 		return http.StatusInternalServerError, err
@@ -87,6 +115,16 @@ func AuthorizeHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Reques
 
 	if accessToken != "" && addProvider {
 		state += "|" + accessToken
+	} else if linkToken != "" {
+		state += "|link:" + linkToken
+	}
+
+	// The user may also choose to keep their new identity apart, in an account of its own
+	message := ""
+	declineLinkHidden := "hidden"
+	if linkToken != "" {
+		message = "An account using the same e-mail address already exists. Log in to it using one of its identity providers to link your new identity to it."
+		declineLinkHidden = ""
 	}
 
 	http.SetCookie(w, &http.Cookie{
@@ -98,6 +136,10 @@ func AuthorizeHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Reques
 	dataFormatted := string(data)
 	dataFormatted = strings.Replace(dataFormatted, "{{nonce}}", nonce, -1)
 	dataFormatted = strings.Replace(dataFormatted, "{{state}}", state, -1)
+	dataFormatted = strings.Replace(dataFormatted, "{{message}}", html.EscapeString(message), -1)
+	dataFormatted = strings.Replace(dataFormatted, "{{decline_link_hidden}}", declineLinkHidden, -1)
+	dataFormatted = strings.Replace(dataFormatted, "{{link_token}}", html.EscapeString(linkToken), -1)
+	dataFormatted = strings.Replace(dataFormatted, "{{rebble_state}}", html.EscapeString(rebbleState), -1)
 	for _, s := range ctx.SSos {
 		dataFormatted = strings.Replace(dataFormatted, "{{"+s.Name+"_authorization_endpoint}}", s.Discovery.AuthorizationEndpoint, -1)
 		dataFormatted = strings.Replace(dataFormatted, "{{"+s.Name+"_client_id}}", s.ClientID, -1)
@@ -131,10 +173,18 @@ func AuthorizeCallbackHandler(ctx *HandlerContext, w http.ResponseWriter, r *htt
 		fmt.Fprintf(w, "Invalid state: %v", state)
 		return http.StatusBadRequest, nil
 	}
-	addProvider := len(state2) == 4
+	// The optional fourth part of the state is either the access token of the account to add a provider to, or the
+	// token of a pending account link
+	addProvider := false
 	rebbleAccessToken := ""
-	if addProvider {
-		rebbleAccessToken = state2[3]
+	linkToken := ""
+	if len(state2) == 4 {
+		if strings.HasPrefix(state2[3], "link:") {
+			linkToken = strings.TrimPrefix(state2[3], "link:")
+		} else {
+			addProvider = true
+			rebbleAccessToken = state2[3]
+		}
 	}
 
 	redirectURIb, err := base64.URLEncoding.DecodeString(state2[1])
@@ -162,48 +212,93 @@ func AuthorizeCallbackHandler(ctx *HandlerContext, w http.ResponseWriter, r *htt
 		}
 	}
 
+	session := db.SessionMetadata{
+		ClientId:    auth.ClientId(redirectURI),
+		RedirectURI: redirectURI,
+		UserAgent:   r.UserAgent(),
+		RemoteIp:    remoteIp(r),
+	}
+
+	// Only login attempts are recorded in the login log, not additions of providers to an account
+	logFailure := func(reason string) {
+		if !addProvider {
+			auth.LogFailedLogin(r.Context(), ctx.Database, provider, reason, session)
+		}
+	}
+
 	if !legitProvider {
+		logFailure(db.LoginInvalidProvider)
 		return http.StatusFound, authorizationFail(fmt.Sprintf("Invalid provider: %v", provider), redirectURI, nil, &w, r)
 	}
 
 	var code string
 	if c, ok := urlquery["code"]; ok {
 		if len(c) != 1 {
+			logFailure(db.LoginInvalidCode)
 			return http.StatusFound, authorizationFail("Multiple values for 'code'", redirectURI, nil, &w, r)
 		}
 		code = c[0]
 	} else {
+		logFailure(db.LoginDenied)
 		return http.StatusFound, authorizationFail("Missing query element: code", redirectURI, nil, &w, r)
 	}
 
 	stateCookie, err := r.Cookie("state")
 	if err != nil {
+		logFailure(db.LoginInvalidState)
 		return http.StatusFound, authorizationFail("Missing cookie: state", redirectURI, nil, &w, r)
 	}
 
 	if state != stateCookie.Value {
+		logFailure(db.LoginInvalidState)
 		return http.StatusFound, authorizationFail(fmt.Sprintf("Invalid state: expected %v, got %v", stateCookie.Value, state), redirectURI, nil, &w, r)
 	}
 
 	if addProvider {
-		success, errorMessage, err := auth.AddProvider(ctx.SSos, ctx.Database, sso.Name, code, rebbleAccessToken, r.RemoteAddr)
+		success, errorMessage, mergeToken, err := auth.AddProvider(r.Context(), ctx.SSos, ctx.Database, sso.Name, code, rebbleAccessToken, session.RemoteIp)
 
 		if err != nil {
+			if db.Unavailable(err) {
+				return http.StatusServiceUnavailable, err
+			}
 			log.Println(err)
 		}
 
-		if success {
+		if success && mergeToken != "" {
+			// The identity belongs to another account, the user has to confirm they want to merge it (see `/user/merge`)
+			http.Redirect(w, r, redirectURI+"?merge_token="+url.QueryEscape(mergeToken), http.StatusFound)
+		} else if success {
 			http.Redirect(w, r, redirectURI+"?success", http.StatusFound)
 		} else {
 			http.Redirect(w, r, redirectURI+"?error="+errorMessage, http.StatusFound)
 		}
 	} else {
-		success, errorMessage, accessToken, err := auth.Login(ctx.SSos, ctx.Database, sso.Name, code, r.RemoteAddr)
+		success, errorMessage, accessToken, newLinkToken, err := auth.Login(r.Context(), ctx.SSos, ctx.Database, sso.Name, code, session)
 
 		if err != nil {
+			if db.Unavailable(err) {
+				return http.StatusServiceUnavailable, err
+			}
 			log.Println(err)
 		}
 
+		if success && newLinkToken != "" {
+			// The user has to log in to the existing account to confirm the link
+			http.Redirect(w, r, "/authorize?redirect_uri="+url.QueryEscape(redirectURI)+"&state="+url.QueryEscape(rebbleState)+"&linkToken="+url.QueryEscape(newLinkToken), http.StatusFound)
+			return http.StatusFound, nil
+		}
+
+		if success && linkToken != "" {
+			success, errorMessage, err = auth.ConfirmLink(r.Context(), ctx.Database, linkToken, accessToken, remoteIp(r))
+
+			if err != nil {
+				if db.Unavailable(err) {
+					return http.StatusServiceUnavailable, err
+				}
+				log.Println(err)
+			}
+		}
+
 		if success {
 			http.Redirect(w, r, redirectURI+"?access_token="+accessToken+"&state="+rebbleState, http.StatusFound)
 		} else {
@@ -213,3 +308,43 @@ func AuthorizeCallbackHandler(ctx *HandlerContext, w http.ResponseWriter, r *htt
 
 	return http.StatusFound, nil
 }
+
+// AuthorizeDeclineLinkHandler creates a separate account for a user who was offered to link their new identity to an
+// existing account (see AuthorizeHandler) but doesn't want to, and sends them back to the client logged in to it. The
+// client is the one the user was logging in to when the link was offered: the form only carries the link token and
+// the client's state, so that it can't be used to send an access token anywhere else.
+func AuthorizeDeclineLinkHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	linkToken := r.PostFormValue("linkToken")
+	rebbleState := r.PostFormValue("state")
+	if linkToken == "" {
+		fmt.Fprintln(w, "Missing linkToken")
+		return http.StatusBadRequest, nil
+	}
+
+	session := db.SessionMetadata{
+		UserAgent: r.UserAgent(),
+		RemoteIp:  remoteIp(r),
+	}
+
+	success, errorMessage, accessToken, redirectURI, err := auth.DeclineLink(r.Context(), ctx.Database, linkToken, session)
+	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
+		log.Println(err)
+	}
+
+	if redirectURI == "" {
+		// Without a known link token, there is no telling where the user came from
+		http.Error(w, errorMessage, http.StatusBadRequest)
+		return http.StatusBadRequest, nil
+	}
+
+	if success {
+		http.Redirect(w, r, redirectURI+"?access_token="+accessToken+"&state="+url.QueryEscape(rebbleState), http.StatusSeeOther)
+	} else {
+		http.Redirect(w, r, redirectURI+"?error="+url.QueryEscape(errorMessage), http.StatusSeeOther)
+	}
+
+	return http.StatusSeeOther, nil
+}
@@ -0,0 +1,68 @@
+package rebbleHandlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"pebble-dev/rebble-auth/db"
+)
+
+func TestAuthorizeOffersToDeclineLink(t *testing.T) {
+	ctx := newTestContext()
+
+	w := serve(ctx, httptest.NewRequest("GET", "/authorize?redirect_uri=https://example.com/callback&state=s", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `action="/authorize/declineLink" hidden`) {
+		t.Errorf("Expected the form to decline a link to be hidden without a link token")
+	}
+
+	w = serve(ctx, httptest.NewRequest("GET", "/authorize?redirect_uri=https://example.com/callback&state=s&linkToken=token", nil))
+	body := w.Body.String()
+	if w.Code != http.StatusOK || strings.Contains(body, `action="/authorize/declineLink" hidden`) || !strings.Contains(body, `name="linkToken" value="token"`) {
+		t.Errorf("Expected the form to decline a link to be shown with a link token")
+	}
+}
+
+func TestAuthorizeDeclineLink(t *testing.T) {
+	ctx := newTestContext()
+	_, _, _, err := ctx.Database.AccountLoginOrRegister(context.Background(), "google", "alice", "Alice", "alice@example.com", true, "{}", "", "", 0, db.SessionMetadata{})
+	if err != nil {
+		t.Fatalf("Could not log in: %v", err)
+	}
+	session := db.SessionMetadata{ClientId: "example.com", RedirectURI: "https://example.com/callback"}
+	_, linkToken, _, err := ctx.Database.AccountLoginOrRegister(context.Background(), "yahoo", "alice", "Alice", "alice@example.com", true, "{}", "", "", 0, session)
+	if err != nil || linkToken == "" {
+		t.Fatalf("Expected a link token, got %q (%v)", linkToken, err)
+	}
+
+	// The user is sent back to where they were logging in to, whatever the form says
+	form := url.Values{"linkToken": {linkToken}, "redirect_uri": {"https://evil.example/callback"}, "state": {"a&b"}}
+	r := httptest.NewRequest("POST", "/authorize/declineLink", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := serve(ctx, r)
+
+	location, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusSeeOther || err != nil {
+		t.Fatalf("Expected a redirect, got %v", w.Code)
+	}
+	accessToken := location.Query().Get("access_token")
+	if location.Host != "example.com" || location.Query().Get("state") != "a&b" || accessToken == "" {
+		t.Fatalf("Unexpected redirect to %v", location)
+	}
+
+	loggedIn, _, _, providers, err := ctx.Database.AccountInformation(context.Background(), accessToken)
+	if !loggedIn || err != nil || len(providers) != 1 || providers[0] != "yahoo" {
+		t.Errorf("Expected to be logged in to a new account with the yahoo identity, got %v", providers)
+	}
+
+	// The link token was used up
+	r = httptest.NewRequest("POST", "/authorize/declineLink", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = serve(ctx, r)
+	if w.Code != http.StatusBadRequest || w.Header().Get("Location") != "" {
+		t.Errorf("Got HTTP %v redirecting to %q when declining the link again, expected an error", w.Code, w.Header().Get("Location"))
+	}
+}
@@ -0,0 +1,274 @@
+package rebbleHandlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"pebble-dev/rebble-auth/auth"
+	"pebble-dev/rebble-auth/common"
+	"pebble-dev/rebble-auth/db"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Default and maximum page sizes of the admin claim queue
+const (
+	adminClaimsDefaultLimit = 100
+	adminClaimsMaxLimit     = 1000
+)
+
+type claimDeveloper struct {
+	DeveloperId string `json:"developerId"`
+}
+
+type verifyClaim struct {
+	Id int64 `json:"id"`
+}
+
+type developerClaim struct {
+	Id          int64     `json:"id"`
+	UserId      string    `json:"userId"`
+	DeveloperId string    `json:"developerId"`
+	Token       string    `json:"token"`
+	Status      string    `json:"status"`
+	ResolvedBy  string    `json:"resolvedBy"`
+	Created     time.Time `json:"created"`
+	Resolved    time.Time `json:"resolved"`
+}
+
+type claimStatus struct {
+	Claim        *developerClaim `json:"claim"`
+	Success      bool            `json:"success"`
+	ErrorMessage string          `json:"errorMessage"`
+}
+
+type claimsStatus struct {
+	Claims       []developerClaim `json:"claims"`
+	Success      bool             `json:"success"`
+	ErrorMessage string           `json:"errorMessage"`
+}
+
+type adminClaimsStatus struct {
+	Claims []developerClaim `json:"claims"`
+	Offset int              `json:"offset"`
+	Limit  int              `json:"limit"`
+}
+
+// newDeveloperClaim converts a developer claim to the format it is shown in
+func newDeveloperClaim(claim db.DeveloperClaim) developerClaim {
+	return developerClaim{
+		Id:          claim.Id,
+		UserId:      claim.UserId,
+		DeveloperId: claim.DeveloperId,
+		Token:       claim.Token,
+		Status:      claim.Status,
+		ResolvedBy:  claim.ResolvedBy,
+		Created:     claim.Created,
+		Resolved:    claim.Resolved,
+	}
+}
+
+// writeJSON sends an object back as JSON
+func writeJSON(w http.ResponseWriter, v interface{}) (int, error) {
+	data, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	// Send the JSON object back to the user
+	w.Header().Add("content-type", "application/json")
+	w.Write(data)
+	return http.StatusOK, nil
+}
+
+// AccountClaimDeveloperHandler lets a user claim the mirror account of a Pebble developer. The claim is granted once
+// its token is found in one of the developer's apps, or once an administrator approves it.
+func AccountClaimDeveloperHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	accessToken, err := common.GetAccessToken(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	decoder := json.NewDecoder(r.Body)
+
+	var info claimDeveloper
+	err = decoder.Decode(&info)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	defer r.Body.Close()
+
+	success, errorMessage, claim, err := auth.ClaimDeveloper(r.Context(), ctx.Database, accessToken, info.DeveloperId, remoteIp(r))
+
+	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
+		log.Println(err)
+	}
+
+	status := claimStatus{
+		Success:      success,
+		ErrorMessage: errorMessage,
+	}
+	if success {
+		c := newDeveloperClaim(claim)
+		status.Claim = &c
+	}
+
+	return writeJSON(w, status)
+}
+
+// AccountClaimsHandler lists the developer claims made by the user
+func AccountClaimsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	accessToken, err := common.GetAccessToken(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	success, errorMessage, claims, err := auth.DeveloperClaims(r.Context(), ctx.Database, accessToken)
+
+	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
+		log.Println(err)
+	}
+
+	status := claimsStatus{
+		Claims:       []developerClaim{},
+		Success:      success,
+		ErrorMessage: errorMessage,
+	}
+	for _, claim := range claims {
+		status.Claims = append(status.Claims, newDeveloperClaim(claim))
+	}
+
+	return writeJSON(w, status)
+}
+
+// AccountVerifyClaimHandler grants one of the user's developer claims if its token can be found in one of the
+// developer's apps
+func AccountVerifyClaimHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	accessToken, err := common.GetAccessToken(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	decoder := json.NewDecoder(r.Body)
+
+	var info verifyClaim
+	err = decoder.Decode(&info)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	defer r.Body.Close()
+
+	success, errorMessage, err := auth.VerifyDeveloperClaim(r.Context(), ctx.Database, ctx.DeveloperClaims, accessToken, info.Id, remoteIp(r))
+
+	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
+		log.Println(err)
+	}
+
+	return writeJSON(w, updateAccountStatus{
+		Success:      success,
+		ErrorMessage: errorMessage,
+	})
+}
+
+// AdminClaimsHandler lets an administrator browse the developer claims, oldest first. `status` selects the claims
+// to show (`pending` by default, `all` for every claim), and results are paginated using `offset` and `limit`.
+func AdminClaimsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	limit, err := queryInt(r, "limit", adminClaimsDefaultLimit)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if limit > adminClaimsMaxLimit {
+		limit = adminClaimsMaxLimit
+	}
+
+	filter := r.URL.Query().Get("status")
+	switch filter {
+	case "":
+		filter = db.ClaimPending
+	case "all":
+		filter = ""
+	case db.ClaimPending, db.ClaimApproved, db.ClaimRejected:
+	default:
+		return http.StatusBadRequest, fmt.Errorf("Invalid value for 'status': %v", filter)
+	}
+
+	claims, err := ctx.Database.DeveloperClaims(r.Context(), filter, offset, limit)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	status := adminClaimsStatus{
+		Claims: []developerClaim{},
+		Offset: offset,
+		Limit:  limit,
+	}
+	for _, claim := range claims {
+		status.Claims = append(status.Claims, newDeveloperClaim(claim))
+	}
+
+	return writeJSON(w, status)
+}
+
+// claimId returns the `{id}` of the claim an admin request is about
+func claimId(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(mux.Vars(r)["id"], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid claim ID: %v", mux.Vars(r)["id"])
+	}
+
+	return id, nil
+}
+
+// AdminApproveClaimHandler approves developer claim `{id}`, merging the developer's mirror account into the
+// claimant's account
+func AdminApproveClaimHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	id, err := claimId(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	errorMessage, err := ctx.Database.ApproveDeveloperClaim(r.Context(), id, db.ClaimByAdmin, sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return writeJSON(w, updateAccountStatus{
+		Success:      errorMessage == "",
+		ErrorMessage: errorMessage,
+	})
+}
+
+// AdminRejectClaimHandler rejects developer claim `{id}`
+func AdminRejectClaimHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	id, err := claimId(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	errorMessage, err := ctx.Database.RejectDeveloperClaim(r.Context(), id, sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return writeJSON(w, updateAccountStatus{
+		Success:      errorMessage == "",
+		ErrorMessage: errorMessage,
+	})
+}
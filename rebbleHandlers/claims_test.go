@@ -0,0 +1,107 @@
+package rebbleHandlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"pebble-dev/rebble-auth/auth"
+	"pebble-dev/rebble-auth/db"
+)
+
+func TestAdminClaims(t *testing.T) {
+	ctx := newTestContext()
+	_, err := ctx.Database.ImportPebbleDevelopers(context.Background(), []db.PebbleDeveloper{{Id: "dev1", Name: "Developer"}, {Id: "dev2", Name: "Developer"}}, db.AuditActorAdmin)
+	if err != nil {
+		t.Fatalf("Could not import developers: %v", err)
+	}
+	aliceToken := testLogin(t, ctx, "alice", "Alice")
+	adminToken := testAdmin(t, ctx, auth.RoleAdmin)
+
+	var claim claimStatus
+	for _, developerId := range []string{"dev1", "dev2"} {
+		claim = claimStatus{}
+		decode(t, serve(ctx, newRequest("POST", "/user/claims/developer", aliceToken, `{"developerId": "`+developerId+`"}`)), &claim)
+		if !claim.Success || claim.Claim == nil || claim.Claim.Token == "" {
+			t.Fatalf("Could not claim %v: %+v", developerId, claim)
+		}
+	}
+
+	var queue adminClaimsStatus
+	decode(t, serve(ctx, newRequest("GET", "/admin/claims", adminToken, "")), &queue)
+	if len(queue.Claims) != 2 || queue.Claims[0].DeveloperId != "dev1" {
+		t.Fatalf("Got claims %+v, expected both pending claims, oldest first", queue.Claims)
+	}
+
+	var status updateAccountStatus
+	decode(t, serve(ctx, newRequest("POST", fmt.Sprintf("/admin/claims/%d/approve", queue.Claims[0].Id), adminToken, "")), &status)
+	if !status.Success {
+		t.Errorf("Could not approve claim: %v", status.ErrorMessage)
+	}
+	status = updateAccountStatus{}
+	decode(t, serve(ctx, newRequest("POST", fmt.Sprintf("/admin/claims/%d/reject", queue.Claims[1].Id), adminToken, "")), &status)
+	if !status.Success {
+		t.Errorf("Could not reject claim: %v", status.ErrorMessage)
+	}
+
+	var claims claimsStatus
+	decode(t, serve(ctx, newRequest("GET", "/user/claims", aliceToken, "")), &claims)
+	statuses := map[string]string{}
+	for _, c := range claims.Claims {
+		statuses[c.DeveloperId] = c.Status
+	}
+	if !claims.Success || statuses["dev1"] != db.ClaimApproved || statuses["dev2"] != db.ClaimRejected {
+		t.Errorf("Got claims %+v, expected the first to be approved and the second rejected", claims)
+	}
+
+	// The reviews are audited as made by the administrator who made them
+	adminId := testUserId(t, ctx, adminToken)
+	for _, action := range []string{db.AuditClaimApprove, db.AuditClaimReject} {
+		entries, err := ctx.Database.AuditLog(context.Background(), db.AuditFilter{Action: action}, 0, 10)
+		if err != nil || len(entries) != 1 || entries[0].ActorId != adminId {
+			t.Errorf("Got %v entries %+v (%v), expected one made by the administrator", action, entries, err)
+		}
+	}
+
+	queue = adminClaimsStatus{}
+	decode(t, serve(ctx, newRequest("GET", "/admin/claims?status=all", adminToken, "")), &queue)
+	if len(queue.Claims) != 2 {
+		t.Errorf("Got claims %+v, expected every claim", queue.Claims)
+	}
+
+	for _, target := range []string{"/admin/claims?status=unknown", "/admin/claims/abc/approve"} {
+		method := "GET"
+		if strings.HasSuffix(target, "/approve") {
+			method = "POST"
+		}
+		w := serve(ctx, newRequest(method, target, adminToken, ""))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Got HTTP %v for %v, expected %v", w.Code, target, http.StatusBadRequest)
+		}
+	}
+
+	w := serve(ctx, newRequest("GET", "/admin/claims", aliceToken, ""))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Got HTTP %v for a user, expected %v", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestVerifyClaimWithoutAppstore(t *testing.T) {
+	ctx := newTestContext()
+	_, err := ctx.Database.ImportPebbleDevelopers(context.Background(), []db.PebbleDeveloper{{Id: "dev1", Name: "Developer"}}, db.AuditActorAdmin)
+	if err != nil {
+		t.Fatalf("Could not import developer: %v", err)
+	}
+	aliceToken := testLogin(t, ctx, "alice", "Alice")
+
+	var claim claimStatus
+	decode(t, serve(ctx, newRequest("POST", "/user/claims/developer", aliceToken, `{"developerId": "dev1"}`)), &claim)
+
+	var status updateAccountStatus
+	decode(t, serve(ctx, newRequest("POST", "/user/claims/verify", aliceToken, fmt.Sprintf(`{"id": %d}`, claim.Claim.Id))), &status)
+	if status.Success || status.ErrorMessage == "" {
+		t.Errorf("Verified a claim without an appstore to check it against")
+	}
+}
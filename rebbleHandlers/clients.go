@@ -0,0 +1,176 @@
+package rebbleHandlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"pebble-dev/rebble-auth/auth"
+	"pebble-dev/rebble-auth/db"
+	"time"
+)
+
+// providerStatsPeriod is how far back the logins shown with the identity providers go
+const providerStatsPeriod = 24 * time.Hour
+
+type client struct {
+	Id          string    `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Created     time.Time `json:"created"`
+	Updated     time.Time `json:"updated"`
+}
+
+type clientsStatus struct {
+	Clients []client `json:"clients"`
+}
+
+type deleteClient struct {
+	Id string `json:"id"`
+}
+
+type providerStatus struct {
+	Name                  string    `json:"name"`
+	Type                  string    `json:"type"`
+	Configured            bool      `json:"configured"` // False for providers which were removed from the configuration, but are still linked to accounts
+	ClientId              string    `json:"clientId"`
+	DiscoverURI           string    `json:"discoverUri"`
+	AuthorizationEndpoint string    `json:"authorizationEndpoint"`
+	TokenEndpoint         string    `json:"tokenEndpoint"`
+	UserinfoEndpoint      string    `json:"userinfoEndpoint"`
+	RevocationEndpoint    string    `json:"revocationEndpoint"`
+	TrustEmail            bool      `json:"trustEmail"`
+	Identities            int64     `json:"identities"`
+	Logins                int64     `json:"logins"`
+	FailedLogins          int64     `json:"failedLogins"`
+	LastLogin             time.Time `json:"lastLogin"`
+}
+
+type providersStatus struct {
+	Providers []providerStatus `json:"providers"`
+	Since     time.Time        `json:"since"`
+}
+
+// listClients returns the registered clients, in the format they are shown in
+func listClients(ctx *HandlerContext, r *http.Request) ([]client, error) {
+	list, err := ctx.Database.Clients(r.Context())
+	if err != nil {
+		return nil, err
+	}
+
+	clients := []client{}
+	for _, c := range list {
+		clients = append(clients, client(c))
+	}
+
+	return clients, nil
+}
+
+// providerStatuses returns the configured identity providers, along with how they were used since the given time
+func providerStatuses(ctx *HandlerContext, r *http.Request, since time.Time) ([]providerStatus, error) {
+	stats, err := ctx.Database.ProviderStats(r.Context(), since)
+	if err != nil {
+		return nil, err
+	}
+
+	providers := []providerStatus{}
+	index := make(map[string]int)
+	for _, s := range ctx.SSos {
+		index[s.Name] = len(providers)
+		providers = append(providers, providerStatus{
+			Name:                  s.Name,
+			Type:                  s.Type,
+			Configured:            true,
+			ClientId:              s.ClientID,
+			DiscoverURI:           s.DiscoverURI,
+			AuthorizationEndpoint: s.Discovery.AuthorizationEndpoint,
+			TokenEndpoint:         s.Discovery.TokenEndpoint,
+			UserinfoEndpoint:      s.Discovery.UserinfoEndpoint,
+			RevocationEndpoint:    s.Discovery.RevocationEndpoint,
+			TrustEmail:            s.TrustEmail,
+		})
+	}
+	for _, s := range stats {
+		i, ok := index[s.Provider]
+		if !ok {
+			i = len(providers)
+			providers = append(providers, providerStatus{Name: s.Provider})
+		}
+
+		providers[i].Identities = s.Identities
+		providers[i].Logins = s.Logins
+		providers[i].FailedLogins = s.FailedLogins
+		providers[i].LastLogin = s.LastLogin
+	}
+
+	return providers, nil
+}
+
+// AdminClientsHandler lists the registered clients
+func AdminClientsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	list, err := listClients(ctx, r)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return writeJSON(w, clientsStatus{
+		Clients: list,
+	})
+}
+
+// AdminSaveClientHandler registers the client in the body of the request, or updates it if it is already registered
+func AdminSaveClientHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	decoder := json.NewDecoder(r.Body)
+
+	var info client
+	err := decoder.Decode(&info)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	defer r.Body.Close()
+
+	success, errorMessage, err := auth.SaveClient(r.Context(), ctx.Database, db.Client{Id: info.Id, Name: info.Name, Description: info.Description}, sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return writeJSON(w, updateAccountStatus{
+		Success:      success,
+		ErrorMessage: errorMessage,
+	})
+}
+
+// AdminDeleteClientHandler unregisters the client in the body of the request
+func AdminDeleteClientHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	decoder := json.NewDecoder(r.Body)
+
+	var info deleteClient
+	err := decoder.Decode(&info)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	defer r.Body.Close()
+
+	success, errorMessage, err := auth.DeleteClient(r.Context(), ctx.Database, info.Id, sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return writeJSON(w, updateAccountStatus{
+		Success:      success,
+		ErrorMessage: errorMessage,
+	})
+}
+
+// AdminProvidersHandler shows the configured identity providers, along with how many identities are linked with
+// each of them and how many logins were made with them over the last day
+func AdminProvidersHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	since := time.Now().Add(-providerStatsPeriod)
+	list, err := providerStatuses(ctx, r, since)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return writeJSON(w, providersStatus{
+		Providers: list,
+		Since:     since,
+	})
+}
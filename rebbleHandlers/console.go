@@ -0,0 +1,499 @@
+package rebbleHandlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"pebble-dev/rebble-auth/auth"
+	"pebble-dev/rebble-auth/common"
+	"pebble-dev/rebble-auth/db"
+
+	"github.com/gorilla/mux"
+)
+
+// The admin console is a set of HTML pages on top of the admin endpoints. Administrators log in to it through
+// `/authorize` like to any other client; their access token is then kept in a cookie restricted to the console, and
+// every form carries a CSRF token derived from it.
+
+// consolePath is where the console is served, and the path of its cookies
+const consolePath = "/admin/console"
+
+// Cookies of the admin console
+const (
+	consoleSessionCookie = "console_session" // Access token of the administrator
+	consoleStateCookie   = "console_state"   // State of an ongoing login, which `/authorize` sends back
+)
+
+// Page sizes of the admin console
+const (
+	consoleUsersLimit   = 50
+	consoleLoginsLimit  = 20
+	consoleHistoryLimit = 20
+)
+
+// consolePage is what every console template is given
+type consolePage struct {
+	Title   string
+	Csrf    string
+	UserId  string // ID of the administrator
+	Message string
+	Error   string
+	Data    interface{}
+}
+
+type consoleUsers struct {
+	Query    string
+	Users    []adminUserSummary
+	Previous int // Offset of the previous page, or -1 if there is none
+	Next     int // Offset of the next page, or -1 if there is none
+}
+
+type consoleUser struct {
+	User    *adminUser
+	Roles   []string
+	Clients map[string]string // Client ID => name
+	History []auditEntry
+}
+
+type consoleProviders struct {
+	Providers []providerStatus
+	Since     time.Time
+}
+
+// consoleFuncs are the functions available to console templates
+var consoleFuncs = template.FuncMap{
+	"date": func(t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+
+		return t.UTC().Format("2006-01-02 15:04:05 MST")
+	},
+	"string": func(data []byte) string {
+		return string(data)
+	},
+}
+
+// consoleCsrf returns the CSRF token of the console forms of the given access token. Only someone who knows the access
+// token can compute it, which another site can't.
+func consoleCsrf(accessToken string) string {
+	mac := hmac.New(sha256.New, []byte(accessToken))
+	mac.Write([]byte("rebble-auth console"))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// consoleURL returns the absolute URL of a console page
+func consoleURL(r *http.Request, path string) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host + consolePath + path
+}
+
+// renderConsole shows a console page, using the template of the same name in static/console
+func renderConsole(w http.ResponseWriter, r *http.Request, status int, name string, page consolePage) (int, error) {
+	tmpl, err := template.New("").Funcs(consoleFuncs).ParseFiles("static/console/layout.html", "static/console/"+name+".html")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if cookie, err := r.Cookie(consoleSessionCookie); err == nil {
+		page.Csrf = consoleCsrf(cookie.Value)
+	}
+	page.UserId = sessionUser(r).UserId
+	if page.Message == "" {
+		page.Message = r.URL.Query().Get("message")
+	}
+	if page.Error == "" {
+		page.Error = r.URL.Query().Get("error")
+	}
+
+	// Rendered to a buffer first, so that a failing template doesn't leave a half-written page behind
+	var buffer bytes.Buffer
+	err = tmpl.ExecuteTemplate(&buffer, "layout", page)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.Header().Set("x-frame-options", "DENY")
+	w.WriteHeader(status)
+	buffer.WriteTo(w)
+
+	return status, nil
+}
+
+// consoleError shows an error page
+func consoleError(w http.ResponseWriter, r *http.Request, status int, errorMessage string) (int, error) {
+	return renderConsole(w, r, status, "message", consolePage{
+		Title: http.StatusText(status),
+		Error: errorMessage,
+	})
+}
+
+// consoleDone sends the administrator back to a console page after a form was submitted, along with its outcome
+func consoleDone(w http.ResponseWriter, r *http.Request, path string, success bool, errorMessage string, message string) (int, error) {
+	query := url.Values{}
+	if success {
+		query.Set("message", message)
+	} else {
+		query.Set("error", errorMessage)
+	}
+
+	http.Redirect(w, r, consolePath+path+"?"+query.Encode(), http.StatusSeeOther)
+	return http.StatusSeeOther, nil
+}
+
+// console returns a copy of the route handler which only lets through administrators logged in to the console, and
+// having the given permission. Forms must carry the CSRF token of the session.
+func (rh routeHandler) console(permission auth.Permission) routeHandler {
+	h := rh.H
+	rh.H = func(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+		cookie, err := r.Cookie(consoleSessionCookie)
+		if err != nil {
+			http.Redirect(w, r, consolePath+"/login", http.StatusSeeOther)
+			return http.StatusSeeOther, nil
+		}
+
+		loggedIn, allowed, errorMessage, session, err := auth.Authorize(r.Context(), ctx.Database, cookie.Value, auth.PermissionConsole)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if !loggedIn {
+			http.SetCookie(w, &http.Cookie{Name: consoleSessionCookie, Path: consolePath, MaxAge: -1})
+			http.Redirect(w, r, consolePath+"/login", http.StatusSeeOther)
+			return http.StatusSeeOther, nil
+		}
+		if !allowed {
+			return consoleError(w, r, http.StatusForbidden, errorMessage)
+		}
+		if !auth.HasPermission(session.Type, permission) {
+			return consoleError(w, r, http.StatusForbidden, "Missing permission "+string(permission))
+		}
+
+		if r.Method == "POST" && !hmac.Equal([]byte(r.PostFormValue("csrf")), []byte(consoleCsrf(cookie.Value))) {
+			return consoleError(w, r, http.StatusForbidden, "Invalid CSRF token, please reload the page and try again")
+		}
+
+		return h(ctx, w, r.WithContext(context.WithValue(r.Context(), sessionUserKey{}, session)))
+	}
+
+	return rh
+}
+
+// ConsoleLoginHandler logs administrators in to the console. Without parameters, it sends them to `/authorize`, which
+// brings them back here with an access token (or an error).
+func ConsoleLoginHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	query := r.URL.Query()
+	if errorMessage := query.Get("error"); errorMessage != "" {
+		return consoleError(w, r, http.StatusUnauthorized, errorMessage)
+	}
+
+	accessToken := query.Get("access_token")
+	if accessToken == "" {
+		state := common.GenerateString(30)
+		http.SetCookie(w, &http.Cookie{
+			Name:     consoleStateCookie,
+			Value:    state,
+			Path:     consolePath,
+			Expires:  time.Now().Add(15 * time.Minute),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+
+		http.Redirect(w, r, "/authorize?redirect_uri="+url.QueryEscape(consoleURL(r, "/login"))+"&state="+url.QueryEscape(state), http.StatusFound)
+		return http.StatusFound, nil
+	}
+
+	// The state makes sure that the login was started here, rather than by another site logging the administrator in
+	// to an account of its choosing
+	state, err := r.Cookie(consoleStateCookie)
+	if err != nil || state.Value == "" || state.Value != query.Get("state") {
+		return consoleError(w, r, http.StatusBadRequest, "Invalid login state, please try again")
+	}
+	http.SetCookie(w, &http.Cookie{Name: consoleStateCookie, Path: consolePath, MaxAge: -1})
+
+	loggedIn, allowed, errorMessage, session, err := auth.Authorize(r.Context(), ctx.Database, accessToken, auth.PermissionConsole)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if !loggedIn {
+		return consoleError(w, r, http.StatusUnauthorized, errorMessage)
+	}
+	if !allowed {
+		// The session was only opened for the console, which it can't be used for
+		_, _, err = auth.RevokeSession(r.Context(), ctx.Database, accessToken, session.SessionId, remoteIp(r))
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+
+		return consoleError(w, r, http.StatusForbidden, "Only administrators can use the admin console")
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     consoleSessionCookie,
+		Value:    accessToken,
+		Path:     consolePath,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	// Redirecting drops the access token from the address bar
+	http.Redirect(w, r, consolePath+"/users", http.StatusSeeOther)
+	return http.StatusSeeOther, nil
+}
+
+// ConsoleLogoutHandler logs the administrator out of the console, revoking their session
+func ConsoleLogoutHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	cookie, err := r.Cookie(consoleSessionCookie)
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+
+	_, _, err = auth.RevokeSession(r.Context(), ctx.Database, cookie.Value, sessionUser(r).SessionId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	http.SetCookie(w, &http.Cookie{Name: consoleSessionCookie, Path: consolePath, MaxAge: -1})
+	r = r.WithContext(context.WithValue(r.Context(), sessionUserKey{}, db.SessionUser{}))
+	return renderConsole(w, r, http.StatusOK, "message", consolePage{
+		Title:   "Logged out",
+		Message: "You are logged out of the admin console.",
+	})
+}
+
+// ConsoleHomeHandler sends administrators to the user search
+func ConsoleHomeHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	http.Redirect(w, r, consolePath+"/users", http.StatusSeeOther)
+	return http.StatusSeeOther, nil
+}
+
+// ConsoleUsersHandler shows the user search
+func ConsoleUsersHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		return consoleError(w, r, http.StatusBadRequest, err.Error())
+	}
+
+	query := r.URL.Query().Get("q")
+	// One more user than shown tells whether there is a next page
+	users, err := ctx.Database.SearchUsers(r.Context(), query, offset, consoleUsersLimit+1)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	data := consoleUsers{
+		Query:    query,
+		Users:    []adminUserSummary{},
+		Previous: -1,
+		Next:     -1,
+	}
+	if offset > 0 {
+		data.Previous = offset - consoleUsersLimit
+		if data.Previous < 0 {
+			data.Previous = 0
+		}
+	}
+	if len(users) > consoleUsersLimit {
+		users = users[:consoleUsersLimit]
+		data.Next = offset + consoleUsersLimit
+	}
+	for _, user := range users {
+		data.Users = append(data.Users, adminUserSummary(user))
+	}
+
+	return renderConsole(w, r, http.StatusOK, "users", consolePage{
+		Title: "Users",
+		Data:  data,
+	})
+}
+
+// ConsoleUserHandler shows the account of user `{id}`, along with the forms to manage it
+func ConsoleUserHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	userId := mux.Vars(r)["id"]
+	export, errorMessage, err := ctx.Database.UserExport(r.Context(), userId)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	if errorMessage != "" {
+		return consoleError(w, r, http.StatusNotFound, errorMessage)
+	}
+
+	data := newExportData(export)
+	if len(data.Logins) > consoleLoginsLimit {
+		data.Logins = data.Logins[:consoleLoginsLimit]
+	}
+
+	history, err := ctx.Database.AuditLog(r.Context(), db.AuditFilter{UserId: userId}, 0, consoleHistoryLimit)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	clients, err := ctx.Database.Clients(r.Context())
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	user := consoleUser{
+		User: &adminUser{
+			exportUser:     data.User,
+			Providers:      data.Providers,
+			Sessions:       data.Sessions,
+			Logins:         data.Logins,
+			MergedAccounts: data.MergedAccounts,
+		},
+		Roles:   auth.Roles(),
+		Clients: make(map[string]string),
+		History: []auditEntry{},
+	}
+	for _, c := range clients {
+		user.Clients[c.Id] = c.Name
+	}
+	for _, entry := range history {
+		user.History = append(user.History, newAuditEntry(entry))
+	}
+
+	return renderConsole(w, r, http.StatusOK, "user", consolePage{
+		Title: export.Name,
+		Data:  user,
+	})
+}
+
+// ConsoleDisableUserHandler disables the account of user `{id}`
+func ConsoleDisableUserHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	userId := mux.Vars(r)["id"]
+	success, errorMessage, err := auth.SetDisabled(r.Context(), ctx.Database, userId, true, sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return consoleDone(w, r, "/users/"+url.PathEscape(userId), success, errorMessage, "The account is disabled.")
+}
+
+// ConsoleEnableUserHandler enables the account of user `{id}` again
+func ConsoleEnableUserHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	userId := mux.Vars(r)["id"]
+	success, errorMessage, err := auth.SetDisabled(r.Context(), ctx.Database, userId, false, sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return consoleDone(w, r, "/users/"+url.PathEscape(userId), success, errorMessage, "The account is enabled.")
+}
+
+// ConsoleLogoutUserHandler logs out all of the sessions of user `{id}`
+func ConsoleLogoutUserHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	userId := mux.Vars(r)["id"]
+	success, errorMessage, sessions, err := auth.LogoutUser(r.Context(), ctx.Database, userId, sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return consoleDone(w, r, "/users/"+url.PathEscape(userId), success, errorMessage, strconv.FormatInt(sessions, 10)+" sessions were logged out.")
+}
+
+// ConsoleRevokeUserSessionHandler logs out session `{session}` of user `{id}`
+func ConsoleRevokeUserSessionHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	userId := mux.Vars(r)["id"]
+	sessionId, err := strconv.ParseInt(mux.Vars(r)["session"], 10, 64)
+	if err != nil {
+		return consoleError(w, r, http.StatusBadRequest, "Invalid session ID")
+	}
+
+	success, errorMessage, err := auth.RevokeUserSession(r.Context(), ctx.Database, userId, sessionId, sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return consoleDone(w, r, "/users/"+url.PathEscape(userId), success, errorMessage, "The session was logged out.")
+}
+
+// ConsoleSetNameHandler changes the name of user `{id}`
+func ConsoleSetNameHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	userId := mux.Vars(r)["id"]
+	success, errorMessage, err := auth.SetName(r.Context(), ctx.Database, userId, r.PostFormValue("name"), sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return consoleDone(w, r, "/users/"+url.PathEscape(userId), success, errorMessage, "The name was changed.")
+}
+
+// ConsoleSetRoleHandler changes the role of user `{id}`
+func ConsoleSetRoleHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	userId := mux.Vars(r)["id"]
+	success, errorMessage, err := auth.SetRole(r.Context(), ctx.Database, userId, r.PostFormValue("role"), sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return consoleDone(w, r, "/users/"+url.PathEscape(userId), success, errorMessage, "The role was changed.")
+}
+
+// ConsoleClientsHandler shows the registered clients, along with the forms to edit them
+func ConsoleClientsHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	list, err := listClients(ctx, r)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return renderConsole(w, r, http.StatusOK, "clients", consolePage{
+		Title: "Clients",
+		Data:  list,
+	})
+}
+
+// ConsoleSaveClientHandler registers or updates a client
+func ConsoleSaveClientHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	client := db.Client{
+		Id:          r.PostFormValue("id"),
+		Name:        r.PostFormValue("name"),
+		Description: r.PostFormValue("description"),
+	}
+	success, errorMessage, err := auth.SaveClient(r.Context(), ctx.Database, client, sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return consoleDone(w, r, "/clients", success, errorMessage, "The client was saved.")
+}
+
+// ConsoleDeleteClientHandler unregisters a client
+func ConsoleDeleteClientHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	success, errorMessage, err := auth.DeleteClient(r.Context(), ctx.Database, r.PostFormValue("id"), sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return consoleDone(w, r, "/clients", success, errorMessage, "The client was deleted.")
+}
+
+// ConsoleProvidersHandler shows the identity providers, and how they were used over the last day
+func ConsoleProvidersHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	since := time.Now().Add(-providerStatsPeriod)
+	list, err := providerStatuses(ctx, r, since)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return renderConsole(w, r, http.StatusOK, "providers", consolePage{
+		Title: "Identity providers",
+		Data: consoleProviders{
+			Providers: list,
+			Since:     since,
+		},
+	})
+}
@@ -0,0 +1,163 @@
+package rebbleHandlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"pebble-dev/rebble-auth/auth"
+)
+
+// consoleRequest returns a request to the admin console, logged in with the given access token (if any). POST requests
+// send the given form.
+func consoleRequest(method string, path string, accessToken string, form url.Values) *http.Request {
+	var r *http.Request
+	if method == "POST" {
+		r = httptest.NewRequest(method, consolePath+path, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		r = httptest.NewRequest(method, consolePath+path, nil)
+	}
+
+	if accessToken != "" {
+		r.AddCookie(&http.Cookie{Name: consoleSessionCookie, Value: accessToken})
+	}
+
+	return r
+}
+
+func TestConsoleRequiresLogin(t *testing.T) {
+	ctx := newTestContext()
+	moderatorToken := testAdmin(t, ctx, auth.RoleModerator)
+
+	for _, accessToken := range []string{"", "invalid"} {
+		w := serve(ctx, consoleRequest("GET", "/users", accessToken, nil))
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != consolePath+"/login" {
+			t.Errorf("Got HTTP %v to %q with access token %q, expected to be sent to the login page", w.Code, w.Header().Get("Location"), accessToken)
+		}
+	}
+
+	// Moderators can use the admin endpoints, but not the console
+	w := serve(ctx, consoleRequest("GET", "/users", moderatorToken, nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Got HTTP %v for a moderator, expected %v", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestConsolePages(t *testing.T) {
+	ctx := newTestContext()
+	adminToken := testAdmin(t, ctx, auth.RoleAdmin)
+	aliceToken := testLogin(t, ctx, "alice", "Alice")
+	aliceId := testUserId(t, ctx, aliceToken)
+
+	for _, path := range []string{"/users", "/users?q=ali", "/users/" + aliceId, "/clients", "/providers"} {
+		w := serve(ctx, consoleRequest("GET", path, adminToken, nil))
+		if w.Code != http.StatusOK || w.Header().Get("x-frame-options") != "DENY" {
+			t.Errorf("Got HTTP %v for %v: %v", w.Code, path, w.Body.String())
+		}
+		if strings.HasPrefix(path, "/users") && !strings.Contains(w.Body.String(), "Alice") {
+			t.Errorf("%v doesn't show alice", path)
+		}
+		if !strings.Contains(w.Body.String(), consoleCsrf(adminToken)) {
+			t.Errorf("%v doesn't carry the CSRF token", path)
+		}
+	}
+}
+
+func TestConsoleCsrf(t *testing.T) {
+	ctx := newTestContext()
+	adminToken := testAdmin(t, ctx, auth.RoleAdmin)
+	aliceToken := testLogin(t, ctx, "alice", "Alice")
+	aliceId := testUserId(t, ctx, aliceToken)
+
+	for _, csrf := range []string{"", "invalid", consoleCsrf(aliceToken)} {
+		w := serve(ctx, consoleRequest("POST", "/users/"+aliceId+"/disable", adminToken, url.Values{"csrf": {csrf}}))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("Got HTTP %v with CSRF token %q, expected %v", w.Code, csrf, http.StatusForbidden)
+		}
+	}
+	loggedIn, _, _ := ctx.Database.SessionInformation(context.Background(), aliceToken)
+	if !loggedIn {
+		t.Fatalf("alice's account was disabled by a form without a valid CSRF token")
+	}
+
+	w := serve(ctx, consoleRequest("POST", "/users/"+aliceId+"/disable", adminToken, url.Values{"csrf": {consoleCsrf(adminToken)}}))
+	if w.Code != http.StatusSeeOther || !strings.HasPrefix(w.Header().Get("Location"), consolePath+"/users/"+aliceId+"?message=") {
+		t.Errorf("Got HTTP %v to %q, expected to be sent back to alice's account", w.Code, w.Header().Get("Location"))
+	}
+	loggedIn, _, _ = ctx.Database.SessionInformation(context.Background(), aliceToken)
+	if loggedIn {
+		t.Errorf("alice's account wasn't disabled")
+	}
+
+	// Failures are shown on the page the administrator is sent back to
+	w = serve(ctx, consoleRequest("POST", "/users/"+aliceId+"/role", adminToken, url.Values{"csrf": {consoleCsrf(adminToken)}, "role": {"root"}}))
+	if w.Code != http.StatusSeeOther || !strings.Contains(w.Header().Get("Location"), "?error=") {
+		t.Errorf("Got HTTP %v to %q, expected an error to be shown", w.Code, w.Header().Get("Location"))
+	}
+}
+
+func TestConsoleLogin(t *testing.T) {
+	ctx := newTestContext()
+	adminToken := testAdmin(t, ctx, auth.RoleAdmin)
+	aliceToken := testLogin(t, ctx, "alice", "Alice")
+
+	w := serve(ctx, consoleRequest("GET", "/login", "", nil))
+	if w.Code != http.StatusFound || !strings.HasPrefix(w.Header().Get("Location"), "/authorize?") {
+		t.Fatalf("Got HTTP %v to %q, expected to be sent to /authorize", w.Code, w.Header().Get("Location"))
+	}
+	var state *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == consoleStateCookie {
+			state = cookie
+		}
+	}
+	if state == nil || state.Value == "" {
+		t.Fatalf("The login state wasn't set")
+	}
+
+	// The state must be the one of the login which was started
+	login := func(accessToken string, stateValue string) *httptest.ResponseRecorder {
+		r := consoleRequest("GET", "/login?access_token="+url.QueryEscape(accessToken)+"&state="+url.QueryEscape(stateValue), "", nil)
+		r.AddCookie(state)
+		return serve(ctx, r)
+	}
+	if w := login(adminToken, "other"); w.Code != http.StatusBadRequest {
+		t.Errorf("Got HTTP %v for a login with another state, expected %v", w.Code, http.StatusBadRequest)
+	}
+
+	// Users who can't use the console have the session opened for it revoked
+	if w := login(aliceToken, state.Value); w.Code != http.StatusForbidden {
+		t.Errorf("Got HTTP %v for a user, expected %v", w.Code, http.StatusForbidden)
+	}
+	loggedIn, _, _ := ctx.Database.SessionInformation(context.Background(), aliceToken)
+	if loggedIn {
+		t.Errorf("The session of a user who can't use the console wasn't revoked")
+	}
+
+	w = login(adminToken, state.Value)
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != consolePath+"/users" {
+		t.Fatalf("Got HTTP %v to %q, expected the admin to be logged in", w.Code, w.Header().Get("Location"))
+	}
+	var session *http.Cookie
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == consoleSessionCookie {
+			session = cookie
+		}
+	}
+	if session == nil || session.Value != adminToken || !session.HttpOnly || session.Path != consolePath {
+		t.Fatalf("Got session cookie %+v, expected it to hold the access token", session)
+	}
+
+	w = serve(ctx, consoleRequest("POST", "/logout", adminToken, url.Values{"csrf": {consoleCsrf(adminToken)}}))
+	if w.Code != http.StatusOK {
+		t.Errorf("Got HTTP %v when logging out", w.Code)
+	}
+	loggedIn, _, _ = ctx.Database.SessionInformation(context.Background(), adminToken)
+	if loggedIn {
+		t.Errorf("The console session wasn't revoked when logging out")
+	}
+}
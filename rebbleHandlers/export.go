@@ -0,0 +1,229 @@
+package rebbleHandlers
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"pebble-dev/rebble-auth/auth"
+	"pebble-dev/rebble-auth/common"
+	"pebble-dev/rebble-auth/db"
+
+	"github.com/gorilla/mux"
+)
+
+type exportUser struct {
+	Id                string    `json:"id"`
+	Name              string    `json:"name"`
+	Email             string    `json:"email"`
+	Type              string    `json:"type"`
+	PebbleMirror      bool      `json:"pebbleMirror"`
+	Disabled          bool      `json:"disabled"`
+	ProfileProvider   string    `json:"profileProvider"`
+	SyncName          bool      `json:"syncName"`
+	DeletionScheduled time.Time `json:"deletionScheduled"`
+}
+
+type exportProvider struct {
+	Provider string          `json:"provider"`
+	Sub      string          `json:"sub"`
+	Profile  json.RawMessage `json:"profile"`
+	Expires  int64           `json:"expires"`
+}
+
+// exportConsent is a client the user allowed to access their account by logging in to it
+type exportConsent struct {
+	ClientId  string    `json:"clientId"`
+	FirstUsed time.Time `json:"firstUsed"`
+	LastUsed  time.Time `json:"lastUsed"`
+}
+
+type exportData struct {
+	Exported       time.Time        `json:"exported"`
+	User           exportUser       `json:"user"`
+	Providers      []exportProvider `json:"linkedProviders"`
+	Sessions       []sessionInfo    `json:"sessions"`
+	Logins         []loginAttempt   `json:"logins"`
+	Consents       []exportConsent  `json:"consents"`
+	MergedAccounts []string         `json:"mergedAccounts"`
+	AuditLog       []auditEntry     `json:"auditLog"`
+}
+
+type exportStatus struct {
+	Export       *exportData `json:"export"`
+	Success      bool        `json:"success"`
+	ErrorMessage string      `json:"errorMessage"`
+}
+
+// exportFileName is the name of the JSON file in zipped exports
+const exportFileName = "rebble-account.json"
+
+// newExportData converts a user export to the format it is handed out in
+func newExportData(export db.UserExport) *exportData {
+	data := &exportData{
+		Exported: time.Now(),
+		User: exportUser{
+			Id:                export.Id,
+			Name:              export.Name,
+			Email:             export.Email,
+			Type:              export.Type,
+			PebbleMirror:      export.PebbleMirror,
+			Disabled:          export.Disabled,
+			ProfileProvider:   export.ProfileProvider,
+			SyncName:          export.SyncName,
+			DeletionScheduled: export.DeletionScheduled,
+		},
+		Providers:      []exportProvider{},
+		Sessions:       []sessionInfo{},
+		Logins:         []loginAttempt{},
+		Consents:       []exportConsent{},
+		MergedAccounts: export.Aliases,
+		AuditLog:       []auditEntry{},
+	}
+
+	for _, provider := range export.Providers {
+		profile := json.RawMessage(provider.Profile)
+		if !json.Valid(profile) {
+			profile, _ = json.Marshal(provider.Profile)
+		}
+
+		data.Providers = append(data.Providers, exportProvider{
+			Provider: provider.Provider,
+			Sub:      provider.Sub,
+			Profile:  profile,
+			Expires:  provider.Expires,
+		})
+	}
+
+	// rebble-auth doesn't ask for consent explicitly, logging in to a client is what grants it access to the account
+	consents := make(map[string]int)
+	for _, session := range export.Sessions {
+		data.Sessions = append(data.Sessions, sessionInfo{
+			Id:        session.Id,
+			Created:   session.Created,
+			LastUsed:  session.LastUsed,
+			Provider:  session.Provider,
+			ClientId:  session.ClientId,
+			UserAgent: session.UserAgent,
+			RemoteIp:  session.RemoteIp,
+		})
+
+		if session.ClientId == "" {
+			continue
+		}
+		if i, ok := consents[session.ClientId]; ok {
+			consent := &data.Consents[i]
+			if session.Created.Before(consent.FirstUsed) {
+				consent.FirstUsed = session.Created
+			}
+			if session.LastUsed.After(consent.LastUsed) {
+				consent.LastUsed = session.LastUsed
+			}
+		} else {
+			consents[session.ClientId] = len(data.Consents)
+			data.Consents = append(data.Consents, exportConsent{
+				ClientId:  session.ClientId,
+				FirstUsed: session.Created,
+				LastUsed:  session.LastUsed,
+			})
+		}
+	}
+
+	for _, attempt := range export.Logins {
+		data.Logins = append(data.Logins, loginAttempt{
+			Time:      attempt.Time,
+			Success:   attempt.Success,
+			Reason:    attempt.Reason,
+			Provider:  attempt.Provider,
+			UserAgent: attempt.UserAgent,
+			RemoteIp:  attempt.RemoteIp,
+		})
+	}
+
+	for _, entry := range export.Audits {
+		data.AuditLog = append(data.AuditLog, newAuditEntry(entry))
+	}
+
+	return data
+}
+
+// writeExport sends an export back, either as JSON or, if `format=zip` was asked for, as a zip file containing it
+func writeExport(w http.ResponseWriter, r *http.Request, status exportStatus) (int, error) {
+	data, err := json.MarshalIndent(status, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	if r.URL.Query().Get("format") != "zip" || !status.Success {
+		// Send the JSON object back to the user
+		w.Header().Add("content-type", "application/json")
+		w.Write(data)
+		return http.StatusOK, nil
+	}
+
+	data, err = json.MarshalIndent(status.Export, "", "\t")
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	w.Header().Add("content-type", "application/zip")
+	w.Header().Add("content-disposition", "attachment; filename=\"rebble-account.zip\"")
+	archive := zip.NewWriter(w)
+	f, err := archive.Create(exportFileName)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	_, err = f.Write(data)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return http.StatusOK, archive.Close()
+}
+
+// AccountExportHandler lets users download everything rebble-auth stores about them
+func AccountExportHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	accessToken, err := common.GetAccessToken(r)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	success, errorMessage, export, err := auth.Export(r.Context(), ctx.Database, accessToken)
+
+	if err != nil {
+		if db.Unavailable(err) {
+			return http.StatusServiceUnavailable, err
+		}
+		log.Println(err)
+	}
+
+	status := exportStatus{
+		Success:      success,
+		ErrorMessage: errorMessage,
+	}
+	if success {
+		status.Export = newExportData(export)
+	}
+
+	return writeExport(w, r, status)
+}
+
+// AdminUserExportHandler lets an administrator export everything rebble-auth stores about user `{id}`
+func AdminUserExportHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	export, errorMessage, err := ctx.Database.UserExport(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	status := exportStatus{
+		Success:      errorMessage == "",
+		ErrorMessage: errorMessage,
+	}
+	if status.Success {
+		status.Export = newExportData(export)
+	}
+
+	return writeExport(w, r, status)
+}
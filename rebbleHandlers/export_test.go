@@ -0,0 +1,77 @@
+package rebbleHandlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"pebble-dev/rebble-auth/auth"
+	"pebble-dev/rebble-auth/db"
+)
+
+func TestAccountExport(t *testing.T) {
+	ctx := newTestContext()
+	accessToken := testLogin(t, ctx, "alice", "Alice")
+
+	var status exportStatus
+	decode(t, serve(ctx, newRequest("GET", "/user/export", accessToken, "")), &status)
+	if !status.Success || status.Export == nil {
+		t.Fatalf("Could not export data: %v", status.ErrorMessage)
+	}
+	if status.Export.User.Name != "Alice" || len(status.Export.Providers) != 1 || len(status.Export.Sessions) != 1 || len(status.Export.Logins) != 1 {
+		t.Errorf("Got %+v, expected alice's account with its identity, session and login", status.Export)
+	}
+	if len(status.Export.AuditLog) != 1 || status.Export.AuditLog[0].Action != db.AuditAccountCreate {
+		t.Errorf("Got audit log %+v, expected the creation of alice's account", status.Export.AuditLog)
+	}
+
+	// Exports are rate limited
+	status = exportStatus{}
+	decode(t, serve(ctx, newRequest("GET", "/user/export", accessToken, "")), &status)
+	if status.Success || status.ErrorMessage == "" {
+		t.Errorf("A second export was allowed right away")
+	}
+}
+
+func TestAccountExportZip(t *testing.T) {
+	ctx := newTestContext()
+	accessToken := testLogin(t, ctx, "alice", "Alice")
+
+	w := serve(ctx, newRequest("GET", "/user/export?format=zip", accessToken, ""))
+	if w.Header().Get("content-type") != "application/zip" {
+		t.Fatalf("Got %v, expected a zip file", w.Header().Get("content-type"))
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil || len(archive.File) != 1 || archive.File[0].Name != exportFileName {
+		t.Fatalf("Expected a zip file containing %v (%v)", exportFileName, err)
+	}
+
+	f, err := archive.File[0].Open()
+	if err != nil {
+		t.Fatalf("Could not open %v: %v", exportFileName, err)
+	}
+	defer f.Close()
+
+	var export exportData
+	err = json.NewDecoder(f).Decode(&export)
+	if err != nil || export.User.Name != "Alice" {
+		t.Errorf("Got %+v (%v), expected alice's account", export, err)
+	}
+}
+
+func TestAdminUserExport(t *testing.T) {
+	ctx := newTestContext()
+	aliceToken := testLogin(t, ctx, "alice", "Alice")
+	adminToken := testAdmin(t, ctx, auth.RoleAdmin)
+
+	// Admin exports aren't rate limited
+	for i := 0; i < 2; i++ {
+		var status exportStatus
+		decode(t, serve(ctx, newRequest("GET", "/admin/users/"+testUserId(t, ctx, aliceToken)+"/export", adminToken, "")), &status)
+		if !status.Success || status.Export.User.Name != "Alice" {
+			t.Errorf("Got %+v, expected alice's account", status)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package rebbleHandlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"pebble-dev/rebble-auth/db"
+)
+
+// The pages are served from the static directory at the root of the repository, where rebble-auth runs from
+func TestMain(m *testing.M) {
+	err := os.Chdir("..")
+	if err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+// newTestContext returns a handler context backed by an empty MemoryStore
+func newTestContext() *HandlerContext {
+	return &HandlerContext{
+		Database: db.NewMemoryStore(),
+	}
+}
+
+// serve sends a request to the routes of rebble-auth, and returns the response
+func serve(ctx *HandlerContext, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	Handlers(ctx).ServeHTTP(w, r)
+
+	return w
+}
+
+// testLogin logs in (registering if needed) the given identity of the "test" provider, and returns the access token
+func testLogin(t *testing.T, ctx *HandlerContext, sub string, name string) string {
+	t.Helper()
+
+	accessToken, _, errorMessage, err := ctx.Database.AccountLoginOrRegister(context.Background(), "test", sub, name, "", false, "{}", "", "", 0, db.SessionMetadata{})
+	if errorMessage != "" || err != nil {
+		t.Fatalf("Could not log in as %v: %v (%v)", sub, errorMessage, err)
+	}
+
+	return accessToken
+}
+
+// newRequest returns a request made with the given access token (if any), whose body is the given JSON (if any)
+func newRequest(method string, target string, accessToken string, body string) *http.Request {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+
+	r := httptest.NewRequest(method, target, reader)
+	if accessToken != "" {
+		r.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	return r
+}
+
+// decode decodes the JSON response of a handler into v, and fails the test if the request didn't succeed
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Got HTTP %v: %v", w.Code, w.Body.String())
+	}
+
+	err := json.Unmarshal(w.Body.Bytes(), v)
+	if err != nil {
+		t.Fatalf("Could not decode response: %v", err)
+	}
+}
+
+// testUserId returns the ID of the user an access token belongs to
+func testUserId(t *testing.T, ctx *HandlerContext, accessToken string) string {
+	t.Helper()
+
+	userId, errorMessage, err := ctx.Database.AccountId(context.Background(), accessToken)
+	if errorMessage != "" || err != nil {
+		t.Fatalf("Could not get user ID: %v (%v)", errorMessage, err)
+	}
+
+	return userId
+}
+
+// testAdmin logs in as a new user having the given role, and returns the access token
+func testAdmin(t *testing.T, ctx *HandlerContext, role string) string {
+	t.Helper()
+
+	accessToken := testLogin(t, ctx, role, "Admin")
+	errorMessage, err := ctx.Database.SetUserRole(context.Background(), testUserId(t, ctx, accessToken), role, db.AuditActorSystem, "")
+	if errorMessage != "" || err != nil {
+		t.Fatalf("Could not give the %v role: %v (%v)", role, errorMessage, err)
+	}
+
+	return accessToken
+}
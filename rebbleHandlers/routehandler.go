@@ -1,18 +1,28 @@
 package rebbleHandlers
 
 import (
+	"context"
+	"errors"
 	"log"
 	"net/http"
 
+	"pebble-dev/rebble-auth/auth"
+	"pebble-dev/rebble-auth/common"
 	"pebble-dev/rebble-auth/db"
+	"pebble-dev/rebble-auth/jobs"
+	"pebble-dev/rebble-auth/scheduler"
 	"pebble-dev/rebble-auth/sso"
 )
 
 // HandlerContext is our struct for storing the data we want to inject in to each handler
 // we can also add things like authorization level, user information, templates, etc.
 type HandlerContext struct {
-	Database *db.Handler
-	SSos     []sso.Sso
+	Database        db.Store
+	SSos            []sso.Sso
+	AccountDeletion auth.DeletionConfig
+	DeveloperClaims auth.ClaimConfig
+	Scheduler       *scheduler.Scheduler
+	Jobs            *jobs.Runner
 }
 
 // routeHandler is a struct that implements http.Handler, allowing us to inject a custom context
@@ -24,6 +34,45 @@ type routeHandler struct {
 	H       func(*HandlerContext, http.ResponseWriter, *http.Request) (int, error)
 }
 
+// requires returns a copy of the route handler which only lets through requests made with the access token of a user
+// having the given permission. The handler can then find out who made the request with sessionUser.
+func (rh routeHandler) requires(permission auth.Permission) routeHandler {
+	h := rh.H
+	rh.H = func(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+		accessToken, err := common.GetAccessToken(r)
+		if err != nil {
+			return http.StatusUnauthorized, err
+		}
+
+		loggedIn, allowed, errorMessage, session, err := auth.Authorize(r.Context(), ctx.Database, accessToken, permission)
+		if err != nil {
+			return http.StatusInternalServerError, err
+		}
+		if !loggedIn {
+			return http.StatusUnauthorized, errors.New(errorMessage)
+		}
+		if !allowed {
+			return http.StatusForbidden, errors.New(errorMessage)
+		}
+
+		return h(ctx, w, r.WithContext(context.WithValue(r.Context(), sessionUserKey{}, session)))
+	}
+
+	return rh
+}
+
+// sessionUserKey is the key of the session of the user who made a request, in the context of the request
+type sessionUserKey struct{}
+
+// sessionUser returns the session of the user who made a request to a route which requires a permission
+func sessionUser(r *http.Request) db.SessionUser {
+	session, _ := r.Context().Value(sessionUserKey{}).(db.SessionUser)
+	return session
+}
+
+// retryAfter is how many seconds clients are asked to wait when the database is unavailable
+const retryAfter = "5"
+
 // AllowedDomains contains the list of Rebble-own domains for the Access-Control-Allow-Origin header
 var AllowedDomains []string
 
@@ -56,10 +105,21 @@ func (rh routeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	// if the handler function returns an error, we log the error and send the appropriate error message
 	if err != nil {
+		// The database timing out or staying locked is temporary, so clients are told to try again later
+		if db.Unavailable(err) {
+			status = http.StatusServiceUnavailable
+		}
+
 		log.Printf("HTTP %d: %q", status, err)
 		switch status {
 		case http.StatusNotFound:
 			http.NotFound(w, r)
+		case http.StatusUnauthorized:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, http.StatusText(status), status)
+		case http.StatusServiceUnavailable:
+			w.Header().Set("Retry-After", retryAfter)
+			http.Error(w, http.StatusText(status), status)
 		case http.StatusInternalServerError:
 			http.Error(w, http.StatusText(status), status)
 		default:
@@ -0,0 +1,111 @@
+package rebbleHandlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"pebble-dev/rebble-auth/auth"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// failWith returns a route handler which fails with the given status and error
+func failWith(status int, err error) routeHandler {
+	return routeHandler{newTestContext(), func(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+		return status, err
+	}}
+}
+
+func TestRouteHandlerErrors(t *testing.T) {
+	for _, test := range []struct {
+		status     int
+		err        error
+		expected   int
+		retryAfter string
+	}{
+		{http.StatusInternalServerError, errors.New("failed"), http.StatusInternalServerError, ""},
+		{http.StatusBadRequest, errors.New("invalid"), http.StatusBadRequest, ""},
+		{http.StatusNotFound, errors.New("not found"), http.StatusNotFound, ""},
+		{http.StatusInternalServerError, context.DeadlineExceeded, http.StatusServiceUnavailable, retryAfter},
+		{http.StatusInternalServerError, fmt.Errorf("Could not log in: %w", sqlite3.Error{Code: sqlite3.ErrBusy}), http.StatusServiceUnavailable, retryAfter},
+		{http.StatusServiceUnavailable, context.DeadlineExceeded, http.StatusServiceUnavailable, retryAfter},
+	} {
+		w := httptest.NewRecorder()
+		failWith(test.status, test.err).ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != test.expected || w.Header().Get("Retry-After") != test.retryAfter {
+			t.Errorf("Got HTTP %v with Retry-After %q for %v, expected HTTP %v with %q", w.Code, w.Header().Get("Retry-After"), test.err, test.expected, test.retryAfter)
+		}
+	}
+}
+
+func TestRouteHandlerUnauthorized(t *testing.T) {
+	w := serve(newTestContext(), newRequest("GET", "/admin/logins", "", ""))
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("Got HTTP %v with WWW-Authenticate %q, expected a bearer token to be asked for", w.Code, w.Header().Get("WWW-Authenticate"))
+	}
+}
+
+func TestRouteHandlerCORS(t *testing.T) {
+	AllowedDomains = []string{"https://rebble.io"}
+	defer func() { AllowedDomains = nil }()
+
+	for origin, expected := range map[string]string{"https://rebble.io": "https://rebble.io", "https://example.com": "null"} {
+		r := newRequest("OPTIONS", "/user/info", "", "")
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Headers", "authorization")
+		w := serve(newTestContext(), r)
+		if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != expected || w.Header().Get("Access-Control-Allow-Headers") != "authorization" {
+			t.Errorf("Got HTTP %v with headers %v for %v, expected %v to be allowed", w.Code, w.Header(), origin, expected)
+		}
+	}
+}
+
+func TestRequires(t *testing.T) {
+	ctx := newTestContext()
+	tokens := map[string]string{}
+	for _, role := range auth.Roles() {
+		tokens[role] = testAdmin(t, ctx, role)
+	}
+	tokens[""] = ""
+	tokens["invalid"] = "invalid"
+
+	for _, test := range []struct {
+		target  string
+		allowed []string // Roles allowed to use the end point
+	}{
+		{"/admin/logins", []string{auth.RoleModerator, auth.RoleAdmin}},
+		{"/admin/users", []string{auth.RoleService, auth.RoleModerator, auth.RoleAdmin}},
+		{"/admin/claims", []string{auth.RoleModerator, auth.RoleAdmin}},
+		{"/admin/scheduler", []string{auth.RoleAdmin}},
+	} {
+		for role, accessToken := range tokens {
+			expected := http.StatusForbidden
+			switch {
+			case role == "" || role == "invalid":
+				expected = http.StatusUnauthorized
+			case contains(test.allowed, role):
+				expected = http.StatusOK
+			}
+
+			w := serve(ctx, newRequest("GET", test.target, accessToken, ""))
+			if w.Code != expected {
+				t.Errorf("Got HTTP %v for %v as %q, expected %v", w.Code, test.target, role, expected)
+			}
+		}
+	}
+}
+
+// contains reports whether a list of strings contains s
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
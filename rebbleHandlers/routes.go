@@ -1,6 +1,8 @@
 package rebbleHandlers
 
 import (
+	"pebble-dev/rebble-auth/auth"
+
 	"github.com/gorilla/mux"
 )
 
@@ -9,13 +11,68 @@ func Handlers(context *HandlerContext) *mux.Router {
 	r := mux.NewRouter()
 	r.Handle("/", routeHandler{context, HomeHandler}).Methods("GET")
 	r.Handle("/authorize", routeHandler{context, AuthorizeHandler}).Methods("GET")
+	r.Handle("/authorize/declineLink", routeHandler{context, AuthorizeDeclineLinkHandler}).Methods("POST")
 	r.Handle("/authorize_callback/{provider}", routeHandler{context, AuthorizeCallbackHandler}).Methods("GET")
 	r.Handle("/user/info", routeHandler{context, AccountInfoHandler}).Methods("GET", "OPTIONS")
 	r.Handle("/user/update/name", routeHandler{context, AccountUpdateNameHandler}).Methods("POST", "OPTIONS")
 	r.Handle("/user/update/removeLinkedProvider", routeHandler{context, AccountRemoveLinkedProviderHandler}).Methods("POST", "OPTIONS")
+	r.Handle("/user/profile", routeHandler{context, AccountProfileSettingsHandler}).Methods("GET", "OPTIONS")
+	r.Handle("/user/update/profile", routeHandler{context, AccountUpdateProfileSettingsHandler}).Methods("POST", "OPTIONS")
+	r.Handle("/user/sessions", routeHandler{context, AccountSessionsHandler}).Methods("GET", "OPTIONS")
+	r.Handle("/user/sessions/revoke", routeHandler{context, AccountRevokeSessionHandler}).Methods("POST", "OPTIONS")
+	r.Handle("/user/logins", routeHandler{context, AccountLoginsHandler}).Methods("GET", "OPTIONS")
+	r.Handle("/user/export", routeHandler{context, AccountExportHandler}).Methods("GET", "OPTIONS")
+	r.Handle("/user/delete", routeHandler{context, AccountDeleteHandler}).Methods("POST", "OPTIONS")
+	r.Handle("/user/claims", routeHandler{context, AccountClaimsHandler}).Methods("GET", "OPTIONS")
+	r.Handle("/user/claims/developer", routeHandler{context, AccountClaimDeveloperHandler}).Methods("POST", "OPTIONS")
+	r.Handle("/user/claims/verify", routeHandler{context, AccountVerifyClaimHandler}).Methods("POST", "OPTIONS")
+	r.Handle("/user/merge", routeHandler{context, AccountMergeHandler}).Methods("POST", "OPTIONS")
 	r.Handle("/user/name/{id}", routeHandler{context, AccountGetNameHandler}).Methods("GET")
-	r.Handle("/admin/rebuild/db", routeHandler{context, AdminRebuildDBHandler}).Host("localhost")
+	r.Handle("/user/id/{id}", routeHandler{context, AccountGetIdHandler}).Methods("GET")
+	r.Handle("/admin/import/developers", routeHandler{context, AdminImportDevelopersHandler}.requires(auth.PermissionRunJobs)).Methods("POST")
+	// Deprecated: kept for the scripts which still use it
+	r.Handle("/admin/rebuild/db", routeHandler{context, AdminImportDevelopersHandler}.requires(auth.PermissionRunJobs)).Methods("POST")
+	r.Handle("/admin/logins", routeHandler{context, AdminLoginsHandler}.requires(auth.PermissionViewLogs)).Methods("GET")
+	r.Handle("/admin/users", routeHandler{context, AdminUsersHandler}.requires(auth.PermissionViewUsers)).Methods("GET")
+	r.Handle("/admin/users/{id}", routeHandler{context, AdminUserHandler}.requires(auth.PermissionViewUsers)).Methods("GET")
+	r.Handle("/admin/users/{id}/export", routeHandler{context, AdminUserExportHandler}.requires(auth.PermissionViewUsers)).Methods("GET")
+	r.Handle("/admin/backup", routeHandler{context, AdminBackupHandler}.requires(auth.PermissionBackup)).Methods("GET")
+	r.Handle("/admin/scheduler", routeHandler{context, AdminSchedulerHandler}.requires(auth.PermissionViewSystem)).Methods("GET")
+	r.Handle("/admin/claims", routeHandler{context, AdminClaimsHandler}.requires(auth.PermissionReviewClaims)).Methods("GET")
+	r.Handle("/admin/claims/{id}/approve", routeHandler{context, AdminApproveClaimHandler}.requires(auth.PermissionReviewClaims)).Methods("POST")
+	r.Handle("/admin/claims/{id}/reject", routeHandler{context, AdminRejectClaimHandler}.requires(auth.PermissionReviewClaims)).Methods("POST")
+	r.Handle("/admin/audit", routeHandler{context, AdminAuditHandler}.requires(auth.PermissionViewLogs)).Methods("GET")
+	r.Handle("/admin/jobs", routeHandler{context, AdminJobsHandler}.requires(auth.PermissionRunJobs)).Methods("GET")
+	r.Handle("/admin/jobs/{id}", routeHandler{context, AdminJobHandler}.requires(auth.PermissionRunJobs)).Methods("GET")
+	r.Handle("/admin/jobs/{id}/cancel", routeHandler{context, AdminJobCancelHandler}.requires(auth.PermissionRunJobs)).Methods("POST")
+	r.Handle("/admin/users/{id}/role", routeHandler{context, AdminSetRoleHandler}.requires(auth.PermissionAssignRoles)).Methods("POST")
+	r.Handle("/admin/users/{id}/disable", routeHandler{context, AdminDisableUserHandler}.requires(auth.PermissionManageUsers)).Methods("POST")
+	r.Handle("/admin/users/{id}/enable", routeHandler{context, AdminEnableUserHandler}.requires(auth.PermissionManageUsers)).Methods("POST")
+	r.Handle("/admin/users/{id}/logout", routeHandler{context, AdminLogoutUserHandler}.requires(auth.PermissionManageUsers)).Methods("POST")
+	r.Handle("/admin/users/{id}/name", routeHandler{context, AdminSetNameHandler}.requires(auth.PermissionManageUsers)).Methods("POST")
+	r.Handle("/admin/users/{id}/sessions/revoke", routeHandler{context, AdminRevokeUserSessionHandler}.requires(auth.PermissionManageUsers)).Methods("POST")
+	r.Handle("/admin/clients", routeHandler{context, AdminClientsHandler}.requires(auth.PermissionManageClients)).Methods("GET")
+	r.Handle("/admin/clients", routeHandler{context, AdminSaveClientHandler}.requires(auth.PermissionManageClients)).Methods("POST")
+	r.Handle("/admin/clients/delete", routeHandler{context, AdminDeleteClientHandler}.requires(auth.PermissionManageClients)).Methods("POST")
+	r.Handle("/admin/providers", routeHandler{context, AdminProvidersHandler}.requires(auth.PermissionViewSystem)).Methods("GET")
 	r.Handle("/admin/version", routeHandler{context, AdminVersionHandler})
 
+	// Admin console, which uses a cookie rather than the Authorization header
+	r.Handle("/admin/console/login", routeHandler{context, ConsoleLoginHandler}).Methods("GET")
+	r.Handle("/admin/console/logout", routeHandler{context, ConsoleLogoutHandler}.console(auth.PermissionConsole)).Methods("POST")
+	r.Handle("/admin/console/", routeHandler{context, ConsoleHomeHandler}.console(auth.PermissionConsole)).Methods("GET")
+	r.Handle("/admin/console/users", routeHandler{context, ConsoleUsersHandler}.console(auth.PermissionViewUsers)).Methods("GET")
+	r.Handle("/admin/console/users/{id}", routeHandler{context, ConsoleUserHandler}.console(auth.PermissionViewUsers)).Methods("GET")
+	r.Handle("/admin/console/users/{id}/disable", routeHandler{context, ConsoleDisableUserHandler}.console(auth.PermissionManageUsers)).Methods("POST")
+	r.Handle("/admin/console/users/{id}/enable", routeHandler{context, ConsoleEnableUserHandler}.console(auth.PermissionManageUsers)).Methods("POST")
+	r.Handle("/admin/console/users/{id}/logout", routeHandler{context, ConsoleLogoutUserHandler}.console(auth.PermissionManageUsers)).Methods("POST")
+	r.Handle("/admin/console/users/{id}/sessions/{session}/revoke", routeHandler{context, ConsoleRevokeUserSessionHandler}.console(auth.PermissionManageUsers)).Methods("POST")
+	r.Handle("/admin/console/users/{id}/name", routeHandler{context, ConsoleSetNameHandler}.console(auth.PermissionManageUsers)).Methods("POST")
+	r.Handle("/admin/console/users/{id}/role", routeHandler{context, ConsoleSetRoleHandler}.console(auth.PermissionAssignRoles)).Methods("POST")
+	r.Handle("/admin/console/clients", routeHandler{context, ConsoleClientsHandler}.console(auth.PermissionManageClients)).Methods("GET")
+	r.Handle("/admin/console/clients", routeHandler{context, ConsoleSaveClientHandler}.console(auth.PermissionManageClients)).Methods("POST")
+	r.Handle("/admin/console/clients/delete", routeHandler{context, ConsoleDeleteClientHandler}.console(auth.PermissionManageClients)).Methods("POST")
+	r.Handle("/admin/console/providers", routeHandler{context, ConsoleProvidersHandler}.console(auth.PermissionViewSystem)).Methods("GET")
+
 	return r
 }
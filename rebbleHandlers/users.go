@@ -0,0 +1,214 @@
+package rebbleHandlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"pebble-dev/rebble-auth/auth"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Default and maximum page sizes of the admin user search
+const (
+	adminUsersDefaultLimit = 50
+	adminUsersMaxLimit     = 1000
+)
+
+// Default and maximum number of login attempts shown with a user
+const (
+	adminUserLoginsDefaultLimit = 50
+	adminUserLoginsMaxLimit     = 1000
+)
+
+type adminUserSummary struct {
+	Id                string    `json:"id"`
+	Name              string    `json:"name"`
+	Email             string    `json:"email"`
+	Type              string    `json:"type"`
+	PebbleMirror      bool      `json:"pebbleMirror"`
+	Disabled          bool      `json:"disabled"`
+	DeletionScheduled time.Time `json:"deletionScheduled"`
+}
+
+type adminUsersStatus struct {
+	Users  []adminUserSummary `json:"users"`
+	Offset int                `json:"offset"`
+	Limit  int                `json:"limit"`
+}
+
+type adminUser struct {
+	exportUser
+	Providers      []exportProvider `json:"linkedProviders"`
+	Sessions       []sessionInfo    `json:"sessions"`
+	Logins         []loginAttempt   `json:"logins"`
+	MergedAccounts []string         `json:"mergedAccounts"`
+}
+
+type adminUserStatus struct {
+	User         *adminUser `json:"user"`
+	Success      bool       `json:"success"`
+	ErrorMessage string     `json:"errorMessage"`
+}
+
+type adminLogoutStatus struct {
+	Sessions     int64  `json:"sessions"`
+	Success      bool   `json:"success"`
+	ErrorMessage string `json:"errorMessage"`
+}
+
+type adminSetName struct {
+	Name string `json:"name"`
+}
+
+// AdminUsersHandler lets an administrator look users up by name, email, ID or linked identity (`q`), or list all of
+// them if `q` is empty. Results are ordered by name, and paginated using `offset` and `limit`.
+func AdminUsersHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	offset, err := queryInt(r, "offset", 0)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	limit, err := queryInt(r, "limit", adminUsersDefaultLimit)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if limit > adminUsersMaxLimit {
+		limit = adminUsersMaxLimit
+	}
+
+	users, err := ctx.Database.SearchUsers(r.Context(), r.URL.Query().Get("q"), offset, limit)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	status := adminUsersStatus{
+		Users:  []adminUserSummary{},
+		Offset: offset,
+		Limit:  limit,
+	}
+	for _, user := range users {
+		status.Users = append(status.Users, adminUserSummary(user))
+	}
+
+	return writeJSON(w, status)
+}
+
+// AdminUserHandler shows the account of user `{id}`: its linked providers, sessions and most recent login attempts,
+// `logins` setting how many of the latter are included
+func AdminUserHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	logins, err := queryInt(r, "logins", adminUserLoginsDefaultLimit)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	if logins > adminUserLoginsMaxLimit {
+		logins = adminUserLoginsMaxLimit
+	}
+
+	export, errorMessage, err := ctx.Database.UserExport(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	status := adminUserStatus{
+		Success:      errorMessage == "",
+		ErrorMessage: errorMessage,
+	}
+	if status.Success {
+		data := newExportData(export)
+		if len(data.Logins) > logins {
+			data.Logins = data.Logins[:logins]
+		}
+
+		status.User = &adminUser{
+			exportUser:     data.User,
+			Providers:      data.Providers,
+			Sessions:       data.Sessions,
+			Logins:         data.Logins,
+			MergedAccounts: data.MergedAccounts,
+		}
+	}
+
+	return writeJSON(w, status)
+}
+
+// AdminDisableUserHandler disables the account of user `{id}`, which can't be used to log in or call the API anymore
+func AdminDisableUserHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	return adminSetDisabled(ctx, w, r, true)
+}
+
+// AdminEnableUserHandler enables the account of user `{id}` again
+func AdminEnableUserHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	return adminSetDisabled(ctx, w, r, false)
+}
+
+// adminSetDisabled disables or enables the account of user `{id}`
+func adminSetDisabled(ctx *HandlerContext, w http.ResponseWriter, r *http.Request, disabled bool) (int, error) {
+	success, errorMessage, err := auth.SetDisabled(r.Context(), ctx.Database, mux.Vars(r)["id"], disabled, sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return writeJSON(w, updateAccountStatus{
+		Success:      success,
+		ErrorMessage: errorMessage,
+	})
+}
+
+// AdminLogoutUserHandler logs out all of the sessions of user `{id}`
+func AdminLogoutUserHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	success, errorMessage, sessions, err := auth.LogoutUser(r.Context(), ctx.Database, mux.Vars(r)["id"], sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return writeJSON(w, adminLogoutStatus{
+		Sessions:     sessions,
+		Success:      success,
+		ErrorMessage: errorMessage,
+	})
+}
+
+// AdminSetNameHandler gives the name in the body of the request to user `{id}`
+func AdminSetNameHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	decoder := json.NewDecoder(r.Body)
+
+	var info adminSetName
+	err := decoder.Decode(&info)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	defer r.Body.Close()
+
+	success, errorMessage, err := auth.SetName(r.Context(), ctx.Database, mux.Vars(r)["id"], info.Name, sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return writeJSON(w, updateAccountStatus{
+		Success:      success,
+		ErrorMessage: errorMessage,
+	})
+}
+
+// AdminRevokeUserSessionHandler logs out the session of user `{id}` given in the body of the request
+func AdminRevokeUserSessionHandler(ctx *HandlerContext, w http.ResponseWriter, r *http.Request) (int, error) {
+	decoder := json.NewDecoder(r.Body)
+
+	var info revokeSession
+	err := decoder.Decode(&info)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	defer r.Body.Close()
+
+	success, errorMessage, err := auth.RevokeUserSession(r.Context(), ctx.Database, mux.Vars(r)["id"], info.Id, sessionUser(r).UserId, remoteIp(r))
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+
+	return writeJSON(w, updateAccountStatus{
+		Success:      success,
+		ErrorMessage: errorMessage,
+	})
+}
@@ -0,0 +1,105 @@
+package rebbleHandlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"pebble-dev/rebble-auth/auth"
+)
+
+func TestAdminUsers(t *testing.T) {
+	ctx := newTestContext()
+	aliceToken := testLogin(t, ctx, "alice", "Alice")
+	aliceId := testUserId(t, ctx, aliceToken)
+	testLogin(t, ctx, "bob", "Bob")
+	moderatorToken := testAdmin(t, ctx, auth.RoleModerator)
+
+	var users adminUsersStatus
+	decode(t, serve(ctx, newRequest("GET", "/admin/users?q=ali", moderatorToken, "")), &users)
+	if len(users.Users) != 1 || users.Users[0].Id != aliceId || users.Users[0].Type != auth.RoleUser {
+		t.Errorf("Got %+v, expected to find alice", users.Users)
+	}
+
+	users = adminUsersStatus{}
+	decode(t, serve(ctx, newRequest("GET", "/admin/users?offset=1&limit=5000", moderatorToken, "")), &users)
+	if len(users.Users) != 2 || users.Offset != 1 || users.Limit != adminUsersMaxLimit {
+		t.Errorf("Got %+v, expected the users after the first one", users)
+	}
+
+	var user adminUserStatus
+	decode(t, serve(ctx, newRequest("GET", "/admin/users/"+aliceId+"?logins=0", moderatorToken, "")), &user)
+	if !user.Success || user.User.Name != "Alice" || len(user.User.Providers) != 1 || len(user.User.Sessions) != 1 || len(user.User.Logins) != 0 {
+		t.Errorf("Got %+v, expected alice's account without her logins", user.User)
+	}
+
+	user = adminUserStatus{}
+	decode(t, serve(ctx, newRequest("GET", "/admin/users/unknown", moderatorToken, "")), &user)
+	if user.Success || user.User != nil {
+		t.Errorf("Got %+v for an unknown user", user)
+	}
+
+	// Moderators can look users up, but not change their accounts
+	w := serve(ctx, newRequest("POST", "/admin/users/"+aliceId+"/disable", moderatorToken, ""))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Got HTTP %v for a moderator disabling an account, expected %v", w.Code, http.StatusForbidden)
+	}
+}
+
+func TestAdminManageUser(t *testing.T) {
+	ctx := newTestContext()
+	adminToken := testAdmin(t, ctx, auth.RoleAdmin)
+	aliceToken := testLogin(t, ctx, "alice", "Alice")
+	aliceId := testUserId(t, ctx, aliceToken)
+	secondToken := testLogin(t, ctx, "alice", "Alice")
+
+	var status updateAccountStatus
+	decode(t, serve(ctx, newRequest("POST", "/admin/users/"+aliceId+"/disable", adminToken, "")), &status)
+	if !status.Success {
+		t.Fatalf("Could not disable account: %v", status.ErrorMessage)
+	}
+	loggedIn, _, _ := ctx.Database.SessionInformation(context.Background(), aliceToken)
+	if loggedIn {
+		t.Errorf("alice is still logged in after her account was disabled")
+	}
+
+	status = updateAccountStatus{}
+	decode(t, serve(ctx, newRequest("POST", "/admin/users/"+aliceId+"/enable", adminToken, "")), &status)
+	if !status.Success {
+		t.Fatalf("Could not enable account: %v", status.ErrorMessage)
+	}
+
+	status = updateAccountStatus{}
+	decode(t, serve(ctx, newRequest("POST", "/admin/users/"+aliceId+"/name", adminToken, `{"name": "Alice Liddell"}`)), &status)
+	name, _, _ := ctx.Database.GetName(context.Background(), aliceId)
+	if !status.Success || name != "Alice Liddell" {
+		t.Errorf("Got %+v and name %q, expected alice to be renamed", status, name)
+	}
+
+	status = updateAccountStatus{}
+	decode(t, serve(ctx, newRequest("POST", "/admin/users/"+aliceId+"/name", adminToken, `{"name": ""}`)), &status)
+	if status.Success {
+		t.Errorf("Gave an empty name to alice")
+	}
+
+	session, _, _ := ctx.Database.LookupSession(context.Background(), secondToken)
+	status = updateAccountStatus{}
+	decode(t, serve(ctx, newRequest("POST", "/admin/users/"+aliceId+"/sessions/revoke", adminToken, fmt.Sprintf(`{"id": %d}`, session.SessionId))), &status)
+	if !status.Success {
+		t.Errorf("Could not revoke session: %v", status.ErrorMessage)
+	}
+
+	var logout adminLogoutStatus
+	decode(t, serve(ctx, newRequest("POST", "/admin/users/"+aliceId+"/logout", adminToken, "")), &logout)
+	if !logout.Success || logout.Sessions != 1 {
+		t.Errorf("Got %+v, expected alice's remaining session to be logged out", logout)
+	}
+
+	// Admins can't lock themselves out
+	status = updateAccountStatus{}
+	decode(t, serve(ctx, newRequest("POST", "/admin/users/"+testUserId(t, ctx, adminToken)+"/disable", adminToken, "")), &status)
+	if status.Success || status.ErrorMessage == "" {
+		t.Errorf("The admin could disable their own account")
+	}
+}
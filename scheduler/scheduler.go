@@ -0,0 +1,168 @@
+package scheduler
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// historySize is how many past runs the scheduler remembers, all jobs included
+const historySize = 100
+
+// Job is a task run periodically by the scheduler
+type Job struct {
+	Name     string
+	Interval time.Duration
+
+	// Run does the job, and returns a short summary of what it did
+	Run func() (string, error)
+}
+
+// Run is a past run of a job
+type Run struct {
+	Job      string
+	Started  time.Time
+	Duration time.Duration
+	Result   string
+	Error    string // Empty if the job succeeded
+}
+
+// JobStatus describes a job and when it runs
+type JobStatus struct {
+	Name     string
+	Interval time.Duration
+	Running  bool
+	LastRun  time.Time // Zero if the job never ran
+	NextRun  time.Time
+}
+
+type scheduledJob struct {
+	Job
+	running bool
+	lastRun time.Time
+	nextRun time.Time
+}
+
+// Scheduler runs jobs in the background, each of them every Interval, and keeps track of how they went
+type Scheduler struct {
+	lock    sync.Mutex
+	jobs    []*scheduledJob
+	history []Run
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New returns a Scheduler for the given jobs. It doesn't run them until it is started.
+func New(jobs ...Job) *Scheduler {
+	scheduler := &Scheduler{
+		stop: make(chan struct{}),
+	}
+	for _, job := range jobs {
+		scheduler.jobs = append(scheduler.jobs, &scheduledJob{Job: job})
+	}
+
+	return scheduler
+}
+
+// Start runs every job right away, then every Interval, until the scheduler is stopped
+func (scheduler *Scheduler) Start() {
+	for _, job := range scheduler.jobs {
+		scheduler.wg.Add(1)
+		go scheduler.loop(job)
+	}
+}
+
+// Stop stops the scheduler, and waits for the jobs which are running to finish
+func (scheduler *Scheduler) Stop() {
+	close(scheduler.stop)
+	scheduler.wg.Wait()
+}
+
+func (scheduler *Scheduler) loop(job *scheduledJob) {
+	defer scheduler.wg.Done()
+
+	for {
+		scheduler.run(job)
+
+		select {
+		case <-scheduler.stop:
+			return
+		case <-time.After(job.Interval):
+		}
+	}
+}
+
+func (scheduler *Scheduler) run(job *scheduledJob) {
+	started := time.Now()
+	scheduler.lock.Lock()
+	job.running = true
+	job.lastRun = started
+	scheduler.lock.Unlock()
+
+	result, err := runJob(job.Job)
+
+	run := Run{
+		Job:      job.Name,
+		Started:  started,
+		Duration: time.Since(started),
+		Result:   result,
+	}
+	if err != nil {
+		run.Error = err.Error()
+		log.Printf("Job %v failed: %v", job.Name, err)
+	}
+
+	scheduler.lock.Lock()
+	job.running = false
+	job.nextRun = time.Now().Add(job.Interval)
+	scheduler.history = append(scheduler.history, run)
+	if len(scheduler.history) > historySize {
+		scheduler.history = scheduler.history[len(scheduler.history)-historySize:]
+	}
+	scheduler.lock.Unlock()
+}
+
+// runJob runs a job, turning a panic into an error so that the job keeps being scheduled
+func runJob(job Job) (result string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return job.Run()
+}
+
+// Jobs returns the status of every job
+func (scheduler *Scheduler) Jobs() []JobStatus {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	jobs := []JobStatus{}
+	for _, job := range scheduler.jobs {
+		jobs = append(jobs, JobStatus{
+			Name:     job.Name,
+			Interval: job.Interval,
+			Running:  job.running,
+			LastRun:  job.lastRun,
+			NextRun:  job.nextRun,
+		})
+	}
+
+	return jobs
+}
+
+// History returns the most recent runs of all jobs, latest first
+func (scheduler *Scheduler) History() []Run {
+	scheduler.lock.Lock()
+	defer scheduler.lock.Unlock()
+
+	history := []Run{}
+	for i := len(scheduler.history) - 1; i >= 0; i-- {
+		history = append(history, scheduler.history[i])
+	}
+
+	return history
+}
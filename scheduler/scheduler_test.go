@@ -0,0 +1,91 @@
+package scheduler
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	var lock sync.Mutex
+	runs := 0
+	scheduler := New(
+		Job{
+			Name:     "count",
+			Interval: 10 * time.Millisecond,
+			Run: func() (string, error) {
+				lock.Lock()
+				defer lock.Unlock()
+				runs++
+				return "counted", nil
+			},
+		},
+		Job{
+			Name:     "fail",
+			Interval: time.Hour,
+			Run: func() (string, error) {
+				return "", errors.New("failed")
+			},
+		},
+		Job{
+			Name:     "panic",
+			Interval: time.Hour,
+			Run: func() (string, error) {
+				panic("oops")
+			},
+		},
+	)
+
+	if jobs := scheduler.Jobs(); len(jobs) != 3 || !jobs[0].LastRun.IsZero() {
+		t.Fatalf("Got %+v before the scheduler was started, expected 3 jobs which never ran", jobs)
+	}
+
+	scheduler.Start()
+	time.Sleep(50 * time.Millisecond)
+	scheduler.Stop()
+
+	lock.Lock()
+	if runs < 2 {
+		t.Errorf("The job ran %v times, expected it to run every interval", runs)
+	}
+	lock.Unlock()
+
+	for _, job := range scheduler.Jobs() {
+		if job.Running || job.LastRun.IsZero() || !job.NextRun.After(job.LastRun) {
+			t.Errorf("Got %+v, expected the job to have run and to be scheduled again", job)
+		}
+	}
+
+	// Panics are turned into errors
+	results := make(map[string]Run)
+	for _, run := range scheduler.History() {
+		results[run.Job] = run
+	}
+	if results["count"].Result != "counted" || results["count"].Error != "" {
+		t.Errorf("Got run %+v, expected it to have succeeded", results["count"])
+	}
+	if results["fail"].Error != "failed" {
+		t.Errorf("Got run %+v, expected it to have failed", results["fail"])
+	}
+	if results["panic"].Error != "panic: oops" {
+		t.Errorf("Got run %+v, expected the panic to be reported", results["panic"])
+	}
+}
+
+func TestSchedulerHistorySize(t *testing.T) {
+	scheduler := New(Job{Name: "noop", Interval: time.Hour, Run: func() (string, error) { return "", nil }})
+	for i := 0; i < historySize+10; i++ {
+		scheduler.run(scheduler.jobs[0])
+	}
+
+	history := scheduler.History()
+	if len(history) != historySize {
+		t.Errorf("Got %v runs, expected only the last %v to be kept", len(history), historySize)
+	}
+	for i, run := range history {
+		if i > 0 && run.Started.After(history[i-1].Started) {
+			t.Errorf("The history isn't sorted latest first")
+		}
+	}
+}
@@ -19,6 +19,7 @@ type Sso struct {
 	DiscoverURI  string `json:"discover_uri"`
 	RedirectURI  string `json:"redirect_uri"`
 	Scopes       string `json:"scopes"`
+	TrustEmail   bool   `json:"trust_email"` // Whether verified e-mail addresses from this provider may be used to link identities to existing accounts
 
 	Discovery Discovery `json:"discovery"`
 	Certs     Certs
@@ -32,6 +33,7 @@ type Discovery struct {
 	TokenEndpoint         string `json:"token_endpoint"`
 	UserinfoEndpoint      string `json:"userinfo_endpoint"`
 	JwksURI               string `json:"jwks_uri"`
+	RevocationEndpoint    string `json:"revocation_endpoint"` // Optional, used to revoke our tokens when an account is deleted
 
 	TokenInfoEndpoint string `json:"tokeninfo_endpoint"` // Not part of the OIDC answer, used by Fitbit API to get user ID
 }